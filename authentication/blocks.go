@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"log"
+
+	"forum/utils"
+)
+
+// contactBlocked reports whether a block between two users should stop direct
+// contact such as chat messages and typing indicators
+// Database errors are treated as blocked so a failure never leaks contact.
+// @param senderID - The user trying to make contact
+// @param recipientID - The user being contacted
+// @returns bool - True if the contact must be dropped
+func contactBlocked(senderID, recipientID string) bool {
+	blocked, err := utils.IsBlockedEitherWay(GlobalDB, senderID, recipientID)
+	if err != nil {
+		log.Printf("Error checking block between %s and %s: %v", senderID, recipientID, err)
+		return true
+	}
+	return blocked
+}
+
+// notificationBlocked reports whether the receiver has blocked the actor, in
+// which case notifications the actor triggers are not created or delivered
+func notificationBlocked(receiverID, actorID string) bool {
+	blocked, err := utils.HasBlocked(GlobalDB, receiverID, actorID)
+	if err != nil {
+		log.Printf("Error checking block of %s by %s: %v", actorID, receiverID, err)
+		return true
+	}
+	return blocked
+}
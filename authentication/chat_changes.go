@@ -0,0 +1,278 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"forum/utils"
+)
+
+// Who a message is deleted for
+const (
+	DeleteForMe       = "me"
+	DeleteForEveryone = "everyone"
+)
+
+// messageChangeRequest is the data of an "edit", "delete" or "react" sent by a client
+type messageChangeRequest struct {
+	MessageID int64  `json:"message_id"`
+	Content   string `json:"content,omitempty"` // The new content of an edit
+	For       string `json:"for,omitempty"`     // DeleteForMe or DeleteForEveryone
+	Emoji     string `json:"emoji,omitempty"`   // The reaction to add or remove
+	Remove    bool   `json:"remove,omitempty"`  // Removes the reaction instead of adding it
+}
+
+// MessageDeletion tells members a message was deleted
+// Deletions for everyone go to the conversation; deletions for one member
+// only go to that member.
+type MessageDeletion struct {
+	MessageID      int64  `json:"message_id"`
+	ConversationID int64  `json:"conversation_id"`
+	For            string `json:"for"`
+	DeletedBy      string `json:"deleted_by"`
+	DeletedAt      string `json:"deleted_at"`
+}
+
+// ReactionUpdate tells members a message's reactions changed
+type ReactionUpdate struct {
+	MessageID      int64                   `json:"message_id"`
+	ConversationID int64                   `json:"conversation_id"`
+	UserID         string                  `json:"user_id"`
+	Emoji          string                  `json:"emoji"`
+	Removed        bool                    `json:"removed"`
+	Reactions      []utils.MessageReaction `json:"reactions"` // Every reaction on the message afterwards
+}
+
+// errInvalidDeleteFor is returned for deletes that are neither for me nor for everyone
+var errInvalidDeleteFor = errors.New(`for must be "me" or "everyone"`)
+
+// messageChangeStatus maps message change errors to HTTP statuses
+func messageChangeStatus(err error) int {
+	switch {
+	case errors.Is(err, utils.ErrMessageNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, utils.ErrNotMessageSender):
+		return http.StatusForbidden
+	case errors.Is(err, utils.ErrEditWindowClosed), errors.Is(err, utils.ErrMessageDeleted),
+		errors.Is(err, utils.ErrTooManyReactions):
+		return http.StatusConflict
+	case errors.Is(err, utils.ErrInvalidReaction), errors.Is(err, utils.ErrEmptyContent),
+		errors.Is(err, utils.ErrContentTooLong), errors.Is(err, errInvalidDeleteFor):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// messageTopic is the topic of the conversation a message belongs to
+func messageTopic(m utils.StoredMessage) string {
+	if m.ReceiverID != "" {
+		return ConversationTopic(m.SenderID, m.ReceiverID)
+	}
+	return GroupTopic(m.ConversationID)
+}
+
+// editChatMessage changes a message's content and pushes it to the conversation
+// Mentions are recorded again, so users newly mentioned are notified and
+// mentions that were edited out are removed.
+// @param userID - The sender editing the message
+// @param messageID - The message
+// @param content - The new content
+// @returns ChatMessage - The edited message
+// @returns error - A utils validation or message change error, or any database error
+func editChatMessage(userID string, messageID int64, content string) (ChatMessage, error) {
+	if err := utils.ValidateContent(content, 5000); err != nil {
+		return ChatMessage{}, err
+	}
+	stored, err := utils.EditMessage(GlobalDB, messageID, userID, content)
+	if err != nil {
+		return ChatMessage{}, err
+	}
+
+	readers, err := conversationReaders(stored.ConversationID, userID)
+	if err != nil {
+		log.Printf("Error loading members of conversation %d: %v", stored.ConversationID, err)
+	}
+	msg := chatMessageFromStored(stored, recordMessageMentions(stored.ID, userID, readers, content))
+	hub.publishEnvelope(messageTopic(stored), "message_edited", chatSend{Message: msg}, nil, false)
+	go PublishConversationSummaries(stored.ConversationID, append(readers, userID)...)
+	return msg, nil
+}
+
+// deleteChatMessage deletes a message for everyone or for one member
+// Deleting for everyone leaves a tombstone that every member is told about;
+// deleting for me hides the message from the member's own history only.
+// @param userID - The member deleting the message
+// @param messageID - The message
+// @param deleteFor - DeleteForMe or DeleteForEveryone
+// @returns MessageDeletion - The deletion that was pushed
+// @returns error - A message change error or any database error
+func deleteChatMessage(userID string, messageID int64, deleteFor string) (MessageDeletion, error) {
+	var stored utils.StoredMessage
+	var err error
+	switch deleteFor {
+	case DeleteForEveryone:
+		stored, err = utils.DeleteMessageForEveryone(GlobalDB, messageID, userID)
+	case DeleteForMe:
+		stored, err = utils.HideMessage(GlobalDB, messageID, userID)
+	default:
+		err = errInvalidDeleteFor
+	}
+	if err != nil {
+		return MessageDeletion{}, err
+	}
+
+	deletion := MessageDeletion{
+		MessageID:      stored.ID,
+		ConversationID: stored.ConversationID,
+		For:            deleteFor,
+		DeletedBy:      userID,
+		DeletedAt:      time.Now().UTC().Format(time.RFC3339),
+	}
+	if deleteFor == DeleteForMe {
+		hub.publishEnvelope(UserTopic(userID), "message_deleted", deletion, nil, false)
+		go PublishConversationSummaries(stored.ConversationID, userID)
+		return deletion, nil
+	}
+
+	// A tombstone has no content, so it mentions no one
+	recordMessageMentions(stored.ID, userID, nil, "")
+	hub.publishEnvelope(messageTopic(stored), "message_deleted", deletion, nil, false)
+	if members, err := utils.ConversationMemberIDs(GlobalDB, stored.ConversationID); err != nil {
+		log.Printf("Error loading members of conversation %d: %v", stored.ConversationID, err)
+	} else {
+		go PublishConversationSummaries(stored.ConversationID, members...)
+	}
+	return deletion, nil
+}
+
+// reactToChatMessage adds or removes a reaction and pushes the message's reactions
+// Reactions in a direct conversation are refused while either user blocks the other.
+// @param userID - The reacting member
+// @param messageID - The message
+// @param emoji - The reaction
+// @param remove - True to remove the reaction instead of adding it
+// @returns ReactionUpdate - The update that was pushed
+// @returns error - A message change error or any database error
+func reactToChatMessage(userID string, messageID int64, emoji string, remove bool) (ReactionUpdate, error) {
+	emoji = strings.TrimSpace(emoji)
+	if m, err := utils.GetMessage(GlobalDB, messageID, userID); err == nil && m.ReceiverID != "" {
+		peer := m.ReceiverID
+		if peer == userID {
+			peer = m.SenderID
+		}
+		if contactBlocked(userID, peer) {
+			return ReactionUpdate{}, utils.ErrMessageNotFound
+		}
+	}
+
+	stored, err := utils.SetReaction(GlobalDB, messageID, userID, emoji, !remove)
+	if err != nil {
+		return ReactionUpdate{}, err
+	}
+	update := ReactionUpdate{
+		MessageID:      stored.ID,
+		ConversationID: stored.ConversationID,
+		UserID:         userID,
+		Emoji:          emoji,
+		Removed:        remove,
+		Reactions:      stored.Reactions,
+	}
+	if update.Reactions == nil {
+		update.Reactions = []utils.MessageReaction{}
+	}
+	hub.publishEnvelope(messageTopic(stored), "reaction", update, nil, false)
+	return update, nil
+}
+
+// handleMessageChange edits, deletes or reacts to a message over a WebSocket
+// The change is made as the connection's user. The change itself reaches
+// the connection through its conversation topic; failures are replied to
+// with an "error" naming the message.
+// @param c - The connection the change came from
+// @param msgType - "edit", "delete" or "react"
+// @param data - The change data
+func handleMessageChange(c *Client, msgType string, data json.RawMessage) {
+	var request messageChangeRequest
+	if err := json.Unmarshal(data, &request); err != nil || request.MessageID <= 0 {
+		c.reply("error", map[string]string{"error": "Invalid " + msgType + " request"})
+		return
+	}
+
+	var err error
+	switch msgType {
+	case "edit":
+		_, err = editChatMessage(c.userID, request.MessageID, request.Content)
+	case "delete":
+		var deletion MessageDeletion
+		deletion, err = deleteChatMessage(c.userID, request.MessageID, request.For)
+		if err == nil && deletion.For == DeleteForMe {
+			c.reply("message_deleted", deletion)
+		}
+	case "react":
+		_, err = reactToChatMessage(c.userID, request.MessageID, request.Emoji, request.Remove)
+	}
+	if err != nil {
+		reason := err.Error()
+		if messageChangeStatus(err) == http.StatusInternalServerError {
+			log.Printf("Error handling %s of message %d from user %s: %v", msgType, request.MessageID, c.userID, err)
+			reason = "Failed to update message"
+		}
+		c.reply("error", map[string]interface{}{"error": reason, "message_id": request.MessageID, "action": msgType})
+	}
+}
+
+// MessageChangeHandler edits, deletes or reacts to a message via HTTP API
+// Served by the API handler after checking the session; changes are made as
+// the signed-in user. Accepts POST requests to:
+//   - /api/chat/edit with {message_id, content}
+//   - /api/chat/delete with {message_id, for}
+//   - /api/chat/react with {message_id, emoji, remove}
+//
+// Changes are pushed over the chat WebSocket as with WebSocket requests.
+func MessageChangeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value("userID").(string)
+	var requestBody messageChangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil || requestBody.MessageID <= 0 {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var result interface{}
+	var err error
+	switch r.URL.Path {
+	case "/api/chat/edit":
+		result, err = editChatMessage(userID, requestBody.MessageID, requestBody.Content)
+	case "/api/chat/delete":
+		result, err = deleteChatMessage(userID, requestBody.MessageID, requestBody.For)
+	case "/api/chat/react":
+		result, err = reactToChatMessage(userID, requestBody.MessageID, requestBody.Emoji, requestBody.Remove)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		status := messageChangeStatus(err)
+		message := err.Error()
+		if status == http.StatusInternalServerError {
+			log.Printf("Error changing message %d for user %s: %v", requestBody.MessageID, userID, err)
+			message = "Failed to update message"
+		}
+		http.Error(w, message, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"result":  result,
+	})
+}
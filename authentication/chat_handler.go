@@ -2,121 +2,268 @@ package handlers
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"forum/utils"
 	"io"
 	"log"
 	"net/http"
 	"strconv"
 	"time"
-
-	"github.com/gorilla/websocket"
 )
 
 // Message represents a chat message structure
 type Message struct {
-	ID         int       `json:"id"`
-	SenderID   string    `json:"sender_id"`
-	ReceiverID string    `json:"receiver_id"`
-	Content    string    `json:"content"`
-	SentAt     time.Time `json:"sent_at"`
-	Read       bool      `json:"read"`
+	ID          int                 `json:"id"`
+	SenderID    string              `json:"sender_id"`
+	ReceiverID  string              `json:"receiver_id"`
+	Content     string              `json:"content"`
+	ContentRaw  string              `json:"content_raw"`
+	ContentHTML string              `json:"content_html"`
+	Mentions    []utils.MentionSpan `json:"mentions"`
+	SentAt      time.Time           `json:"sent_at"`
+	Read        bool                `json:"read"`
+	Status      string              `json:"status"`
 }
 
-// GetChatHistoryHandler fetches chat history between two users with pagination
+// GetChatHistoryHandler fetches chat history between two users a page at a time
+// With a conversation parameter instead of user2, it fetches the history of
+// a group user1 belongs to. user1 is the signed-in user; the parameter may be
+// left out. Messages are returned as they are now: edited
+// content, tombstones for deleted messages, reactions and attachments.
+// Messages user1 deleted for themselves are left out.
+//
+// Pages are anchored on a message rather than counted, so messages arriving
+// meanwhile never shift them. Messages are ordered by (sent_at, id) and each
+// page is returned oldest first. Query parameters:
+//   - limit: page size (default 10, max 100)
+//   - before: a message ID; returns the messages just older than it
+//   - after: a message ID; returns the messages just newer than it
+//   - around: a message ID; returns it with the messages on either side,
+//     for jumping to a message such as a search result
+//
+// Without an anchor the newest messages are returned. An anchor outside the
+// conversation gets 404.
 func GetChatHistoryHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	// Get query parameters
-	user1 := r.URL.Query().Get("user1")
-	user2 := r.URL.Query().Get("user2")
-
-	// Pagination parameters
-	pageStr := r.URL.Query().Get("page")
-	limitStr := r.URL.Query().Get("limit")
+	query := r.URL.Query()
+	user1, ok := requestUser(w, r, query.Get("user1"))
+	if !ok {
+		return
+	}
+	user2 := query.Get("user2")
+	conversationStr := query.Get("conversation")
 
-	page := 1
 	limit := 10
+	if l, err := strconv.Atoi(query.Get("limit")); err == nil && l > 0 {
+		limit = l
+	}
+	if limit > utils.MaxMessageReplay {
+		limit = utils.MaxMessageReplay
+	}
+
+	if user2 == "" && conversationStr == "" {
+		log.Printf("Missing user parameters: user1=%s, user2=%s", user1, user2)
+		http.Error(w, "user2 or conversation parameter required", http.StatusBadRequest)
+		return
+	}
 
-	if pageStr != "" {
-		if p, err := strconv.Atoi(pageStr); err == nil && p > 0 {
-			page = p
+	// At most one anchor may be given
+	var anchorName string
+	var anchorID int64
+	for _, name := range []string{"before", "after", "around"} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || id <= 0 || anchorName != "" {
+			http.Error(w, "Use one of before, after or around with a message ID", http.StatusBadRequest)
+			return
+		}
+		anchorName, anchorID = name, id
+	}
+
+	condition := "(sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)"
+	args := []interface{}{user1, user2, user2, user1}
+	if conversationStr != "" {
+		conversationID, err := strconv.ParseInt(conversationStr, 10, 64)
+		if err != nil || !utils.IsGroupMember(GlobalDB, conversationID, user1) {
+			http.Error(w, utils.ErrNotConversationMember.Error(), http.StatusForbidden)
+			return
 		}
+		condition = "conversation_id = ?"
+		args = []interface{}{conversationID}
+		user2 = "conversation " + conversationStr
 	}
 
-	if limitStr != "" {
-		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
-			limit = l
+	if anchorName != "" {
+		var found bool
+		err := GlobalDB.QueryRow(`
+			SELECT EXISTS (SELECT 1 FROM messages WHERE id = ? AND (`+condition+`)
+			AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = messages.id AND h.user_id = ?))
+		`, append(append([]interface{}{anchorID}, args...), user1)...).Scan(&found)
+		if err != nil {
+			log.Printf("Database error finding message %d: %v", anchorID, err)
+			http.Error(w, "Failed to query messages", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "Message not found", http.StatusNotFound)
+			return
 		}
 	}
 
-	offset := (page - 1) * limit
+	log.Printf("Fetching chat history between users %s and %s (%s %d, limit %d)", user1, user2, anchorName, anchorID, limit)
 
-	if user1 == "" || user2 == "" {
-		log.Printf("Missing user parameters: user1=%s, user2=%s", user1, user2)
-		http.Error(w, "Both user1 and user2 parameters are required", http.StatusBadRequest)
+	var messages []map[string]interface{}
+	var err error
+	switch anchorName {
+	case "before", "":
+		messages, err = historyPage(condition, args, user1, "<", anchorID, limit)
+	case "after":
+		messages, err = historyPage(condition, args, user1, ">", anchorID, limit)
+	case "around":
+		var older, newer []map[string]interface{}
+		older, err = historyPage(condition, args, user1, "<=", anchorID, limit/2+1)
+		if err == nil {
+			newer, err = historyPage(condition, args, user1, ">", anchorID, limit-len(older))
+		}
+		messages = append(older, newer...)
+	}
+	if err != nil {
+		log.Printf("Database error querying messages: %v", err)
+		http.Error(w, "Failed to query messages", http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Fetching chat history between users %s and %s (page %d, limit %d)", user1, user2, page, limit)
+	messageIDs := make([]int64, len(messages))
+	for i, message := range messages {
+		messageIDs[i] = message["id"].(int64)
+	}
+	reactions, err := utils.MessageReactions(GlobalDB, messageIDs)
+	if err != nil {
+		log.Printf("Error loading message reactions: %v", err)
+	}
+	attachments, err := utils.MessageAttachmentsFor(GlobalDB, messageIDs)
+	if err != nil {
+		log.Printf("Error loading message attachments: %v", err)
+	}
+	for i, message := range messages {
+		if r, ok := reactions[messageIDs[i]]; ok {
+			message["reactions"] = r
+		}
+		if a, ok := attachments[messageIDs[i]]; ok {
+			message["attachments"] = a
+		}
+	}
+
+	// If no messages were found, return an empty array rather than null
+	if messages == nil {
+		messages = []map[string]interface{}{}
+	}
+	log.Printf("Found %d messages between users %s and %s", len(messages), user1, user2)
+
+	// Return the messages as JSON
+	if err := json.NewEncoder(w).Encode(messages); err != nil {
+		log.Printf("Error encoding messages to JSON: %v", err)
+		http.Error(w, "Error encoding response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// historyPage loads the messages on one side of an anchor message
+// @param condition - SQL condition selecting the conversation's messages
+// @param args - The condition's arguments
+// @param viewerID - The member the history is for; messages they hid are left out
+// @param direction - "<" or "<=" for messages before the anchor, ">" for after
+// @param anchorID - The anchor message; 0 to start from the newest message
+// @param limit - The most messages to load
+// @returns []map[string]interface{} - The messages oldest first, in the form sent to clients
+// @returns error - Any database error
+func historyPage(condition string, args []interface{}, viewerID, direction string, anchorID int64, limit int) ([]map[string]interface{}, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	order := "DESC"
+	if direction == ">" {
+		order = "ASC"
+	}
+	keyset := ""
+	queryArgs := append(append([]interface{}{}, args...), viewerID)
+	if anchorID != 0 {
+		keyset = "AND (sent_at, id) " + direction + " (SELECT sent_at, id FROM messages WHERE id = ?)"
+		queryArgs = append(queryArgs, anchorID)
+	}
 
-	// Query the database for messages between these users with pagination
 	rows, err := GlobalDB.Query(`
-		SELECT id, sender_id, receiver_id, content, sent_at, read
+		SELECT id, conversation_id, sender_id, receiver_id, content, sent_at, COALESCE(client_msg_id, ''), `+utils.MessageStatusColumn+`,
+			edited_at, deleted_at IS NOT NULL
 		FROM messages
-		WHERE (sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)
-		ORDER BY sent_at DESC
-		LIMIT ? OFFSET ?
-	`, user1, user2, user2, user1, limit, offset)
+		WHERE (`+condition+`)
+		AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = messages.id AND h.user_id = ?)
+		`+keyset+`
+		ORDER BY sent_at `+order+`, id `+order+`
+		LIMIT ?
+	`, append(queryArgs, limit)...)
 	if err != nil {
-		log.Printf("Database error querying messages: %v", err)
-		http.Error(w, "Failed to query messages", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 	defer rows.Close()
 
 	var messages []map[string]interface{}
 	for rows.Next() {
-		var id int
+		var id int64
+		var conversationID sql.NullInt64
 		var senderID, receiverID, content string
 		var sentAt string
-		var read bool
+		var clientMsgID, status string
+		var editedAt sql.NullTime
+		var deleted bool
 
-		if err := rows.Scan(&id, &senderID, &receiverID, &content, &sentAt, &read); err != nil {
+		if err := rows.Scan(&id, &conversationID, &senderID, &receiverID, &content, &sentAt, &clientMsgID, &status, &editedAt, &deleted); err != nil {
 			log.Printf("Error scanning message row: %v", err)
 			continue
 		}
 
 		// Format the message in the format expected by the client
-		messages = append(messages, map[string]interface{}{
-			"id":        id,
-			"sender":    senderID,
-			"recipient": receiverID,
-			"content":   content,
-			"timestamp": sentAt,
-			"read":      read,
-		})
+		message := map[string]interface{}{
+			"id":              id,
+			"conversation_id": conversationID.Int64,
+			"sender":          senderID,
+			"recipient":       receiverID,
+			"content":         content,
+			"content_raw":     content,
+			"content_html":    utils.RenderContent(content),
+			"mentions":        messageMentions(content),
+			"timestamp":       sentAt,
+			"read":            status == utils.MessageStatusRead,
+			"client_msg_id":   clientMsgID,
+			"status":          status,
+			"edited":          editedAt.Valid,
+			"deleted":         deleted,
+			"reactions":       []utils.MessageReaction{},
+			"attachments":     []utils.MessageAttachment{},
+		}
+		if editedAt.Valid {
+			message["edited_at"] = editedAt.Time.UTC().Format(time.RFC3339)
+		}
+		messages = append(messages, message)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
-	// If no messages were found, return an empty array rather than null
-	if messages == nil {
-		messages = []map[string]interface{}{}
-		log.Printf("No messages found between users %s and %s for page %d", user1, user2, page)
-	} else {
-		log.Printf("Found %d messages between users %s and %s for page %d", len(messages), user1, user2, page)
-		// Reverse the order to get chronological order (oldest first)
+	// Pages before an anchor are loaded newest first; return them oldest first
+	if order == "DESC" {
 		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
 			messages[i], messages[j] = messages[j], messages[i]
 		}
 	}
-
-	// Return the messages as JSON
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(messages); err != nil {
-		log.Printf("Error encoding messages to JSON: %v", err)
-		http.Error(w, "Error encoding response", http.StatusInternalServerError)
-		return
-	}
+	return messages, nil
 }
 
 // GetNewMessagesHandler fetches only new messages since a specific message ID
@@ -137,7 +284,7 @@ func GetNewMessagesHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Query the database for new messages between these users
 	rows, err := GlobalDB.Query(`
-		SELECT id, sender_id, receiver_id, content, sent_at
+		SELECT id, sender_id, receiver_id, content, sent_at, `+utils.MessageStatusColumn+`
 		FROM messages
 		WHERE ((sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?))
 		AND id > ?
@@ -152,10 +299,14 @@ func GetNewMessagesHandler(w http.ResponseWriter, r *http.Request) {
 	var messages []Message
 	for rows.Next() {
 		var msg Message
-		if err := rows.Scan(&msg.ID, &msg.SenderID, &msg.ReceiverID, &msg.Content, &msg.SentAt); err != nil {
+		if err := rows.Scan(&msg.ID, &msg.SenderID, &msg.ReceiverID, &msg.Content, &msg.SentAt, &msg.Status); err != nil {
 			http.Error(w, "Failed to scan message", http.StatusInternalServerError)
 			return
 		}
+		msg.Read = msg.Status == utils.MessageStatusRead
+		msg.ContentRaw = msg.Content
+		msg.ContentHTML = utils.RenderContent(msg.Content)
+		msg.Mentions = messageMentions(msg.Content)
 		messages = append(messages, msg)
 	}
 
@@ -166,6 +317,7 @@ func GetNewMessagesHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // SendMessageHandler handles sending a new message via HTTP API
+// The message is sent by the signed-in user; sender_id may be left out.
 func SendMessageHandler(w http.ResponseWriter, r *http.Request) {
 	// Only allow POST method
 	if r.Method != http.MethodPost {
@@ -177,8 +329,13 @@ func SendMessageHandler(w http.ResponseWriter, r *http.Request) {
 	var requestBody struct {
 		SenderID   string `json:"sender_id"`
 		ReceiverID string `json:"receiver_id"`
-		Content    string `json:"content"`
-		Timestamp  string `json:"timestamp,omitempty"`
+		// ConversationID sends to a group instead of a receiver
+		ConversationID int64  `json:"conversation_id,omitempty"`
+		Content        string `json:"content"`
+		// ClientMsgID makes retries idempotent; the server sets the timestamp
+		ClientMsgID string `json:"client_msg_id,omitempty"`
+		// AttachmentIDs are attachments the sender uploaded; content may then be empty
+		AttachmentIDs []int64 `json:"attachment_ids,omitempty"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
@@ -187,192 +344,83 @@ func SendMessageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Validate request data
-	if requestBody.SenderID == "" || requestBody.ReceiverID == "" || requestBody.Content == "" {
-		http.Error(w, "sender_id, receiver_id, and content are required", http.StatusBadRequest)
+	senderID, ok := requestUser(w, r, requestBody.SenderID)
+	if !ok {
 		return
 	}
+	requestBody.SenderID = senderID
 
-	log.Printf("Saving message: From %s to %s: %s", requestBody.SenderID, requestBody.ReceiverID, requestBody.Content)
-
-	// Get current time for message timestamp
-	var sentAt time.Time
-	if requestBody.Timestamp != "" {
-		// Try to parse the provided timestamp
-		var err error
-		sentAt, err = time.Parse(time.RFC3339, requestBody.Timestamp)
-		if err != nil {
-			log.Printf("Error parsing timestamp %s: %v", requestBody.Timestamp, err)
-			sentAt = time.Now()
-		}
-	} else {
-		sentAt = time.Now()
+	// Validate request data
+	if (requestBody.ReceiverID == "" && requestBody.ConversationID == 0) ||
+		(requestBody.Content == "" && len(requestBody.AttachmentIDs) == 0) {
+		http.Error(w, "receiver_id or conversation_id, and content or attachment_ids are required", http.StatusBadRequest)
+		return
 	}
 
-	// Format the timestamp as a string
-	sentAtStr := sentAt.Format("2006-01-02 15:04:05")
-	log.Printf("Formatted timestamp: %s", sentAtStr)
+	log.Printf("Saving message: From %s to %s: %s", requestBody.SenderID, requestBody.ReceiverID, requestBody.Content)
 
-	// Validate sender and receiver IDs
-	if err := utils.ValidateUserID(requestBody.SenderID); err != nil {
-		log.Printf("Invalid sender ID: %s, error: %v", requestBody.SenderID, err)
-		http.Error(w, "Invalid sender ID", http.StatusBadRequest)
-		return
-	}
+	// Validate receiver ID
 
-	if err := utils.ValidateUserID(requestBody.ReceiverID); err != nil {
-		log.Printf("Invalid receiver ID: %s, error: %v", requestBody.ReceiverID, err)
-		http.Error(w, "Invalid receiver ID", http.StatusBadRequest)
-		return
+	if requestBody.ConversationID == 0 {
+		if err := utils.ValidateUserID(requestBody.ReceiverID); err != nil {
+			log.Printf("Invalid receiver ID: %s, error: %v", requestBody.ReceiverID, err)
+			http.Error(w, "Invalid receiver ID", http.StatusBadRequest)
+			return
+		}
 	}
 
 	// Validate message content
-	if err := utils.ValidateContent(requestBody.Content, 5000); err != nil {
+	if err := validateChatContent(requestBody.Content, requestBody.AttachmentIDs); err != nil {
 		log.Printf("Invalid message content: %v", err)
 		http.Error(w, "Invalid message content", http.StatusBadRequest)
 		return
 	}
 
-	// Sanitize message content to prevent XSS
-	sanitizedContent := utils.SanitizeString(requestBody.Content)
-
-	// Insert message into database - explicitly set read to 0 (false) to ensure it's unread
-	result, err := GlobalDB.Exec(`
-		INSERT INTO messages (sender_id, receiver_id, content, sent_at, read)
-		VALUES (?, ?, ?, ?, 0)
-	`, requestBody.SenderID, requestBody.ReceiverID, sanitizedContent, sentAtStr)
-	if err != nil {
-		log.Printf("Database error saving message: %v", err)
-		http.Error(w, "Failed to save message", http.StatusInternalServerError)
+	if len(requestBody.ClientMsgID) > utils.MaxClientMsgIDLength {
+		http.Error(w, utils.ErrInvalidClientMsgID.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Get the ID of the inserted message
-	messageID, err := result.LastInsertId()
-	if err != nil {
-		log.Printf("Error getting last insert ID: %v", err)
-		http.Error(w, "Failed to get message ID", http.StatusInternalServerError)
+	// Content is stored as written; clients render the sanitized content_html
+	// A retry with the same client message ID returns the saved message
+	var message ChatMessage
+	var duplicate bool
+	var err error
+	if requestBody.ConversationID != 0 {
+		if !utils.IsGroupMember(GlobalDB, requestBody.ConversationID, requestBody.SenderID) {
+			http.Error(w, utils.ErrNotConversationMember.Error(), http.StatusForbidden)
+			return
+		}
+		message, duplicate, err = deliverGroupMessage(requestBody.ConversationID, requestBody.SenderID, requestBody.Content, requestBody.ClientMsgID, requestBody.AttachmentIDs, nil)
+	} else {
+		if contactBlocked(requestBody.SenderID, requestBody.ReceiverID) {
+			log.Printf("Message from %s to %s dropped: blocked", requestBody.SenderID, requestBody.ReceiverID)
+			http.Error(w, "You cannot message this user", http.StatusForbidden)
+			return
+		}
+		message, duplicate, err = deliverChatMessage(requestBody.SenderID, requestBody.ReceiverID, requestBody.Content, requestBody.ClientMsgID, requestBody.AttachmentIDs, nil)
+	}
+	if chatSendStatus(err) == http.StatusBadRequest {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	log.Printf("Message saved successfully with ID: %d", messageID)
-
-	// Verify the message was saved by retrieving it
-	var savedID int
-	var savedContent string
-	err = GlobalDB.QueryRow("SELECT id, content FROM messages WHERE id = ?", messageID).Scan(&savedID, &savedContent)
 	if err != nil {
-		log.Printf("Error verifying saved message: %v", err)
-	} else {
-		log.Printf("Verified saved message: ID=%d, Content=%s", savedID, savedContent)
+		log.Printf("Database error saving message: %v", err)
+		http.Error(w, "Failed to save message", http.StatusInternalServerError)
+		return
 	}
 
-	// Notify any connected WebSocket clients about the new message
-	// Broadcast a notification to update the users_nav component
-	go BroadcastNewMessage(requestBody.SenderID, requestBody.ReceiverID)
-
 	// Return success response with the saved message in the format expected by the client
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"message": map[string]interface{}{
-			"id":        messageID,
-			"sender":    requestBody.SenderID,
-			"recipient": requestBody.ReceiverID,
-			"content":   requestBody.Content,
-			"timestamp": sentAt.Format(time.RFC3339),
-		},
+		"success":   true,
+		"duplicate": duplicate,
+		"message":   message,
 	})
 }
 
-// HandleChatMessage processes an incoming chat message from WebSocket
-func HandleChatMessage(conn *websocket.Conn, message map[string]interface{}) {
-	// Extract message data
-	messageData, ok := message["message"].(map[string]interface{})
-	if !ok {
-		log.Printf("Invalid message format: %v", message)
-		return
-	}
-
-	// Extract sender and recipient
-	sender, ok1 := messageData["sender"].(string)
-	recipient, ok2 := messageData["recipient"].(string)
-	content, ok3 := messageData["content"].(string)
-
-	if !ok1 || !ok2 || !ok3 {
-		log.Printf("Missing required message fields: %v", messageData)
-		return
-	}
-
-	// Get timestamp or use current time
-	var timestamp string
-	if ts, ok := messageData["timestamp"].(string); ok && ts != "" {
-		timestamp = ts
-	} else {
-		timestamp = time.Now().Format(time.RFC3339)
-	}
-
-	log.Printf("Processing chat message from %s to %s: %s", sender, recipient, content)
-
-	// Store message in database
-	var messageID int64
-	result, err := GlobalDB.Exec(`
-		INSERT INTO messages (sender_id, receiver_id, content, sent_at, read)
-		VALUES (?, ?, ?, ?, false)
-	`, sender, recipient, content, timestamp)
-	if err != nil {
-		log.Printf("Error storing message in database: %v", err)
-		return
-	}
-
-	messageID, err = result.LastInsertId()
-	if err != nil {
-		log.Printf("Error getting last insert ID: %v", err)
-		return
-	}
-
-	log.Printf("Message stored in database with ID: %d", messageID)
-
-	// Create response message
-	responseMessage := map[string]interface{}{
-		"type": "message",
-		"message": map[string]interface{}{
-			"id":        messageID,
-			"sender":    sender,
-			"recipient": recipient,
-			"content":   content,
-			"timestamp": timestamp,
-			"read":      false,
-		},
-	}
-
-	// Send to sender for confirmation
-	err = conn.WriteJSON(responseMessage)
-	if err != nil {
-		log.Printf("Error sending message confirmation to sender: %v", err)
-	}
-
-	// Find recipient's connection and send message
-	clientsMux.RLock()
-	recipientConn, exists := clients[recipient]
-	clientsMux.RUnlock()
-
-	if exists {
-		err = recipientConn.WriteJSON(responseMessage)
-		if err != nil {
-			log.Printf("Error sending message to recipient: %v", err)
-		} else {
-			log.Printf("Successfully forwarded message to user %s", recipient)
-		}
-	} else {
-		log.Printf("Recipient %s not connected to chat with %s (key: %s:%s not found)", recipient, sender, recipient, sender)
-	}
-
-	// Broadcast to all clients that a new message was sent to update their user lists
-	go BroadcastMessageNotification(sender, recipient)
-}
-
 // MarkMessagesAsReadHandler handles marking messages as read
+// The messages are read by the signed-in user; receiver_id may be left out.
 func MarkMessagesAsReadHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("MarkMessagesAsReadHandler called with method: %s", r.Method)
 
@@ -385,8 +433,9 @@ func MarkMessagesAsReadHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Parse request body
 	var requestBody struct {
-		ReceiverID string `json:"receiver_id"` // The user who is reading the messages
-		SenderID   string `json:"sender_id"`   // The user who sent the messages
+		ReceiverID     string `json:"receiver_id"`               // The user who is reading the messages
+		SenderID       string `json:"sender_id"`                 // The user who sent the messages
+		ConversationID int64  `json:"conversation_id,omitempty"` // The group being read, instead of a sender
 	}
 
 	// Read the request body for logging
@@ -411,73 +460,63 @@ func MarkMessagesAsReadHandler(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Decoded request body: %+v", requestBody)
 
+	receiverID, ok := requestUser(w, r, requestBody.ReceiverID)
+	if !ok {
+		return
+	}
+	requestBody.ReceiverID = receiverID
+
 	// Validate request data
-	if requestBody.ReceiverID == "" || requestBody.SenderID == "" {
+	if requestBody.SenderID == "" && requestBody.ConversationID == 0 {
 		log.Printf("Missing required fields: receiver_id=%s, sender_id=%s", requestBody.ReceiverID, requestBody.SenderID)
-		http.Error(w, "receiver_id and sender_id are required", http.StatusBadRequest)
+		http.Error(w, "sender_id or conversation_id is required", http.StatusBadRequest)
 		return
 	}
+	if requestBody.ConversationID == 0 {
+		if err := utils.ValidateUserID(requestBody.SenderID); err != nil || requestBody.SenderID == requestBody.ReceiverID {
+			log.Printf("Invalid sender ID: %s", requestBody.SenderID)
+			http.Error(w, "Invalid sender ID", http.StatusBadRequest)
+			return
+		}
+	}
 
 	log.Printf("Marking messages as read: From %s to %s", requestBody.SenderID, requestBody.ReceiverID)
 
-	// Check if there are any unread messages
-	var unreadCount int
-	err = GlobalDB.QueryRow(`
-		SELECT COUNT(*)
-		FROM messages
-		WHERE sender_id = ? AND receiver_id = ? AND read = 0
-	`, requestBody.SenderID, requestBody.ReceiverID).Scan(&unreadCount)
-
-	if err != nil {
-		log.Printf("Error checking unread messages: %v", err)
-	} else {
-		log.Printf("Found %d unread messages from %s to %s", unreadCount, requestBody.SenderID, requestBody.ReceiverID)
+	// Move the reader's read pointer to the latest message and send receipts
+	conversationID := requestBody.ConversationID
+	if conversationID == 0 {
+		if conversationID, err = utils.DirectConversationID(GlobalDB, requestBody.ReceiverID, requestBody.SenderID); err != nil {
+			log.Printf("Database error finding conversation: %v", err)
+			http.Error(w, "Failed to mark messages as read", http.StatusInternalServerError)
+			return
+		}
+	}
+	receipts, err := utils.MarkConversationRead(GlobalDB, requestBody.ReceiverID, conversationID)
+	if errors.Is(err, utils.ErrNotConversationMember) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
 	}
-
-	// Update messages in the database
-	result, err := GlobalDB.Exec(`
-		UPDATE messages
-		SET read = 1
-		WHERE sender_id = ? AND receiver_id = ? AND read = 0
-	`, requestBody.SenderID, requestBody.ReceiverID)
 	if err != nil {
 		log.Printf("Database error marking messages as read: %v", err)
 		http.Error(w, "Failed to mark messages as read", http.StatusInternalServerError)
 		return
 	}
-
-	// Get the number of rows affected
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		log.Printf("Error getting rows affected: %v", err)
-	} else {
-		log.Printf("Marked %d messages as read", rowsAffected)
+	var rowsAffected int
+	for _, receipt := range receipts {
+		rowsAffected += len(receipt.MessageIDs)
 	}
+	log.Printf("Marked %d messages as read", rowsAffected)
+	publishReceipts(requestBody.ReceiverID, receipts)
 
-	// Broadcast a message_read event to the sender
-	if rowsAffected > 0 {
+	// Broadcast a message_read event to the sender of a direct conversation
+	if rowsAffected > 0 && requestBody.ConversationID == 0 {
 		log.Printf("Broadcasting message_read event from %s to %s", requestBody.ReceiverID, requestBody.SenderID)
 
-		// Create a message_read notification
 		readNotification := map[string]interface{}{
-			"type":       "message_read",
 			"senderID":   requestBody.SenderID,   // The original sender of the messages
 			"receiverID": requestBody.ReceiverID, // The person who read the messages
 		}
-
-		// Find the sender's connection and send the notification
-		clientsMux.RLock()
-		senderConn, exists := clients[requestBody.SenderID]
-		clientsMux.RUnlock()
-
-		if exists {
-			err = senderConn.WriteJSON(readNotification)
-			if err != nil {
-				log.Printf("Error sending message_read notification to sender: %v", err)
-			} else {
-				log.Printf("Successfully sent message_read notification to user %s", requestBody.SenderID)
-			}
-		} else {
+		if Publish(UserTopic(requestBody.SenderID), "message_read", readNotification) == 0 {
 			log.Printf("Sender %s not connected, could not send message_read notification", requestBody.SenderID)
 		}
 	}
@@ -492,40 +531,3 @@ func MarkMessagesAsReadHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Sending response: %+v", response)
 	json.NewEncoder(w).Encode(response)
 }
-
-// BroadcastMessageNotification notifies all clients that a new message has been sent
-// This is a separate function from BroadcastNewMessage in websocket.go to avoid name conflicts
-func BroadcastMessageNotification(senderID string, receiverID string) {
-	log.Printf("Broadcasting new message notification from %s to %s", senderID, receiverID)
-
-	notification := NewMessageNotification{
-		Type:       "refresh_users",
-		SenderID:   senderID,
-		ReceiverID: receiverID,
-	}
-
-	// Use a separate goroutine for broadcasting to avoid blocking
-	go func() {
-		clientsMux.RLock()
-		clientsCopy := make(map[string]*ClientConnection)
-		for id, conn := range clients {
-			clientsCopy[id] = conn
-		}
-		clientsMux.RUnlock()
-
-		// Now we can safely iterate through our copy without holding the lock
-		for _, conn := range clientsCopy {
-			err := conn.WriteJSON(notification)
-			if err != nil {
-				log.Printf("Error broadcasting message notification: %v", err)
-				continue
-			}
-		}
-		log.Printf("Broadcasted message notification from %s to %s", senderID, receiverID)
-
-		// After sending the notification, also broadcast the updated users list
-		// Use a small delay to avoid concurrent writes
-		time.Sleep(100 * time.Millisecond)
-		BroadcastUsersList()
-	}()
-}
@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+
+	"forum/utils"
 )
 
 // GetChatUsersHandler returns a list of users with their last message timestamps
@@ -26,16 +28,18 @@ func GetChatUsersHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Fetching chat users for user ID: %s", currentUserID)
 
 	// Query all users with their last message timestamp and unread message count
+	// Unread messages are those past the current user's read pointer
 	// Sort by last message time (like Discord), with alphabetical fallback for users without messages
 	rows, err := GlobalDB.Query(`
-		SELECT u.id, u.nickname, u.profile_pic, u.is_online,
+		SELECT u.id, u.nickname, u.profile_pic, `+utils.VisibleStatusSQL("u")+`,
 			   (SELECT MAX(sent_at)
 				FROM messages
 				WHERE (sender_id = u.id AND receiver_id = ?)
 				   OR (sender_id = ? AND receiver_id = u.id)) as last_message_time,
 			   (SELECT COUNT(*)
-				FROM messages
-				WHERE sender_id = u.id AND receiver_id = ? AND read = 0) as unread_count
+				FROM messages m
+				JOIN conversation_members cm ON cm.conversation_id = m.conversation_id AND cm.user_id = ?
+				WHERE m.sender_id = u.id AND m.receiver_id = ? AND m.id > cm.last_read_message_id) as unread_count
 		FROM users u
 		WHERE u.id != ?
 		ORDER BY
@@ -48,7 +52,7 @@ func GetChatUsersHandler(w http.ResponseWriter, r *http.Request) {
 			last_message_time DESC,
 			-- Finally, sort alphabetically for users without messages
 			nickname ASC
-	`, currentUserID, currentUserID, currentUserID, currentUserID, currentUserID, currentUserID)
+	`, currentUserID, currentUserID, currentUserID, currentUserID, currentUserID, currentUserID, currentUserID)
 	if err != nil {
 		log.Printf("Error querying users with messages: %v", err)
 		http.Error(w, "Failed to fetch users", http.StatusInternalServerError)
@@ -60,11 +64,11 @@ func GetChatUsersHandler(w http.ResponseWriter, r *http.Request) {
 	for rows.Next() {
 		var id, nickname string
 		var profilePic sql.NullString
-		var isOnline bool
+		var status string
 		var lastMessageTime sql.NullString
 		var unreadCount int
 
-		if err := rows.Scan(&id, &nickname, &profilePic, &isOnline, &lastMessageTime, &unreadCount); err != nil {
+		if err := rows.Scan(&id, &nickname, &profilePic, &status, &lastMessageTime, &unreadCount); err != nil {
 			log.Printf("Error scanning user row: %v", err)
 			continue
 		}
@@ -72,7 +76,8 @@ func GetChatUsersHandler(w http.ResponseWriter, r *http.Request) {
 		user := map[string]interface{}{
 			"id":          id,
 			"userName":    nickname,
-			"isOnline":    isOnline,
+			"isOnline":    status != utils.UserStatusOffline,
+			"status":      status,
 			"unreadCount": unreadCount,
 		}
 
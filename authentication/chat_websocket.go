@@ -2,50 +2,118 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
-	"sync"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/gorilla/websocket"
+	"forum/utils"
 )
 
-// Chat WebSocket connection management
-var (
-	// chatClients maps user chat connections using a composite key format "userID:chatPartnerID"
-	chatClients = make(map[string]*websocket.Conn)
-	// chatClientsMux protects concurrent access to the chatClients map
-	chatClientsMux sync.RWMutex
-)
-
-// ChatMessage represents a message sent between users
+// ChatMessage represents a message sent in a direct or group conversation
+// Direct messages name their recipient; group messages have an empty
+// recipient and are sent by conversation ID. A message deleted for everyone
+// keeps its ID and time but has no content. Clients send the IDs of
+// attachments they uploaded and get the attachments back.
 type ChatMessage struct {
-	Type      string `json:"type"`
-	Sender    string `json:"sender"`
-	Recipient string `json:"recipient"`
-	Content   string `json:"content"`
-	Timestamp string `json:"timestamp"`
+	ID             int64                     `json:"id,omitempty"`
+	ConversationID int64                     `json:"conversation_id,omitempty"`
+	ClientMsgID    string                    `json:"client_msg_id,omitempty"`
+	Sender         string                    `json:"sender"`
+	Recipient      string                    `json:"recipient"`
+	Content        string                    `json:"content"`
+	ContentRaw     string                    `json:"content_raw,omitempty"`
+	ContentHTML    string                    `json:"content_html,omitempty"`
+	Mentions       []utils.MentionSpan       `json:"mentions"`
+	Timestamp      string                    `json:"timestamp"`
+	Status         string                    `json:"status,omitempty"`
+	Edited         bool                      `json:"edited,omitempty"`
+	EditedAt       string                    `json:"edited_at,omitempty"`
+	Deleted        bool                      `json:"deleted,omitempty"`
+	Reactions      []utils.MessageReaction   `json:"reactions,omitempty"`
+	AttachmentIDs  []int64                   `json:"attachment_ids,omitempty"`
+	Attachments    []utils.MessageAttachment `json:"attachments,omitempty"`
+}
+
+// chatSend is the data of a "message" sent by a client, and of one pushed to it
+type chatSend struct {
+	Message  ChatMessage `json:"message"`
+	Replayed bool        `json:"replayed,omitempty"`
+}
+
+// MessageAck confirms to the sender that a message was saved
+type MessageAck struct {
+	ClientMsgID    string `json:"client_msg_id"`
+	ID             int64  `json:"id"`
+	ConversationID int64  `json:"conversation_id"`
+	Timestamp      string `json:"timestamp"`
+	// Duplicate is set when the client message ID was already used, e.g. by a retry
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+// ReceiptMessage tells a sender their messages were delivered to or read by a member
+type ReceiptMessage struct {
+	Status         string  `json:"status"`
+	ConversationID int64   `json:"conversation_id"`
+	MessageIDs     []int64 `json:"message_ids"`
+	SenderID       string  `json:"sender_id"`
+	ReceiverID     string  `json:"receiver_id"`
+	At             string  `json:"at"`
 }
 
-// TypingIndicator represents a typing status update
-type TypingIndicator struct {
-	Type      string `json:"type"`
-	Sender    string `json:"sender"`
-	Recipient string `json:"recipient"`
+// receiptRequest is the data of a "delivered" or "read" sent by a client
+type receiptRequest struct {
+	MessageIDs []int64 `json:"message_ids"`
+}
+
+// resumeRequest is the data of a "resume" sent by a client
+type resumeRequest struct {
+	Since          int64  `json:"since"`
+	With           string `json:"with"`
+	ConversationID int64  `json:"conversation_id"`
 }
 
 // HandleChatWebSocket handles WebSocket connections for real-time chat messaging
+// The connection is registered with the hub and subscribed to the
+// conversation between the signed-in user and user2, or to the group given
+// by conversation. The user comes from the session cookie and is checked
+// before the upgrade; user1, if given, must be that user. With a since
+// parameter, messages after that ID are replayed before anything new.
 func HandleChatWebSocket(w http.ResponseWriter, r *http.Request) {
-	// Get user IDs from query parameters
-	user1 := r.URL.Query().Get("user1")
+	user1, ok := requestUser(w, r, r.URL.Query().Get("user1"))
+	if !ok {
+		return
+	}
 	user2 := r.URL.Query().Get("user2")
+	conversationStr := r.URL.Query().Get("conversation")
 
-	if user1 == "" || user2 == "" {
+	if user2 == "" && conversationStr == "" {
 		log.Printf("Missing user parameters for chat WebSocket")
-		http.Error(w, "Both user1 and user2 parameters required", http.StatusBadRequest)
+		http.Error(w, "user2 or conversation parameter required", http.StatusBadRequest)
 		return
 	}
 
+	var conversationID int64
+	if conversationStr != "" {
+		var err error
+		conversationID, err = strconv.ParseInt(conversationStr, 10, 64)
+		if err != nil || !utils.IsGroupMember(GlobalDB, conversationID, user1) {
+			http.Error(w, utils.ErrNotConversationMember.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	var since int64 = -1
+	if sinceStr := r.URL.Query().Get("since"); sinceStr != "" {
+		var err error
+		if since, err = strconv.ParseInt(sinceStr, 10, 64); err != nil || since < 0 {
+			http.Error(w, "since must be a message ID", http.StatusBadRequest)
+			return
+		}
+	}
+
 	// Upgrade HTTP connection to WebSocket
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -53,176 +121,410 @@ func HandleChatWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Create a composite key for this specific chat connection
-	chatKey := user1 + ":" + user2
+	topic := ConversationTopic(user1, user2)
+	if conversationID != 0 {
+		topic = GroupTopic(conversationID)
+	}
+	client := newClient(hub, conn, user1, false, topic)
+	client.conversation = topic
+
+	log.Printf("Chat WebSocket connection established for user: %s on %s", user1, topic)
+	client.open()
+	if since >= 0 {
+		if conversationID != 0 {
+			resumeConversation(client, conversationID, "", since)
+		} else {
+			resumeDirect(client, user2, since)
+		}
+	}
+	client.readPump()
+	log.Printf("Chat WebSocket connection closed for user: %s on %s", user1, topic)
+}
+
+// chatMessageFromStored converts a saved message into the form sent to clients
+// @param m - The saved message
+// @param mentions - Its mentions; nil to resolve them from the content
+// @returns ChatMessage - The message with rendered content
+func chatMessageFromStored(m utils.StoredMessage, mentions []utils.MentionSpan) ChatMessage {
+	if mentions == nil {
+		mentions = messageMentions(m.Content)
+	}
+	msg := ChatMessage{
+		ID:             m.ID,
+		ConversationID: m.ConversationID,
+		ClientMsgID:    m.ClientMsgID,
+		Sender:         m.SenderID,
+		Recipient:      m.ReceiverID,
+		Content:        m.Content,
+		ContentRaw:     m.Content,
+		ContentHTML:    utils.RenderContent(m.Content),
+		Mentions:       mentions,
+		Timestamp:      m.SentAt.UTC().Format(time.RFC3339),
+		Status:         m.Status,
+		Deleted:        m.Deleted,
+		Reactions:      m.Reactions,
+		Attachments:    m.Attachments,
+	}
+	if !m.EditedAt.IsZero() {
+		msg.Edited = true
+		msg.EditedAt = m.EditedAt.UTC().Format(time.RFC3339)
+	}
+	return msg
+}
+
+// errInvalidRecipient is returned for direct messages to the sender or to users who do not exist
+var errInvalidRecipient = errors.New("invalid recipient")
 
-	// Register client with the composite key
-	chatClientsMux.Lock()
-	chatClients[chatKey] = conn
-	chatClientsMux.Unlock()
+// validateRecipient checks a direct message can be sent to receiverID
+// @param senderID - The sending user
+// @param receiverID - The receiving user
+// @returns error - errInvalidRecipient, or any database error
+func validateRecipient(senderID, receiverID string) error {
+	if utils.ValidateUserID(receiverID) != nil || receiverID == senderID {
+		return errInvalidRecipient
+	}
+	var exists bool
+	err := GlobalDB.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)", receiverID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errInvalidRecipient
+	}
+	return nil
+}
 
-	log.Printf("Chat WebSocket connection established for user: %s chatting with: %s (key: %s)", user1, user2, chatKey)
+// deliverChatMessage saves a direct message and pushes it to the conversation
+// A message whose client message ID was already used is not saved or
+// pushed again; the stored copy is returned so the sender can be acked.
+// @param senderID - The sending user
+// @param receiverID - The receiving user
+// @param content - The message text, already validated
+// @param clientMsgID - The sender's idempotency key, may be empty
+// @param attachmentIDs - Attachments the sender uploaded to send with the message
+// @param except - The connection the message came from, which is not sent it; nil for none
+// @returns ChatMessage - The saved message
+// @returns bool - True if the message had already been saved
+// @returns error - errInvalidRecipient, a utils attachment error or any database error
+func deliverChatMessage(senderID, receiverID, content, clientMsgID string, attachmentIDs []int64, except *Client) (ChatMessage, bool, error) {
+	if err := validateRecipient(senderID, receiverID); err != nil {
+		return ChatMessage{}, false, err
+	}
+	conversationID, err := utils.DirectConversationID(GlobalDB, senderID, receiverID)
+	if err != nil {
+		return ChatMessage{}, false, err
+	}
+	msg, duplicate, err := saveChatMessage(conversationID, senderID, receiverID, []string{receiverID}, content, clientMsgID, attachmentIDs)
+	if err != nil || duplicate {
+		return msg, duplicate, err
+	}
 
-	// Clean up on disconnect
-	defer func() {
-		chatClientsMux.Lock()
-		delete(chatClients, chatKey)
-		chatClientsMux.Unlock()
-		conn.Close()
-		log.Printf("Chat WebSocket connection closed for user: %s chatting with: %s (key: %s)", user1, user2, chatKey)
-	}()
+	hub.publishEnvelope(ConversationTopic(senderID, receiverID), "message", chatSend{Message: msg}, except, false)
+	go BroadcastNewMessage(conversationID, senderID, receiverID)
+	return msg, false, nil
+}
 
-	// Listen for messages
-	for {
-		_, message, err := conn.ReadMessage()
-		if err != nil {
-			log.Printf("Error reading message: %v", err)
-			break
+// deliverGroupMessage saves a group message and pushes it to the group
+// The sender must already be known to be a member.
+// @param conversationID - The group
+// @param senderID - The sending member
+// @param content - The message text, already validated
+// @param clientMsgID - The sender's idempotency key, may be empty
+// @param attachmentIDs - Attachments the sender uploaded to send with the message
+// @param except - The connection the message came from, which is not sent it; nil for none
+// @returns ChatMessage - The saved message
+// @returns bool - True if the message had already been saved
+// @returns error - A utils attachment error or any database error
+func deliverGroupMessage(conversationID int64, senderID, content, clientMsgID string, attachmentIDs []int64, except *Client) (ChatMessage, bool, error) {
+	others, err := conversationReaders(conversationID, senderID)
+	if err != nil {
+		return ChatMessage{}, false, err
+	}
+
+	msg, duplicate, err := saveChatMessage(conversationID, senderID, "", others, content, clientMsgID, attachmentIDs)
+	if err != nil || duplicate {
+		return msg, duplicate, err
+	}
+
+	hub.publishEnvelope(GroupTopic(conversationID), "message", chatSend{Message: msg}, except, false)
+	go BroadcastGroupMessage(conversationID, senderID, others)
+	return msg, false, nil
+}
+
+// saveChatMessage stores a message with its attachments and records its mentions
+// Only the readers, the other members of the conversation, can be mentioned.
+// The attachments are checked before the message is saved, so a message is
+// never sent without the attachments it was meant to carry.
+func saveChatMessage(conversationID int64, senderID, receiverID string, readers []string, content, clientMsgID string, attachmentIDs []int64) (ChatMessage, bool, error) {
+	if err := utils.ValidatePendingAttachments(GlobalDB, senderID, clientMsgID, attachmentIDs); err != nil {
+		return ChatMessage{}, false, err
+	}
+	stored, duplicate, err := utils.SaveMessage(GlobalDB, conversationID, senderID, receiverID, content, clientMsgID)
+	if err != nil {
+		return ChatMessage{}, false, err
+	}
+	if !duplicate {
+		if err := utils.ClaimMessageAttachments(GlobalDB, stored.ID, senderID, attachmentIDs); err != nil {
+			log.Printf("Error attaching attachments to message %d: %v", stored.ID, err)
 		}
+	}
+	messages := []utils.StoredMessage{stored}
+	if err := utils.AttachMessageAttachments(GlobalDB, messages); err != nil {
+		log.Printf("Error loading attachments of message %d: %v", stored.ID, err)
+	}
+	stored = messages[0]
+	if duplicate {
+		return chatMessageFromStored(stored, nil), true, nil
+	}
 
-		// Parse the message
-		var msg map[string]interface{}
-		if err := json.Unmarshal(message, &msg); err != nil {
-			log.Printf("Error parsing message: %v", err)
-			continue
+	mentions := recordMessageMentions(stored.ID, senderID, readers, content)
+	if mentions == nil {
+		mentions = []utils.MentionSpan{}
+	}
+	return chatMessageFromStored(stored, mentions), false, nil
+}
+
+// validateChatContent checks the text of a message being sent
+// Messages carrying attachments may have no text.
+func validateChatContent(content string, attachmentIDs []int64) error {
+	if len(attachmentIDs) > 0 && strings.TrimSpace(content) == "" {
+		return nil
+	}
+	return utils.ValidateContent(content, 5000)
+}
+
+// chatSendStatus maps errors from sending a message to HTTP statuses
+func chatSendStatus(err error) int {
+	switch {
+	case errors.Is(err, utils.ErrAttachmentNotFound), errors.Is(err, utils.ErrTooManyAttachments),
+		errors.Is(err, errInvalidRecipient):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// conversationReaders lists the members of a conversation other than a sender
+func conversationReaders(conversationID int64, senderID string) ([]string, error) {
+	members, err := utils.ConversationMemberIDs(GlobalDB, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	var others []string
+	for _, memberID := range members {
+		if memberID != senderID {
+			others = append(others, memberID)
 		}
+	}
+	return others, nil
+}
 
-		// Handle different message types
-		msgType, ok := msg["type"].(string)
-		if !ok {
-			log.Printf("Invalid message type")
-			continue
+// handleChatSend saves a message sent over a WebSocket and acks it
+// The sender is always the connection's user. Messages with a conversation
+// ID go to that group, others to their recipient. The message is not echoed
+// back to the connection it came from, which gets an ack instead.
+// @param c - The connection the message came from
+// @param data - The message data
+func handleChatSend(c *Client, data json.RawMessage) {
+	var send chatSend
+	if err := json.Unmarshal(data, &send); err != nil || (send.Message.Recipient == "" && send.Message.ConversationID == 0) {
+		log.Printf("Invalid chat message from user %s", c.userID)
+		c.reply("error", map[string]string{"error": "Invalid message"})
+		return
+	}
+	msg := send.Message
+	fail := func(reason string) {
+		c.reply("error", map[string]string{"error": reason, "client_msg_id": msg.ClientMsgID})
+	}
+
+	if err := validateChatContent(msg.Content, msg.AttachmentIDs); err != nil {
+		fail("Invalid message content")
+		return
+	}
+	if len(msg.ClientMsgID) > utils.MaxClientMsgIDLength {
+		fail(utils.ErrInvalidClientMsgID.Error())
+		return
+	}
+
+	var saved ChatMessage
+	var duplicate bool
+	var err error
+	if msg.ConversationID != 0 {
+		if !utils.IsGroupMember(GlobalDB, msg.ConversationID, c.userID) {
+			fail(utils.ErrNotConversationMember.Error())
+			return
 		}
-		switch msgType {
-		case "message":
-			// Save message to database
-			if msgObj, ok := msg["message"].(map[string]interface{}); ok {
-				sender := msgObj["sender"].(string)
-				recipient := msgObj["recipient"].(string)
-				content := msgObj["content"].(string)
-				timestamp := msgObj["timestamp"].(string)
-
-				log.Printf("WebSocket: Saving message from %s to %s: %s", sender, recipient, content)
-
-				// Parse the timestamp
-				parsedTime, err := time.Parse(time.RFC3339, timestamp)
-				if err != nil {
-					log.Printf("Error parsing timestamp: %v, using current time instead", err)
-					parsedTime = time.Now()
-				}
-
-				// Format the timestamp as a string
-				sentAtStr := parsedTime.Format("2006-01-02 15:04:05")
-				log.Printf("Formatted timestamp: %s", sentAtStr)
-
-				// Ensure the messages table exists
-				_, err = GlobalDB.Exec(`
-					CREATE TABLE IF NOT EXISTS messages (
-						id INTEGER PRIMARY KEY AUTOINCREMENT,
-						sender_id TEXT NOT NULL,
-						receiver_id TEXT NOT NULL,
-						content TEXT NOT NULL,
-						sent_at TIMESTAMP NOT NULL,
-						read BOOLEAN DEFAULT 0
-					)
-				`)
-				if err != nil {
-					log.Printf("Error ensuring messages table exists: %v", err)
-				}
-
-				// Insert into database
-				result, err := GlobalDB.Exec(
-					"INSERT INTO messages (sender_id, receiver_id, content, sent_at, read) VALUES (?, ?, ?, ?, 0)",
-					sender, recipient, content, sentAtStr,
-				)
-				if err != nil {
-					log.Printf("Error saving message via WebSocket: %v", err)
-				} else {
-					if id, err := result.LastInsertId(); err == nil {
-						log.Printf("Message saved via WebSocket with ID: %d", id)
-
-						// Verify the message was saved
-						var savedID int
-						var savedContent string
-						err = GlobalDB.QueryRow("SELECT id, content FROM messages WHERE id = ?", id).Scan(&savedID, &savedContent)
-						if err != nil {
-							log.Printf("Error verifying saved message: %v", err)
-						} else {
-							log.Printf("Verified saved message: ID=%d, Content=%s", savedID, savedContent)
-						}
-					}
-				}
-
-				// Forward message to recipient if online
-				forwardMessageToUser(recipient, message)
-			}
-		case "typing", "stop_typing":
-			// Forward typing indicator to the recipient
-			if recipient, ok := msg["recipient"].(string); ok {
-				forwardMessageToUser(recipient, message)
-			}
+		saved, duplicate, err = deliverGroupMessage(msg.ConversationID, c.userID, msg.Content, msg.ClientMsgID, msg.AttachmentIDs, c)
+	} else {
+		if contactBlocked(c.userID, msg.Recipient) {
+			log.Printf("WebSocket: Message from %s to %s dropped: blocked", c.userID, msg.Recipient)
+			fail("You cannot message this user")
+			return
 		}
+		saved, duplicate, err = deliverChatMessage(c.userID, msg.Recipient, msg.Content, msg.ClientMsgID, msg.AttachmentIDs, c)
+	}
+	if chatSendStatus(err) == http.StatusBadRequest {
+		fail(err.Error())
+		return
 	}
+	if err != nil {
+		log.Printf("Error saving message via WebSocket: %v", err)
+		fail("Failed to save message")
+		return
+	}
+	c.reply("ack", MessageAck{
+		ClientMsgID:    msg.ClientMsgID,
+		ID:             saved.ID,
+		ConversationID: saved.ConversationID,
+		Timestamp:      saved.Timestamp,
+		Duplicate:      duplicate,
+	})
 }
 
-// forwardMessageToUser sends a message to a specific user if they're connected
-func forwardMessageToUser(recipientID string, message []byte) {
-	// Parse the message to get the sender ID
-	var msg map[string]interface{}
-	if err := json.Unmarshal(message, &msg); err != nil {
-		log.Printf("Error parsing message in forwardMessageToUser: %v", err)
+// handleReceipt records that the connection's user got or read messages
+// Marking a message also marks every earlier message in its conversation.
+// @param c - The connection the receipt came from
+// @param status - utils.MessageStatusDelivered or utils.MessageStatusRead
+// @param data - The receipt data listing message IDs
+func handleReceipt(c *Client, status string, data json.RawMessage) {
+	var request receiptRequest
+	if err := json.Unmarshal(data, &request); err != nil || len(request.MessageIDs) > utils.MaxMessageReplay {
+		c.reply("error", map[string]string{"error": "Invalid receipt"})
 		return
 	}
+	receipts, err := utils.MarkMessages(GlobalDB, c.userID, status, request.MessageIDs)
+	if err != nil {
+		log.Printf("Error recording %s receipt from user %s: %v", status, c.userID, err)
+		return
+	}
+	publishReceipts(c.userID, receipts)
+}
 
-	var senderID string
-
-	// Extract sender ID based on message type
-	if msgType, ok := msg["type"].(string); ok {
-		switch msgType {
-		case "message":
-			if msgObj, ok := msg["message"].(map[string]interface{}); ok {
-				if sender, ok := msgObj["sender"].(string); ok {
-					senderID = sender
-				}
-			}
-		case "typing", "stop_typing":
-			if sender, ok := msg["sender"].(string); ok {
-				senderID = sender
-			}
+// publishReceipts tells senders their messages changed status
+// Receipts go to the conversation or group, for open chat windows, and to
+// the sender. Readers get the conversation's list entry with its new
+// unread count. Only the signed-in reader's own receipts are published.
+// @param readerID - The signed-in user the receipts were recorded for
+// @param receipts - The receipts to publish
+func publishReceipts(readerID string, receipts []utils.MessageReceipt) {
+	read := make(map[int64]string)
+	for _, receipt := range receipts {
+		if receipt.ReceiverID != readerID {
+			log.Printf("Dropped %s receipt for user %s recorded by %s", receipt.Status, receipt.ReceiverID, readerID)
+			continue
+		}
+		if receipt.Status == utils.MessageStatusRead {
+			read[receipt.ConversationID] = receipt.ReceiverID
+		}
+		message := ReceiptMessage{
+			Status:         receipt.Status,
+			ConversationID: receipt.ConversationID,
+			MessageIDs:     receipt.MessageIDs,
+			SenderID:       receipt.SenderID,
+			ReceiverID:     receipt.ReceiverID,
+			At:             receipt.At.Format(time.RFC3339),
+		}
+		topic := ConversationTopic(receipt.SenderID, receipt.ReceiverID)
+		if receipt.Kind == utils.ConversationKindGroup {
+			topic = GroupTopic(receipt.ConversationID)
 		}
+		hub.publishEnvelope(topic, "receipt", message, nil, false)
+		hub.publishEnvelope(UserTopic(receipt.SenderID), "receipt", message, nil, false)
 	}
+	for conversationID, readerID := range read {
+		PublishConversationSummaries(conversationID, readerID)
+	}
+}
 
-	if senderID == "" {
-		log.Printf("Could not determine sender ID from message")
+// handleResume replays messages the client missed while disconnected
+// @param c - The connection asking to resume
+// @param data - The resume data: the last message ID seen, and for
+// connections not opened for a conversation, the other participant or group
+func handleResume(c *Client, data json.RawMessage) {
+	var request resumeRequest
+	if err := json.Unmarshal(data, &request); err != nil || request.Since < 0 {
+		c.reply("error", map[string]string{"error": "Invalid resume request"})
 		return
 	}
+	if request.With == "" && request.ConversationID == 0 {
+		request.With, request.ConversationID = c.chatPeer(), c.chatGroup()
+	}
 
-	// Create the composite key for the recipient's connection
-	chatKey := recipientID + ":" + senderID
+	switch {
+	case request.ConversationID != 0:
+		if !utils.IsGroupMember(GlobalDB, request.ConversationID, c.userID) {
+			c.reply("error", map[string]string{"error": utils.ErrNotConversationMember.Error()})
+			return
+		}
+		resumeConversation(c, request.ConversationID, "", request.Since)
+	case request.With != "":
+		resumeDirect(c, request.With, request.Since)
+	default:
+		c.reply("error", map[string]string{"error": "Resume needs the other participant or conversation"})
+	}
+}
 
-	chatClientsMux.RLock()
-	conn, exists := chatClients[chatKey]
-	chatClientsMux.RUnlock()
+// resumeDirect replays a direct conversation to one of its participants
+func resumeDirect(c *Client, peerID string, since int64) {
+	conversationID, err := utils.DirectConversationID(GlobalDB, c.userID, peerID)
+	if err != nil {
+		log.Printf("Error finding conversation of %s and %s: %v", c.userID, peerID, err)
+		c.reply("error", map[string]string{"error": "Failed to load messages"})
+		return
+	}
+	resumeConversation(c, conversationID, peerID, since)
+}
 
-	if exists {
-		if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
-			log.Printf("Error forwarding message to user %s (key: %s): %v", recipientID, chatKey, err)
-		} else {
-			log.Printf("Successfully forwarded message to user %s (key: %s)", recipientID, chatKey)
+// resumeConversation sends a connection the messages after a message ID
+// The replay ends with a "resumed" message; when has_more is set the client
+// resumes again from last_id.
+// @param c - The connection to send to
+// @param conversationID - The conversation to replay
+// @param peerID - The other participant of a direct conversation, empty for groups
+// @param since - The last message ID the client has seen
+func resumeConversation(c *Client, conversationID int64, peerID string, since int64) {
+	messages, err := utils.MessagesSince(GlobalDB, conversationID, c.userID, since, utils.MaxMessageReplay)
+	if err != nil {
+		log.Printf("Error replaying messages for user %s: %v", c.userID, err)
+		c.reply("error", map[string]string{"error": "Failed to load messages"})
+		return
+	}
 
-			// Only trigger a refresh and notification for actual messages, not typing indicators
-			if msgType, ok := msg["type"].(string); ok && msgType == "message" {
-				// Trigger a refresh of the users list
-				go BroadcastNewMessage(senderID, recipientID)
-			}
-		}
-	} else {
-		log.Printf("Recipient %s not connected to chat with %s (key: %s not found)", recipientID, senderID, chatKey)
+	lastID := since
+	for _, m := range messages {
+		c.reply("message", chatSend{Message: chatMessageFromStored(m, nil), Replayed: true})
+		lastID = m.ID
+	}
+	resumed := map[string]interface{}{
+		"conversation_id": conversationID,
+		"since":           since,
+		"last_id":         lastID,
+		"has_more":        len(messages) == utils.MaxMessageReplay,
+	}
+	if peerID != "" {
+		resumed["with"] = peerID
+	}
+	c.reply("resumed", resumed)
+}
 
-		// Only broadcast notification for actual messages, not typing indicators
-		if msgType, ok := msg["type"].(string); ok && msgType == "message" {
-			// Broadcast notification even if recipient is not connected
-			go BroadcastNewMessage(senderID, recipientID)
-		}
+// chatPeer is the other participant of the direct conversation a chat connection was opened for
+func (c *Client) chatPeer() string {
+	users, ok := strings.CutPrefix(c.conversation, "conversation:")
+	if !ok {
+		return ""
+	}
+	userA, userB, _ := strings.Cut(users, ":")
+	if userA == c.userID {
+		return userB
+	}
+	return userA
+}
+
+// chatGroup is the group a chat connection was opened for, or 0
+func (c *Client) chatGroup() int64 {
+	id, ok := strings.CutPrefix(c.conversation, "group:")
+	if !ok {
+		return 0
 	}
+	conversationID, _ := strconv.ParseInt(id, 10, 64)
+	return conversationID
 }
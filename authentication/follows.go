@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"log"
+)
+
+// NotifyFollowers creates a new_post notification for every follower of the
+// author who has not muted them, and pushes it to followers who are online
+// @param authorID - The user who published the post
+// @param postID - The new post
+func NotifyFollowers(authorID string, postID int64) {
+	rows, err := GlobalDB.Query(`
+		SELECT follower_id FROM follows
+		WHERE followed_id = ? AND muted = FALSE AND follower_id != ?
+		AND follower_id NOT IN (
+			SELECT blocker_id FROM user_blocks WHERE blocked_id = ? AND kind = 'block'
+		)
+	`, authorID, authorID, authorID)
+	if err != nil {
+		log.Printf("Error finding followers of user %s: %v", authorID, err)
+		return
+	}
+
+	var followers []string
+	for rows.Next() {
+		var followerID string
+		if err := rows.Scan(&followerID); err == nil {
+			followers = append(followers, followerID)
+		}
+	}
+	rows.Close()
+
+	for _, followerID := range followers {
+		_, err := GlobalDB.Exec(`
+			INSERT INTO notifications (user_id, actor_id, post_id, type, created_at, is_read)
+			VALUES (?, ?, ?, 'new_post', CURRENT_TIMESTAMP, false)
+		`, followerID, authorID, postID)
+		if err != nil {
+			log.Printf("Error creating new_post notification for user %s: %v", followerID, err)
+			continue
+		}
+
+		BroadcastNotification(followerID, authorID, "new_post")
+	}
+}
@@ -0,0 +1,490 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"forum/utils"
+
+	"github.com/gorilla/websocket"
+)
+
+// EnvelopeVersion is the version of the envelope format sent to clients
+const EnvelopeVersion = 1
+
+// Connection tuning for the hub's read and write pumps
+const (
+	// writeWait is how long a single write may take before the connection is dropped
+	writeWait = 10 * time.Second
+	// pongWait is how long a connection may stay silent before it is considered dead
+	pongWait = 60 * time.Second
+	// pingPeriod is how often pings are sent; it must be shorter than pongWait
+	pingPeriod = pongWait * 9 / 10
+	// maxMessageSize is the largest message accepted from a client
+	maxMessageSize = 64 << 10
+	// sendQueueSize is how many messages may wait for a connection before it is evicted
+	sendQueueSize = 256
+)
+
+// Envelope wraps every message sent over a WebSocket connection
+// Type names the payload in Data; Topic is the subscription it was
+// delivered through, empty for messages sent to every connection.
+type Envelope struct {
+	V     int         `json:"v"`
+	Type  string      `json:"type"`
+	Topic string      `json:"topic,omitempty"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// inboundEnvelope is a message received from a client
+// Clients that predate envelopes send flat messages with only a type; for
+// those the whole message is the data.
+type inboundEnvelope struct {
+	V     int             `json:"v"`
+	Type  string          `json:"type"`
+	Topic string          `json:"topic"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// UserTopic is the topic of everything addressed to one user
+// @param userID - The user
+// @returns string - The topic name
+func UserTopic(userID string) string {
+	return "user:" + userID
+}
+
+// ConversationTopic is the topic of a direct conversation between two users
+// The order of the users does not matter.
+// @param userA - One participant
+// @param userB - The other participant
+// @returns string - The topic name
+func ConversationTopic(userA, userB string) string {
+	users := []string{userA, userB}
+	sort.Strings(users)
+	return "conversation:" + users[0] + ":" + users[1]
+}
+
+// GroupTopic is the topic of a group conversation
+// @param conversationID - The group
+// @returns string - The topic name
+func GroupTopic(conversationID int64) string {
+	return "group:" + strconv.FormatInt(conversationID, 10)
+}
+
+// PostTopic is the topic of live updates to one post, such as poll results
+// @param postID - The post
+// @returns string - The topic name
+func PostTopic(postID int64) string {
+	return "post:" + strconv.FormatInt(postID, 10)
+}
+
+// CategoryTopic is the topic of posts published in one category
+// @param categoryID - The category
+// @returns string - The topic name
+func CategoryTopic(categoryID int64) string {
+	return "category:" + strconv.FormatInt(categoryID, 10)
+}
+
+// Client is one WebSocket connection registered with the hub
+// Messages are queued on send and written by the connection's write pump,
+// so publishers never block on a slow network.
+type Client struct {
+	hub    *Hub
+	conn   *websocket.Conn
+	userID string
+	// presence marks connections that keep their user online
+	presence bool
+	// conversation is the conversation a chat connection was opened for
+	conversation string
+	// topics are subscribed when the client registers
+	topics []string
+	send   chan []byte
+	// closeCode and closeReason are set by the hub before it closes send
+	closeCode   int
+	closeReason string
+}
+
+// subscription asks the hub to add or remove a client from a topic
+// Without a client, every connection of userID is removed from the topic.
+type subscription struct {
+	client      *Client
+	userID      string
+	topic       string
+	unsubscribe bool
+}
+
+// publication asks the hub to deliver a message to a topic's subscribers
+// An empty topic delivers to every presence connection, so chat windows
+// are not sent site-wide events; a target delivers to that connection alone.
+type publication struct {
+	topic     string
+	target    *Client
+	message   []byte
+	except    *Client
+	delivered chan int
+}
+
+// Hub routes messages from publishers to the connections subscribed to their topic
+// All maps are owned by the hub goroutine started by run; everything else
+// talks to it over channels.
+type Hub struct {
+	register   chan *Client
+	unregister chan *Client
+	subscribe  chan subscription
+	publish    chan publication
+
+	clients map[*Client]map[string]bool
+	topics  map[string]map[*Client]bool
+	// presence is told about presence connections opening and closing; may be nil
+	presence *Presence
+}
+
+// hub is the process-wide hub every WebSocket connection registers with
+var hub *Hub
+
+func init() {
+	hub = startHub(newPresence(dbPresenceStore{}))
+}
+
+// newHub creates a hub; run must be started before it is used
+func newHub(presence *Presence) *Hub {
+	return &Hub{
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		subscribe:  make(chan subscription),
+		publish:    make(chan publication, 256),
+		clients:    make(map[*Client]map[string]bool),
+		topics:     make(map[string]map[*Client]bool),
+		presence:   presence,
+	}
+}
+
+// startHub creates a hub and starts its goroutine and its presence tracker's
+func startHub(presence *Presence) *Hub {
+	h := newHub(presence)
+	go h.run()
+	if presence != nil {
+		presence.hub = h
+		go presence.run()
+	}
+	return h
+}
+
+// run serves the hub's channels until the process exits
+func (h *Hub) run() {
+	for {
+		select {
+		case client := <-h.register:
+			h.clients[client] = make(map[string]bool)
+			for _, topic := range client.topics {
+				h.addToTopic(client, topic)
+			}
+			if client.presence && h.presence != nil {
+				h.presence.connect(client)
+			}
+		case client := <-h.unregister:
+			h.remove(client, websocket.CloseNormalClosure, "")
+		case sub := <-h.subscribe:
+			if sub.client == nil {
+				for client := range h.topics[sub.topic] {
+					if client.userID == sub.userID {
+						h.removeFromTopic(client, sub.topic)
+					}
+				}
+				continue
+			}
+			if _, ok := h.clients[sub.client]; !ok {
+				continue
+			}
+			if sub.unsubscribe {
+				h.removeFromTopic(sub.client, sub.topic)
+			} else {
+				h.addToTopic(sub.client, sub.topic)
+			}
+		case pub := <-h.publish:
+			delivered := 0
+			recipients := h.topics[pub.topic]
+			if pub.target != nil {
+				recipients = map[*Client]bool{pub.target: h.clients[pub.target] != nil}
+			} else if pub.topic == "" {
+				recipients = make(map[*Client]bool, len(h.clients))
+				for client := range h.clients {
+					recipients[client] = client.presence
+				}
+			}
+			for client := range recipients {
+				if !recipients[client] || client == pub.except {
+					continue
+				}
+				select {
+				case client.send <- pub.message:
+					delivered++
+				default:
+					// A full queue means the client cannot keep up; dropping it
+					// lets it reconnect and resync instead of silently missing messages
+					log.Printf("Evicting slow WebSocket client for user %s", client.userID)
+					h.remove(client, websocket.ClosePolicyViolation, "send queue full")
+				}
+			}
+			if pub.delivered != nil {
+				pub.delivered <- delivered
+			}
+		}
+	}
+}
+
+// addToTopic subscribes a registered client to a topic
+func (h *Hub) addToTopic(client *Client, topic string) {
+	if h.topics[topic] == nil {
+		h.topics[topic] = make(map[*Client]bool)
+	}
+	h.topics[topic][client] = true
+	h.clients[client][topic] = true
+}
+
+// removeFromTopic unsubscribes a client from a topic
+func (h *Hub) removeFromTopic(client *Client, topic string) {
+	delete(h.topics[topic], client)
+	if len(h.topics[topic]) == 0 {
+		delete(h.topics, topic)
+	}
+	delete(h.clients[client], topic)
+}
+
+// remove drops a client from the hub and closes its send queue
+// The write pump sends the close code and reason, then closes the connection.
+func (h *Hub) remove(client *Client, closeCode int, closeReason string) {
+	topics, ok := h.clients[client]
+	if !ok {
+		return
+	}
+	for topic := range topics {
+		h.removeFromTopic(client, topic)
+	}
+	delete(h.clients, client)
+
+	client.closeCode = closeCode
+	client.closeReason = closeReason
+	close(client.send)
+
+	if client.presence && h.presence != nil {
+		h.presence.disconnect(client)
+	}
+}
+
+// publishEnvelope encodes an envelope once and queues it for a topic's subscribers
+func (h *Hub) publishEnvelope(topic, msgType string, data interface{}, except *Client, wait bool) int {
+	message, err := json.Marshal(Envelope{V: EnvelopeVersion, Type: msgType, Topic: topic, Data: data})
+	if err != nil {
+		log.Printf("Error encoding %s message: %v", msgType, err)
+		return 0
+	}
+	pub := publication{topic: topic, message: message, except: except}
+	if wait {
+		pub.delivered = make(chan int, 1)
+	}
+	h.publish <- pub
+	if !wait {
+		return 0
+	}
+	return <-pub.delivered
+}
+
+// Publish sends a message to every connection subscribed to a topic
+// Nothing is queued for topics without subscribers.
+// @param topic - The topic, e.g. from UserTopic or PostTopic
+// @param msgType - The envelope type clients dispatch on
+// @param data - Any JSON-encodable payload
+// @returns int - The number of connections the message was queued for
+func Publish(topic, msgType string, data interface{}) int {
+	return hub.publishEnvelope(topic, msgType, data, nil, true)
+}
+
+// PublishAll sends a message to every user's main connections, e.g. for new users
+// @param msgType - The envelope type clients dispatch on
+// @param data - Any JSON-encodable payload
+func PublishAll(msgType string, data interface{}) {
+	hub.publishEnvelope("", msgType, data, nil, false)
+}
+
+// UnsubscribeUser removes every connection of a user from a topic
+// Used when a user loses access, e.g. on being removed from a group.
+// @param userID - The user
+// @param topic - The topic
+func UnsubscribeUser(userID, topic string) {
+	hub.subscribe <- subscription{userID: userID, topic: topic, unsubscribe: true}
+}
+
+// newClient creates a client for an upgraded connection
+func newClient(h *Hub, conn *websocket.Conn, userID string, presence bool, topics ...string) *Client {
+	return &Client{
+		hub:      h,
+		conn:     conn,
+		userID:   userID,
+		presence: presence,
+		topics:   topics,
+		send:     make(chan []byte, sendQueueSize),
+	}
+}
+
+// serve registers the client and runs its pumps until the connection closes
+// The write pump runs in its own goroutine; the read pump runs on the caller's.
+func (c *Client) serve() {
+	c.open()
+	c.readPump()
+}
+
+// open registers the client and starts its write pump
+// Messages queued for the client after open returns are delivered after
+// anything published to its topics before then.
+func (c *Client) open() {
+	c.hub.register <- c
+	go c.writePump()
+}
+
+// readPump reads messages from the connection and dispatches them
+// The read deadline is pushed back by every pong, so a peer that stops
+// answering pings is disconnected.
+func (c *Client) readPump() {
+	defer func() {
+		c.hub.unregister <- c
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		_, message, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure, websocket.CloseNoStatusReceived) {
+				log.Printf("Error reading message from user %s: %v", c.userID, err)
+			}
+			return
+		}
+		c.handleMessage(message)
+	}
+}
+
+// writePump writes queued messages and pings to the connection
+// It is the only goroutine that writes to the connection.
+func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case message, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				// The hub closed the queue
+				c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(c.closeCode, c.closeReason))
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// reply queues a message for this connection only
+// It goes through the hub so it is never sent after the queue is closed.
+func (c *Client) reply(msgType string, data interface{}) {
+	message, err := json.Marshal(Envelope{V: EnvelopeVersion, Type: msgType, Data: data})
+	if err != nil {
+		log.Printf("Error encoding %s reply: %v", msgType, err)
+		return
+	}
+	c.hub.publish <- publication{target: c, message: message}
+}
+
+// handleMessage decodes a message from the client and dispatches it by type
+func (c *Client) handleMessage(raw []byte) {
+	var msg inboundEnvelope
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		log.Printf("Error parsing WebSocket message from user %s: %v", c.userID, err)
+		return
+	}
+	if msg.V == 0 {
+		msg.Data = raw
+	}
+
+	switch msg.Type {
+	case "subscribe", "unsubscribe":
+		if msg.Type == "subscribe" && !canSubscribe(c.userID, msg.Topic) {
+			c.reply("error", map[string]string{"error": "Cannot subscribe to " + msg.Topic, "topic": msg.Topic})
+			return
+		}
+		c.hub.subscribe <- subscription{client: c, topic: msg.Topic, unsubscribe: msg.Type == "unsubscribe"}
+		if msg.Type == "subscribe" && c.hub.presence != nil &&
+			(msg.Topic == PresenceTopic || strings.HasPrefix(msg.Topic, PresenceTopic+":")) {
+			c.hub.presence.requestSnapshot(c, msg.Topic)
+		}
+	case "presence":
+		handlePresenceMessage(c, msg.Data)
+	case "typing", "stop_typing":
+		handleTypingMessage(c, msg.Type, msg.Data)
+	case "message":
+		handleChatSend(c, msg.Data)
+	case "delivered", "read":
+		handleReceipt(c, msg.Type, msg.Data)
+	case "resume":
+		handleResume(c, msg.Data)
+	case "edit", "delete", "react":
+		handleMessageChange(c, msg.Type, msg.Data)
+	default:
+		log.Printf("Unhandled WebSocket message type from user %s: %s", c.userID, msg.Type)
+	}
+}
+
+// canSubscribe reports whether a user may subscribe to a topic
+// Users only hear their own user topic and conversations and groups they take part in;
+// post and category topics are open for published posts and existing categories,
+// and presence topics for every user.
+func canSubscribe(userID, topic string) bool {
+	if topic == PresenceTopic {
+		return true
+	}
+	kind, id, ok := strings.Cut(topic, ":")
+	if !ok || id == "" {
+		return false
+	}
+
+	switch kind {
+	case "user":
+		return id == userID
+	case PresenceTopic:
+		return true
+	case "conversation":
+		userA, userB, ok := strings.Cut(id, ":")
+		return ok && topic == ConversationTopic(userA, userB) && (userA == userID || userB == userID)
+	case "group":
+		conversationID, err := strconv.ParseInt(id, 10, 64)
+		return err == nil && utils.IsGroupMember(GlobalDB, conversationID, userID)
+	case "post":
+		var exists bool
+		err := GlobalDB.QueryRow("SELECT EXISTS (SELECT 1 FROM posts WHERE id = ? AND status = 'published')", id).Scan(&exists)
+		return err == nil && exists
+	case "category":
+		var exists bool
+		err := GlobalDB.QueryRow("SELECT EXISTS (SELECT 1 FROM categories WHERE id = ?)", id).Scan(&exists)
+		return err == nil && exists
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testClient registers a client without a connection; tests read its queue directly
+func testClient(h *Hub, userID string, queue int, topics ...string) *Client {
+	c := newClient(h, nil, userID, true, topics...)
+	c.send = make(chan []byte, queue)
+	h.register <- c
+	return c
+}
+
+// receive reads one envelope from a client's queue
+func receive(t *testing.T, c *Client) Envelope {
+	t.Helper()
+	select {
+	case message, ok := <-c.send:
+		if !ok {
+			t.Fatalf("queue of %s closed", c.userID)
+		}
+		var envelope Envelope
+		if err := json.Unmarshal(message, &envelope); err != nil {
+			t.Fatal(err)
+		}
+		return envelope
+	case <-time.After(time.Second):
+		t.Fatalf("nothing queued for %s", c.userID)
+	}
+	return Envelope{}
+}
+
+func TestHubTopics(t *testing.T) {
+	h := startHub(nil)
+
+	alice := testClient(h, "alice", 8, UserTopic("alice"))
+	bob := testClient(h, "bob", 8, UserTopic("bob"), ConversationTopic("bob", "alice"))
+
+	if n := h.publishEnvelope(UserTopic("bob"), "feed_post", map[string]int{"id": 1}, nil, true); n != 1 {
+		t.Errorf("published to %d clients, want 1", n)
+	}
+	if envelope := receive(t, bob); envelope.V != EnvelopeVersion || envelope.Type != "feed_post" || envelope.Topic != "user:bob" {
+		t.Errorf("bob received %+v", envelope)
+	}
+
+	// Conversation topics do not depend on the order of the participants
+	h.subscribe <- subscription{client: alice, topic: ConversationTopic("alice", "bob")}
+	if n := h.publishEnvelope(ConversationTopic("alice", "bob"), "message", nil, alice, true); n != 1 {
+		t.Errorf("published to %d clients, want 1 (the sender is skipped)", n)
+	}
+	receive(t, bob)
+
+	h.publishEnvelope("", "new_user", nil, nil, true)
+	receive(t, alice)
+	receive(t, bob)
+
+	h.unregister <- alice
+	if n := h.publishEnvelope(UserTopic("alice"), "feed_post", nil, nil, true); n != 0 {
+		t.Errorf("published to %d clients after unregister", n)
+	}
+}
+
+func TestHubEvictsSlowClients(t *testing.T) {
+	h := startHub(nil)
+	slow := testClient(h, "slow", 1, UserTopic("slow"))
+	fast := testClient(h, "fast", 4, UserTopic("fast"))
+
+	h.publishEnvelope("", "new_user", nil, nil, true)
+	if n := h.publishEnvelope("", "new_user", nil, nil, true); n != 1 {
+		t.Errorf("published to %d clients, want 1", n)
+	}
+
+	<-slow.send
+	if _, ok := <-slow.send; ok {
+		t.Fatal("slow client's queue was not closed")
+	}
+	if slow.closeCode != websocket.ClosePolicyViolation {
+		t.Errorf("close code = %d", slow.closeCode)
+	}
+	receive(t, fast)
+	receive(t, fast)
+
+	// The read pump unregisters the evicted client again when its connection drops
+	h.unregister <- slow
+	if n := h.publishEnvelope(UserTopic("slow"), "feed_post", nil, nil, true); n != 0 {
+		t.Errorf("published to %d clients after eviction", n)
+	}
+}
+
+func TestCanSubscribe(t *testing.T) {
+	tests := []struct {
+		topic string
+		want  bool
+	}{
+		{"user:alice", true},
+		{"user:bob", false},
+		{ConversationTopic("bob", "alice"), true},
+		{"conversation:bob:alice", false},
+		{ConversationTopic("bob", "carol"), false},
+		{"user:", false},
+		{PresenceTopic, true},
+		{PresenceUserTopic("bob"), true},
+		{"everything", false},
+	}
+	for _, tt := range tests {
+		if got := canSubscribe("alice", tt.topic); got != tt.want {
+			t.Errorf("canSubscribe(alice, %q) = %v, want %v", tt.topic, got, tt.want)
+		}
+	}
+}
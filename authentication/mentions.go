@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"log"
+
+	"forum/utils"
+)
+
+// NotifyMentions creates a mention notification for each mentioned user and
+// pushes it to them in real time
+// @param actorID - The user who wrote the mention
+// @param postID - The post the mention belongs to, or 0 for chat messages
+// @param userIDs - The users to notify, as returned by utils.SaveMentions
+func NotifyMentions(actorID string, postID int64, userIDs []string) {
+	// Chat mentions have no post; store NULL rather than a dangling post ID
+	var post interface{}
+	if postID != 0 {
+		post = postID
+	}
+
+	for _, userID := range userIDs {
+		if userID == actorID || notificationBlocked(userID, actorID) {
+			continue
+		}
+
+		_, err := GlobalDB.Exec(`
+			INSERT INTO notifications (user_id, actor_id, post_id, type, created_at, is_read)
+			VALUES (?, ?, ?, 'mention', CURRENT_TIMESTAMP, false)
+		`, userID, actorID, post)
+		if err != nil {
+			log.Printf("Error creating mention notification for user %s: %v", userID, err)
+			continue
+		}
+
+		BroadcastNotification(userID, actorID, "mention")
+	}
+}
+
+// recordMessageMentions resolves and stores the mentions in a chat message
+// Only the other members of the conversation can read a private message, so
+// they are the only mentioned users who are recorded and notified.
+// @param messageID - ID of the saved message
+// @param senderID - The message author
+// @param readerIDs - The other members of the conversation
+// @param content - The raw message content
+// @returns []utils.MentionSpan - The resolved mention spans for the client
+func recordMessageMentions(messageID int64, senderID string, readerIDs []string, content string) []utils.MentionSpan {
+	spans, err := utils.ResolveMentions(GlobalDB, content)
+	if err != nil {
+		log.Printf("Error resolving mentions in message %d: %v", messageID, err)
+		return []utils.MentionSpan{}
+	}
+
+	readers := make(map[string]bool, len(readerIDs))
+	for _, readerID := range readerIDs {
+		readers[readerID] = true
+	}
+	var visible []utils.MentionSpan
+	for _, span := range spans {
+		if readers[span.UserID] {
+			visible = append(visible, span)
+		}
+	}
+
+	added, err := utils.SaveMentions(GlobalDB, utils.MentionSourceMessage, messageID, senderID, visible)
+	if err != nil {
+		log.Printf("Error saving mentions for message %d: %v", messageID, err)
+		return spans
+	}
+	NotifyMentions(senderID, 0, added)
+
+	return spans
+}
+
+// messageMentions resolves the mention spans in a stored chat message
+func messageMentions(content string) []utils.MentionSpan {
+	spans, err := utils.ResolveMentions(GlobalDB, content)
+	if err != nil {
+		log.Printf("Error resolving message mentions: %v", err)
+		return []utils.MentionSpan{}
+	}
+	return spans
+}
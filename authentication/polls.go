@@ -0,0 +1,22 @@
+package handlers
+
+import (
+	"log"
+)
+
+// NotifyPollClosed creates a poll_closed notification for the creator of a
+// poll once voting has ended, and pushes it if they are online
+// @param userID - The poll creator, who is also the notification's actor
+// @param postID - The post carrying the poll
+func NotifyPollClosed(userID string, postID int64) {
+	_, err := GlobalDB.Exec(`
+		INSERT INTO notifications (user_id, actor_id, post_id, type, created_at, is_read)
+		VALUES (?, ?, ?, 'poll_closed', CURRENT_TIMESTAMP, false)
+	`, userID, userID, postID)
+	if err != nil {
+		log.Printf("Error creating poll_closed notification for user %s: %v", userID, err)
+		return
+	}
+
+	BroadcastNotification(userID, userID, "poll_closed")
+}
@@ -0,0 +1,474 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"forum/utils"
+)
+
+// Presence statuses sent to clients
+// Users who chose utils.UserStatusInvisible are sent as offline.
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceDND     = "dnd"
+	PresenceOffline = "offline"
+)
+
+// PresenceTopic is the topic of every user's presence changes
+// Clients watching a single user subscribe to PresenceUserTopic instead.
+const PresenceTopic = "presence"
+
+// Presence tuning
+const (
+	// presenceFlushInterval is how often changed users are sent, batched into one message
+	presenceFlushInterval = time.Second
+	// presenceOfflineGrace is how long a user without connections stays
+	// online, so reloading a page or a brief network drop is not reported
+	presenceOfflineGrace = 10 * time.Second
+	// presenceIdleTimeout is how long a connection stays active without a
+	// heartbeat; users whose connections are all idle are shown away
+	presenceIdleTimeout = 5 * time.Minute
+)
+
+// PresenceUserTopic is the topic of one user's presence changes
+// @param userID - The user
+// @returns string - The topic name
+func PresenceUserTopic(userID string) string {
+	return PresenceTopic + ":" + userID
+}
+
+// PresenceDelta is one user's presence after a change
+type PresenceDelta struct {
+	UserID   string `json:"user_id"`
+	Status   string `json:"status"`              // One of the Presence statuses
+	Text     string `json:"text,omitempty"`      // Custom status text, never sent for offline users
+	Emoji    string `json:"emoji,omitempty"`     // Custom status emoji, never sent for offline users
+	LastSeen string `json:"last_seen,omitempty"` // When an offline user was last seen, RFC 3339
+}
+
+// presenceBatch is the data of "presence" and "presence_snapshot" messages
+type presenceBatch struct {
+	Users []PresenceDelta `json:"users"`
+}
+
+// presenceRequest is the data of a "presence" message sent by a client
+type presenceRequest struct {
+	Status string `json:"status"` // PresenceOnline as a heartbeat, or PresenceAway when idle
+}
+
+// presenceStore keeps presence outside the tracker, e.g. in the users table
+type presenceStore interface {
+	// load returns the status a user chose and when they were last seen
+	load(userID string) (*utils.UserStatus, time.Time)
+	// save records whether a user is shown online and, if not, since when
+	save(userID string, online bool, lastSeen time.Time)
+	// expire resets a user whose chosen status expired
+	expire(userID string)
+}
+
+// userPresence is what the tracker knows about one user
+type userPresence struct {
+	// connections are the user's presence connections with their last
+	// heartbeat, zero for those that reported idle
+	connections map[*Client]time.Time
+	// disconnectedAt is when the last connection closed, zero while connected
+	disconnectedAt time.Time
+	// chosen is the status the user chose, nil until loaded from the store
+	chosen *utils.UserStatus
+	// published is what clients were last sent
+	published PresenceDelta
+	// saved is whether the store last recorded the user online; nil before the first save
+	saved *bool
+	// lastSeen is when the user was last shown online
+	lastSeen time.Time
+}
+
+// snapshotRequest asks for the current presence to be sent to a new subscriber
+type snapshotRequest struct {
+	client *Client
+	topic  string
+}
+
+// Presence tracks which users are online and sends changes as deltas
+// The hub reports every presence connection opening and closing, and
+// clients send heartbeats while their user is active. Changes are not sent
+// as they happen: every presenceFlushInterval the users whose presence
+// changed are sent in one "presence" message to PresenceTopic, and one per
+// user to their PresenceUserTopic. Users are reported offline only
+// presenceOfflineGrace after their last connection closed, so flapping
+// connections produce no messages at all. Snapshots are sent by the same
+// goroutine as deltas, so a subscriber never sees a delta older than its
+// snapshot. Only users with connections are tracked, so each flush costs
+// as much as the users online rather than every user.
+type Presence struct {
+	hub *Hub
+	// store may be nil, e.g. in tests
+	store presenceStore
+
+	mu        sync.Mutex
+	users     map[string]*userPresence
+	snapshots []snapshotRequest
+	wake      chan struct{}
+}
+
+// newPresence creates a presence tracker; startHub attaches it to its hub and runs it
+func newPresence(store presenceStore) *Presence {
+	return &Presence{
+		store: store,
+		users: make(map[string]*userPresence),
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// run flushes changes until the process exits
+// Snapshot requests and status changes wake it early.
+func (p *Presence) run() {
+	ticker := time.NewTicker(presenceFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.wake:
+		}
+		p.flush(time.Now())
+	}
+}
+
+// poke wakes the flush goroutine without waiting for it
+func (p *Presence) poke() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// connect records a presence connection opening; called by the hub
+func (p *Presence) connect(c *Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	up := p.users[c.userID]
+	if up == nil {
+		up = &userPresence{connections: make(map[*Client]time.Time), published: PresenceDelta{UserID: c.userID, Status: PresenceOffline}}
+		p.users[c.userID] = up
+	}
+	up.connections[c] = time.Now()
+	up.disconnectedAt = time.Time{}
+}
+
+// disconnect records a presence connection closing; called by the hub
+func (p *Presence) disconnect(c *Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	up := p.users[c.userID]
+	if up == nil {
+		return
+	}
+	delete(up.connections, c)
+	if len(up.connections) == 0 {
+		up.disconnectedAt = time.Now()
+	}
+}
+
+// heartbeat records a connection's user being active, or idle
+// A user is shown away once every one of their connections is idle.
+func (p *Presence) heartbeat(c *Client, active bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	up := p.users[c.userID]
+	if up == nil {
+		return
+	}
+	if _, ok := up.connections[c]; !ok {
+		return
+	}
+	if active {
+		up.connections[c] = time.Now()
+	} else {
+		up.connections[c] = time.Time{}
+	}
+}
+
+// choose records a status a user chose; untracked users pick it up from the store on connecting
+func (p *Presence) choose(userID string, status *utils.UserStatus) {
+	p.mu.Lock()
+	if up := p.users[userID]; up != nil {
+		up.chosen = status
+	}
+	p.mu.Unlock()
+	p.poke()
+}
+
+// requestSnapshot queues the current presence for a client that subscribed to a presence topic
+func (p *Presence) requestSnapshot(c *Client, topic string) {
+	p.mu.Lock()
+	p.snapshots = append(p.snapshots, snapshotRequest{client: c, topic: topic})
+	p.mu.Unlock()
+	p.poke()
+}
+
+// current is the presence a user should be shown with now
+// ok is false while a disconnected user is within the offline grace period.
+func (up *userPresence) current(now time.Time) (delta PresenceDelta, ok bool) {
+	delta = PresenceDelta{UserID: up.published.UserID, Status: PresenceOffline}
+	if len(up.connections) == 0 {
+		if now.Sub(up.disconnectedAt) < presenceOfflineGrace {
+			return up.published, false
+		}
+		return delta, true
+	}
+
+	switch up.chosen.Status {
+	case utils.UserStatusInvisible:
+		return delta, true
+	case utils.UserStatusDND:
+		delta.Status = PresenceDND
+	case utils.UserStatusAway:
+		delta.Status = PresenceAway
+	default:
+		delta.Status = PresenceAway
+		for _, active := range up.connections {
+			if now.Sub(active) < presenceIdleTimeout {
+				delta.Status = PresenceOnline
+				break
+			}
+		}
+	}
+	delta.Text, delta.Emoji = up.chosen.Text, up.chosen.Emoji
+	return delta, true
+}
+
+// flush sends the changes since the last flush and any requested snapshots
+// Users who connected since the last flush have their chosen status loaded
+// first. Messages are built under the lock and published after it is
+// released, so neither the store nor the hub, which calls connect and
+// disconnect, is waited on while holding it.
+func (p *Presence) flush(now time.Time) {
+	p.mu.Lock()
+	var unloaded []string
+	for userID, up := range p.users {
+		if up.chosen == nil {
+			unloaded = append(unloaded, userID)
+		}
+	}
+	p.mu.Unlock()
+
+	type loaded struct {
+		chosen   *utils.UserStatus
+		lastSeen time.Time
+	}
+	statuses := make(map[string]loaded, len(unloaded))
+	for _, userID := range unloaded {
+		status := loaded{chosen: &utils.UserStatus{Status: utils.UserStatusOnline}}
+		if p.store != nil {
+			if chosen, lastSeen := p.store.load(userID); chosen != nil {
+				status = loaded{chosen: chosen, lastSeen: lastSeen}
+			}
+		}
+		statuses[userID] = status
+	}
+
+	type save struct {
+		userID   string
+		online   bool
+		lastSeen time.Time
+	}
+	var deltas []PresenceDelta
+	var saves []save
+	var expired []string
+	p.mu.Lock()
+	for userID, up := range p.users {
+		if up.chosen == nil {
+			status, ok := statuses[userID]
+			if !ok {
+				continue // Connected while loading; loaded on the next flush
+			}
+			up.chosen, up.lastSeen = status.chosen, status.lastSeen
+		}
+		if up.chosen.Expired(now) {
+			up.chosen = &utils.UserStatus{Status: utils.UserStatusOnline}
+			expired = append(expired, userID)
+		}
+
+		delta, ok := up.current(now)
+		if !ok {
+			continue // Checked again on the next flush
+		}
+		online := delta.Status != PresenceOffline
+		if online || up.published.Status != PresenceOffline {
+			// Invisible users keep the last_seen of when they were last shown online
+			up.lastSeen = now
+			if len(up.connections) == 0 {
+				up.lastSeen = up.disconnectedAt
+			}
+		}
+		if !online && !up.lastSeen.IsZero() {
+			delta.LastSeen = up.lastSeen.UTC().Format(time.RFC3339)
+		}
+		if delta.Status != up.published.Status || delta.Text != up.published.Text || delta.Emoji != up.published.Emoji {
+			up.published = delta
+			deltas = append(deltas, delta)
+		}
+		if up.saved == nil || *up.saved != online {
+			up.saved = &online
+			saves = append(saves, save{userID: userID, online: online, lastSeen: up.lastSeen})
+		}
+		if len(up.connections) == 0 {
+			delete(p.users, userID)
+		}
+	}
+
+	type snapshot struct {
+		client *Client
+		topic  string
+		users  []PresenceDelta
+	}
+	var snapshots []snapshot
+	var untracked []snapshotRequest
+	for _, request := range p.snapshots {
+		users := []PresenceDelta{}
+		if userID, ok := strings.CutPrefix(request.topic, PresenceTopic+":"); ok {
+			up := p.users[userID]
+			if up == nil || up.chosen == nil {
+				untracked = append(untracked, request)
+				continue
+			}
+			users = append(users, up.published)
+		} else {
+			// Offline users are left out, so the snapshot grows with the users online
+			for _, up := range p.users {
+				if up.published.Status != PresenceOffline {
+					users = append(users, up.published)
+				}
+			}
+		}
+		snapshots = append(snapshots, snapshot{client: request.client, topic: request.topic, users: users})
+	}
+	p.snapshots = nil
+	p.mu.Unlock()
+
+	if p.store != nil {
+		for _, s := range saves {
+			p.store.save(s.userID, s.online, s.lastSeen)
+		}
+		for _, userID := range expired {
+			p.store.expire(userID)
+		}
+	}
+	for _, request := range untracked {
+		delta := PresenceDelta{UserID: strings.TrimPrefix(request.topic, PresenceTopic+":"), Status: PresenceOffline}
+		if p.store != nil {
+			if _, lastSeen := p.store.load(delta.UserID); !lastSeen.IsZero() {
+				delta.LastSeen = lastSeen.UTC().Format(time.RFC3339)
+			}
+		}
+		snapshots = append(snapshots, snapshot{client: request.client, topic: request.topic, users: []PresenceDelta{delta}})
+	}
+
+	if p.hub == nil {
+		return
+	}
+	if len(deltas) > 0 {
+		p.hub.publishEnvelope(PresenceTopic, "presence", presenceBatch{Users: deltas}, nil, false)
+		for _, delta := range deltas {
+			p.hub.publishEnvelope(PresenceUserTopic(delta.UserID), "presence", presenceBatch{Users: []PresenceDelta{delta}}, nil, false)
+		}
+	}
+	for _, userID := range expired {
+		// The user's own clients show the status they chose, so tell them it reset
+		p.hub.publishEnvelope(UserTopic(userID), "presence_status", utils.UserStatus{Status: utils.UserStatusOnline}, nil, false)
+	}
+	for _, s := range snapshots {
+		// Sent to the subscriber alone, with the topic it asked about
+		message, err := json.Marshal(Envelope{V: EnvelopeVersion, Type: "presence_snapshot", Topic: s.topic, Data: presenceBatch{Users: s.users}})
+		if err != nil {
+			log.Printf("Error encoding presence snapshot: %v", err)
+			continue
+		}
+		p.hub.publish <- publication{target: s.client, message: message}
+	}
+}
+
+// handlePresenceMessage records a heartbeat from a connection
+// Clients send "online" every minute or so while their user is active and
+// "away" when they go idle; connections that stop sending heartbeats go
+// idle after presenceIdleTimeout.
+// @param c - The connection the heartbeat came from
+// @param data - The heartbeat, {"status": "online"} or {"status": "away"}
+func handlePresenceMessage(c *Client, data json.RawMessage) {
+	var request presenceRequest
+	if err := json.Unmarshal(data, &request); err != nil ||
+		(request.Status != PresenceOnline && request.Status != PresenceAway) {
+		c.reply("error", map[string]string{"error": "Invalid presence status"})
+		return
+	}
+	if c.hub.presence != nil && c.presence {
+		c.hub.presence.heartbeat(c, request.Status == PresenceOnline)
+	}
+}
+
+// SetPresenceStatus applies a status a user chose, already stored with utils.SetUserStatus
+// Other users see the change with the next presence flush, and the user's
+// own connections get it as a presence_status message.
+// @param userID - The user
+// @param status - The status they chose
+func SetPresenceStatus(userID string, status *utils.UserStatus) {
+	if hub.presence != nil {
+		hub.presence.choose(userID, status)
+	}
+	Publish(UserTopic(userID), "presence_status", status)
+}
+
+// dbPresenceStore keeps presence in the users table
+type dbPresenceStore struct{}
+
+// load reads a user's chosen status and last_seen
+func (dbPresenceStore) load(userID string) (*utils.UserStatus, time.Time) {
+	if GlobalDB == nil {
+		return nil, time.Time{}
+	}
+	status, err := utils.GetUserStatus(GlobalDB, userID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error loading status of user %s: %v", userID, err)
+		}
+		return nil, time.Time{}
+	}
+	var lastSeen time.Time
+	if err := GlobalDB.QueryRow("SELECT last_seen FROM users WHERE id = ?", userID).Scan(&lastSeen); err != nil {
+		log.Printf("Error loading last_seen of user %s: %v", userID, err)
+	}
+	return status, lastSeen
+}
+
+// save records is_online, and last_seen for users shown offline
+// Away and do-not-disturb users count as online; invisible users as offline.
+func (dbPresenceStore) save(userID string, online bool, lastSeen time.Time) {
+	if GlobalDB == nil {
+		return
+	}
+	var err error
+	if online {
+		_, err = GlobalDB.Exec("UPDATE users SET is_online = 1 WHERE id = ?", userID)
+	} else {
+		_, err = GlobalDB.Exec("UPDATE users SET is_online = 0, last_seen = ? WHERE id = ?", lastSeen.UTC(), userID)
+	}
+	if err != nil {
+		log.Printf("Error storing presence of user %s: %v", userID, err)
+	}
+}
+
+// expire clears a user's expired status
+func (dbPresenceStore) expire(userID string) {
+	if GlobalDB == nil {
+		return
+	}
+	if err := utils.ClearUserStatus(GlobalDB, userID); err != nil {
+		log.Printf("Error clearing status of user %s: %v", userID, err)
+	}
+}
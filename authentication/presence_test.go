@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"encoding/json"
+	"sort"
+	"testing"
+	"time"
+
+	"forum/utils"
+)
+
+// memoryPresenceStore is a presenceStore for tests
+type memoryPresenceStore struct {
+	statuses map[string]*utils.UserStatus
+	saved    []string
+	expired  []string
+}
+
+func (s *memoryPresenceStore) load(userID string) (*utils.UserStatus, time.Time) {
+	status := s.statuses[userID]
+	if status == nil {
+		status = &utils.UserStatus{Status: utils.UserStatusOnline}
+	}
+	return status, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+func (s *memoryPresenceStore) save(userID string, online bool, lastSeen time.Time) {
+	if online {
+		s.saved = append(s.saved, userID+" online")
+	} else {
+		s.saved = append(s.saved, userID+" offline")
+	}
+}
+
+func (s *memoryPresenceStore) expire(userID string) {
+	s.expired = append(s.expired, userID)
+}
+
+// presenceUsers decodes the users of a presence envelope as "id status text" strings
+func presenceUsers(t *testing.T, envelope Envelope) []string {
+	t.Helper()
+	data, _ := json.Marshal(envelope.Data)
+	var batch presenceBatch
+	if err := json.Unmarshal(data, &batch); err != nil {
+		t.Fatal(err)
+	}
+	users := make([]string, len(batch.Users))
+	for i, user := range batch.Users {
+		users[i] = user.UserID + " " + user.Status
+		if user.Text != "" {
+			users[i] += " " + user.Text
+		}
+		if user.Status == PresenceOffline && user.LastSeen == "" {
+			t.Errorf("%s is offline without last_seen", user.UserID)
+		}
+	}
+	sort.Strings(users)
+	return users
+}
+
+// expectPresence checks the users of the next envelope queued for a client
+func expectPresence(t *testing.T, c *Client, msgType string, want ...string) {
+	t.Helper()
+	envelope := receive(t, c)
+	got := presenceUsers(t, envelope)
+	if envelope.Type != msgType || len(got) != len(want) {
+		t.Errorf("%s got %s %v, want %s %v", c.userID, envelope.Type, got, msgType, want)
+		return
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("%s got %v, want %v", c.userID, got, want)
+			return
+		}
+	}
+}
+
+func TestPresence(t *testing.T) {
+	store := &memoryPresenceStore{statuses: map[string]*utils.UserStatus{}}
+	p := newPresence(store)
+	h := newHub(p)
+	p.hub = h
+	go h.run()
+	// settle waits until the hub handled everything queued before it
+	settle := func() { h.publishEnvelope("settle", "settle", nil, nil, true) }
+	// quiet checks nothing was queued for a client
+	quiet := func(c *Client, when string) {
+		t.Helper()
+		settle()
+		if len(c.send) != 0 {
+			t.Errorf("%s: %v", when, presenceUsers(t, receive(t, c)))
+		}
+	}
+
+	carol := testClient(h, "carol", 16, PresenceTopic)
+	alice := testClient(h, "alice", 16, UserTopic("alice"))
+	settle()
+	p.flush(time.Now())
+	expectPresence(t, carol, "presence", "alice online", "carol online")
+
+	// Reconnecting within the grace period is not reported
+	h.unregister <- alice
+	alice = testClient(h, "alice", 16, UserTopic("alice"))
+	settle()
+	p.flush(time.Now())
+	quiet(carol, "reconnect was reported")
+
+	// Idle connections, whether reported or without heartbeats, are away
+	p.heartbeat(alice, false)
+	p.flush(time.Now())
+	expectPresence(t, carol, "presence", "alice away")
+	p.heartbeat(alice, true)
+	p.flush(time.Now().Add(presenceIdleTimeout))
+	expectPresence(t, carol, "presence", "carol away")
+	p.flush(time.Now())
+	expectPresence(t, carol, "presence", "alice online", "carol online")
+
+	p.choose("alice", &utils.UserStatus{Status: utils.UserStatusDND, Text: "focusing"})
+	p.flush(time.Now())
+	expectPresence(t, carol, "presence", "alice dnd focusing")
+
+	p.choose("alice", &utils.UserStatus{Status: utils.UserStatusInvisible, Text: "hidden"})
+	p.flush(time.Now())
+	expectPresence(t, carol, "presence", "alice offline")
+
+	p.requestSnapshot(carol, PresenceTopic)
+	p.flush(time.Now())
+	expectPresence(t, carol, "presence_snapshot", "carol online")
+
+	// Invisible users going offline for real are not reported again
+	h.unregister <- alice
+	settle()
+	p.flush(time.Now().Add(presenceOfflineGrace))
+	quiet(carol, "invisible user's disconnect was reported")
+
+	// Expired statuses reset to online
+	alice = testClient(h, "alice", 16, UserTopic("alice"))
+	expiry := time.Now().Add(time.Minute)
+	store.statuses["alice"] = &utils.UserStatus{Status: utils.UserStatusAway, Text: "lunch", ExpiresAt: &expiry}
+	settle()
+	p.flush(time.Now())
+	expectPresence(t, carol, "presence", "alice away lunch")
+	p.heartbeat(alice, true)
+	p.flush(time.Now().Add(time.Minute))
+	expectPresence(t, carol, "presence", "alice online")
+	if envelope := receive(t, alice); envelope.Type != "presence_status" {
+		t.Errorf("alice got %s, want presence_status", envelope.Type)
+	}
+	if len(store.expired) != 1 || store.expired[0] != "alice" {
+		t.Errorf("expired %v, want alice", store.expired)
+	}
+
+	h.unregister <- alice
+	settle()
+	p.flush(time.Now())
+	quiet(carol, "disconnect was reported before the grace period")
+	p.flush(time.Now().Add(presenceOfflineGrace))
+	expectPresence(t, carol, "presence", "alice offline")
+
+	// Untracked users are offline in their own snapshot
+	p.requestSnapshot(carol, PresenceUserTopic("dave"))
+	p.flush(time.Now())
+	expectPresence(t, carol, "presence_snapshot", "dave offline")
+
+	want := []string{"alice online", "carol online", "alice offline", "alice online", "alice offline"}
+	sort.Strings(store.saved[:2])
+	if len(store.saved) != len(want) {
+		t.Fatalf("saved %v, want %v", store.saved, want)
+	}
+	for i := range want {
+		if store.saved[i] != want[i] {
+			t.Errorf("saved %v, want %v", store.saved, want)
+			break
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"net/http"
+
+	"forum/utils"
+)
+
+// sessionUser returns the signed-in user of a request from its session cookie
+// @param r - The request
+// @returns string - The user ID
+// @returns error - http.ErrNoCookie or the session validation error
+func sessionUser(r *http.Request) (string, error) {
+	cookie, err := r.Cookie("session_token")
+	if err != nil {
+		return "", err
+	}
+	return utils.ValidateSession(GlobalDB, cookie.Value)
+}
+
+// requestUser identifies the signed-in user a request is made by
+// Handlers that still take the user as a parameter pass it as claimed; a
+// request claiming to be made by anyone else is refused.
+// @param w - The response, written to when the request is refused
+// @param r - The request
+// @param claimed - The user named by the request, or "" if it names none
+// @returns string - The session user
+// @returns bool - False if an error response was written
+func requestUser(w http.ResponseWriter, r *http.Request, claimed string) (string, bool) {
+	userID, err := sessionUser(r)
+	if err != nil {
+		http.Error(w, utils.ErrUnauthorized, http.StatusUnauthorized)
+		return "", false
+	}
+	if claimed != "" && claimed != userID {
+		http.Error(w, utils.ErrForbidden, http.StatusForbidden)
+		return "", false
+	}
+	return userID, true
+}
@@ -0,0 +1,369 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"forum/utils"
+
+	"github.com/gorilla/websocket"
+)
+
+// setupSessionDB creates the sessions and conversation tables in memory with
+// a session for alice and bob, and a group only alice belongs to
+func setupSessionDB(t *testing.T) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open test db: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec(`
+		CREATE TABLE sessions (id TEXT PRIMARY KEY, user_id TEXT, expires_at DATETIME);
+		CREATE TABLE conversations (id INTEGER PRIMARY KEY AUTOINCREMENT, kind TEXT NOT NULL DEFAULT 'group');
+		CREATE TABLE conversation_members (conversation_id INTEGER, user_id TEXT, role TEXT NOT NULL DEFAULT 'member', PRIMARY KEY (conversation_id, user_id));
+		INSERT INTO conversations (id, kind) VALUES (1, 'group');
+		INSERT INTO conversation_members (conversation_id, user_id) VALUES (1, 'alice');
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create test tables: %v", err)
+	}
+	expires := time.Now().Add(time.Hour)
+	for _, user := range []string{"alice", "bob"} {
+		if _, err := db.Exec("INSERT INTO sessions (id, user_id, expires_at) VALUES (?, ?, ?)", user+"-session", user, expires); err != nil {
+			t.Fatalf("Failed to create session: %v", err)
+		}
+	}
+
+	previous := GlobalDB
+	GlobalDB = db
+	t.Cleanup(func() { GlobalDB = previous })
+}
+
+func TestHandleWebSocketSession(t *testing.T) {
+	setupSessionDB(t)
+	server := httptest.NewServer(http.HandlerFunc(HandleWebSocket))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	tests := []struct {
+		name   string
+		query  string
+		cookie string
+		want   int
+	}{
+		{"No session", "?user_id=alice", "", http.StatusUnauthorized},
+		{"Invalid session", "?user_id=alice", "expired", http.StatusUnauthorized},
+		{"Someone else's user_id", "?user_id=alice", "bob-session", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.cookie != "" {
+				header.Set("Cookie", "session_token="+tt.cookie)
+			}
+			conn, resp, err := websocket.DefaultDialer.Dial(url+tt.query, header)
+			if conn != nil {
+				conn.Close()
+			}
+			if resp == nil {
+				t.Fatalf("Dial() error = %v", err)
+			}
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleChatWebSocketSession(t *testing.T) {
+	setupSessionDB(t)
+	server := httptest.NewServer(http.HandlerFunc(HandleChatWebSocket))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	tests := []struct {
+		name   string
+		query  string
+		cookie string
+		want   int
+	}{
+		{"No session", "?user1=alice&user2=bob&since=0", "", http.StatusUnauthorized},
+		{"Invalid session", "?user1=alice&user2=bob&since=0", "expired", http.StatusUnauthorized},
+		{"Someone else's user1", "?user1=alice&user2=bob&since=0", "bob-session", http.StatusForbidden},
+		{"Group the session user is not in", "?conversation=1&since=0", "bob-session", http.StatusForbidden},
+		{"Direct conversation", "?user2=bob", "alice-session", http.StatusSwitchingProtocols},
+		{"Group member", "?user1=alice&conversation=1", "alice-session", http.StatusSwitchingProtocols},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.cookie != "" {
+				header.Set("Cookie", "session_token="+tt.cookie)
+			}
+			conn, resp, err := websocket.DefaultDialer.Dial(url+tt.query, header)
+			if conn != nil {
+				conn.Close()
+			}
+			if resp == nil {
+				t.Fatalf("Dial() error = %v", err)
+			}
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestChatHandlersSession(t *testing.T) {
+	setupSessionDB(t)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		target  string
+		body    string
+		cookie  string
+		want    int
+	}{
+		{"History without session", GetChatHistoryHandler, "GET", "/api/chat/history?user1=alice&user2=bob", "", "", http.StatusUnauthorized},
+		{"History of someone else", GetChatHistoryHandler, "GET", "/api/chat/history?user1=alice&user2=bob", "", "bob-session", http.StatusForbidden},
+		{"History of a group the session user is not in", GetChatHistoryHandler, "GET", "/api/chat/history?user1=bob&conversation=1", "", "bob-session", http.StatusForbidden},
+		{"Mark read without session", MarkMessagesAsReadHandler, "POST", "/api/chat/mark-read", `{"receiver_id":"alice","conversation_id":1}`, "", http.StatusUnauthorized},
+		{"Send without session", SendMessageHandler, "POST", "/api/chat/send", `{"receiver_id":"bob","content":"hi"}`, "", http.StatusUnauthorized},
+		{"Send as someone else", SendMessageHandler, "POST", "/api/chat/send", `{"sender_id":"alice","receiver_id":"bob","content":"hi"}`, "bob-session", http.StatusForbidden},
+		{"Mark read as someone else", MarkMessagesAsReadHandler, "POST", "/api/chat/mark-read", `{"receiver_id":"alice","conversation_id":1}`, "bob-session", http.StatusForbidden},
+		{"Send to a group the session user is not in", SendMessageHandler, "POST", "/api/chat/send", `{"conversation_id":1,"content":"hi"}`, "bob-session", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "session_token", Value: tt.cookie})
+			}
+			rr := httptest.NewRecorder()
+			tt.handler(rr, req)
+			if rr.Code != tt.want {
+				t.Errorf("status = %d, want %d", rr.Code, tt.want)
+			}
+		})
+	}
+}
+
+// Users created by setupChatDB
+const (
+	chatAlice = "00000000-0000-4000-8000-000000000001"
+	chatBob   = "00000000-0000-4000-8000-000000000002"
+)
+
+// setupChatDB creates the full forum schema in a temporary directory with
+// chatAlice and chatBob signed in
+// @returns map[string]string - Session tokens by user ID
+func setupChatDB(t *testing.T) (*sql.DB, map[string]string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The database file is opened relative to the working directory by
+	// every new connection, so the test stays in the temporary directory
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	db, err := utils.InitialiseDB()
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	// GlobalDB is not restored: notifications are sent in the background and
+	// may still read it after the test ends
+	GlobalDB = db
+
+	tokens := make(map[string]string)
+	for _, id := range []string{chatAlice, chatBob} {
+		if _, err := db.Exec("INSERT INTO users (id, nickname, email) VALUES (?, ?, ?)", id, id, id+"@example.com"); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+		if tokens[id], err = utils.CreateSession(db, id); err != nil {
+			t.Fatalf("Failed to create session: %v", err)
+		}
+	}
+	return db, tokens
+}
+
+func TestMarkMessagesAsReadSession(t *testing.T) {
+	db, tokens := setupChatDB(t)
+	alice, bob := chatAlice, chatBob
+	conversationID, err := utils.DirectConversationID(db, alice, bob)
+	if err != nil {
+		t.Fatalf("DirectConversationID() error = %v", err)
+	}
+	_, err = db.Exec(
+		"INSERT INTO messages (id, conversation_id, sender_id, receiver_id, content, sent_at) VALUES (1, ?, ?, ?, 'hello', ?)",
+		conversationID, alice, bob, time.Now(),
+	)
+	if err != nil {
+		t.Fatalf("Failed to insert message: %v", err)
+	}
+
+	// lastRead is bob's read pointer in the conversation
+	lastRead := func() int64 {
+		t.Helper()
+		var id int64
+		err := db.QueryRow(
+			"SELECT last_read_message_id FROM conversation_members WHERE conversation_id = ? AND user_id = ?", conversationID, bob,
+		).Scan(&id)
+		if err != nil {
+			t.Fatalf("Failed to read pointer: %v", err)
+		}
+		return id
+	}
+
+	body := `{"receiver_id":"` + bob + `","sender_id":"` + alice + `"}`
+	tests := []struct {
+		name     string
+		token    string
+		want     int
+		wantRead int64
+	}{
+		{"No session", "", http.StatusUnauthorized, 0},
+		{"Another user's session", tokens[alice], http.StatusForbidden, 0},
+		{"Reader's session", tokens[bob], http.StatusOK, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/api/chat/mark-read", strings.NewReader(body))
+			if tt.token != "" {
+				req.AddCookie(&http.Cookie{Name: "session_token", Value: tt.token})
+			}
+			rr := httptest.NewRecorder()
+			MarkMessagesAsReadHandler(rr, req)
+			if rr.Code != tt.want {
+				t.Errorf("status = %d, want %d", rr.Code, tt.want)
+			}
+			if got := lastRead(); got != tt.wantRead {
+				t.Errorf("last_read_message_id = %d, want %d", got, tt.wantRead)
+			}
+		})
+	}
+}
+
+func TestHandleChatSendRecipient(t *testing.T) {
+	db, tokens := setupChatDB(t)
+	server := httptest.NewServer(http.HandlerFunc(HandleWebSocket))
+	defer server.Close()
+	header := http.Header{}
+	header.Set("Cookie", "session_token="+tokens[chatAlice])
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), header)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+
+	tests := []struct {
+		name      string
+		recipient string
+		want      string
+	}{
+		{"Self", chatAlice, "error"},
+		{"Unknown user", "00000000-0000-4000-8000-000000000099", "error"},
+		{"Malformed ID", "bob", "error"},
+		{"Existing user", chatBob, "ack"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := conn.WriteJSON(map[string]interface{}{
+				"v":    1,
+				"type": "message",
+				"data": map[string]interface{}{"message": map[string]string{"recipient": tt.recipient, "content": "hi"}},
+			})
+			if err != nil {
+				t.Fatalf("WriteJSON() error = %v", err)
+			}
+			// Skip anything else pushed to the connection, such as presence
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			for {
+				var reply Envelope
+				if err := conn.ReadJSON(&reply); err != nil {
+					t.Fatalf("ReadJSON() error = %v", err)
+				}
+				if reply.Type == "error" || reply.Type == "ack" {
+					if reply.Type != tt.want {
+						t.Errorf("reply = %s %v, want %s", reply.Type, reply.Data, tt.want)
+					}
+					return
+				}
+			}
+		})
+	}
+
+	var conversations int
+	db.QueryRow("SELECT COUNT(*) FROM conversations").Scan(&conversations)
+	if conversations != 1 {
+		t.Errorf("%d conversations created, want 1", conversations)
+	}
+}
+
+func TestLoginInvisibleUserListedOffline(t *testing.T) {
+	db, _ := setupChatDB(t)
+	alice, bob := chatAlice, chatBob
+	hash, err := utils.HashPassword("Password1!")
+	if err != nil {
+		t.Fatalf("HashPassword() error = %v", err)
+	}
+	if _, err := db.Exec("UPDATE users SET password = ?, presence_status = 'invisible' WHERE id = ?", hash, bob); err != nil {
+		t.Fatalf("Failed to update bob: %v", err)
+	}
+	conversationID, err := utils.DirectConversationID(db, alice, bob)
+	if err != nil {
+		t.Fatalf("DirectConversationID() error = %v", err)
+	}
+	if _, _, err := utils.SaveMessage(db, conversationID, alice, bob, "hello", ""); err != nil {
+		t.Fatalf("SaveMessage() error = %v", err)
+	}
+
+	body := `{"email":"` + bob + `@example.com","password":"Password1!"}`
+	rr := httptest.NewRecorder()
+	LoginHandler(rr, httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("LoginHandler() status = %d, want %d: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	// peerStatus is bob's presence as listed in alice's conversations
+	peerStatus := func() (string, bool) {
+		t.Helper()
+		conversations, err := utils.ListConversations(db, alice, 0, 0)
+		if err != nil {
+			t.Fatalf("ListConversations() error = %v", err)
+		}
+		if len(conversations) != 1 || conversations[0].Peer == nil {
+			t.Fatalf("ListConversations() = %+v, want one direct conversation", conversations)
+		}
+		return conversations[0].Peer.Status, conversations[0].Peer.IsOnline
+	}
+	if status, online := peerStatus(); status != utils.UserStatusOffline || online {
+		t.Errorf("invisible peer after login = %q (online %v), want %q", status, online, utils.UserStatusOffline)
+	}
+
+	// Even once the tracker marks him connected, bob stays hidden
+	dbPresenceStore{}.save(bob, true, time.Now())
+	if status, online := peerStatus(); status != utils.UserStatusOffline || online {
+		t.Errorf("connected invisible peer = %q (online %v), want %q", status, online, utils.UserStatusOffline)
+	}
+
+	if _, err := db.Exec("UPDATE users SET presence_status = 'dnd' WHERE id = ?", bob); err != nil {
+		t.Fatalf("Failed to update bob: %v", err)
+	}
+	if status, online := peerStatus(); status != "dnd" || !online {
+		t.Errorf("connected dnd peer = %q (online %v), want %q", status, online, "dnd")
+	}
+}
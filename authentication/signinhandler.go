@@ -78,14 +78,6 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	go broadcastUserStatus(userId, true)
-
-	// Mark user as online
-	_, err = GlobalDB.Exec("UPDATE users SET is_online = TRUE WHERE id = ?", userId)
-	if err != nil {
-		log.Printf("Error updating user online status: %v", err)
-	}
-
 	// Create session
 	sessionToken, err := utils.CreateSession(GlobalDB, userId)
 	if err != nil {
@@ -125,9 +117,9 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 func GetUsersWithStatus(w http.ResponseWriter, r *http.Request) {
     // Query users with their online status
     rows, err := GlobalDB.Query(`
-        SELECT id, nickname, first_name || ' ' || last_name as user_name, profile_pic, is_online
+        SELECT id, nickname, first_name || ' ' || last_name as user_name, profile_pic, ` + utils.VisibleStatusSQL("users") + ` AS status
         FROM users
-        ORDER BY is_online DESC, nickname ASC
+        ORDER BY status = 'offline', nickname ASC
     `)
     if err != nil {
         http.Error(w, "Failed to fetch users", http.StatusInternalServerError)
@@ -141,6 +133,7 @@ func GetUsersWithStatus(w http.ResponseWriter, r *http.Request) {
         Nickname  string         `json:"nickname"`
         ProfilePic sql.NullString `json:"profile_pic"`
         IsOnline  bool           `json:"is_online"`
+        Status    string         `json:"status"`
     }
 
     for rows.Next() {
@@ -150,11 +143,13 @@ func GetUsersWithStatus(w http.ResponseWriter, r *http.Request) {
             Nickname  string         `json:"nickname"`
             ProfilePic sql.NullString `json:"profile_pic"`
             IsOnline  bool           `json:"is_online"`
+            Status    string         `json:"status"`
         }
-        if err := rows.Scan(&user.ID, &user.Nickname, &user.Username, &user.ProfilePic, &user.IsOnline); err != nil {
+        if err := rows.Scan(&user.ID, &user.Nickname, &user.Username, &user.ProfilePic, &user.Status); err != nil {
             http.Error(w, "Failed to parse user data", http.StatusInternalServerError)
             return
         }
+        user.IsOnline = user.Status != utils.UserStatusOffline
         users = append(users, user)
     }
 
@@ -17,6 +17,7 @@ type UserResponse struct {
 	Email      string `json:"email,omitempty"`
 	ProfilePic string `json:"profile_pic,omitempty"`
 	IsOnline   bool   `json:"is_online"`
+	Status     string `json:"status"` // Status shown to others: online, away, dnd or offline
 }
 
 // UserResponseWithLastMessage extends UserResponse with last message timestamp
@@ -30,12 +31,19 @@ type UserResponseWithLastMessage struct {
 // - GET /api/users/ - Get all users
 // - GET /api/users/{id} - Get a specific user
 // - GET /api/users/with-last-message - Get all users with their last message timestamps
+// - GET /api/users/autocomplete?q={prefix} - Get users whose nickname starts with a prefix
 func GetUserHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	// Extract path to determine if we're getting all users or a specific user
 	pathParts := strings.Split(r.URL.Path, "/")
 
+	// Check for nickname autocomplete used when typing @mentions
+	if len(pathParts) > 3 && pathParts[3] == "autocomplete" {
+		autocompleteUsers(w, r)
+		return
+	}
+
 	// Check for with-last-message parameter
 	if len(pathParts) > 3 && pathParts[3] == "with-last-message" {
 		getUsersWithLastMessage(w, r)
@@ -53,6 +61,64 @@ func GetUserHandler(w http.ResponseWriter, r *http.Request) {
 	getSingleUser(w, r, userID)
 }
 
+// autocompleteUsers returns up to ten users whose nickname starts with the q parameter
+// The prefix is matched case-insensitively, with exact matches listed first
+func autocompleteUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	prefix := strings.TrimPrefix(strings.TrimSpace(r.URL.Query().Get("q")), "@")
+	if len(prefix) > 30 {
+		http.Error(w, "Query too long", http.StatusBadRequest)
+		return
+	}
+
+	users := []UserResponse{}
+	if prefix == "" {
+		json.NewEncoder(w).Encode(users)
+		return
+	}
+
+	// Escape LIKE wildcards; nicknames may legitimately contain underscores
+	escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.ToLower(prefix))
+
+	rows, err := GlobalDB.Query(`
+        SELECT id, nickname, profile_pic, `+utils.VisibleStatusSQL("users")+`
+        FROM users
+        WHERE LOWER(nickname) LIKE ? ESCAPE '\'
+        ORDER BY CASE WHEN LOWER(nickname) = ? THEN 0 ELSE 1 END, LENGTH(nickname), nickname ASC
+        LIMIT 10
+    `, escaped+"%", strings.ToLower(prefix))
+	if err != nil {
+		log.Printf("Error querying nickname autocomplete: %v", err)
+		http.Error(w, "Failed to fetch users", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user UserResponse
+		var profilePic sql.NullString
+
+		if err := rows.Scan(&user.ID, &user.Nickname, &profilePic, &user.Status); err != nil {
+			log.Printf("Error scanning user row: %v", err)
+			continue
+		}
+
+		if profilePic.Valid {
+			user.ProfilePic = profilePic.String
+		}
+		user.UserName = user.Nickname
+		user.IsOnline = user.Status != utils.UserStatusOffline
+
+		users = append(users, user)
+	}
+
+	json.NewEncoder(w).Encode(users)
+}
+
 // getUsersWithLastMessage fetches all users with their last message timestamp
 // Used for sorting users in chat interface by most recent conversation
 func getUsersWithLastMessage(w http.ResponseWriter, r *http.Request) {
@@ -66,22 +132,22 @@ func getUsersWithLastMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Query all users with their last message timestamp
+	// Query all users with the time of the last message in their direct
+	// conversation with the current user, found once per conversation
 	rows, err := GlobalDB.Query(`
-        SELECT u.id, u.nickname, u.email, u.profile_pic, u.is_online,
-               (SELECT MAX(timestamp)
-                FROM messages
-                WHERE (sender_id = u.id AND receiver_id = ?)
-                   OR (sender_id = ? AND receiver_id = u.id)) as last_message_time
+        SELECT u.id, u.nickname, u.email, u.profile_pic, `+utils.VisibleStatusSQL("u")+`, last.sent_at AS last_message_time
         FROM users u
-        ORDER BY
-            CASE WHEN (SELECT MAX(timestamp)
-                      FROM messages
-                      WHERE (sender_id = u.id AND receiver_id = ?)
-                         OR (sender_id = ? AND receiver_id = u.id)) IS NULL THEN 1 ELSE 0 END,
-            last_message_time DESC,
-            nickname ASC
-    `, currentUserID, currentUserID, currentUserID, currentUserID)
+        LEFT JOIN (
+            SELECT peer.user_id, MAX(m.sent_at) AS sent_at
+            FROM conversation_members me
+            JOIN conversations c ON c.id = me.conversation_id AND c.kind = 'direct'
+            JOIN conversation_members peer ON peer.conversation_id = me.conversation_id AND peer.user_id != me.user_id
+            JOIN messages m ON m.conversation_id = me.conversation_id
+            WHERE me.user_id = ?
+            GROUP BY peer.user_id
+        ) last ON last.user_id = u.id
+        ORDER BY last.sent_at IS NULL, last.sent_at DESC, u.nickname ASC
+    `, currentUserID)
 
 	if err != nil {
 		log.Printf("Error querying users with messages: %v", err)
@@ -97,7 +163,7 @@ func getUsersWithLastMessage(w http.ResponseWriter, r *http.Request) {
 		var lastMessageTime sql.NullString
 
 		// Scan the row into our user struct
-		err := rows.Scan(&user.ID, &user.Nickname, &user.Email, &profilePic, &user.IsOnline, &lastMessageTime)
+		err := rows.Scan(&user.ID, &user.Nickname, &user.Email, &profilePic, &user.Status, &lastMessageTime)
 		if err != nil {
 			log.Printf("Error scanning user row: %v", err)
 			continue
@@ -117,6 +183,7 @@ func getUsersWithLastMessage(w http.ResponseWriter, r *http.Request) {
 		if user.UserName == "" {
 			user.UserName = user.Nickname
 		}
+		user.IsOnline = user.Status != utils.UserStatusOffline
 
 		users = append(users, user)
 	}
@@ -137,7 +204,7 @@ func getAllUsers(w http.ResponseWriter, r *http.Request) {
 
 	// Query all users
 	rows, err := GlobalDB.Query(`
-        SELECT id, nickname, email, profile_pic, is_online
+        SELECT id, nickname, email, profile_pic, ` + utils.VisibleStatusSQL("users") + `
         FROM users
         ORDER BY nickname ASC
     `)
@@ -154,7 +221,7 @@ func getAllUsers(w http.ResponseWriter, r *http.Request) {
 		var profilePic sql.NullString
 
 		// Scan the row into our user struct
-		err := rows.Scan(&user.ID, &user.Nickname, &user.Email, &profilePic, &user.IsOnline)
+		err := rows.Scan(&user.ID, &user.Nickname, &user.Email, &profilePic, &user.Status)
 		if err != nil {
 			log.Printf("Error scanning user row: %v", err)
 			continue
@@ -169,6 +236,7 @@ func getAllUsers(w http.ResponseWriter, r *http.Request) {
 		if user.UserName == "" {
 			user.UserName = user.Nickname
 		}
+		user.IsOnline = user.Status != utils.UserStatusOffline
 
 		users = append(users, user)
 	}
@@ -206,10 +274,10 @@ func getSingleUser(w http.ResponseWriter, r *http.Request, userID string) {
 
 	// Query the user
 	err := GlobalDB.QueryRow(`
-        SELECT id, nickname, email, profile_pic, is_online
+        SELECT id, nickname, email, profile_pic, `+utils.VisibleStatusSQL("users")+`
         FROM users
         WHERE id = ?
-    `, userID).Scan(&user.ID, &user.Nickname, &user.Email, &profilePic, &user.IsOnline)
+    `, userID).Scan(&user.ID, &user.Nickname, &user.Email, &profilePic, &user.Status)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -231,6 +299,7 @@ func getSingleUser(w http.ResponseWriter, r *http.Request, userID string) {
 	if user.UserName == "" {
 		user.UserName = user.Nickname
 	}
+	user.IsOnline = user.Status != utils.UserStatusOffline
 
 	log.Printf("Successfully found user: %+v", user)
 	json.NewEncoder(w).Encode(user)
@@ -5,52 +5,23 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
-	"sync"
-	"time"
 
-	"github.com/gorilla/websocket"
-)
-
-// ClientConnection represents a WebSocket connection with a mutex for thread safety
-type ClientConnection struct {
-	Conn  *websocket.Conn
-	Mutex sync.Mutex // Protects writes to this connection
-}
+	"forum/utils"
 
-// WriteJSON safely writes a JSON message to the WebSocket connection
-// It uses a mutex to ensure only one goroutine can write at a time
-func (c *ClientConnection) WriteJSON(v interface{}) error {
-	c.Mutex.Lock()
-	defer c.Mutex.Unlock()
-	return c.Conn.WriteJSON(v)
-}
-
-// WebSocket configuration and client management
-var (
-	// upgrader handles WebSocket protocol upgrade
-	upgrader = websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
-	}
-	// clients maps user IDs to their WebSocket connections
-	clients = make(map[string]*ClientConnection)
-	// clientsMux protects concurrent access to the clients map
-	clientsMux sync.RWMutex
+	"github.com/gorilla/websocket"
 )
 
-// StatusMessage represents a user's online status update
-type StatusMessage struct {
-	Type     string `json:"type"`
-	UserID   string `json:"user_id"`
-	IsOnline bool   `json:"is_online"`
+// upgrader handles WebSocket protocol upgrade
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
 }
 
 // NewUserMessage represents a notification about a new user registration
 type NewUserMessage struct {
-	Type string `json:"type"`
 	User struct {
 		ID       string `json:"id"`
 		Nickname string `json:"nickname"`
@@ -58,40 +29,25 @@ type NewUserMessage struct {
 	} `json:"user"`
 }
 
-// NewMessageNotification represents a notification about a new chat message
-type NewMessageNotification struct {
-	Type       string `json:"type"`
-	SenderID   string `json:"sender_id"`
-	ReceiverID string `json:"receiver_id"`
-}
-
 // NotificationMessage represents a notification event
 type NotificationMessage struct {
-	Type         string      `json:"type"`
 	Notification interface{} `json:"notification"`
 	UnreadCount  int         `json:"unread_count"`
 	ReceiverID   string      `json:"receiver_id"`
 }
 
-// UsersListMessage represents a list of all users and their statuses
-type UsersListMessage struct {
-	Type  string      `json:"type"`
-	Users interface{} `json:"users"`
-}
-
-// HandleWebSocket upgrades HTTP connection to WebSocket and manages user connections
+// HandleWebSocket upgrades HTTP connection to WebSocket and registers it with the hub
+// The connection is subscribed to the user's own topic and keeps the user
+// online until their last such connection closes. The user comes from the
+// session cookie and is checked before the upgrade; user_id, if given, must
+// be that user.
 func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Received WebSocket connection request from: %s", r.RemoteAddr)
-
-	userID := r.URL.Query().Get("user_id")
-	if userID == "" {
-		log.Printf("Missing user_id parameter from: %s", r.RemoteAddr)
-		http.Error(w, "user_id parameter required", http.StatusBadRequest)
+	userID, ok := requestUser(w, r, r.URL.Query().Get("user_id"))
+	if !ok {
+		log.Printf("Rejected WebSocket connection from: %s", r.RemoteAddr)
 		return
 	}
 
-	log.Printf("Attempting WebSocket upgrade for user: %s", userID)
-
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("WebSocket upgrade error for user %s: %v", userID, err)
@@ -99,172 +55,79 @@ func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 
 	log.Printf("WebSocket connection established for user: %s", userID)
-
-	defer conn.Close()
-
-	// Create a new client connection with mutex
-	clientConn := &ClientConnection{
-		Conn: conn,
-	}
-
-	// Register client
-	clientsMux.Lock()
-	clients[userID] = clientConn
-	clientsMux.Unlock()
-
-	// Broadcast user online status
-	broadcastUserStatus(userID, true)
-
-	defer func() {
-		clientsMux.Lock()
-		delete(clients, userID)
-		clientsMux.Unlock()
-		conn.Close()
-		// Broadcast user offline status
-		broadcastUserStatus(userID, false)
-	}()
-
-	// Keep connection alive and handle messages
-	for {
-		_, message, err := conn.ReadMessage()
-		if err != nil {
-			log.Printf("Error reading message from user %s: %v", userID, err)
-			break
-		}
-
-		// Process the message
-		go handleWebSocketMessage(userID, message)
-	}
-}
-
-// broadcastUserStatus updates a user's online status and notifies all clients
-func broadcastUserStatus(userID string, isOnline bool) {
-	// Update database first
-	_, err := GlobalDB.Exec("UPDATE users SET is_online = ? WHERE id = ?", isOnline, userID)
-	if err != nil {
-		log.Printf("Error updating user online status in database: %v", err)
-	}
-
-	status := StatusMessage{
-		Type:     "user_status",
-		UserID:   userID,
-		IsOnline: isOnline,
-	}
-
-	// Use a separate goroutine for broadcasting to avoid blocking
-	go func() {
-		clientsMux.RLock()
-		clientsCopy := make(map[string]*ClientConnection)
-		for id, conn := range clients {
-			clientsCopy[id] = conn
-		}
-		clientsMux.RUnlock()
-
-		// Now we can safely iterate through our copy without holding the lock
-		for _, conn := range clientsCopy {
-			err := conn.WriteJSON(status)
-			if err != nil {
-				log.Printf("Error broadcasting status: %v", err)
-				continue
-			}
-		}
-		log.Printf("Broadcasted status update for user %s: online=%v", userID, isOnline)
-
-		// After sending the status update, also broadcast the updated users list
-		// Use a small delay to avoid concurrent writes
-		time.Sleep(100 * time.Millisecond)
-		BroadcastUsersList()
-	}()
+	newClient(hub, conn, userID, true, UserTopic(userID)).serve()
+	log.Printf("WebSocket connection closed for user: %s", userID)
 }
 
 // BroadcastNewUser notifies all connected clients about a new user registration
 func BroadcastNewUser(userID string, nickname string) {
 	log.Printf("Broadcasting new user notification for user %s (%s)", userID, nickname)
 
-	newUserMsg := NewUserMessage{
-		Type: "new_user",
-	}
+	var newUserMsg NewUserMessage
 	newUserMsg.User.ID = userID
 	newUserMsg.User.Nickname = nickname
 	newUserMsg.User.IsOnline = true
 
-	// Use a separate goroutine for broadcasting to avoid blocking
-	go func() {
-		clientsMux.RLock()
-		clientsCopy := make(map[string]*ClientConnection)
-		for id, conn := range clients {
-			clientsCopy[id] = conn
-		}
-		clientsMux.RUnlock()
-
-		// Now we can safely iterate through our copy without holding the lock
-		for _, conn := range clientsCopy {
-			err := conn.WriteJSON(newUserMsg)
-			if err != nil {
-				log.Printf("Error broadcasting new user notification: %v", err)
-				continue
-			}
-		}
-		log.Printf("Broadcasted new user notification for user %s", userID)
-
-		// After sending the notification, also broadcast the updated users list
-		// Use a small delay to avoid concurrent writes
-		time.Sleep(100 * time.Millisecond)
-		BroadcastUsersList()
-	}()
+	PublishAll("new_user", newUserMsg)
 }
 
-// BroadcastNewMessage notifies clients that a new message has been sent
-func BroadcastNewMessage(senderID string, receiverID string) {
-	log.Printf("Broadcasting new message notification from %s to %s", senderID, receiverID)
-
-	notification := NewMessageNotification{
-		Type:       "refresh_users",
-		SenderID:   senderID,
-		ReceiverID: receiverID,
-	}
+// BroadcastNewMessage tells both participants of a conversation that a new message was sent
+// Both get the conversation's new entry for their list and the receiver
+// gets a notification.
+// @param conversationID - The direct conversation
+// @param senderID - The user who sent the message
+// @param receiverID - The other participant
+func BroadcastNewMessage(conversationID int64, senderID string, receiverID string) {
+	PublishConversationSummaries(conversationID, senderID, receiverID)
+	BroadcastNotification(receiverID, senderID, "message")
+}
 
-	// Use a separate goroutine for broadcasting to avoid blocking
-	go func() {
-		clientsMux.RLock()
-		clientsCopy := make(map[string]*ClientConnection)
-		for id, conn := range clients {
-			clientsCopy[id] = conn
+// PublishConversationSummaries pushes a conversation's entry in members' conversation lists
+// Each member gets their own summary, with their own unread count and last
+// visible message, on their user topic as a conversation_summary, so
+// clients update one entry instead of loading the whole list again.
+// @param conversationID - The conversation that changed
+// @param userIDs - The members whose entries changed
+func PublishConversationSummaries(conversationID int64, userIDs ...string) {
+	for _, userID := range userIDs {
+		summary, err := utils.GetConversationSummary(GlobalDB, userID, conversationID)
+		if err != nil {
+			log.Printf("Error loading conversation %d for user %s: %v", conversationID, userID, err)
+			continue
 		}
-		clientsMux.RUnlock()
+		Publish(UserTopic(userID), "conversation_summary", summary)
+	}
+}
 
-		// Now we can safely iterate through our copy without holding the lock
-		for _, conn := range clientsCopy {
-			err := conn.WriteJSON(notification)
-			if err != nil {
-				log.Printf("Error broadcasting message notification: %v", err)
-				continue
-			}
-		}
-		log.Printf("Broadcasted message notification from %s to %s", senderID, receiverID)
-
-		// After sending the notification, also broadcast the updated users list
-		// Use a small delay to avoid concurrent writes
-		time.Sleep(100 * time.Millisecond)
-		BroadcastUsersList()
-
-		// Also broadcast a real-time notification to the receiver
-		// Use another small delay to avoid concurrent writes
-		time.Sleep(100 * time.Millisecond)
-		// Call directly since BroadcastNotification already uses a goroutine internally
-		BroadcastNotification(receiverID, senderID, "message")
-	}()
+// BroadcastGroupMessage tells a group's members about a new message
+// Like BroadcastNewMessage, each member gets the group's new list entry
+// and the other members get a message notification.
+// @param conversationID - The group
+// @param senderID - The member who sent the message
+// @param memberIDs - The other members
+func BroadcastGroupMessage(conversationID int64, senderID string, memberIDs []string) {
+	PublishConversationSummaries(conversationID, append([]string{senderID}, memberIDs...)...)
+	for _, memberID := range memberIDs {
+		BroadcastNotification(memberID, senderID, "message")
+	}
 }
 
 // BroadcastNotification sends a real-time notification to a specific user
 // receiverID: the user who should receive the notification
 // actorID: the user who triggered the notification (sender, commenter, etc.)
 // notificationType: the type of notification (message, like, comment, etc.)
+// Users in do-not-disturb are not sent it; it is still stored for them.
 func BroadcastNotification(receiverID string, actorID string, notificationType string) {
 	// Use a separate goroutine to avoid blocking and potential deadlocks
 	go func() {
 		log.Printf("Broadcasting %s notification from %s to %s", notificationType, actorID, receiverID)
 
+		// Users never hear from someone they have blocked
+		if notificationBlocked(receiverID, actorID) {
+			log.Printf("Dropping %s notification from %s to %s: blocked", notificationType, actorID, receiverID)
+			return
+		}
+
 		var notificationID int
 		var unreadCount int
 		var actorName string
@@ -293,6 +156,12 @@ func BroadcastNotification(receiverID string, actorID string, notificationType s
 			}
 		}
 
+		// Do-not-disturb users find the notification stored, but are not interrupted
+		if utils.IsDoNotDisturb(GlobalDB, receiverID) {
+			log.Printf("Not pushing %s notification to user %s: do not disturb", notificationType, receiverID)
+			return
+		}
+
 		// Get the actor's details (sender's name and profile pic)
 		err := GlobalDB.QueryRow(`
 			SELECT nickname, profile_pic FROM users WHERE id = ?
@@ -346,25 +215,13 @@ func BroadcastNotification(receiverID string, actorID string, notificationType s
 			"actorProfilePic": profilePicStr,
 		}
 
-		// Create the notification message
+		// Send only to the specific receiver
 		message := NotificationMessage{
-			Type:         "new_notification",
 			Notification: notificationData,
 			UnreadCount:  unreadCount,
 			ReceiverID:   receiverID,
 		}
-
-		// Send only to the specific receiver
-		clientsMux.RLock()
-		conn, exists := clients[receiverID]
-		clientsMux.RUnlock()
-
-		if exists {
-			err := conn.WriteJSON(message)
-			if err != nil {
-				log.Printf("Error sending notification to user %s: %v", receiverID, err)
-				return
-			}
+		if Publish(UserTopic(receiverID), "new_notification", message) > 0 {
 			log.Printf("Successfully sent %s notification to user %s", notificationType, receiverID)
 		} else {
 			log.Printf("User %s is not connected, notification will be delivered when they connect", receiverID)
@@ -372,172 +229,46 @@ func BroadcastNotification(receiverID string, actorID string, notificationType s
 	}()
 }
 
-// TriggerUsersListBroadcast is a handler that can be called from HTTP endpoints
-// to manually trigger a broadcast of the users list
-func TriggerUsersListBroadcast(w http.ResponseWriter, r *http.Request) {
-	// Only allow POST requests
-	if r.Method != "POST" {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		w.Write([]byte("Method not allowed"))
-		return
-	}
-
-	// Trigger the broadcast
-	go BroadcastUsersList()
-
-	// Return success
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Users list broadcast triggered"))
-}
-
 // TypingMessage represents a typing status update
+// Direct conversations name the recipient; groups give the conversation ID.
 type TypingMessage struct {
-	Type      string `json:"type"`
-	Sender    string `json:"sender"`
-	Recipient string `json:"recipient"`
+	Sender         string `json:"sender"`
+	Recipient      string `json:"recipient,omitempty"`
+	ConversationID int64  `json:"conversation_id,omitempty"`
 }
 
-// handleWebSocketMessage processes messages received from the main WebSocket connection
-func handleWebSocketMessage(senderID string, message []byte) {
-	// Parse the message
-	var msg map[string]interface{}
-	if err := json.Unmarshal(message, &msg); err != nil {
-		log.Printf("Error parsing WebSocket message: %v", err)
-		return
-	}
-
-	// Get message type
-	msgType, ok := msg["type"].(string)
-	if !ok {
-		log.Printf("Invalid message type in WebSocket message")
-		return
-	}
-
-	// Handle different message types
-	switch msgType {
-	case "typing", "stop_typing":
-		// Handle typing status messages
-		handleTypingMessage(senderID, msg)
-	default:
-		log.Printf("Unhandled message type in main WebSocket: %s", msgType)
-	}
-}
-
-// handleTypingMessage processes typing status messages and forwards them to the recipient
-func handleTypingMessage(senderID string, msg map[string]interface{}) {
-	// Extract recipient ID
-	recipientID, ok := msg["recipient"].(string)
-	if !ok {
-		log.Printf("Missing recipient in typing message")
+// handleTypingMessage forwards a typing status to the other participants
+// Group statuses go to the group's other members. Chat connections publish
+// to their conversation, where the recipient's chat window listens; other
+// connections publish to the recipient's user topic. Typing indicators are
+// silently dropped between blocked users.
+// @param c - The connection the status came from
+// @param msgType - "typing" or "stop_typing"
+// @param data - The message data, naming the recipient or group
+func handleTypingMessage(c *Client, msgType string, data json.RawMessage) {
+	var typing TypingMessage
+	if err := json.Unmarshal(data, &typing); err != nil || (typing.Recipient == "" && typing.ConversationID == 0) {
+		log.Printf("Missing recipient in typing message from user %s", c.userID)
 		return
 	}
+	typing.Sender = c.userID
 
-	// Create typing message
-	typingMsg := TypingMessage{
-		Type:      msg["type"].(string),
-		Sender:    senderID,
-		Recipient: recipientID,
-	}
-
-	// Forward to recipient if online
-	clientsMux.RLock()
-	recipientConn, exists := clients[recipientID]
-	clientsMux.RUnlock()
-
-	if exists {
-		if err := recipientConn.WriteJSON(typingMsg); err != nil {
-			log.Printf("Error forwarding typing status to user %s: %v", recipientID, err)
-		} else {
-			log.Printf("Successfully forwarded typing status from %s to %s", senderID, recipientID)
+	if typing.ConversationID != 0 {
+		if !utils.IsGroupMember(GlobalDB, typing.ConversationID, c.userID) {
+			return
 		}
-	} else {
-		log.Printf("Recipient %s not connected, typing status not delivered", recipientID)
-	}
-}
-
-// BroadcastUsersList sends the current list of users to all connected clients
-func BroadcastUsersList() {
-	log.Printf("Broadcasting users list to all clients")
-
-	// Get all users from the database
-	rows, err := GlobalDB.Query(`
-		SELECT id, nickname, email, first_name, last_name, age, gender, profile_pic, created_at, is_online, last_seen
-		FROM users
-		ORDER BY nickname ASC
-	`)
-	if err != nil {
-		log.Printf("Error querying users for broadcast: %v", err)
+		typing.Recipient = ""
+		c.hub.publishEnvelope(GroupTopic(typing.ConversationID), msgType, typing, c, false)
 		return
 	}
-	defer rows.Close()
-
-	var users []map[string]interface{}
-	for rows.Next() {
-		var (
-			id         string
-			nickname   string
-			email      string
-			firstName  sql.NullString
-			lastName   sql.NullString
-			age        sql.NullInt64
-			gender     sql.NullString
-			profilePic sql.NullString
-			createdAt  time.Time
-			isOnline   bool
-			lastSeen   sql.NullTime
-		)
-
-		err := rows.Scan(
-			&id, &nickname, &email, &firstName, &lastName,
-			&age, &gender, &profilePic, &createdAt, &isOnline, &lastSeen,
-		)
-		if err != nil {
-			log.Printf("Error scanning user row: %v", err)
-			continue
-		}
-
-		user := map[string]interface{}{
-			"ID":       id,
-			"UserName": nickname,
-			"Email":    email,
-			"isOnline": isOnline,
-		}
-
-		if profilePic.Valid {
-			user["ProfilePic"] = profilePic.String
-		} else {
-			user["ProfilePic"] = ""
-		}
-
-		users = append(users, user)
-	}
-
-	if users == nil {
-		users = []map[string]interface{}{}
-	}
 
-	// Create the users list message
-	message := UsersListMessage{
-		Type:  "users_list",
-		Users: users,
+	if contactBlocked(typing.Sender, typing.Recipient) {
+		return
 	}
 
-	// Broadcast to all clients
-	clientsMux.RLock()
-	clientsCopy := make(map[string]*ClientConnection)
-	for id, conn := range clients {
-		clientsCopy[id] = conn
+	topic := UserTopic(typing.Recipient)
+	if c.conversation == ConversationTopic(typing.Sender, typing.Recipient) {
+		topic = c.conversation
 	}
-	clientsMux.RUnlock()
-
-	// Now we can safely iterate through our copy without holding the lock
-	for _, conn := range clientsCopy {
-		err := conn.WriteJSON(message)
-		if err != nil {
-			log.Printf("Error broadcasting users list: %v", err)
-			continue
-		}
-	}
-
-	log.Printf("Broadcasted users list with %d users", len(users))
+	c.hub.publishEnvelope(topic, msgType, typing, c, false)
 }
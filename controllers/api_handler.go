@@ -4,11 +4,12 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	handlers "forum/authentication"
@@ -124,10 +125,160 @@ func (ah *APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+	case "/api/users/follow", "/api/users/unfollow":
+		if !ah.checkAuth(w, r) {
+			return
+		}
+		ah.handleFollowChange(w, r)
+	case "/api/users/follow/mute":
+		if !ah.checkAuth(w, r) {
+			return
+		}
+		ah.handleFollowMute(w, r)
+	case "/api/users/followers", "/api/users/following":
+		if !ah.checkAuth(w, r) {
+			return
+		}
+		ah.handleFollowList(w, r)
+
+	case "/api/users/block", "/api/users/unblock", "/api/users/mute", "/api/users/unmute":
+		if !ah.checkAuth(w, r) {
+			return
+		}
+		ah.handleBlockChange(w, r)
+	case "/api/users/blocked":
+		if !ah.checkAuth(w, r) {
+			return
+		}
+		ah.handleBlockList(w, r)
+
+	case "/api/posts/drafts":
+		if !ah.checkAuth(w, r) {
+			return
+		}
+		ah.handleDrafts(w, r)
+	case "/api/posts/draft":
+		if !ah.checkAuth(w, r) {
+			return
+		}
+		ah.handleSaveDraft(w, r)
+
+	case "/api/bookmarks":
+		if !ah.checkAuth(w, r) {
+			return
+		}
+		ah.handleBookmarks(w, r)
+	case "/api/bookmarks/add", "/api/bookmarks/remove":
+		if !ah.checkAuth(w, r) {
+			return
+		}
+		ah.handleBookmarkChange(w, r)
+	case "/api/collections":
+		if !ah.checkAuth(w, r) {
+			return
+		}
+		ah.handleCollections(w, r)
+	case "/api/collections/create", "/api/collections/update", "/api/collections/delete":
+		if !ah.checkAuth(w, r) {
+			return
+		}
+		ah.handleCollectionChange(w, r)
+	case "/api/collections/shared":
+		ah.handleSharedCollection(w, r)
+
+	case "/api/attachments/view", "/api/attachments/download":
+		ah.handleAttachmentFile(w, r)
+	case "/api/attachments/upload":
+		if !ah.checkAuth(w, r) {
+			return
+		}
+		ah.handleAttachmentUpload(w, r)
+	case "/api/attachments/delete", "/api/attachments/reorder":
+		if !ah.checkAuth(w, r) {
+			return
+		}
+		ah.handleAttachmentChange(w, r)
+	case "/api/chat/attachments/upload":
+		if !ah.checkAuth(w, r) {
+			return
+		}
+		ah.handleChatAttachmentUpload(w, r)
+	case "/api/chat/attachments/view", "/api/chat/attachments/download":
+		if !ah.checkAuth(w, r) {
+			return
+		}
+		ah.handleChatAttachmentFile(w, r)
+	case "/api/chat/search":
+		if !ah.checkAuth(w, r) {
+			return
+		}
+		ah.handleChatSearch(w, r)
+	case "/api/chat/edit", "/api/chat/delete", "/api/chat/react":
+		if !ah.checkAuth(w, r) {
+			return
+		}
+		handlers.MessageChangeHandler(w, r)
+
+	case "/api/polls":
+		ah.handlePoll(w, r)
+	case "/api/polls/vote", "/api/polls/retract":
+		if !ah.checkAuth(w, r) {
+			return
+		}
+		ah.handlePollVote(w, r)
+
 	case "/api/users/stats":
 		ah.handleUserStats(w, r)
 		return
 
+	case "/api/categories":
+		ah.handleListCategories(w, r)
+	case "/api/admin/categories/create", "/api/admin/categories/rename",
+		"/api/admin/categories/describe", "/api/admin/categories/reorder",
+		"/api/admin/categories/merge", "/api/admin/categories/archive":
+		if !ah.checkAuth(w, r) || !ah.checkAdmin(w, r) {
+			return
+		}
+		ah.handleAdminCategories(w, r)
+
+	case "/api/feed":
+		if !ah.checkAuth(w, r) {
+			return
+		}
+		ah.handleFeed(w, r)
+	case "/api/subscriptions":
+		if !ah.checkAuth(w, r) {
+			return
+		}
+		ah.handleSubscriptions(w, r)
+	case "/api/subscriptions/add", "/api/subscriptions/remove":
+		if !ah.checkAuth(w, r) {
+			return
+		}
+		ah.handleSubscriptionChange(w, r)
+
+	case "/api/presence/status":
+		if !ah.checkAuth(w, r) {
+			return
+		}
+		ah.handlePresenceStatus(w, r)
+	case "/api/conversations":
+		if !ah.checkAuth(w, r) {
+			return
+		}
+		ah.handleListConversations(w, r)
+	case "/api/conversations/group":
+		if !ah.checkAuth(w, r) {
+			return
+		}
+		ah.handleGroupConversation(w, r)
+	case "/api/conversations/create", "/api/conversations/invite", "/api/conversations/leave",
+		"/api/conversations/kick", "/api/conversations/role", "/api/conversations/rename":
+		if !ah.checkAuth(w, r) {
+			return
+		}
+		ah.handleConversationChange(w, r)
+
 	default:
 		w.WriteHeader(http.StatusNotFound)
 	}
@@ -183,6 +334,7 @@ func (ah *APIHandler) handlePosts(w http.ResponseWriter, r *http.Request) {
                (SELECT COUNT(*) FROM comments WHERE post_id = p.id) as comments
         FROM posts p
         JOIN users u ON p.user_id = u.id
+        WHERE p.status = 'published'
         ORDER BY p.post_at DESC
     `
 
@@ -232,13 +384,14 @@ func (ah *APIHandler) handlePosts(w http.ResponseWriter, r *http.Request) {
 
 		posts = append(posts, post)
 	}
+	renderPostsContent(posts)
 
 	// If no posts were found, return an empty array rather than nil
 	if posts == nil {
 		posts = []utils.Post{}
 	}
 
-	json.NewEncoder(w).Encode(posts)
+	json.NewEncoder(w).Encode(viewerPosts(r, posts))
 }
 
 // handleSinglePost returns detailed information about a specific post
@@ -266,7 +419,8 @@ func (ah *APIHandler) handleSinglePost(w http.ResponseWriter, r *http.Request) {
                u.nickname, u.profile_pic,
                (SELECT COUNT(*) FROM reaction WHERE post_id = p.id AND like = 1) as likes,
                (SELECT COUNT(*) FROM reaction WHERE post_id = p.id AND like = 0) as dislikes,
-               (SELECT COUNT(*) FROM comments WHERE post_id = p.id) as comments
+               (SELECT COUNT(*) FROM comments WHERE post_id = p.id) as comments,
+               p.status, p.publish_at
         FROM posts p
         JOIN users u ON p.user_id = u.id
         WHERE p.id = ?
@@ -275,11 +429,24 @@ func (ah *APIHandler) handleSinglePost(w http.ResponseWriter, r *http.Request) {
 	var post utils.Post
 	var postTime string
 	var profilePic sql.NullString
+	var publishAt sql.NullTime
 
 	err = utils.GlobalDB.QueryRow(query, postID).Scan(
 		&post.ID, &post.Title, &post.Content, &post.ImagePath, &postTime, &post.UserID,
 		&post.Username, &profilePic, &post.Likes, &post.Dislikes, &post.Comments,
+		&post.Status, &publishAt,
 	)
+
+	// Drafts and scheduled posts are only shown to their author
+	if err == nil && post.Status != utils.PostStatusPublished {
+		if viewerID(r) != post.UserID {
+			err = sql.ErrNoRows
+		} else if publishAt.Valid {
+			post.PublishAt = publishAt.Time.Format(time.RFC3339)
+		}
+	} else if err == nil {
+		post.Status = ""
+	}
 	if err != nil {
 		if err == sql.ErrNoRows {
 			w.WriteHeader(http.StatusNotFound)
@@ -294,6 +461,7 @@ func (ah *APIHandler) handleSinglePost(w http.ResponseWriter, r *http.Request) {
 
 	// Format the time
 	post.PostTime = postTime
+	renderPostContent(&post)
 
 	// Handle profile picture
 	if profilePic.Valid {
@@ -312,6 +480,15 @@ func (ah *APIHandler) handleSinglePost(w http.ResponseWriter, r *http.Request) {
 		post.Categories = categories
 	}
 
+	if userID := viewerID(r); userID != "" {
+		utils.GlobalDB.QueryRow(
+			"SELECT EXISTS(SELECT 1 FROM bookmarks WHERE user_id = ? AND post_id = ?)", userID, post.ID,
+		).Scan(&post.IsBookmarked)
+	}
+	single := []utils.Post{post}
+	attachPostMedia(viewerID(r), single)
+	post = single[0]
+
 	// Get comments for this post
 	commentsQuery := `
         SELECT c.id, c.content, c.comment_at, c.user_id, u.nickname, u.profile_pic,
@@ -363,6 +540,7 @@ func (ah *APIHandler) handleSinglePost(w http.ResponseWriter, r *http.Request) {
 			comment.ProfilePic = ""
 		}
 
+		renderCommentContent(&comment)
 		comments = append(comments, comment)
 	}
 
@@ -374,7 +552,7 @@ func (ah *APIHandler) handleSinglePost(w http.ResponseWriter, r *http.Request) {
 	// Return post and comments
 	response := map[string]interface{}{
 		"post":     post,
-		"comments": comments,
+		"comments": filterHiddenComments(r, comments),
 	}
 
 	json.NewEncoder(w).Encode(response)
@@ -401,7 +579,7 @@ func (ah *APIHandler) handleUsers(w http.ResponseWriter, r *http.Request) {
 	}
 
 	query := `
-		SELECT id, nickname, email, first_name, last_name, age, gender, profile_pic, created_at, is_online, last_seen
+		SELECT id, nickname, email, first_name, last_name, age, gender, profile_pic, created_at, ` + utils.VisibleStatusSQL("users") + `, last_seen
 		FROM users
 		ORDER BY created_at DESC
 	`
@@ -423,12 +601,13 @@ func (ah *APIHandler) handleUsers(w http.ResponseWriter, r *http.Request) {
 		// Scan into the User struct with proper handling for NULL profile_pic
 		err := rows.Scan(
 			&user.ID, &user.Nickname, &user.Email, &user.FirstName, &user.LastName,
-			&user.Age, &user.Gender, &profilePic, &createdAt, &user.IsOnline, &user.LastSeen,
+			&user.Age, &user.Gender, &profilePic, &createdAt, &user.Status, &user.LastSeen,
 		)
 		if err != nil {
 			log.Printf("Error scanning user row: %v", err)
 			continue
 		}
+		user.IsOnline = user.Status != utils.UserStatusOffline
 
 		// Format the time
 		user.CreatedAt = createdAt
@@ -495,7 +674,7 @@ func (ah *APIHandler) handleFilteredPosts(w http.ResponseWriter, r *http.Request
 
 	// Return success response
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(posts)
+	json.NewEncoder(w).Encode(viewerPosts(r, posts))
 }
 
 // handleCreatePost processes requests to create a new post
@@ -530,103 +709,130 @@ func (ah *APIHandler) handleCreatePost(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Post data received - Title: %s, Content length: %d, Categories: %v",
 		title, len(content), categories)
 
-	if title == "" || content == "" || len(categories) == 0 {
-		log.Printf("Invalid post data: missing required fields")
+	// Posts are published immediately unless saved as a draft or scheduled
+	currentTime := time.Now().UTC()
+	postStatus, publishAt, err := parsePostSchedule(r.FormValue("status"), r.FormValue("publish_at"), currentTime)
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Title, content, and at least one category are required"})
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
 		return
 	}
 
-	// Handle optional image
-	var imagePath string
-	file, header, err := r.FormFile("image")
-	if err != nil && err != http.ErrMissingFile {
-		log.Printf("Error getting image file: %v", err)
+	var categoryIDs []int64
+	if postStatus == utils.PostStatusDraft {
+		categoryIDs, err = resolveCategoryIDs(categories, nil)
+	} else {
+		categoryIDs, err = validatePostFields(title, content, categories, nil)
+	}
+	if err != nil {
+		log.Printf("Invalid post data: %v", err)
 		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Error processing image: " + err.Error()})
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
 		return
 	}
 
-	if err == nil && file != nil {
-		log.Printf("Image file received: %s, size: %d bytes", header.Filename, header.Size)
-		defer file.Close()
-		if header.Size > 20<<20 {
-			log.Printf("Image too large: %d bytes", header.Size)
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Image too large (max 20MB)"})
-			return
-		}
+	// Tags may be sent as repeated tags[] fields or as one comma-separated tags field
+	tags, err := parsePostTags(append(r.Form["tags[]"], r.Form["tags"]...))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
 
-		imageHandler := NewImageHandler()
-		imagePath, err = imageHandler.ProcessImage(file, header)
-		if err != nil {
-			log.Printf("Image processing failed: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Image processing failed: " + err.Error()})
-			return
-		}
-		log.Printf("Image processed successfully: %s", imagePath)
+	// A poll is optional; it must close after the post goes live
+	opensAt := currentTime
+	if postStatus == utils.PostStatusScheduled {
+		opensAt = publishAt.Time
+	}
+	poll, err := parsePostPoll(r, opensAt)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	// Handle optional image
+	imagePath, status, err := processPostImage(r)
+	if err != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	// Handle optional gallery images and file attachments
+	attachments, status, err := processPostAttachments(r, 0)
+	if err != nil {
+		NewImageHandler().RemoveImage(imagePath)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	discardUploads := func() {
+		NewImageHandler().RemoveImage(imagePath)
+		removeAttachmentFiles(attachments)
 	}
 
 	// Start transaction
 	tx, err := utils.GlobalDB.Begin()
 	if err != nil {
 		log.Printf("Database error starting transaction: %v", err)
+		discardUploads()
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"error": "Database error: " + err.Error()})
 		return
 	}
 	defer tx.Rollback()
 
-	// Insert post
-	currentTime := time.Now()
-	log.Printf("Inserting post into database - UserID: %s, Title: %s, Time: %v",
-		userID, title, currentTime)
+	// Insert post; a scheduled post carries its publication time as post_at
+	postTime := opensAt
+	log.Printf("Inserting post into database - UserID: %s, Title: %s, Status: %s, Time: %v",
+		userID, title, postStatus, postTime)
 
 	result, err := tx.Exec(`
-        INSERT INTO posts (user_id, title, content, imagepath, post_at)
-        VALUES (?, ?, ?, ?, ?)
-    `, userID, title, content, imagePath, currentTime)
+        INSERT INTO posts (user_id, title, content, imagepath, post_at, status, publish_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?)
+    `, userID, title, content, imagePath, postTime, postStatus, publishAt)
 	if err != nil {
 		log.Printf("Error creating post: %v", err)
+		discardUploads()
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"error": "Error creating post: " + err.Error()})
 		return
 	}
 
 	postID, _ := result.LastInsertId()
-	processedCategories := make(map[string]bool)
 
-	for _, categoryName := range categories {
-		// Skip if category was already processed
-		if processedCategories[categoryName] {
-			continue
-		}
-		processedCategories[categoryName] = true
+	if err := setPostCategories(tx, postID, categoryIDs); err != nil {
+		log.Printf("Error inserting categories: %v", err)
+		discardUploads()
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error adding categories"})
+		return
+	}
 
-		log.Printf("Processing category: %s", categoryName)
+	if err := utils.SetPostTags(tx, postID, tags, utils.ExtractTags(content)); err != nil {
+		log.Printf("Error tagging post: %v", err)
+		discardUploads()
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error adding tags"})
+		return
+	}
 
-		categoryID, err := getCategoryIdByName(categoryName)
-		if err != nil {
-			log.Printf("Error getting category ID: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{
-				"error": fmt.Sprintf("Category not found: %s", categoryName),
-			})
-			return
-		}
+	if err := saveAttachments(tx, postID, attachments); err != nil {
+		log.Printf("Error saving attachments: %v", err)
+		discardUploads()
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error adding attachments"})
+		return
+	}
 
-		// Try to insert, ignore duplicate errors
-		_, err = tx.Exec(`
-            INSERT OR IGNORE INTO post_categories (post_id, category_id)
-            VALUES (?, ?)
-        `, postID, categoryID)
+	if poll != nil {
+		_, err := utils.CreatePoll(tx, postID, poll.question, poll.options, poll.multiple, poll.anonymous, poll.closesAt)
 		if err != nil {
-			log.Printf("Error inserting category: %v", err)
+			log.Printf("Error creating poll: %v", err)
+			discardUploads()
 			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{
-				"error": fmt.Sprintf("Error adding category %s", categoryName),
-			})
+			json.NewEncoder(w).Encode(map[string]string{"error": "Error adding poll"})
 			return
 		}
 	}
@@ -634,33 +840,199 @@ func (ah *APIHandler) handleCreatePost(w http.ResponseWriter, r *http.Request) {
 	// Commit transaction
 	if err := tx.Commit(); err != nil {
 		log.Printf("Error committing transaction: %v", err)
+		discardUploads()
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"error": "Error committing transaction: " + err.Error()})
 		return
 	}
 
-	log.Printf("Post created successfully - ID: %d", postID)
+	log.Printf("Post created successfully - ID: %d, Status: %s", postID, postStatus)
+
+	if postStatus == utils.PostStatusPublished {
+		ah.AnnouncePost(postID, userID)
+	}
 
 	// Return success response
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success": true,
 		"postId":  postID,
+		"status":  postStatus,
 		"message": "Post created successfully",
 	})
 }
 
+// AnnouncePost runs everything that happens when a post goes live: its
+// @mentions are recorded and notified, followers get a new_post notification
+// and the post is pushed to subscribers' feeds
+// Called when a post is created published, when a draft is published and by
+// the post scheduler.
+// @param postID - The published post
+// @param authorID - The post author
+func (ah *APIHandler) AnnouncePost(postID int64, authorID string) {
+	var content string
+	if err := utils.GlobalDB.QueryRow("SELECT content FROM posts WHERE id = ?", postID).Scan(&content); err != nil {
+		log.Printf("Error loading post %d to announce: %v", postID, err)
+		return
+	}
+
+	mentioned := saveContentMentions(utils.GlobalDB, utils.MentionSourcePost, postID, authorID, content)
+	handlers.NotifyMentions(authorID, postID, mentioned)
+	handlers.NotifyFollowers(authorID, postID)
+	go ah.pushPostToSubscribers(postID, authorID)
+}
+
+// validatePostFields checks the title, content and categories of a post
+// Shared by post creation and editing so both apply the same rules
+// @param title - The post title
+// @param content - The post content
+// @param categories - The category names selected for the post
+// @param currentIDs - Categories the post already has; these may stay even if archived
+// @returns []int64 - The IDs of the selected categories, without duplicates
+// @returns error - A client-facing error if validation fails
+func validatePostFields(title, content string, categories []string, currentIDs map[int64]bool) ([]int64, error) {
+	if err := requirePostFields(title, content, len(categories)); err != nil {
+		return nil, err
+	}
+	return resolveCategoryIDs(categories, currentIDs)
+}
+
+// requirePostFields checks that a post about to be published is complete
+// Drafts skip this check so they can be saved while still being written.
+func requirePostFields(title, content string, categoryCount int) error {
+	if strings.TrimSpace(title) == "" || strings.TrimSpace(content) == "" || categoryCount == 0 {
+		return fmt.Errorf("Title, content, and at least one category are required")
+	}
+	return nil
+}
+
+// resolveCategoryIDs looks up the IDs of the selected category names
+// @param categories - The category names selected for the post
+// @param currentIDs - Categories the post already has; these may stay even if archived
+// @returns []int64 - The IDs of the selected categories, without duplicates
+// @returns error - A client-facing error for unknown or archived categories
+func resolveCategoryIDs(categories []string, currentIDs map[int64]bool) ([]int64, error) {
+	processedCategories := make(map[string]bool)
+	var categoryIDs []int64
+	for _, categoryName := range categories {
+		// Skip if category was already processed
+		if processedCategories[categoryName] {
+			continue
+		}
+		processedCategories[categoryName] = true
+
+		categoryID, archived, err := getCategoryIdByName(categoryName)
+		if err != nil {
+			return nil, fmt.Errorf("Category not found: %s", categoryName)
+		}
+		if archived && !currentIDs[categoryID] {
+			return nil, fmt.Errorf("Category is archived: %s", categoryName)
+		}
+		categoryIDs = append(categoryIDs, categoryID)
+	}
+
+	return categoryIDs, nil
+}
+
+// processPostImage validates and stores the optional "image" file of a post form
+// @param r - The request with an already parsed multipart form
+// @returns string - The stored image path, or an empty string if no image was sent
+// @returns int - The HTTP status to respond with when an error is returned
+// @returns error - Any error that occurred while handling the image
+func processPostImage(r *http.Request) (string, int, error) {
+	file, header, err := r.FormFile("image")
+	if err == http.ErrMissingFile || err == http.ErrNotMultipart {
+		return "", http.StatusOK, nil
+	}
+	if err != nil {
+		log.Printf("Error getting image file: %v", err)
+		return "", http.StatusBadRequest, fmt.Errorf("Error processing image: %v", err)
+	}
+	defer file.Close()
+
+	log.Printf("Image file received: %s, size: %d bytes", header.Filename, header.Size)
+
+	imagePath, err := NewImageHandler().ProcessImage(file, header)
+	if err != nil {
+		log.Printf("Image processing failed: %v", err)
+		status, message := uploadErrorResponse(err)
+		return "", status, errors.New(message)
+	}
+	log.Printf("Image processed successfully: %s", imagePath)
+
+	return imagePath, http.StatusOK, nil
+}
+
+// parsePostTags normalizes the explicit tags sent with a post
+// Each value may itself hold several tags separated by commas or spaces
+// @param values - The raw tag values from the request
+// @returns []string - Normalized tags without duplicates
+// @returns error - A client-facing error if a tag is invalid
+func parsePostTags(values []string) ([]string, error) {
+	var names []string
+	for _, value := range values {
+		names = append(names, strings.FieldsFunc(value, func(r rune) bool {
+			return r == ',' || r == ' '
+		})...)
+	}
+	return utils.NormalizeTags(names)
+}
+
+// setPostCategories replaces the category set of a post within a transaction
+// @param tx - The transaction to run the statements in
+// @param postID - The ID of the post
+// @param categoryIDs - The IDs of the categories the post should belong to
+// @returns error - Any error that occurred
+func setPostCategories(tx *sql.Tx, postID int64, categoryIDs []int64) error {
+	if _, err := tx.Exec("DELETE FROM post_categories WHERE post_id = ?", postID); err != nil {
+		return err
+	}
+
+	for _, categoryID := range categoryIDs {
+		_, err := tx.Exec(`
+            INSERT OR IGNORE INTO post_categories (post_id, category_id)
+            VALUES (?, ?)
+        `, postID, categoryID)
+		if err != nil {
+			return fmt.Errorf("error adding category %d: %v", categoryID, err)
+		}
+	}
+
+	return nil
+}
+
+// getPostCategoryIDs returns the set of category IDs currently on a post
+func getPostCategoryIDs(postID int64) (map[int64]bool, error) {
+	rows, err := utils.GlobalDB.Query("SELECT category_id FROM post_categories WHERE post_id = ?", postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make(map[int64]bool)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
+
 // getCategoryIdByName retrieves the ID of a category by its name
 // @param categoryName - The name of the category to look up
 // @returns int64 - The ID of the category
+// @returns bool - Whether the category is archived
 // @returns error - Error if category not found
-func getCategoryIdByName(categoryName string) (int64, error) {
+func getCategoryIdByName(categoryName string) (int64, bool, error) {
 	var id int64
-	err := utils.GlobalDB.QueryRow("SELECT id FROM categories WHERE name = ?", categoryName).Scan(&id)
+	var archived bool
+	err := utils.GlobalDB.QueryRow("SELECT id, archived FROM categories WHERE name = ?", categoryName).Scan(&id, &archived)
 	if err != nil {
-		return 0, fmt.Errorf("category not found: %s", categoryName)
+		return 0, false, fmt.Errorf("category not found: %s", categoryName)
 	}
-	return id, nil
+	return id, archived, nil
 }
 
 // handleReaction processes like/dislike reactions on posts
@@ -680,6 +1052,13 @@ func (ah *APIHandler) handleReaction(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Drafts and scheduled posts cannot be reacted to
+	if !isPublishedPost(int64(req.PostID)) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Post not found"})
+		return
+	}
+
 	tx, err := utils.GlobalDB.Begin()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -783,8 +1162,15 @@ func (ah *APIHandler) handleComment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Drafts and scheduled posts cannot be commented on
+	if !isPublishedPost(int64(req.PostID)) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Post not found"})
+		return
+	}
+
 	// Insert comment
-	_, err := utils.GlobalDB.Exec(`
+	result, err := utils.GlobalDB.Exec(`
         INSERT INTO comments (post_id, user_id, content)
         VALUES (?, ?, ?)`,
 		req.PostID, userID, req.Content,
@@ -794,6 +1180,7 @@ func (ah *APIHandler) handleComment(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to add comment"})
 		return
 	}
+	commentID, _ := result.LastInsertId()
 
 	// Update post comment count
 	_, err = utils.GlobalDB.Exec(`
@@ -814,34 +1201,85 @@ func (ah *APIHandler) handleComment(w http.ResponseWriter, r *http.Request) {
 		handlers.BroadcastNotification(postOwnerID, userID, "comment")
 	}
 
+	mentioned := saveContentMentions(utils.GlobalDB, utils.MentionSourceComment, commentID, userID, req.Content)
+	handlers.NotifyMentions(userID, int64(req.PostID), mentioned)
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"message": "Comment added successfully",
+		"success":   true,
+		"message":   "Comment added successfully",
+		"commentId": commentID,
+		"mentions":  contentMentions(req.Content),
 	})
 }
 
 // handleEditPost processes requests to edit existing posts
 // Verifies the user owns the post before allowing edits
+// Accepts either a JSON body (title and content only) or a multipart form that
+// can also replace the category set and replace or remove the image
 func (ah *APIHandler) handleEditPost(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	userID := r.Context().Value("userID").(string)
 
 	var req struct {
-		PostID  int64  `json:"post_id"`
-		Title   string `json:"title"`
-		Content string `json:"content"`
+		PostID      int64    `json:"post_id"`
+		Title       string   `json:"title"`
+		Content     string   `json:"content"`
+		Categories  []string `json:"categories"`
+		Tags        []string `json:"tags"`
+		RemoveImage bool     `json:"remove_image"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	isMultipart := strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data")
+	hasCategories := false
+	hasTags := false
+
+	if isMultipart {
+		if err := r.ParseMultipartForm(20 << 20); err != nil {
+			log.Printf("Error parsing edit form: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Error parsing form: " + err.Error()})
+			return
+		}
+
+		postID, err := strconv.ParseInt(r.FormValue("post_id"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid post ID"})
+			return
+		}
+		req.PostID = postID
+		req.Title = r.FormValue("title")
+		req.Content = r.FormValue("content")
+		req.Categories, hasCategories = r.MultipartForm.Value["categories[]"]
+		tagValues, hasTagList := r.MultipartForm.Value["tags[]"]
+		tagField, hasTagField := r.MultipartForm.Value["tags"]
+		req.Tags = append(tagValues, tagField...)
+		hasTags = hasTagList || hasTagField
+		req.RemoveImage = r.FormValue("remove_image") == "true"
+	} else {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+			return
+		}
+		hasCategories = req.Categories != nil
+		hasTags = req.Tags != nil
+	}
+
+	tags, err := parsePostTags(req.Tags)
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
 		return
 	}
 
 	// Verify post exists and user owns it
-	var postOwnerID string
-	err := utils.GlobalDB.QueryRow("SELECT user_id FROM posts WHERE id = ?", req.PostID).Scan(&postOwnerID)
+	var postOwnerID, postStatus string
+	var oldImagePath sql.NullString
+	err = utils.GlobalDB.QueryRow(
+		"SELECT user_id, imagepath, status FROM posts WHERE id = ?", req.PostID,
+	).Scan(&postOwnerID, &oldImagePath, &postStatus)
 	if err == sql.ErrNoRows {
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(map[string]string{"error": "Post not found"})
@@ -858,35 +1296,131 @@ func (ah *APIHandler) handleEditPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Validate input
-	if req.Title == "" || req.Content == "" {
+	if postStatus != utils.PostStatusPublished {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Drafts and scheduled posts are saved through /api/posts/draft"})
+		return
+	}
+
+	// Validate input with the same rules as post creation. The category set is
+	// only replaced when the request carries one.
+	var categoryIDs []int64
+	if hasCategories {
+		currentIDs, err := getPostCategoryIDs(req.PostID)
+		if err != nil {
+			log.Printf("Error loading categories for post %d: %v", req.PostID, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Database error"})
+			return
+		}
+		categoryIDs, err = validatePostFields(req.Title, req.Content, req.Categories, currentIDs)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+	} else if strings.TrimSpace(req.Title) == "" || strings.TrimSpace(req.Content) == "" {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{"error": "Title and content are required"})
 		return
 	}
 
+	// Handle an optional replacement image
+	newImagePath := ""
+	if isMultipart {
+		var status int
+		newImagePath, status, err = processPostImage(r)
+		if err != nil {
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+	}
+
+	imagePath := oldImagePath.String
+	if newImagePath != "" {
+		imagePath = newImagePath
+	} else if req.RemoveImage {
+		imagePath = ""
+	}
+
+	imageHandler := NewImageHandler()
+
+	tx, err := utils.GlobalDB.Begin()
+	if err != nil {
+		imageHandler.RemoveImage(newImagePath)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
 	// Update the post
-	result, err := utils.GlobalDB.Exec(
-		"UPDATE posts SET title = ?, content = ? WHERE id = ?",
-		req.Title, req.Content, req.PostID,
+	_, err = tx.Exec(
+		"UPDATE posts SET title = ?, content = ?, imagepath = ? WHERE id = ?",
+		req.Title, req.Content, imagePath, req.PostID,
 	)
 	if err != nil {
+		imageHandler.RemoveImage(newImagePath)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update post"})
 		return
 	}
 
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Post not found"})
+	if hasCategories {
+		if err := setPostCategories(tx, req.PostID, categoryIDs); err != nil {
+			log.Printf("Error updating categories for post %d: %v", req.PostID, err)
+			imageHandler.RemoveImage(newImagePath)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update post categories"})
+			return
+		}
+	}
+
+	// Explicit tags are kept unless the request replaces them; content tags
+	// always follow the edited content
+	if !hasTags {
+		tags, err = utils.GetExplicitPostTags(tx, req.PostID)
+		if err != nil {
+			log.Printf("Error loading tags for post %d: %v", req.PostID, err)
+			imageHandler.RemoveImage(newImagePath)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update post tags"})
+			return
+		}
+	}
+	if err := utils.SetPostTags(tx, req.PostID, tags, utils.ExtractTags(req.Content)); err != nil {
+		log.Printf("Error updating tags for post %d: %v", req.PostID, err)
+		imageHandler.RemoveImage(newImagePath)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update post tags"})
+		return
+	}
+
+	mentioned := saveContentMentions(tx, utils.MentionSourcePost, req.PostID, userID, req.Content)
+
+	if err := tx.Commit(); err != nil {
+		imageHandler.RemoveImage(newImagePath)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to commit transaction"})
 		return
 	}
 
+	// The old file is only cleaned up once the new state is committed
+	if oldImagePath.String != "" && oldImagePath.String != imagePath {
+		if err := imageHandler.RemoveImage(oldImagePath.String); err != nil {
+			log.Printf("Error removing old image %s: %v", oldImagePath.String, err)
+		}
+	}
+
+	// Only users added by this edit are notified
+	handlers.NotifyMentions(userID, req.PostID, mentioned)
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"message": "Post updated successfully",
+		"success":   true,
+		"message":   "Post updated successfully",
+		"imagePath": imagePath,
 	})
 }
 
@@ -907,8 +1441,10 @@ func (ah *APIHandler) handleDeletePost(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Verify post exists and user owns it
-	var postOwnerID string
-	err := utils.GlobalDB.QueryRow("SELECT user_id FROM posts WHERE id = ?", req.PostID).Scan(&postOwnerID)
+	var postOwnerID, imagePath string
+	err := utils.GlobalDB.QueryRow(
+		"SELECT user_id, COALESCE(imagepath, '') FROM posts WHERE id = ?", req.PostID,
+	).Scan(&postOwnerID, &imagePath)
 	if err == sql.ErrNoRows {
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(map[string]string{"error": "Post not found"})
@@ -925,6 +1461,11 @@ func (ah *APIHandler) handleDeletePost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	byPost, err := utils.GetPostAttachments(utils.GlobalDB, []int64{req.PostID})
+	if err != nil {
+		log.Printf("Error loading attachments of post %d: %v", req.PostID, err)
+	}
+
 	// Start transaction
 	tx, err := utils.GlobalDB.Begin()
 	if err != nil {
@@ -977,6 +1518,13 @@ func (ah *APIHandler) handleDeletePost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Uploads in the blob store are released by the delete and collected
+	// once nothing uses them; files stored before it are removed here
+	if err := NewImageHandler().RemoveImage(imagePath); err != nil {
+		log.Printf("Error removing image of post %d: %v", req.PostID, err)
+	}
+	removeAttachmentFiles(byPost[req.PostID])
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success": true,
@@ -1003,7 +1551,8 @@ func (ah *APIHandler) handleEditComment(w http.ResponseWriter, r *http.Request)
 
 	// Validate ownership
 	var ownerID string
-	err := utils.GlobalDB.QueryRow("SELECT user_id FROM comments WHERE id = ?", req.CommentID).Scan(&ownerID)
+	var postID int64
+	err := utils.GlobalDB.QueryRow("SELECT user_id, post_id FROM comments WHERE id = ?", req.CommentID).Scan(&ownerID, &postID)
 	if err != nil || ownerID != userID {
 		w.WriteHeader(http.StatusForbidden)
 		json.NewEncoder(w).Encode(map[string]string{"error": "Not authorized"})
@@ -1018,10 +1567,14 @@ func (ah *APIHandler) handleEditComment(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	mentioned := saveContentMentions(utils.GlobalDB, utils.MentionSourceComment, int64(req.CommentID), userID, req.Content)
+	handlers.NotifyMentions(userID, postID, mentioned)
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"message": "Comment updated successfully",
+		"success":  true,
+		"message":  "Comment updated successfully",
+		"mentions": contentMentions(req.Content),
 	})
 }
 
@@ -1069,7 +1622,7 @@ func (ah *APIHandler) handleCategoryPosts(w http.ResponseWriter, r *http.Request
 		FROM posts p
 		JOIN users u ON p.user_id = u.id
 		JOIN post_categories pc ON p.id = pc.post_id
-		WHERE pc.category_id = ?
+		WHERE pc.category_id = ? AND p.status = 'published'
 		ORDER BY p.post_at DESC
 	`
 
@@ -1123,6 +1676,7 @@ func (ah *APIHandler) handleCategoryPosts(w http.ResponseWriter, r *http.Request
 
 		posts = append(posts, post)
 	}
+	renderPostsContent(posts)
 
 	// If no posts were found, return an empty array rather than nil
 	if posts == nil {
@@ -1135,7 +1689,7 @@ func (ah *APIHandler) handleCategoryPosts(w http.ResponseWriter, r *http.Request
 	// Return posts as JSON
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(posts)
+	json.NewEncoder(w).Encode(viewerPosts(r, posts))
 }
 
 // handleDeleteComment processes requests to delete comments
@@ -1286,6 +1840,11 @@ func (ah *APIHandler) handleGetProfile(w http.ResponseWriter, r *http.Request) {
 		Age        int            `json:"age"`
 		Gender     string         `json:"gender"`
 		ProfilePic sql.NullString `json:"profile_pic"`
+
+		FollowerCount  int  `json:"follower_count"`
+		FollowingCount int  `json:"following_count"`
+		IsFollowing    bool `json:"is_following"`
+		FollowMuted    bool `json:"follow_muted"`
 	}
 
 	err := utils.GlobalDB.QueryRow(query, userID).Scan(
@@ -1307,6 +1866,19 @@ func (ah *APIHandler) handleGetProfile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	user.FollowerCount, user.FollowingCount, err = getFollowCounts(userID)
+	if err != nil {
+		log.Printf("Error getting follow counts: %v", err)
+	}
+
+	// Let a signed-in viewer see whether they already follow this user
+	if cookie, err := r.Cookie("session_token"); err == nil {
+		viewerID, err := utils.ValidateSession(utils.GlobalDB, cookie.Value)
+		if err == nil && viewerID != "" && viewerID != userID {
+			user.IsFollowing, user.FollowMuted = getFollowState(viewerID, userID)
+		}
+	}
+
 	// Return user data
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success": true,
@@ -1387,23 +1959,28 @@ func (ah *APIHandler) handleUpdateProfilePic(w http.ResponseWriter, r *http.Requ
 
 	log.Printf("Processing profile picture: %s, size: %d bytes", header.Filename, header.Size)
 
-	// Process image using ImageHandler
+	// Process image using ImageHandler; avatars are cropped to squares
 	imageHandler := NewImageHandler()
-	imagePath, err := imageHandler.ProcessImage(file, header)
+	imagePath, err := imageHandler.ProcessAvatar(file, header)
 	if err != nil {
 		log.Printf("Error processing image: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		status, message := uploadErrorResponse(err)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": message})
 		return
 	}
 
 	log.Printf("Image processed successfully: %s", imagePath)
 
-	// Update database
+	var oldImagePath sql.NullString
+	if err := utils.GlobalDB.QueryRow("SELECT profile_pic FROM users WHERE id = ?", userID).Scan(&oldImagePath); err != nil {
+		log.Printf("Error loading old profile_pic: %v", err)
+	}
+
+	// Update database; an unused new image is left to the upload collector
 	_, err = utils.GlobalDB.Exec("UPDATE users SET profile_pic = ? WHERE id = ?", imagePath, userID)
 	if err != nil {
 		log.Printf("Error updating profile_pic in database: %v", err)
-		os.Remove(imagePath)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update profile picture in database"})
 		return
@@ -1411,11 +1988,25 @@ func (ah *APIHandler) handleUpdateProfilePic(w http.ResponseWriter, r *http.Requ
 
 	log.Printf("Profile picture updated successfully for user: %s", userID)
 
+	// Pictures in the blob store are released by the update and collected
+	// once nothing uses them; older ones are removed here
+	if oldImagePath.String != "" && oldImagePath.String != imagePath {
+		if err := imageHandler.RemoveImage(oldImagePath.String); err != nil {
+			log.Printf("Error removing old profile picture: %v", err)
+		}
+	}
+
+	infos, err := utils.GetImageInfo(utils.GlobalDB, []string{imagePath})
+	if err != nil {
+		log.Printf("Error loading profile picture renditions: %v", err)
+	}
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success": true,
 		"message": "Profile picture updated successfully",
 		"path":    imagePath,
+		"image":   infos[imagePath],
 	})
 }
 
@@ -2008,7 +2599,7 @@ func (ah *APIHandler) handleCreatedPosts(w http.ResponseWriter, r *http.Request)
                (SELECT COUNT(*) FROM comments WHERE post_id = p.id) as comments
         FROM posts p
         JOIN users u ON p.user_id = u.id
-        WHERE p.user_id = ?
+        WHERE p.user_id = ? AND p.status = 'published'
         ORDER BY p.post_at DESC
     `
 
@@ -2056,6 +2647,7 @@ func (ah *APIHandler) handleCreatedPosts(w http.ResponseWriter, r *http.Request)
 
 		posts = append(posts, post)
 	}
+	renderPostsContent(posts)
 
 	// If no posts were found, return an empty array rather than nil
 	if posts == nil {
@@ -2066,7 +2658,7 @@ func (ah *APIHandler) handleCreatedPosts(w http.ResponseWriter, r *http.Request)
 
 	// Return posts as JSON
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(posts)
+	json.NewEncoder(w).Encode(viewerPosts(r, posts))
 }
 
 // handleLikedPosts returns posts liked by the current user
@@ -2121,7 +2713,7 @@ func (ah *APIHandler) handleLikedPosts(w http.ResponseWriter, r *http.Request) {
         FROM posts p
         JOIN users u ON p.user_id = u.id
         JOIN reaction r ON p.id = r.post_id
-        WHERE r.user_id = ? AND r.like = 1
+        WHERE r.user_id = ? AND r.like = 1 AND p.status = 'published'
         GROUP BY p.id
         ORDER BY p.post_at DESC
     `
@@ -2170,6 +2762,7 @@ func (ah *APIHandler) handleLikedPosts(w http.ResponseWriter, r *http.Request) {
 
 		posts = append(posts, post)
 	}
+	renderPostsContent(posts)
 
 	// If no posts were found, return an empty array rather than nil
 	if posts == nil {
@@ -2180,7 +2773,7 @@ func (ah *APIHandler) handleLikedPosts(w http.ResponseWriter, r *http.Request) {
 
 	// Return posts as JSON
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(posts)
+	json.NewEncoder(w).Encode(viewerPosts(r, posts))
 }
 
 // handleUserStats returns statistics for a user (post count, comment count, likes received)
@@ -2229,7 +2822,7 @@ func (ah *APIHandler) handleUserStats(w http.ResponseWriter, r *http.Request) {
 
 	// Get post count
 	var postCount int
-	err := utils.GlobalDB.QueryRow("SELECT COUNT(*) FROM posts WHERE user_id = ?", userID).Scan(&postCount)
+	err := utils.GlobalDB.QueryRow("SELECT COUNT(*) FROM posts WHERE user_id = ? AND status = 'published'", userID).Scan(&postCount)
 	if err != nil {
 		log.Printf("Error getting post count: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -2268,12 +2861,25 @@ func (ah *APIHandler) handleUserStats(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Get follower and following counts
+	followerCount, followingCount, err := getFollowCounts(userID)
+	if err != nil {
+		log.Printf("Error getting follow counts: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": fmt.Sprintf("Error getting follow counts: %v", err),
+		})
+		return
+	}
+
 	// Return stats
 	stats := map[string]interface{}{
-		"post_count":     postCount,
-		"comment_count":  commentCount,
-		"likes_received": likesReceived,
-		"user_id":        userID,
+		"post_count":      postCount,
+		"comment_count":   commentCount,
+		"likes_received":  likesReceived,
+		"follower_count":  followerCount,
+		"following_count": followingCount,
+		"user_id":         userID,
 	}
 
 	json.NewEncoder(w).Encode(stats)
@@ -2331,7 +2937,7 @@ func (ah *APIHandler) handleCommentedPosts(w http.ResponseWriter, r *http.Reques
         FROM posts p
         JOIN users u ON p.user_id = u.id
         JOIN comments c ON p.id = c.post_id
-        WHERE c.user_id = ?
+        WHERE c.user_id = ? AND p.status = 'published'
         GROUP BY p.id
         ORDER BY p.post_at DESC
     `
@@ -2380,6 +2986,7 @@ func (ah *APIHandler) handleCommentedPosts(w http.ResponseWriter, r *http.Reques
 
 		posts = append(posts, post)
 	}
+	renderPostsContent(posts)
 
 	// If no posts were found, return an empty array rather than nil
 	if posts == nil {
@@ -2390,7 +2997,7 @@ func (ah *APIHandler) handleCommentedPosts(w http.ResponseWriter, r *http.Reques
 
 	// Return posts as JSON
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(posts)
+	json.NewEncoder(w).Encode(viewerPosts(r, posts))
 }
 
 func (ah *APIHandler) handleOnlineUsers(w http.ResponseWriter, r *http.Request) {
@@ -2399,7 +3006,7 @@ func (ah *APIHandler) handleOnlineUsers(w http.ResponseWriter, r *http.Request)
 	rows, err := utils.GlobalDB.Query(`
         SELECT id, nickname, first_name || ' ' || last_name as user_name, profile_pic
         FROM users
-        WHERE is_online = 1
+        WHERE ` + utils.VisibleStatusSQL("users") + ` != 'offline'
     `)
 	if err != nil {
 		http.Error(w, "Failed to fetch online users", http.StatusInternalServerError)
@@ -0,0 +1,54 @@
+package controllers
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"forum/utils"
+)
+
+func TestAPIHandler_messageChanges(t *testing.T) {
+	testDB, users := setupForumTestDB(t, "alice", "bob")
+	alice, bob := users["alice"], users["bob"]
+
+	conversationID, err := utils.DirectConversationID(testDB, alice.ID, bob.ID)
+	if err != nil {
+		t.Fatalf("DirectConversationID() error = %v", err)
+	}
+	_, err = testDB.Exec(
+		"INSERT INTO messages (id, conversation_id, sender_id, receiver_id, content, sent_at) VALUES (1, ?, ?, ?, 'hello', ?)",
+		conversationID, alice.ID, bob.ID, time.Now(),
+	)
+	if err != nil {
+		t.Fatalf("Failed to insert message: %v", err)
+	}
+
+	// The user named in the body is ignored; changes are made as the session user
+	spoofed := `"user_id":"` + alice.ID + `","message_id":1`
+	tests := []struct {
+		name  string
+		path  string
+		token string
+		body  string
+		want  int
+	}{
+		{"Edit without session", "/api/chat/edit", "", `{` + spoofed + `,"content":"changed"}`, http.StatusUnauthorized},
+		{"Edit by non-sender", "/api/chat/edit", bob.Token, `{` + spoofed + `,"content":"changed"}`, http.StatusForbidden},
+		{"Delete for everyone by non-sender", "/api/chat/delete", bob.Token, `{` + spoofed + `,"for":"everyone"}`, http.StatusForbidden},
+		{"Edit by sender", "/api/chat/edit", alice.Token, `{"message_id":1,"content":"edited"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := apiRequest(t, "POST", tt.path, tt.token, tt.body, nil); code != tt.want {
+				t.Errorf("got status %v want %v", code, tt.want)
+			}
+		})
+	}
+
+	var content string
+	testDB.QueryRow("SELECT content FROM messages WHERE id = 1").Scan(&content)
+	if content != "edited" {
+		t.Errorf("message content = %q, want %q", content, "edited")
+	}
+}
@@ -0,0 +1,556 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"forum/utils"
+)
+
+// attachmentDir held attachment files before they moved to the blob store.
+// Attachments stored there are still served and removed until they are
+// migrated with the migrate-uploads command.
+const attachmentDir = "uploads/attachments"
+
+// attachmentFiles returns the files sent in the attachments[] field of a multipart form
+func attachmentFiles(r *http.Request) []*multipart.FileHeader {
+	if r.MultipartForm == nil {
+		return nil
+	}
+	return append(r.MultipartForm.File["attachments[]"], r.MultipartForm.File["attachments"]...)
+}
+
+// storeAttachment validates an uploaded file against its policy and stores it
+// @param header - The uploaded file
+// @param keyPrefix - Prepended to the blob key, e.g. utils.ChatAttachmentKeyPrefix; empty for posts
+// @returns *utils.Attachment - The stored attachment, without a post ID
+// @returns int - The HTTP status to respond with when an error is returned
+// @returns error - A client-facing error if the file is rejected
+func storeAttachment(header *multipart.FileHeader, keyPrefix string) (*utils.Attachment, int, error) {
+	policy, contentType, err := utils.AttachmentPolicyFor(header.Filename)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if header.Size > policy.MaxSize {
+		return nil, http.StatusRequestEntityTooLarge,
+			fmt.Errorf("%s is too large (max %dMB)", header.Filename, policy.MaxSize>>20)
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("Error reading %s", header.Filename)
+	}
+	defer file.Close()
+
+	attachment := &utils.Attachment{
+		Kind:        policy.Kind,
+		FileName:    filepath.Base(header.Filename),
+		ContentType: contentType,
+	}
+
+	// Read one byte past the limit so a wrong header size is still caught
+	data, err := io.ReadAll(io.LimitReader(file, policy.MaxSize+1))
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("Error reading %s", header.Filename)
+	}
+	if int64(len(data)) > policy.MaxSize {
+		return nil, http.StatusRequestEntityTooLarge,
+			fmt.Errorf("%s is too large (max %dMB)", header.Filename, policy.MaxSize>>20)
+	}
+
+	if policy.Kind == utils.AttachmentKindImage {
+		status, err := storeImageAttachment(attachment, data, keyPrefix)
+		if err != nil {
+			return nil, status, err
+		}
+		return attachment, http.StatusOK, nil
+	}
+
+	head := data
+	if len(head) > 512 {
+		head = head[:512]
+	}
+	if err := utils.CheckFileContent(head, contentType); err != nil {
+		log.Printf("Rejected attachment %s: %v", header.Filename, err)
+		return nil, http.StatusUnsupportedMediaType,
+			fmt.Errorf("%s does not match its file type", header.Filename)
+	}
+
+	attachment.StoragePath = keyPrefix + utils.ContentKey(data, filepath.Ext(header.Filename))
+	blobs := []utils.Blob{{Key: attachment.StoragePath, Data: data, ContentType: contentType}}
+	if _, err := utils.StoreUpload(context.Background(), utils.GlobalDB, utils.Blobs, attachment.StoragePath, blobs); err != nil {
+		log.Printf("Error storing attachment %s: %v", header.Filename, err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("Failed to store %s", header.Filename)
+	}
+
+	sum := sha256.Sum256(data)
+	attachment.Size = int64(len(data))
+	attachment.Checksum = hex.EncodeToString(sum[:])
+	return attachment, http.StatusOK, nil
+}
+
+// storeImageAttachment re-encodes an image attachment without its metadata
+// and stores it in every utils.PostImageSizes rendition. The attachment's
+// name, type, size, dimensions and checksum describe the full rendition,
+// whose content-addressed key the other renditions are named after.
+// @param attachment - The attachment being stored, updated in place
+// @param data - The uploaded image, already checked against the size limit
+// @param keyPrefix - Prepended to the blob key; empty for posts
+// @returns int - The HTTP status to respond with when an error is returned
+// @returns error - A client-facing error if the image is rejected
+func storeImageAttachment(attachment *utils.Attachment, data []byte, keyPrefix string) (int, error) {
+	renditions, err := utils.RenderImage(data, utils.PostImageSizes, false)
+	if err != nil {
+		log.Printf("Rejected image attachment %s: %v", attachment.FileName, err)
+		var uploadErr *utils.UploadError
+		if errors.As(err, &uploadErr) && uploadErr.Kind == utils.UploadTooManyPixels {
+			return uploadErr.Status(), fmt.Errorf("%s: %s", attachment.FileName, uploadErr.Message())
+		}
+		return http.StatusUnsupportedMediaType, fmt.Errorf("%s is not a valid image", attachment.FileName)
+	}
+
+	// The stored format may differ from the upload, e.g. WebP is stored as JPEG
+	ext := renditions[0].Ext
+	attachment.FileName = strings.TrimSuffix(attachment.FileName, filepath.Ext(attachment.FileName)) + ext
+	attachment.ContentType = utils.ImageAttachmentPolicy.Types[ext]
+	for _, rendition := range renditions {
+		if rendition.Name == "full" {
+			sum := sha256.Sum256(rendition.Data)
+			attachment.StoragePath = keyPrefix + utils.ContentKey(rendition.Data, ext)
+			attachment.Checksum = hex.EncodeToString(sum[:])
+			attachment.Size = int64(len(rendition.Data))
+			attachment.Width, attachment.Height = rendition.Width, rendition.Height
+		}
+	}
+
+	blobs := make([]utils.Blob, 0, len(renditions))
+	blobs = append(blobs, utils.Blob{Key: attachment.StoragePath, ContentType: attachment.ContentType})
+	for _, rendition := range renditions {
+		if rendition.Name == "full" {
+			blobs[0].Data = rendition.Data
+			continue
+		}
+		blobs = append(blobs, utils.Blob{
+			Key:         utils.RenditionPath(attachment.StoragePath, rendition.Name),
+			Data:        rendition.Data,
+			ContentType: attachment.ContentType,
+		})
+	}
+	if _, err := utils.StoreUpload(context.Background(), utils.GlobalDB, utils.Blobs, attachment.StoragePath, blobs); err != nil {
+		log.Printf("Error storing attachment %s: %v", attachment.FileName, err)
+		return http.StatusInternalServerError, fmt.Errorf("Failed to store %s", attachment.FileName)
+	}
+
+	return http.StatusOK, nil
+}
+
+// processPostAttachments validates and stores the attachments[] files of a post form
+// Files already stored are removed again if a later one is rejected.
+// @param r - The request with an already parsed multipart form
+// @param existing - Number of attachments the post already has
+// @returns []utils.Attachment - The stored attachments, without a post ID
+// @returns int - The HTTP status to respond with when an error is returned
+// @returns error - A client-facing error if a file is rejected
+func processPostAttachments(r *http.Request, existing int) ([]utils.Attachment, int, error) {
+	headers := attachmentFiles(r)
+	if existing+len(headers) > utils.MaxAttachmentsPerPost {
+		return nil, http.StatusBadRequest,
+			fmt.Errorf("A post can have at most %d attachments", utils.MaxAttachmentsPerPost)
+	}
+
+	var attachments []utils.Attachment
+	for _, header := range headers {
+		attachment, status, err := storeAttachment(header, "")
+		if err != nil {
+			removeAttachmentFiles(attachments)
+			return nil, status, err
+		}
+		attachments = append(attachments, *attachment)
+	}
+	return attachments, http.StatusOK, nil
+}
+
+// saveAttachments records stored attachments for a post
+// @param db - Database connection or transaction
+// @param postID - The post the attachments belong to
+// @param attachments - The stored attachments, appended to the post's gallery in order
+// @returns error - Any database error
+func saveAttachments(db utils.DBExecutor, postID int64, attachments []utils.Attachment) error {
+	for i := range attachments {
+		attachments[i].PostID = postID
+		id, err := utils.CreateAttachment(db, &attachments[i])
+		if err != nil {
+			return err
+		}
+		attachments[i].ID = id
+	}
+	return nil
+}
+
+// removeAttachmentFiles deletes the stored files of attachments that are no
+// longer needed, including the renditions of images. Attachments in the blob
+// store are reference counted and removed by the upload collector once
+// nothing uses them, so only files stored in attachmentDir before the blob
+// store are deleted here, and only if no other attachment uses them.
+func removeAttachmentFiles(attachments []utils.Attachment) {
+	for _, attachment := range attachments {
+		if !isLegacyAttachment(attachment.StoragePath) {
+			continue
+		}
+
+		var users int
+		err := utils.GlobalDB.QueryRow(
+			"SELECT COUNT(*) FROM attachments WHERE storage_path = ?", attachment.StoragePath,
+		).Scan(&users)
+		if err != nil {
+			log.Printf("Error checking use of attachment file %s: %v", attachment.StoragePath, err)
+			continue
+		}
+		if users > 0 {
+			continue
+		}
+
+		for _, size := range utils.PostImageSizes {
+			if attachment.Kind != utils.AttachmentKindImage && size.Name != "full" {
+				continue
+			}
+			path := filepath.Join(attachmentDir, filepath.Base(utils.RenditionPath(attachment.StoragePath, size.Name)))
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				log.Printf("Error removing attachment file %s: %v", path, err)
+			}
+		}
+	}
+}
+
+// isLegacyAttachment reports whether an attachment was stored in
+// attachmentDir before the blob store; blob keys always contain a slash
+func isLegacyAttachment(storagePath string) bool {
+	return !strings.Contains(storagePath, "/")
+}
+
+// attachPostAttachments loads the attachments of every post in a listing
+// @param posts - The posts to attach to, changed in place
+func attachPostAttachments(posts []utils.Post) {
+	if len(posts) == 0 {
+		return
+	}
+
+	postIDs := make([]int64, len(posts))
+	for i, post := range posts {
+		postIDs[i] = post.ID
+	}
+	byPost, err := utils.GetPostAttachments(utils.GlobalDB, postIDs)
+	if err != nil {
+		log.Printf("Error loading attachments: %v", err)
+		return
+	}
+	for i := range posts {
+		posts[i].Attachments = byPost[posts[i].ID]
+	}
+}
+
+// ownPostForAttachments checks that the current user wrote a post
+// @returns int - The HTTP status to respond with when an error is returned
+// @returns error - A client-facing error if the post is missing or not the user's
+func ownPostForAttachments(postID int64, userID string) (int, error) {
+	var ownerID string
+	err := utils.GlobalDB.QueryRow("SELECT user_id FROM posts WHERE id = ?", postID).Scan(&ownerID)
+	if err == sql.ErrNoRows {
+		return http.StatusNotFound, fmt.Errorf("Post not found")
+	} else if err != nil {
+		log.Printf("Error loading post %d: %v", postID, err)
+		return http.StatusInternalServerError, fmt.Errorf("Database error")
+	}
+	if ownerID != userID {
+		return http.StatusForbidden, fmt.Errorf("Not authorized to change this post")
+	}
+	return http.StatusOK, nil
+}
+
+// handleAttachmentUpload adds attachments to an existing post
+// Accepts multipart POST requests to /api/attachments/upload with post_id and
+// attachments[] files; the files are appended to the end of the gallery
+func (ah *APIHandler) handleAttachmentUpload(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	userID := r.Context().Value("userID").(string)
+
+	if err := r.ParseMultipartForm(20 << 20); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error parsing form: " + err.Error()})
+		return
+	}
+
+	postID, err := strconv.ParseInt(r.FormValue("post_id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid post ID"})
+		return
+	}
+	if status, err := ownPostForAttachments(postID, userID); err != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if len(attachmentFiles(r)) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No files uploaded"})
+		return
+	}
+
+	var existing int
+	if err := utils.GlobalDB.QueryRow("SELECT COUNT(*) FROM attachments WHERE post_id = ?", postID).Scan(&existing); err != nil {
+		log.Printf("Error counting attachments of post %d: %v", postID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Database error"})
+		return
+	}
+
+	attachments, status, err := processPostAttachments(r, existing)
+	if err != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	tx, err := utils.GlobalDB.Begin()
+	if err != nil {
+		removeAttachmentFiles(attachments)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	if err := saveAttachments(tx, postID, attachments); err != nil {
+		log.Printf("Error saving attachments of post %d: %v", postID, err)
+		removeAttachmentFiles(attachments)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save attachments"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing attachments of post %d: %v", postID, err)
+		removeAttachmentFiles(attachments)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save attachments"})
+		return
+	}
+
+	byPost, err := utils.GetPostAttachments(utils.GlobalDB, []int64{postID})
+	if err != nil {
+		log.Printf("Error loading attachments of post %d: %v", postID, err)
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"attachments": byPost[postID],
+	})
+}
+
+// handleAttachmentChange deletes or reorders a post's attachments
+// Accepts POST requests to /api/attachments/delete with {id} and
+// /api/attachments/reorder with {post_id, attachment_ids}, where
+// attachment_ids lists every attachment of the post in the new order
+func (ah *APIHandler) handleAttachmentChange(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	userID := r.Context().Value("userID").(string)
+
+	var req struct {
+		ID            int64   `json:"id"`
+		PostID        int64   `json:"post_id"`
+		AttachmentIDs []int64 `json:"attachment_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+		return
+	}
+
+	if r.URL.Path == "/api/attachments/delete" {
+		attachment, err := utils.GetAttachment(utils.GlobalDB, req.ID)
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Attachment not found"})
+			return
+		} else if err != nil {
+			log.Printf("Error loading attachment %d: %v", req.ID, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Database error"})
+			return
+		}
+		if status, err := ownPostForAttachments(attachment.PostID, userID); err != nil {
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+
+		if _, err := utils.GlobalDB.Exec("DELETE FROM attachments WHERE id = ?", req.ID); err != nil {
+			log.Printf("Error deleting attachment %d: %v", req.ID, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to delete attachment"})
+			return
+		}
+		removeAttachmentFiles([]utils.Attachment{*attachment})
+
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+		return
+	}
+
+	if status, err := ownPostForAttachments(req.PostID, userID); err != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if err := utils.ReorderAttachments(utils.GlobalDB, req.PostID, req.AttachmentIDs); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	byPost, err := utils.GetPostAttachments(utils.GlobalDB, []int64{req.PostID})
+	if err != nil {
+		log.Printf("Error loading attachments of post %d: %v", req.PostID, err)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"attachments": byPost[req.PostID],
+	})
+}
+
+// handleAttachmentFile serves the content of an attachment
+// GET /api/attachments/view?id={id} shows images inline; every other file,
+// and any file requested through /api/attachments/download?id={id}, is sent
+// as a download under its original name. Attachments of drafts and scheduled
+// posts are only served to their author.
+func (ah *APIHandler) handleAttachmentFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid attachment ID", http.StatusBadRequest)
+		return
+	}
+
+	attachment, err := utils.GetAttachment(utils.GlobalDB, id)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Error loading attachment %d: %v", id, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	var ownerID, status string
+	err = utils.GlobalDB.QueryRow("SELECT user_id, status FROM posts WHERE id = ?", attachment.PostID).Scan(&ownerID, &status)
+	if err != nil || (status != utils.PostStatusPublished && viewerID(r) != ownerID) {
+		http.NotFound(w, r)
+		return
+	}
+
+	inline := r.URL.Path == "/api/attachments/view" && attachment.Kind == utils.AttachmentKindImage
+	serveAttachment(w, r, attachment, inline)
+}
+
+// serveAttachment streams a stored attachment after access has been checked
+// Images may be requested in a smaller rendition with size=thumb or
+// size=feed. Responses are private, as attachments may not be public.
+// @param attachment - The attachment to send
+// @param inline - True to show the file in the browser rather than download it
+func serveAttachment(w http.ResponseWriter, r *http.Request, attachment *utils.Attachment, inline bool) {
+	storagePath, etag := attachment.StoragePath, attachment.Checksum
+	if size := r.URL.Query().Get("size"); size != "" && size != "full" && attachment.Kind == utils.AttachmentKindImage {
+		for _, s := range utils.PostImageSizes {
+			if s.Name == size {
+				storagePath, etag = utils.RenditionPath(attachment.StoragePath, size), attachment.Checksum+"-"+size
+			}
+		}
+	}
+
+	var content io.ReadCloser
+	var size int64
+	var err error
+	if isLegacyAttachment(storagePath) {
+		var file *os.File
+		file, err = os.Open(filepath.Join(attachmentDir, filepath.Base(storagePath)))
+		if err == nil {
+			content = file
+			if stat, statErr := file.Stat(); statErr == nil {
+				size = stat.Size()
+			}
+		}
+	} else {
+		var info utils.BlobInfo
+		content, info, err = utils.Blobs.Open(r.Context(), storagePath)
+		size = info.Size
+	}
+	if err != nil {
+		log.Printf("Error opening attachment %s: %v", storagePath, err)
+		http.NotFound(w, r)
+		return
+	}
+	defer content.Close()
+
+	disposition := "attachment"
+	if inline {
+		disposition = "inline"
+	}
+
+	w.Header().Set("Content-Type", attachment.ContentType)
+	if value := mime.FormatMediaType(disposition, map[string]string{"filename": attachment.FileName}); value != "" {
+		disposition = value
+	}
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", `"`+etag+`"`)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+
+	// Local files support range requests; remote blobs are streamed whole
+	if seeker, ok := content.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, attachment.FileName, time.Time{}, seeker)
+		return
+	}
+	if match := r.Header.Get("If-None-Match"); match == `"`+etag+`"` {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	if r.Method == http.MethodGet {
+		io.Copy(w, content)
+	}
+}
@@ -0,0 +1,254 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"forum/utils"
+)
+
+// BlockedUser is an entry in the current user's block or mute list
+type BlockedUser struct {
+	ID         string `json:"id"`
+	Nickname   string `json:"nickname"`
+	ProfilePic string `json:"profilePic"`
+}
+
+// handleBlockChange blocks, unblocks, mutes or unmutes a user
+// Accepts POST requests to /api/users/block, /api/users/unblock, /api/users/mute
+// and /api/users/unmute with {user_id}. Blocking replaces a mute and removes
+// follows in both directions; muting a blocked user leaves the block in place.
+// Neither action is visible to the other user.
+func (ah *APIHandler) handleBlockChange(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	userID := r.Context().Value("userID").(string)
+
+	var req struct {
+		UserID string `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+		return
+	}
+	if req.UserID == userID {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "You cannot block or mute yourself"})
+		return
+	}
+
+	var exists bool
+	err := utils.GlobalDB.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)", req.UserID).Scan(&exists)
+	if err != nil {
+		log.Printf("Error checking user %s: %v", req.UserID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update block"})
+		return
+	}
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
+		return
+	}
+
+	switch r.URL.Path {
+	case "/api/users/block":
+		err = blockUser(userID, req.UserID)
+	case "/api/users/mute":
+		_, err = utils.GlobalDB.Exec(
+			"INSERT OR IGNORE INTO user_blocks (blocker_id, blocked_id, kind) VALUES (?, ?, ?)",
+			userID, req.UserID, utils.BlockKindMute,
+		)
+	case "/api/users/unblock":
+		_, err = utils.GlobalDB.Exec(
+			"DELETE FROM user_blocks WHERE blocker_id = ? AND blocked_id = ? AND kind = ?",
+			userID, req.UserID, utils.BlockKindBlock,
+		)
+	case "/api/users/unmute":
+		_, err = utils.GlobalDB.Exec(
+			"DELETE FROM user_blocks WHERE blocker_id = ? AND blocked_id = ? AND kind = ?",
+			userID, req.UserID, utils.BlockKindMute,
+		)
+	}
+	if err != nil {
+		log.Printf("Error updating block from %s to %s: %v", userID, req.UserID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update block"})
+		return
+	}
+
+	kind := ""
+	err = utils.GlobalDB.QueryRow(
+		"SELECT kind FROM user_blocks WHERE blocker_id = ? AND blocked_id = ?", userID, req.UserID,
+	).Scan(&kind)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error reading block from %s to %s: %v", userID, req.UserID, err)
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"blocked": kind == utils.BlockKindBlock,
+		"muted":   kind == utils.BlockKindMute,
+	})
+}
+
+// blockUser records a block and removes follows between the two users
+func blockUser(blockerID, blockedID string) error {
+	tx, err := utils.GlobalDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO user_blocks (blocker_id, blocked_id, kind) VALUES (?, ?, ?)
+		ON CONFLICT (blocker_id, blocked_id) DO UPDATE SET kind = excluded.kind
+	`, blockerID, blockedID, utils.BlockKindBlock)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM follows
+		WHERE (follower_id = ? AND followed_id = ?) OR (follower_id = ? AND followed_id = ?)
+	`, blockerID, blockedID, blockedID, blockerID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// handleBlockList returns the users the current user has blocked and muted
+func (ah *APIHandler) handleBlockList(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	userID := r.Context().Value("userID").(string)
+
+	rows, err := utils.GlobalDB.Query(`
+		SELECT b.kind, u.id, u.nickname, u.profile_pic
+		FROM user_blocks b
+		JOIN users u ON u.id = b.blocked_id
+		WHERE b.blocker_id = ?
+		ORDER BY b.created_at DESC
+	`, userID)
+	if err != nil {
+		log.Printf("Error querying blocks for user %s: %v", userID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get blocked users"})
+		return
+	}
+	defer rows.Close()
+
+	blocked := []BlockedUser{}
+	muted := []BlockedUser{}
+	for rows.Next() {
+		var kind string
+		var user BlockedUser
+		var profilePic sql.NullString
+		if err := rows.Scan(&kind, &user.ID, &user.Nickname, &profilePic); err != nil {
+			log.Printf("Error scanning block row: %v", err)
+			continue
+		}
+		user.ProfilePic = profilePic.String
+		if kind == utils.BlockKindBlock {
+			blocked = append(blocked, user)
+		} else {
+			muted = append(muted, user)
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"blocked": blocked,
+		"muted":   muted,
+	})
+}
+
+// viewerID returns the signed-in user for endpoints that also serve guests
+// @returns string - The user ID, or "" for guests and invalid sessions
+func viewerID(r *http.Request) string {
+	if userID, ok := r.Context().Value("userID").(string); ok && userID != "" {
+		return userID
+	}
+	cookie, err := r.Cookie("session_token")
+	if err != nil {
+		return ""
+	}
+	userID, err := utils.ValidateSession(utils.GlobalDB, cookie.Value)
+	if err != nil {
+		return ""
+	}
+	return userID
+}
+
+// hiddenUsers loads the users whose content a viewer has blocked or muted
+// @param viewerID - The signed-in user, or "" for guests
+// @returns map[string]bool - Set of hidden user IDs, empty for guests
+func hiddenUsers(viewerID string) map[string]bool {
+	hidden := map[string]bool{}
+	if viewerID == "" {
+		return hidden
+	}
+
+	rows, err := utils.GlobalDB.Query(utils.HiddenUsersQuery, viewerID)
+	if err != nil {
+		log.Printf("Error loading hidden users for %s: %v", viewerID, err)
+		return hidden
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID string
+		if rows.Scan(&userID) == nil {
+			hidden[userID] = true
+		}
+	}
+	return hidden
+}
+
+// filterHiddenPosts drops posts written by users the viewer has blocked or muted
+func filterHiddenPosts(r *http.Request, posts []utils.Post) []utils.Post {
+	hidden := hiddenUsers(viewerID(r))
+	if len(hidden) == 0 {
+		return posts
+	}
+
+	visible := posts[:0]
+	for _, post := range posts {
+		if !hidden[post.UserID] {
+			visible = append(visible, post)
+		}
+	}
+	return visible
+}
+
+// filterHiddenComments drops comments written by users the viewer has blocked or muted
+func filterHiddenComments(r *http.Request, comments []utils.Comment) []utils.Comment {
+	hidden := hiddenUsers(viewerID(r))
+	if len(hidden) == 0 {
+		return comments
+	}
+
+	visible := comments[:0]
+	for _, comment := range comments {
+		if !hidden[comment.UserID] {
+			visible = append(visible, comment)
+		}
+	}
+	return visible
+}
@@ -0,0 +1,146 @@
+package controllers
+
+import (
+	"net/http"
+	"testing"
+
+	"forum/utils"
+)
+
+func TestAPIHandler_blocks(t *testing.T) {
+	testDB, users := setupForumTestDB(t, "alice", "bob", "carol")
+	alice, bob, carol := users["alice"], users["bob"], users["carol"]
+	target := func(user testUser) string { return `{"user_id":"` + user.ID + `"}` }
+
+	_, err := testDB.Exec(`
+		INSERT INTO posts (id, user_id, title, content, imagepath) VALUES (1, ?, 'By alice', 'content', ''), (2, ?, 'By bob', 'content', '');
+		INSERT INTO follows (follower_id, followed_id) VALUES (?, ?), (?, ?);
+		INSERT INTO reaction (user_id, post_id, like) VALUES (?, 2, 1);
+		INSERT INTO comments (post_id, user_id, content) VALUES (2, ?, 'nice');
+		INSERT INTO bookmarks (user_id, post_id) VALUES (?, 2);
+	`, alice.ID, bob.ID, alice.ID, bob.ID, bob.ID, alice.ID, alice.ID, alice.ID, alice.ID)
+	if err != nil {
+		t.Fatalf("Failed to insert test data: %v", err)
+	}
+
+	// notifications counts the notifications alice received from an actor
+	notifications := func(actor testUser) int {
+		t.Helper()
+		var count int
+		err := testDB.QueryRow(
+			"SELECT COUNT(*) FROM notifications WHERE user_id = ? AND actor_id = ?", alice.ID, actor.ID,
+		).Scan(&count)
+		if err != nil {
+			t.Fatalf("Failed to count notifications: %v", err)
+		}
+		return count
+	}
+	// interact has a user react to and comment on alice's post
+	interact := func(actor testUser) {
+		t.Helper()
+		_, err := testDB.Exec(`
+			INSERT OR REPLACE INTO reaction (user_id, post_id, like) VALUES (?, 1, 1);
+			INSERT INTO comments (post_id, user_id, content) VALUES (1, ?, 'hi');
+		`, actor.ID, actor.ID)
+		if err != nil {
+			t.Fatalf("Failed to interact with post: %v", err)
+		}
+	}
+	// visiblePosts lists the posts alice can see in a listing by title
+	visiblePosts := func(path string) map[string]utils.Post {
+		t.Helper()
+		var posts []utils.Post
+		apiRequest(t, "GET", path, alice.Token, "", &posts)
+		titles := make(map[string]utils.Post)
+		for _, post := range posts {
+			titles[post.Title] = post
+		}
+		return titles
+	}
+	listings := []string{"/api/posts", "/api/posts/liked", "/api/posts/commented"}
+
+	interact(bob)
+	if got := notifications(bob); got != 2 {
+		t.Fatalf("notifications before blocking = %d, want 2", got)
+	}
+
+	var state struct {
+		Blocked bool `json:"blocked"`
+		Muted   bool `json:"muted"`
+	}
+	if code := apiRequest(t, "POST", "/api/users/block", alice.Token, target(alice), nil); code != http.StatusBadRequest {
+		t.Errorf("block self: got status %v want %v", code, http.StatusBadRequest)
+	}
+
+	// Blocking replaces a mute, removes follows and silences the triggers
+	apiRequest(t, "POST", "/api/users/mute", alice.Token, target(bob), &state)
+	if state.Blocked || !state.Muted {
+		t.Errorf("mute: got %+v, want muted", state)
+	}
+	if code := apiRequest(t, "POST", "/api/users/block", alice.Token, target(bob), &state); code != http.StatusOK {
+		t.Fatalf("block: got status %v want %v", code, http.StatusOK)
+	}
+	if !state.Blocked || state.Muted {
+		t.Errorf("block: got %+v, want blocked", state)
+	}
+	var follows int
+	testDB.QueryRow("SELECT COUNT(*) FROM follows").Scan(&follows)
+	if follows != 0 {
+		t.Errorf("%d follows left after blocking, want 0", follows)
+	}
+	interact(bob)
+	if got := notifications(bob); got != 2 {
+		t.Errorf("notifications while blocked = %d, want 2", got)
+	}
+	if blocked, err := utils.IsBlockedEitherWay(testDB, bob.ID, alice.ID); err != nil || !blocked {
+		t.Errorf("IsBlockedEitherWay(bob, alice) = %v, %v, want true", blocked, err)
+	}
+	for _, path := range listings {
+		if _, ok := visiblePosts(path)["By bob"]; ok {
+			t.Errorf("%s: blocked user's post is visible", path)
+		}
+	}
+
+	// Mutes hide content but still notify
+	apiRequest(t, "POST", "/api/users/mute", alice.Token, target(carol), nil)
+	var lists struct {
+		Blocked []BlockedUser `json:"blocked"`
+		Muted   []BlockedUser `json:"muted"`
+	}
+	apiRequest(t, "GET", "/api/users/blocked", alice.Token, "", &lists)
+	if len(lists.Blocked) != 1 || lists.Blocked[0].ID != bob.ID || len(lists.Muted) != 1 || lists.Muted[0].ID != carol.ID {
+		t.Errorf("block list: got %+v, want bob blocked and carol muted", lists)
+	}
+	interact(carol)
+	if got := notifications(carol); got != 2 {
+		t.Errorf("notifications from muted user = %d, want 2", got)
+	}
+	if blocked, _ := utils.IsBlockedEitherWay(testDB, alice.ID, carol.ID); blocked {
+		t.Errorf("mute counted as a block")
+	}
+
+	// Unblocking restores notifications and content
+	apiRequest(t, "POST", "/api/users/unblock", alice.Token, target(bob), &state)
+	if state.Blocked || state.Muted {
+		t.Errorf("unblock: got %+v, want neither", state)
+	}
+	apiRequest(t, "POST", "/api/users/unmute", alice.Token, target(carol), nil)
+	var remaining int
+	testDB.QueryRow("SELECT COUNT(*) FROM user_blocks").Scan(&remaining)
+	if remaining != 0 {
+		t.Errorf("%d blocks left after unblocking and unmuting, want 0", remaining)
+	}
+	interact(bob)
+	if got := notifications(bob); got != 4 {
+		t.Errorf("notifications after unblocking = %d, want 4", got)
+	}
+	for _, path := range listings {
+		if post, ok := visiblePosts(path)["By bob"]; !ok || !post.IsBookmarked {
+			t.Errorf("%s: unblocked user's post is hidden or not flagged as bookmarked", path)
+		}
+	}
+
+	if code := apiRequest(t, "POST", "/api/users/block", alice.Token, `{"user_id":"nobody"}`, nil); code != http.StatusNotFound {
+		t.Errorf("block unknown user: got status %v want %v", code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,548 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"forum/utils"
+)
+
+// maxCollectionNameLength limits collection names
+const maxCollectionNameLength = 50
+
+// handleBookmarkChange bookmarks a post or removes a bookmark
+// Accepts POST requests to /api/bookmarks/add with {post_id, collection_id}
+// and /api/bookmarks/remove with {post_id}. Adding an existing bookmark moves
+// it to the given collection; a collection_id of 0 files it in no collection.
+func (ah *APIHandler) handleBookmarkChange(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	userID := r.Context().Value("userID").(string)
+
+	var req struct {
+		PostID       int64 `json:"post_id"`
+		CollectionID int64 `json:"collection_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+		return
+	}
+
+	if r.URL.Path == "/api/bookmarks/remove" {
+		_, err := utils.GlobalDB.Exec("DELETE FROM bookmarks WHERE user_id = ? AND post_id = ?", userID, req.PostID)
+		if err != nil {
+			log.Printf("Error removing bookmark of post %d for user %s: %v", req.PostID, userID, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to remove bookmark"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "isBookmarked": false})
+		return
+	}
+
+	var exists bool
+	err := utils.GlobalDB.QueryRow("SELECT EXISTS(SELECT 1 FROM posts WHERE id = ? AND status = 'published')", req.PostID).Scan(&exists)
+	if err != nil {
+		log.Printf("Error checking post %d: %v", req.PostID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to add bookmark"})
+		return
+	}
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Post not found"})
+		return
+	}
+
+	var collectionID sql.NullInt64
+	if req.CollectionID != 0 {
+		if _, err := getOwnCollection(userID, req.CollectionID); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Collection not found"})
+			return
+		}
+		collectionID = sql.NullInt64{Int64: req.CollectionID, Valid: true}
+	}
+
+	_, err = utils.GlobalDB.Exec(`
+		INSERT INTO bookmarks (user_id, post_id, collection_id) VALUES (?, ?, ?)
+		ON CONFLICT (user_id, post_id) DO UPDATE SET collection_id = excluded.collection_id
+	`, userID, req.PostID, collectionID)
+	if err != nil {
+		log.Printf("Error bookmarking post %d for user %s: %v", req.PostID, userID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to add bookmark"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "isBookmarked": true})
+}
+
+// handleBookmarks returns a page of the current user's bookmarked posts, most recently saved first
+// Query parameters: collection_id (optional, all bookmarks when omitted), page and limit
+func (ah *APIHandler) handleBookmarks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	userID := r.Context().Value("userID").(string)
+	page, limit, offset := parsePagination(r, 20, 100)
+
+	filter := "b.user_id = ?"
+	args := []interface{}{userID}
+	if value := r.URL.Query().Get("collection_id"); value != "" {
+		collectionID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid collection ID"})
+			return
+		}
+		if _, err := getOwnCollection(userID, collectionID); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Collection not found"})
+			return
+		}
+		filter += " AND b.collection_id = ?"
+		args = append(args, collectionID)
+	}
+
+	posts, err := ah.getBookmarkedPosts(filter, args, limit+1, offset)
+	if err != nil {
+		log.Printf("Error querying bookmarks for user %s: %v", userID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get bookmarks"})
+		return
+	}
+
+	hasMore := len(posts) > limit
+	if hasMore {
+		posts = posts[:limit]
+	}
+	for i := range posts {
+		posts[i].IsBookmarked = true
+	}
+	attachPostMedia(userID, posts)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"posts":   posts,
+		"page":    page,
+		"limit":   limit,
+		"hasMore": hasMore,
+	})
+}
+
+// handleSharedCollection returns a shared collection and a page of its posts
+// Accepts GET requests to /api/collections/shared?token={token}; no sign-in is needed
+func (ah *APIHandler) handleSharedCollection(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Share token is required"})
+		return
+	}
+
+	var collection utils.Collection
+	err := utils.GlobalDB.QueryRow(`
+		SELECT c.id, c.name, u.nickname,
+		       (SELECT COUNT(*) FROM bookmarks WHERE collection_id = c.id)
+		FROM collections c
+		JOIN users u ON u.id = c.user_id
+		WHERE c.share_token = ?
+	`, token).Scan(&collection.ID, &collection.Name, &collection.OwnerName, &collection.BookmarkCount)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Collection not found"})
+		return
+	} else if err != nil {
+		log.Printf("Error querying shared collection: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get collection"})
+		return
+	}
+	collection.Shared = true
+
+	page, limit, offset := parsePagination(r, 20, 100)
+	posts, err := ah.getBookmarkedPosts("b.collection_id = ?", []interface{}{collection.ID}, limit, offset)
+	if err != nil {
+		log.Printf("Error querying posts of collection %d: %v", collection.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get collection"})
+		return
+	}
+
+	hasMore := offset+len(posts) < collection.BookmarkCount
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"collection": collection,
+		"posts":      viewerPosts(r, posts),
+		"page":       page,
+		"limit":      limit,
+		"hasMore":    hasMore,
+	})
+}
+
+// getBookmarkedPosts fetches bookmarked posts matching a filter on the bookmarks table (alias b)
+// @param filter - SQL condition on b, using ? placeholders
+// @param args - Values for the filter placeholders
+// @param limit - Maximum number of posts to return
+// @param offset - Number of posts to skip
+// @returns []utils.Post - The posts, most recently bookmarked first, never nil
+// @returns error - Any database error
+func (ah *APIHandler) getBookmarkedPosts(filter string, args []interface{}, limit, offset int) ([]utils.Post, error) {
+	args = append(args, limit, offset)
+	rows, err := utils.GlobalDB.Query(`
+		SELECT p.id, p.title, p.content, p.imagepath, p.post_at, p.user_id,
+			   u.nickname, u.profile_pic,
+			   (SELECT COUNT(*) FROM reaction WHERE post_id = p.id AND like = 1) as likes,
+			   (SELECT COUNT(*) FROM reaction WHERE post_id = p.id AND like = 0) as dislikes,
+			   (SELECT COUNT(*) FROM comments WHERE post_id = p.id) as comments
+		FROM bookmarks b
+		JOIN posts p ON p.id = b.post_id
+		JOIN users u ON p.user_id = u.id
+		WHERE p.status = 'published' AND `+filter+`
+		ORDER BY b.created_at DESC, p.id DESC
+		LIMIT ? OFFSET ?
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	posts := []utils.Post{}
+	for rows.Next() {
+		var post utils.Post
+		var imagePath, profilePic sql.NullString
+
+		err := rows.Scan(
+			&post.ID, &post.Title, &post.Content, &imagePath, &post.PostTime, &post.UserID,
+			&post.Username, &profilePic, &post.Likes, &post.Dislikes, &post.Comments,
+		)
+		if err != nil {
+			log.Printf("Error scanning post row: %v", err)
+			continue
+		}
+
+		post.ImagePath = imagePath.String
+		post.ProfilePic = profilePic.String
+
+		categories, err := ah.postHandler.getPostCategories(post.ID)
+		if err != nil {
+			log.Printf("Error getting categories for post %d: %v", post.ID, err)
+			categories = []utils.Category{}
+		}
+		post.Categories = categories
+
+		posts = append(posts, post)
+	}
+	renderPostsContent(posts)
+
+	return posts, rows.Err()
+}
+
+// markBookmarkedPosts sets IsBookmarked on the posts the user has bookmarked
+// @param userID - The signed-in user, or "" for guests
+// @param posts - The posts to mark in place
+func markBookmarkedPosts(userID string, posts []utils.Post) {
+	if userID == "" || len(posts) == 0 {
+		return
+	}
+
+	placeholders := make([]string, len(posts))
+	args := []interface{}{userID}
+	index := make(map[int64][]int, len(posts))
+	for i, post := range posts {
+		placeholders[i] = "?"
+		args = append(args, post.ID)
+		index[post.ID] = append(index[post.ID], i)
+	}
+
+	rows, err := utils.GlobalDB.Query(
+		"SELECT post_id FROM bookmarks WHERE user_id = ? AND post_id IN ("+strings.Join(placeholders, ",")+")",
+		args...,
+	)
+	if err != nil {
+		log.Printf("Error loading bookmarks for user %s: %v", userID, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var postID int64
+		if rows.Scan(&postID) == nil {
+			for _, i := range index[postID] {
+				posts[i].IsBookmarked = true
+			}
+		}
+	}
+}
+
+// viewerPosts prepares a post listing for the requesting user
+// Posts by blocked and muted users are dropped, bookmarks are flagged and
+// polls, attachments and image renditions are filled in.
+func viewerPosts(r *http.Request, posts []utils.Post) []utils.Post {
+	posts = filterHiddenPosts(r, posts)
+	markBookmarkedPosts(viewerID(r), posts)
+	attachPostMedia(viewerID(r), posts)
+	return posts
+}
+
+// attachPostMedia fills in the polls, attachments and image renditions of a listing
+// @param userID - The viewer whose poll votes are shown, or "" for guests
+// @param posts - The posts to fill in, changed in place
+func attachPostMedia(userID string, posts []utils.Post) {
+	attachPostPolls(userID, posts)
+	attachPostAttachments(posts)
+	attachPostImages(posts)
+}
+
+// handleCollections lists the current user's collections with their bookmark counts
+func (ah *APIHandler) handleCollections(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	userID := r.Context().Value("userID").(string)
+
+	rows, err := utils.GlobalDB.Query(`
+		SELECT c.id, c.name, COALESCE(c.share_token, ''),
+		       (SELECT COUNT(*) FROM bookmarks WHERE collection_id = c.id)
+		FROM collections c
+		WHERE c.user_id = ?
+		ORDER BY c.name COLLATE NOCASE
+	`, userID)
+	if err != nil {
+		log.Printf("Error querying collections for user %s: %v", userID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get collections"})
+		return
+	}
+	defer rows.Close()
+
+	collections := []utils.Collection{}
+	for rows.Next() {
+		var collection utils.Collection
+		if err := rows.Scan(&collection.ID, &collection.Name, &collection.ShareToken, &collection.BookmarkCount); err != nil {
+			log.Printf("Error scanning collection row: %v", err)
+			continue
+		}
+		collection.Shared = collection.ShareToken != ""
+		collections = append(collections, collection)
+	}
+
+	json.NewEncoder(w).Encode(collections)
+}
+
+// handleCollectionChange creates, updates or deletes a collection
+// Accepts POST requests to:
+// - /api/collections/create with {name, shared}
+// - /api/collections/update with {id, name, shared}; an empty name keeps the current one
+// - /api/collections/delete with {id}; its bookmarks are kept without a collection
+// Sharing a collection gives it a share token; unsharing discards the token
+// so earlier links stop working.
+func (ah *APIHandler) handleCollectionChange(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	userID := r.Context().Value("userID").(string)
+
+	var req struct {
+		ID     int64  `json:"id"`
+		Name   string `json:"name"`
+		Shared bool   `json:"shared"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+		return
+	}
+
+	var collection *utils.Collection
+	var status int
+	var err error
+	switch r.URL.Path {
+	case "/api/collections/create":
+		collection, status, err = createCollection(userID, req.Name, req.Shared)
+	case "/api/collections/update":
+		collection, status, err = updateCollection(userID, req.ID, req.Name, req.Shared)
+	case "/api/collections/delete":
+		status, err = deleteCollection(userID, req.ID)
+	}
+
+	if err != nil {
+		if status == http.StatusInternalServerError {
+			log.Printf("Error changing collection for user %s: %v", userID, err)
+			err = fmt.Errorf("Failed to update collection")
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	response := map[string]interface{}{"success": true}
+	if collection != nil {
+		response["collection"] = collection
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// createCollection adds a collection for a user
+// @returns *utils.Collection - The new collection
+// @returns int - The HTTP status to respond with
+// @returns error - Any error that occurred
+func createCollection(userID, name string, shared bool) (*utils.Collection, int, error) {
+	name, err := validateCollectionName(name)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	var token sql.NullString
+	if shared {
+		token = sql.NullString{String: generateShareToken(), Valid: true}
+	}
+
+	result, err := utils.GlobalDB.Exec(
+		"INSERT INTO collections (user_id, name, share_token) VALUES (?, ?, ?)",
+		userID, name, token,
+	)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			return nil, http.StatusConflict, fmt.Errorf("You already have a collection with this name")
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return &utils.Collection{ID: id, Name: name, Shared: shared, ShareToken: token.String}, http.StatusCreated, nil
+}
+
+// updateCollection renames a collection and changes whether it is shared
+// An existing share token is kept while the collection stays shared
+// @returns *utils.Collection - The updated collection
+// @returns int - The HTTP status to respond with
+// @returns error - Any error that occurred
+func updateCollection(userID string, collectionID int64, name string, shared bool) (*utils.Collection, int, error) {
+	collection, err := getOwnCollection(userID, collectionID)
+	if err == sql.ErrNoRows {
+		return nil, http.StatusNotFound, fmt.Errorf("Collection not found")
+	} else if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	if strings.TrimSpace(name) != "" {
+		if collection.Name, err = validateCollectionName(name); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	}
+
+	if !shared {
+		collection.ShareToken = ""
+	} else if collection.ShareToken == "" {
+		collection.ShareToken = generateShareToken()
+	}
+	collection.Shared = shared
+
+	token := sql.NullString{String: collection.ShareToken, Valid: collection.ShareToken != ""}
+	_, err = utils.GlobalDB.Exec(
+		"UPDATE collections SET name = ?, share_token = ? WHERE id = ? AND user_id = ?",
+		collection.Name, token, collectionID, userID,
+	)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			return nil, http.StatusConflict, fmt.Errorf("You already have a collection with this name")
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return collection, http.StatusOK, nil
+}
+
+// deleteCollection removes a collection; its bookmarks are kept unfiled
+// @returns int - The HTTP status to respond with
+// @returns error - Any error that occurred
+func deleteCollection(userID string, collectionID int64) (int, error) {
+	result, err := utils.GlobalDB.Exec("DELETE FROM collections WHERE id = ? AND user_id = ?", collectionID, userID)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return http.StatusNotFound, fmt.Errorf("Collection not found")
+	}
+	return http.StatusOK, nil
+}
+
+// getOwnCollection loads one of a user's collections
+// @returns *utils.Collection - The collection, with its share token if shared
+// @returns error - sql.ErrNoRows if the user has no such collection
+func getOwnCollection(userID string, collectionID int64) (*utils.Collection, error) {
+	collection := &utils.Collection{}
+	err := utils.GlobalDB.QueryRow(`
+		SELECT id, name, COALESCE(share_token, ''),
+		       (SELECT COUNT(*) FROM bookmarks WHERE collection_id = collections.id)
+		FROM collections
+		WHERE id = ? AND user_id = ?
+	`, collectionID, userID).Scan(&collection.ID, &collection.Name, &collection.ShareToken, &collection.BookmarkCount)
+	if err != nil {
+		return nil, err
+	}
+	collection.Shared = collection.ShareToken != ""
+	return collection, nil
+}
+
+// validateCollectionName trims a collection name and checks its length
+func validateCollectionName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", fmt.Errorf("Collection name is required")
+	}
+	if len([]rune(name)) > maxCollectionNameLength {
+		return "", fmt.Errorf("Collection name must be at most %d characters", maxCollectionNameLength)
+	}
+	return name, nil
+}
+
+// generateShareToken creates an unguessable token for a collection share link
+func generateShareToken() string {
+	b := make([]byte, 18)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -21,6 +21,11 @@ func (ch *CategoryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodGet {
 			ch.handleGetCategories(w, r)
 		} else if r.Method == http.MethodPost {
+			// Only admins may create categories, as with /api/admin/categories/create
+			if !ch.checkAdminStatus(r) {
+				utils.RenderErrorPage(w, http.StatusForbidden, utils.ErrForbidden)
+				return
+			}
 			ch.handleCreateCategory(w, r)
 		} else {
 			utils.RenderErrorPage(w, http.StatusMethodNotAllowed, utils.ErrMethodNotAllowed)
@@ -64,6 +69,20 @@ func (ch *CategoryHandler) checkAuthStatus(r *http.Request) bool {
 	return err == nil
 }
 
+// checkAdminStatus reports whether the request comes from a signed-in admin
+func (ch *CategoryHandler) checkAdminStatus(r *http.Request) bool {
+	cookie, err := r.Cookie("session_token")
+	if err != nil {
+		return false
+	}
+	userID, err := utils.ValidateSession(utils.GlobalDB, cookie.Value)
+	if err != nil {
+		return false
+	}
+	isAdmin, err := utils.IsAdmin(utils.GlobalDB, userID)
+	return err == nil && isAdmin
+}
+
 func (ch *CategoryHandler) getAllUsers() ([]utils.User, error) {
 	rows, err := utils.GlobalDB.Query(`
 		SELECT id, username, profile_pic 
@@ -146,6 +165,7 @@ func (ch *CategoryHandler) handleGetPostsByCategoryName(w http.ResponseWriter, r
 		utils.RenderErrorPage(w, http.StatusInternalServerError, utils.ErrInternalServer)
 		return
 	}
+	posts = viewerPosts(r, posts)
 
 	users, err := ch.getAllUsers()
 	if err != nil {
@@ -195,7 +215,7 @@ func (ch *CategoryHandler) getPostsByCategoryName(categoryName string) ([]utils.
         JOIN post_categories pc ON p.id = pc.post_id
         JOIN users u ON p.user_id = u.id
         JOIN categories c ON pc.category_id = c.id
-        WHERE c.name = ?
+        WHERE c.name = ? AND p.status = 'published'
     `, categoryName)
 	if err != nil {
 		return nil, err
@@ -222,6 +242,7 @@ func (ch *CategoryHandler) getPostsByCategoryName(categoryName string) ([]utils.
 	for _, post := range postMap {
 		posts = append(posts, post)
 	}
+	renderPostsContent(posts)
 
 	return posts, rows.Err()
 }
@@ -6,6 +6,7 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"forum/utils"
 )
@@ -28,7 +29,8 @@ func setupTestDB(t *testing.T) *sql.DB {
 			content TEXT,
 			imagepath TEXT,
 			post_at DATETIME,
-			user_id INTEGER
+			user_id INTEGER,
+			status TEXT NOT NULL DEFAULT 'published'
 		);
 		CREATE TABLE post_categories (
 			post_id INTEGER,
@@ -74,6 +76,133 @@ func TestCategoryHandler_handleCreateCategory(t *testing.T) {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusSeeOther)
 	}
 }
+
+// setupCategoryAPITestDB creates the tables used by the category admin API
+// along with an admin and a regular user, each with a session
+func setupCategoryAPITestDB(t *testing.T) *sql.DB {
+	testDB, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open test db: %v", err)
+	}
+	testDB.SetMaxOpenConns(1)
+
+	_, err = testDB.Exec(`
+		CREATE TABLE users (id TEXT PRIMARY KEY, role TEXT NOT NULL DEFAULT 'user');
+		CREATE TABLE sessions (id TEXT PRIMARY KEY, user_id TEXT, expires_at DATETIME);
+		CREATE TABLE categories (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT UNIQUE NOT NULL,
+			description TEXT NOT NULL DEFAULT '',
+			position INTEGER NOT NULL DEFAULT 0,
+			archived BOOLEAN NOT NULL DEFAULT 0
+		);
+		CREATE TABLE posts (id INTEGER PRIMARY KEY, post_at DATETIME, status TEXT NOT NULL DEFAULT 'published');
+		CREATE TABLE comments (id INTEGER PRIMARY KEY, post_id INTEGER, comment_at DATETIME);
+		CREATE TABLE post_categories (post_id INTEGER, category_id INTEGER, PRIMARY KEY (post_id, category_id));
+		CREATE TABLE subscriptions (user_id TEXT, target_type TEXT, target_id INTEGER, PRIMARY KEY (user_id, target_type, target_id));
+		INSERT INTO users (id, role) VALUES ('admin', 'admin'), ('member', 'user');
+		INSERT INTO categories (name, position) VALUES ('Tech', 0), ('Programming', 1);
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create test tables: %v", err)
+	}
+
+	expires := time.Now().Add(time.Hour)
+	for _, user := range []string{"admin", "member"} {
+		if _, err := testDB.Exec("INSERT INTO sessions (id, user_id, expires_at) VALUES (?, ?, ?)", user+"-session", user, expires); err != nil {
+			t.Fatalf("Failed to create session: %v", err)
+		}
+	}
+
+	return testDB
+}
+
+// categoryAPIRequest sends a JSON POST to the API handler as the given user
+func categoryAPIRequest(t *testing.T, path, userID, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(&http.Cookie{Name: "session_token", Value: userID + "-session"})
+
+	rr := httptest.NewRecorder()
+	NewAPIHandler().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAPIHandler_adminCategories(t *testing.T) {
+	testDB := setupCategoryAPITestDB(t)
+	defer testDB.Close()
+
+	utils.GlobalDB = testDB
+
+	// Regular users cannot manage categories
+	rr := categoryAPIRequest(t, "/api/admin/categories/create", "member", `{"name":"Music"}`)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("create as member: got status %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	rr = categoryAPIRequest(t, "/api/admin/categories/create", "admin", `{"name":"Music","description":"Songs"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create as admin: got status %v want %v: %s", rr.Code, http.StatusCreated, rr.Body.String())
+	}
+
+	// The category form is restricted to admins as well
+	req := httptest.NewRequest("POST", "/categories", strings.NewReader("name=Games"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: "session_token", Value: "member-session"})
+	rr = httptest.NewRecorder()
+	NewCategoryHandler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("form create as member: got status %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	rr = categoryAPIRequest(t, "/api/admin/categories/create", "admin", `{"name":"music"}`)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("duplicate create: got status %v want %v", rr.Code, http.StatusConflict)
+	}
+
+	// Merging re-points posts and removes the source category
+	if _, err := testDB.Exec(`
+		INSERT INTO posts (id, post_at) VALUES (1, '2024-01-01 10:00:00'), (2, '2024-01-02 10:00:00');
+		INSERT INTO post_categories (post_id, category_id) VALUES (1, 1), (2, 1), (2, 2);
+	`); err != nil {
+		t.Fatalf("Failed to insert posts: %v", err)
+	}
+
+	rr = categoryAPIRequest(t, "/api/admin/categories/merge", "admin", `{"source_id":1,"target_id":2}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("merge: got status %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	var links int
+	testDB.QueryRow("SELECT COUNT(*) FROM post_categories WHERE category_id = 2").Scan(&links)
+	if links != 2 {
+		t.Errorf("merge: target has %d posts, want 2", links)
+	}
+
+	categories, err := getCategoryListings()
+	if err != nil {
+		t.Fatalf("getCategoryListings returned error: %v", err)
+	}
+	if len(categories) != 2 || categories[0].Name != "Programming" || categories[0].PostCount != 2 {
+		t.Errorf("unexpected listing after merge: %+v", categories)
+	}
+	if categories[0].LatestActivity != "2024-01-02T10:00:00Z" {
+		t.Errorf("latest activity = %q, want 2024-01-02T10:00:00Z", categories[0].LatestActivity)
+	}
+
+	// Archiving is reflected in the listing and blocks new posts
+	rr = categoryAPIRequest(t, "/api/admin/categories/archive", "admin", `{"id":2,"archived":true}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("archive: got status %v want %v", rr.Code, http.StatusOK)
+	}
+	if _, err := validatePostFields("Title", "Body", []string{"Programming"}, nil); err == nil {
+		t.Errorf("validatePostFields accepted an archived category")
+	}
+	if _, err := validatePostFields("Title", "Body", []string{"Programming"}, map[int64]bool{2: true}); err != nil {
+		t.Errorf("validatePostFields rejected an archived category already on the post: %v", err)
+	}
+}
+
 func TestCategoryHandler_getAllCategories(t *testing.T) {
 	testDB := setupTestDB(t)
 	defer testDB.Close()
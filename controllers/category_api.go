@@ -0,0 +1,404 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"forum/utils"
+)
+
+// maxCategoryNameLength and maxCategoryDescriptionLength bound admin input
+const (
+	maxCategoryNameLength        = 50
+	maxCategoryDescriptionLength = 500
+)
+
+// checkAdmin verifies that the request comes from a signed-in admin
+// Must be called after checkAuth so the user ID is in the request context
+// @returns bool - True if the user is an admin, false if a response was written
+func (ah *APIHandler) checkAdmin(w http.ResponseWriter, r *http.Request) bool {
+	userID := r.Context().Value("userID").(string)
+
+	isAdmin, err := utils.IsAdmin(utils.GlobalDB, userID)
+	if err != nil {
+		log.Printf("Error checking admin role for %s: %v", userID, err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Database error"})
+		return false
+	}
+	if !isAdmin {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Admin access required"})
+		return false
+	}
+	return true
+}
+
+// handleListCategories returns every category in display order with its
+// description, archive state, post count and latest activity
+// Archived categories are included so their posts stay browsable
+func (ah *APIHandler) handleListCategories(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	categories, err := getCategoryListings()
+	if err != nil {
+		log.Printf("Error listing categories: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get categories"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(categories)
+}
+
+// getCategoryListings loads all categories with their counts and latest activity
+// Latest activity is the newest post or comment on a post in the category
+// @returns []utils.CategoryListing - Categories ordered by position, never nil
+// @returns error - Any database error
+func getCategoryListings() ([]utils.CategoryListing, error) {
+	rows, err := utils.GlobalDB.Query(`
+		SELECT c.id, c.name, c.description, c.position, c.archived,
+		       (SELECT COUNT(*) FROM post_categories pc
+		        JOIN posts p ON p.id = pc.post_id
+		        WHERE pc.category_id = c.id AND p.status = 'published') AS post_count,
+		       (SELECT MAX(datetime(p.post_at)) FROM posts p
+		        JOIN post_categories pc ON pc.post_id = p.id
+		        WHERE pc.category_id = c.id AND p.status = 'published') AS latest_post,
+		       (SELECT MAX(datetime(cm.comment_at)) FROM comments cm
+		        JOIN post_categories pc ON pc.post_id = cm.post_id
+		        WHERE pc.category_id = c.id) AS latest_comment
+		FROM categories c
+		ORDER BY c.position ASC, c.id ASC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories := []utils.CategoryListing{}
+	for rows.Next() {
+		var category utils.CategoryListing
+		var latestPost, latestComment sql.NullString
+
+		err := rows.Scan(
+			&category.ID, &category.Name, &category.Description, &category.Position,
+			&category.Archived, &category.PostCount, &latestPost, &latestComment,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		// Both values are UTC "YYYY-MM-DD HH:MM:SS" strings, so they compare as text
+		latest := latestPost.String
+		if latestComment.String > latest {
+			latest = latestComment.String
+		}
+		if t, err := time.Parse("2006-01-02 15:04:05", latest); err == nil {
+			category.LatestActivity = t.UTC().Format(time.RFC3339)
+		}
+
+		categories = append(categories, category)
+	}
+
+	return categories, rows.Err()
+}
+
+// handleAdminCategories routes the admin category actions
+// Routes (all POST with a JSON body, admin only):
+// - /api/admin/categories/create - {name, description}
+// - /api/admin/categories/rename - {id, name}
+// - /api/admin/categories/describe - {id, description}
+// - /api/admin/categories/reorder - {ids}: every category ID in the new order
+// - /api/admin/categories/merge - {source_id, target_id}: moves posts and removes the source
+// - /api/admin/categories/archive - {id, archived}
+func (ah *APIHandler) handleAdminCategories(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	var req struct {
+		ID          int64   `json:"id"`
+		Name        string  `json:"name"`
+		Description string  `json:"description"`
+		IDs         []int64 `json:"ids"`
+		SourceID    int64   `json:"source_id"`
+		TargetID    int64   `json:"target_id"`
+		Archived    bool    `json:"archived"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+		return
+	}
+
+	var status int
+	var err error
+	action := strings.TrimPrefix(r.URL.Path, "/api/admin/categories/")
+
+	switch action {
+	case "create":
+		var id int64
+		id, status, err = createCategory(req.Name, req.Description)
+		req.ID = id
+	case "rename":
+		status, err = renameCategory(req.ID, req.Name)
+	case "describe":
+		status, err = describeCategory(req.ID, req.Description)
+	case "reorder":
+		status, err = reorderCategories(req.IDs)
+	case "merge":
+		status, err = mergeCategories(req.SourceID, req.TargetID)
+		req.ID = req.TargetID
+	case "archive":
+		status, err = archiveCategory(req.ID, req.Archived)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Unknown category action"})
+		return
+	}
+
+	if err != nil {
+		if status == http.StatusInternalServerError {
+			log.Printf("Error in category %s: %v", action, err)
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to " + action + " category"})
+			return
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	categories, err := getCategoryListings()
+	if err != nil {
+		log.Printf("Error listing categories: %v", err)
+		categories = []utils.CategoryListing{}
+	}
+
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"id":         req.ID,
+		"categories": categories,
+	})
+}
+
+// validateCategoryName trims a category name and checks its length
+// @returns string - The trimmed name
+// @returns error - A client-facing error if the name is invalid
+func validateCategoryName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > maxCategoryNameLength {
+		return "", fmt.Errorf("Category name must be between 1 and %d characters", maxCategoryNameLength)
+	}
+	return name, nil
+}
+
+// categoryNameTaken reports whether another category already uses a name
+// Names are compared case-insensitively so "Tech" and "tech" cannot coexist
+func categoryNameTaken(name string, exceptID int64) (bool, error) {
+	var exists bool
+	err := utils.GlobalDB.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM categories WHERE LOWER(name) = LOWER(?) AND id != ?)",
+		name, exceptID,
+	).Scan(&exists)
+	return exists, err
+}
+
+// createCategory adds a new category at the end of the display order
+// @returns int64 - The new category ID
+// @returns int - The HTTP status to respond with
+// @returns error - Any error that occurred
+func createCategory(name, description string) (int64, int, error) {
+	name, err := validateCategoryName(name)
+	if err != nil {
+		return 0, http.StatusBadRequest, err
+	}
+	description = strings.TrimSpace(description)
+	if len(description) > maxCategoryDescriptionLength {
+		return 0, http.StatusBadRequest, fmt.Errorf("Description must be at most %d characters", maxCategoryDescriptionLength)
+	}
+
+	taken, err := categoryNameTaken(name, 0)
+	if err != nil {
+		return 0, http.StatusInternalServerError, err
+	}
+	if taken {
+		return 0, http.StatusConflict, fmt.Errorf("Category already exists: %s", name)
+	}
+
+	result, err := utils.GlobalDB.Exec(`
+		INSERT INTO categories (name, description, position)
+		VALUES (?, ?, (SELECT COALESCE(MAX(position), -1) + 1 FROM categories))
+	`, name, description)
+	if err != nil {
+		return 0, http.StatusInternalServerError, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, http.StatusInternalServerError, err
+	}
+	return id, http.StatusCreated, nil
+}
+
+// renameCategory changes the name of a category
+// @returns int - The HTTP status to respond with
+// @returns error - Any error that occurred
+func renameCategory(id int64, name string) (int, error) {
+	name, err := validateCategoryName(name)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	taken, err := categoryNameTaken(name, id)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if taken {
+		return http.StatusConflict, fmt.Errorf("Category already exists: %s", name)
+	}
+
+	return updateCategory(id, "UPDATE categories SET name = ? WHERE id = ?", name, id)
+}
+
+// describeCategory sets the description of a category
+// @returns int - The HTTP status to respond with
+// @returns error - Any error that occurred
+func describeCategory(id int64, description string) (int, error) {
+	description = strings.TrimSpace(description)
+	if len(description) > maxCategoryDescriptionLength {
+		return http.StatusBadRequest, fmt.Errorf("Description must be at most %d characters", maxCategoryDescriptionLength)
+	}
+	return updateCategory(id, "UPDATE categories SET description = ? WHERE id = ?", description, id)
+}
+
+// archiveCategory archives or restores a category
+// @returns int - The HTTP status to respond with
+// @returns error - Any error that occurred
+func archiveCategory(id int64, archived bool) (int, error) {
+	return updateCategory(id, "UPDATE categories SET archived = ? WHERE id = ?", archived, id)
+}
+
+// updateCategory runs a single-row category update
+// @returns int - 404 if the category does not exist, otherwise 200 or 500
+// @returns error - Any error that occurred
+func updateCategory(id int64, query string, args ...interface{}) (int, error) {
+	result, err := utils.GlobalDB.Exec(query, args...)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return http.StatusNotFound, fmt.Errorf("Category not found: %d", id)
+	}
+	return http.StatusOK, nil
+}
+
+// reorderCategories sets the display order from a complete list of category IDs
+// @param ids - Every category ID, in the new order
+// @returns int - The HTTP status to respond with
+// @returns error - Any error that occurred
+func reorderCategories(ids []int64) (int, error) {
+	var total int
+	if err := utils.GlobalDB.QueryRow("SELECT COUNT(*) FROM categories").Scan(&total); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	seen := make(map[int64]bool)
+	for _, id := range ids {
+		seen[id] = true
+	}
+	if len(ids) != total || len(seen) != total {
+		return http.StatusBadRequest, fmt.Errorf("ids must list every category exactly once")
+	}
+
+	tx, err := utils.GlobalDB.Begin()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer tx.Rollback()
+
+	for position, id := range ids {
+		result, err := tx.Exec("UPDATE categories SET position = ? WHERE id = ?", position, id)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if n, err := result.RowsAffected(); err == nil && n == 0 {
+			return http.StatusBadRequest, fmt.Errorf("Category not found: %d", id)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// mergeCategories moves every post and subscriber from the source category
+// into the target and deletes the source. Posts already in both keep a single link.
+// @param sourceID - The category to merge away
+// @param targetID - The category that receives the posts
+// @returns int - The HTTP status to respond with
+// @returns error - Any error that occurred
+func mergeCategories(sourceID, targetID int64) (int, error) {
+	if sourceID == targetID {
+		return http.StatusBadRequest, fmt.Errorf("Cannot merge a category into itself")
+	}
+
+	var count int
+	err := utils.GlobalDB.QueryRow(
+		"SELECT COUNT(*) FROM categories WHERE id IN (?, ?)", sourceID, targetID,
+	).Scan(&count)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if count != 2 {
+		return http.StatusNotFound, fmt.Errorf("Category not found")
+	}
+
+	tx, err := utils.GlobalDB.Begin()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer tx.Rollback()
+
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{`INSERT OR IGNORE INTO post_categories (post_id, category_id)
+		  SELECT post_id, ? FROM post_categories WHERE category_id = ?`, []interface{}{targetID, sourceID}},
+		{"DELETE FROM post_categories WHERE category_id = ?", []interface{}{sourceID}},
+		{`INSERT OR IGNORE INTO subscriptions (user_id, target_type, target_id)
+		  SELECT user_id, 'category', ? FROM subscriptions WHERE target_type = 'category' AND target_id = ?`, []interface{}{targetID, sourceID}},
+		{"DELETE FROM subscriptions WHERE target_type = 'category' AND target_id = ?", []interface{}{sourceID}},
+		{"DELETE FROM categories WHERE id = ?", []interface{}{sourceID}},
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement.query, statement.args...); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
@@ -0,0 +1,159 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"forum/utils"
+)
+
+// handleChatAttachmentUpload stores images and files to send in chat
+// Accepts multipart POST requests to /api/chat/attachments/upload with
+// attachments[] files. Images are validated like post images before they are
+// processed. The stored attachments are returned with their IDs, which the
+// client sends as attachment_ids with the message; until then only the
+// uploader can load them.
+func (ah *APIHandler) handleChatAttachmentUpload(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	userID := r.Context().Value("userID").(string)
+
+	if err := r.ParseMultipartForm(20 << 20); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error parsing form: " + err.Error()})
+		return
+	}
+	headers := attachmentFiles(r)
+	if len(headers) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No files uploaded"})
+		return
+	}
+	if len(headers) > utils.MaxAttachmentsPerMessage {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": utils.ErrTooManyAttachments.Error()})
+		return
+	}
+
+	// Every file is checked before any is stored, so a rejected upload
+	// leaves nothing behind
+	for _, header := range headers {
+		policy, _, err := utils.AttachmentPolicyFor(header.Filename)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		if policy.Kind != utils.AttachmentKindImage {
+			continue
+		}
+		file, err := header.Open()
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Error reading " + header.Filename})
+			return
+		}
+		err = utils.ValidateImage(file, header)
+		file.Close()
+		if err != nil {
+			log.Printf("Rejected chat image %s from user %s: %v", header.Filename, userID, err)
+			status, message := uploadErrorResponse(err)
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]string{"error": header.Filename + ": " + message})
+			return
+		}
+	}
+
+	attachments := make([]*utils.MessageAttachment, 0, len(headers))
+	for _, header := range headers {
+		stored, status, err := storeAttachment(header, utils.ChatAttachmentKeyPrefix)
+		if err != nil {
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+
+		attachment := &utils.MessageAttachment{
+			UploaderID:  userID,
+			Kind:        stored.Kind,
+			FileName:    stored.FileName,
+			ContentType: stored.ContentType,
+			Size:        stored.Size,
+			Width:       stored.Width,
+			Height:      stored.Height,
+			Checksum:    stored.Checksum,
+			StoragePath: stored.StoragePath,
+		}
+		id, err := utils.CreateMessageAttachment(utils.GlobalDB, attachment)
+		if err == nil {
+			attachment, err = utils.GetMessageAttachment(utils.GlobalDB, id)
+		}
+		if err != nil {
+			log.Printf("Error saving chat attachment %s for user %s: %v", header.Filename, userID, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save attachments"})
+			return
+		}
+		attachments = append(attachments, attachment)
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"attachments": attachments,
+	})
+}
+
+// handleChatAttachmentFile serves the content of a chat attachment
+// GET /api/chat/attachments/view?id={id} shows images inline, optionally as
+// size=thumb or size=feed; /api/chat/attachments/download?id={id} sends any
+// attachment under its original name. Only members of the message's
+// conversation, or the uploader of an unsent attachment, are served; anyone
+// else gets 404.
+func (ah *APIHandler) handleChatAttachmentFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	userID := r.Context().Value("userID").(string)
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid attachment ID", http.StatusBadRequest)
+		return
+	}
+
+	attachment, err := utils.GetMessageAttachment(utils.GlobalDB, id)
+	if errors.Is(err, utils.ErrAttachmentNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Error loading chat attachment %d: %v", id, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !utils.CanViewMessageAttachment(utils.GlobalDB, attachment, userID) {
+		http.NotFound(w, r)
+		return
+	}
+
+	inline := r.URL.Path == "/api/chat/attachments/view" && attachment.Kind == utils.AttachmentKindImage
+	serveAttachment(w, r, &utils.Attachment{
+		Kind:        attachment.Kind,
+		FileName:    attachment.FileName,
+		ContentType: attachment.ContentType,
+		Checksum:    attachment.Checksum,
+		StoragePath: attachment.StoragePath,
+	}, inline)
+}
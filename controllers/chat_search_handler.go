@@ -0,0 +1,115 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"forum/utils"
+)
+
+// chatSearchResult is a message found by a chat search
+type chatSearchResult struct {
+	MessageID      int64  `json:"message_id"`
+	ConversationID int64  `json:"conversation_id"`
+	Sender         string `json:"sender"`
+	Recipient      string `json:"recipient"` // Empty for group messages
+	Timestamp      string `json:"timestamp"`
+	Edited         bool   `json:"edited,omitempty"`
+	Snippet        string `json:"snippet"` // Escaped HTML with the matches in <mark>
+}
+
+// handleChatSearch searches the messages of the current user's conversations
+// Accepts GET requests to /api/chat/search with:
+//   - q: the words to look for; the last one also matches as a prefix
+//   - conversation: a conversation ID, or with: a user ID, to search one
+//     conversation; without either every conversation is searched
+//   - before: the next_before of the previous page
+//   - limit: page size (default 20, max 50)
+//
+// Results are newest first. Open a result with the chat history's around
+// parameter.
+func (ah *APIHandler) handleChatSearch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	userID := r.Context().Value("userID").(string)
+	query := r.URL.Query()
+	_, limit, _ := parsePagination(r, 20, 50)
+
+	var conversationID, beforeID int64
+	var err error
+	if value := query.Get("conversation"); value != "" {
+		conversationID, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || !utils.IsConversationMember(utils.GlobalDB, conversationID, userID) {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Conversation not found"})
+			return
+		}
+	} else if with := query.Get("with"); with != "" {
+		err = utils.GlobalDB.QueryRow(
+			"SELECT id FROM conversations WHERE direct_key = ?", utils.DirectConversationKey(userID, with),
+		).Scan(&conversationID)
+		if err == sql.ErrNoRows {
+			// No messages were ever exchanged, so nothing can match
+			json.NewEncoder(w).Encode(map[string]interface{}{"results": []chatSearchResult{}, "next_before": 0})
+			return
+		} else if err != nil {
+			log.Printf("Error loading conversation with %s for user %s: %v", with, userID, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to search messages"})
+			return
+		}
+	}
+	if value := query.Get("before"); value != "" {
+		if beforeID, err = strconv.ParseInt(value, 10, 64); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid before"})
+			return
+		}
+	}
+
+	found, err := utils.SearchMessages(utils.GlobalDB, userID, query.Get("q"), conversationID, beforeID, limit+1)
+	if errors.Is(err, utils.ErrEmptySearch) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	} else if err != nil {
+		log.Printf("Error searching messages for user %s: %v", userID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to search messages"})
+		return
+	}
+
+	var nextBefore int64
+	if len(found) > limit {
+		found = found[:limit]
+		nextBefore = found[limit-1].ID
+	}
+	results := make([]chatSearchResult, len(found))
+	for i, result := range found {
+		results[i] = chatSearchResult{
+			MessageID:      result.ID,
+			ConversationID: result.ConversationID,
+			Sender:         result.SenderID,
+			Recipient:      result.ReceiverID,
+			Timestamp:      result.SentAt.UTC().Format(time.RFC3339),
+			Edited:         !result.EditedAt.IsZero(),
+			Snippet:        result.Snippet,
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"results":     results,
+		"next_before": nextBefore,
+	})
+}
@@ -0,0 +1,250 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	handlers "forum/authentication"
+	"forum/utils"
+)
+
+// conversationEvent is pushed when a group changes
+// It goes to the group's topic and to the user topics of the users who
+// joined or left, who are not subscribed to the group.
+type conversationEvent struct {
+	Event        string              `json:"event"` // created, invited, left, kicked, role or renamed
+	ActorID      string              `json:"actor_id"`
+	UserIDs      []string            `json:"user_ids,omitempty"`
+	Conversation *utils.Conversation `json:"conversation"`
+}
+
+// conversationErrorStatus maps conversation errors to HTTP statuses
+// Users who are not members get 404, so groups stay private.
+func conversationErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, utils.ErrConversationNotFound), errors.Is(err, utils.ErrNotConversationMember):
+		return http.StatusNotFound
+	case errors.Is(err, utils.ErrConversationPermission):
+		return http.StatusForbidden
+	case errors.Is(err, utils.ErrConversationFull):
+		return http.StatusConflict
+	case errors.Is(err, utils.ErrNotGroupConversation), errors.Is(err, utils.ErrInvalidConversationTitle),
+		errors.Is(err, utils.ErrInvalidConversationRole):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// handleGroupConversation returns a group and its members
+// Accepts GET requests to /api/conversations/group?id=, for members only.
+func (ah *APIHandler) handleGroupConversation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	userID := r.Context().Value("userID").(string)
+	conversationID, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil || !utils.IsGroupMember(utils.GlobalDB, conversationID, userID) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Conversation not found"})
+		return
+	}
+
+	conversation, err := utils.GetConversation(utils.GlobalDB, conversationID)
+	if err != nil {
+		log.Printf("Error loading conversation %d: %v", conversationID, err)
+		w.WriteHeader(conversationErrorStatus(err))
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get conversation"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"conversation": conversation})
+}
+
+// handleListConversations returns the current user's conversation list
+// Accepts GET requests to /api/conversations with:
+//   - before: the next_before of the previous page
+//   - limit: page size (default 30, max 50)
+//
+// Conversations are most recently active first, each with its last message,
+// unread count and, for direct conversations, the other participant's
+// presence. Changes are pushed over the WebSocket as conversation_summary.
+func (ah *APIHandler) handleListConversations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	userID := r.Context().Value("userID").(string)
+	_, limit, _ := parsePagination(r, 30, 50)
+
+	var beforeID int64
+	if value := r.URL.Query().Get("before"); value != "" {
+		var err error
+		if beforeID, err = strconv.ParseInt(value, 10, 64); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid before"})
+			return
+		}
+	}
+
+	conversations, err := utils.ListConversations(utils.GlobalDB, userID, beforeID, limit+1)
+	if err != nil {
+		log.Printf("Error listing conversations for user %s: %v", userID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get conversations"})
+		return
+	}
+
+	var nextBefore int64
+	if len(conversations) > limit {
+		conversations = conversations[:limit]
+		nextBefore = conversations[limit-1].ID
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"conversations": conversations,
+		"next_before":   nextBefore,
+	})
+}
+
+// handleConversationChange creates a group or changes its members, roles or title
+// Accepts POST requests to:
+//   - /api/conversations/create with {title, user_ids}
+//   - /api/conversations/invite with {conversation_id, user_ids}
+//   - /api/conversations/leave with {conversation_id}
+//   - /api/conversations/kick with {conversation_id, user_id}
+//   - /api/conversations/role with {conversation_id, user_id, role}
+//   - /api/conversations/rename with {conversation_id, title}
+//
+// Owners and admins invite and rename; see utils.RemoveConversationMember
+// for who may kick whom. Every change is pushed as a conversation_update.
+func (ah *APIHandler) handleConversationChange(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	userID := r.Context().Value("userID").(string)
+
+	var req struct {
+		ConversationID int64    `json:"conversation_id"`
+		Title          string   `json:"title"`
+		UserIDs        []string `json:"user_ids"`
+		UserID         string   `json:"user_id"`
+		Role           string   `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+		return
+	}
+
+	event := conversationEvent{ActorID: userID}
+	var err error
+	switch r.URL.Path {
+	case "/api/conversations/create":
+		event.Event = "created"
+		req.ConversationID, err = utils.CreateGroupConversation(utils.GlobalDB, userID, req.Title, req.UserIDs)
+	case "/api/conversations/invite":
+		event.Event = "invited"
+		event.UserIDs, err = utils.AddConversationMembers(utils.GlobalDB, req.ConversationID, userID, req.UserIDs)
+	case "/api/conversations/leave":
+		event.Event = "left"
+		event.UserIDs = []string{userID}
+		err = utils.RemoveConversationMember(utils.GlobalDB, req.ConversationID, userID, userID)
+	case "/api/conversations/kick":
+		event.Event = "kicked"
+		event.UserIDs = []string{req.UserID}
+		err = utils.RemoveConversationMember(utils.GlobalDB, req.ConversationID, userID, req.UserID)
+	case "/api/conversations/role":
+		event.Event = "role"
+		event.UserIDs = []string{req.UserID}
+		err = utils.SetConversationMemberRole(utils.GlobalDB, req.ConversationID, userID, req.UserID, req.Role)
+	case "/api/conversations/rename":
+		event.Event = "renamed"
+		_, err = utils.RenameConversation(utils.GlobalDB, req.ConversationID, userID, req.Title)
+	}
+	if err != nil {
+		status := conversationErrorStatus(err)
+		message := err.Error()
+		if status == http.StatusInternalServerError {
+			log.Printf("Error changing conversation %d for user %s: %v", req.ConversationID, userID, err)
+			message = "Failed to update conversation"
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": message})
+		return
+	}
+
+	event.Conversation, err = utils.GetConversation(utils.GlobalDB, req.ConversationID)
+	if err != nil {
+		log.Printf("Error loading conversation %d: %v", req.ConversationID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get conversation"})
+		return
+	}
+	publishConversationEvent(event)
+
+	response := map[string]interface{}{"success": true}
+	if event.Event != "left" {
+		response["conversation"] = event.Conversation
+	}
+	if event.Event == "invited" {
+		added := event.UserIDs
+		if added == nil {
+			added = []string{}
+		}
+		response["added"] = added
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// publishConversationEvent pushes a group change to the group and the users it affects
+// Removed members are unsubscribed from the group first, so they only hear
+// the change on their own topic. Members whose conversation list shows the
+// group differently afterwards, such as new members, get its list entry.
+func publishConversationEvent(event conversationEvent) {
+	topic := handlers.GroupTopic(event.Conversation.ID)
+	recipients := event.UserIDs
+	switch event.Event {
+	case "created":
+		recipients = nil
+		for _, member := range event.Conversation.Members {
+			recipients = append(recipients, member.UserID)
+		}
+	case "left", "kicked":
+		for _, userID := range event.UserIDs {
+			handlers.UnsubscribeUser(userID, topic)
+		}
+	case "role":
+		recipients = nil
+	}
+
+	handlers.Publish(topic, "conversation_update", event)
+	for _, userID := range recipients {
+		handlers.Publish(handlers.UserTopic(userID), "conversation_update", event)
+	}
+
+	switch event.Event {
+	case "created", "invited":
+		handlers.PublishConversationSummaries(event.Conversation.ID, recipients...)
+	case "renamed":
+		members := make([]string, len(event.Conversation.Members))
+		for i, member := range event.Conversation.Members {
+			members[i] = member.UserID
+		}
+		handlers.PublishConversationSummaries(event.Conversation.ID, members...)
+	}
+}
@@ -0,0 +1,304 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"forum/utils"
+)
+
+// parsePostSchedule validates the requested status of a post
+// @param status - "draft", "scheduled" or "published"; empty means published
+// @param publishAt - RFC3339 publication time, required when scheduling
+// @param now - The current time; scheduled times must be after it
+// @returns string - The status to store
+// @returns sql.NullTime - The publication time, only valid for scheduled posts
+// @returns error - A client-facing error if the status or time is invalid
+func parsePostSchedule(status, publishAt string, now time.Time) (string, sql.NullTime, error) {
+	switch status {
+	case "", utils.PostStatusPublished:
+		return utils.PostStatusPublished, sql.NullTime{}, nil
+	case utils.PostStatusDraft:
+		return utils.PostStatusDraft, sql.NullTime{}, nil
+	case utils.PostStatusScheduled:
+		if publishAt == "" {
+			return "", sql.NullTime{}, fmt.Errorf("publish_at is required to schedule a post")
+		}
+		t, err := time.Parse(time.RFC3339, publishAt)
+		if err != nil {
+			return "", sql.NullTime{}, fmt.Errorf("publish_at must be an RFC3339 time")
+		}
+		if !t.After(now) {
+			return "", sql.NullTime{}, fmt.Errorf("publish_at must be in the future")
+		}
+		return utils.PostStatusScheduled, sql.NullTime{Time: t.UTC(), Valid: true}, nil
+	default:
+		return "", sql.NullTime{}, fmt.Errorf("status must be 'draft', 'scheduled' or 'published'")
+	}
+}
+
+// isPublishedPost reports whether a post exists and is published
+func isPublishedPost(postID int64) bool {
+	var published bool
+	err := utils.GlobalDB.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM posts WHERE id = ? AND status = ?)", postID, utils.PostStatusPublished,
+	).Scan(&published)
+	if err != nil {
+		log.Printf("Error checking post %d: %v", postID, err)
+		return false
+	}
+	return published
+}
+
+// handleDrafts lists the current user's drafts and scheduled posts
+// Scheduled posts come first in publication order, then drafts by last save
+func (ah *APIHandler) handleDrafts(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	userID := r.Context().Value("userID").(string)
+
+	rows, err := utils.GlobalDB.Query(`
+		SELECT p.id, p.title, p.content, p.imagepath, p.post_at, p.user_id,
+			   u.nickname, u.profile_pic, p.status, p.publish_at
+		FROM posts p
+		JOIN users u ON p.user_id = u.id
+		WHERE p.user_id = ? AND p.status IN (?, ?)
+		ORDER BY p.status = ? DESC, p.publish_at ASC, p.post_at DESC
+	`, userID, utils.PostStatusDraft, utils.PostStatusScheduled, utils.PostStatusScheduled)
+	if err != nil {
+		log.Printf("Error querying drafts for user %s: %v", userID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get drafts"})
+		return
+	}
+	defer rows.Close()
+
+	posts := []utils.Post{}
+	for rows.Next() {
+		var post utils.Post
+		var imagePath, profilePic sql.NullString
+		var savedAt time.Time
+		var publishAt sql.NullTime
+
+		err := rows.Scan(
+			&post.ID, &post.Title, &post.Content, &imagePath, &savedAt, &post.UserID,
+			&post.Username, &profilePic, &post.Status, &publishAt,
+		)
+		if err != nil {
+			log.Printf("Error scanning draft row: %v", err)
+			continue
+		}
+
+		post.ImagePath = imagePath.String
+		post.ProfilePic = profilePic.String
+		post.PostTime = FormatTimeAgo(savedAt)
+		if publishAt.Valid {
+			post.PublishAt = publishAt.Time.Format(time.RFC3339)
+		}
+
+		categories, err := ah.postHandler.getPostCategories(post.ID)
+		if err != nil {
+			log.Printf("Error getting categories for post %d: %v", post.ID, err)
+			categories = []utils.Category{}
+		}
+		post.Categories = categories
+
+		posts = append(posts, post)
+	}
+	renderPostsContent(posts)
+	attachPostMedia(userID, posts)
+
+	json.NewEncoder(w).Encode(posts)
+}
+
+// handleSaveDraft autosaves a draft or scheduled post and changes its status
+// Accepts PATCH requests to /api/posts/draft with {post_id} and any of:
+// - title, content: replace the text
+// - categories, tags: replace the category names or explicit tags
+// - status, publish_at: "draft", "scheduled" with a future publish_at, or "published" to publish now
+// Fields that are left out keep their saved values. Drafts may be incomplete;
+// scheduling or publishing applies the same checks as creating a post.
+// Drafts are created through /api/posts/create with status=draft.
+func (ah *APIHandler) handleSaveDraft(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPatch {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	userID := r.Context().Value("userID").(string)
+
+	var req struct {
+		PostID     int64    `json:"post_id"`
+		Title      *string  `json:"title"`
+		Content    *string  `json:"content"`
+		Categories []string `json:"categories"`
+		Tags       []string `json:"tags"`
+		Status     string   `json:"status"`
+		PublishAt  string   `json:"publish_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+		return
+	}
+
+	var ownerID, title, content, status string
+	var savedPublishAt sql.NullTime
+	err := utils.GlobalDB.QueryRow(
+		"SELECT user_id, title, content, status, publish_at FROM posts WHERE id = ?", req.PostID,
+	).Scan(&ownerID, &title, &content, &status, &savedPublishAt)
+	if err == sql.ErrNoRows || (err == nil && ownerID != userID) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Draft not found"})
+		return
+	} else if err != nil {
+		log.Printf("Error loading draft %d: %v", req.PostID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Database error"})
+		return
+	}
+	if status == utils.PostStatusPublished {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Post is already published"})
+		return
+	}
+
+	if req.Title != nil {
+		title = *req.Title
+	}
+	if req.Content != nil {
+		content = *req.Content
+	}
+
+	// Keep the saved status and time unless the request changes them
+	if req.Status == "" {
+		req.Status = status
+	}
+	if req.PublishAt == "" && savedPublishAt.Valid {
+		req.PublishAt = savedPublishAt.Time.Format(time.RFC3339)
+	}
+	now := time.Now().UTC()
+	newStatus, publishAt, err := parsePostSchedule(req.Status, req.PublishAt, now)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	currentIDs, err := getPostCategoryIDs(req.PostID)
+	if err != nil {
+		log.Printf("Error loading categories for post %d: %v", req.PostID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Database error"})
+		return
+	}
+	categoryCount := len(currentIDs)
+	var categoryIDs []int64
+	if req.Categories != nil {
+		categoryIDs, err = resolveCategoryIDs(req.Categories, currentIDs)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		categoryCount = len(categoryIDs)
+	}
+
+	if newStatus != utils.PostStatusDraft {
+		if err := requirePostFields(title, content, categoryCount); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+	}
+
+	tags, err := parsePostTags(req.Tags)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	tx, err := utils.GlobalDB.Begin()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	// post_at records the last save of a draft, the publication time of a
+	// scheduled post and the time a post went live
+	postTime := now
+	if newStatus == utils.PostStatusScheduled {
+		postTime = publishAt.Time
+	}
+	_, err = tx.Exec(`
+		UPDATE posts SET title = ?, content = ?, status = ?, publish_at = ?, post_at = ?
+		WHERE id = ?
+	`, title, content, newStatus, publishAt, postTime, req.PostID)
+	if err != nil {
+		log.Printf("Error saving draft %d: %v", req.PostID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save draft"})
+		return
+	}
+
+	if req.Categories != nil {
+		if err := setPostCategories(tx, req.PostID, categoryIDs); err != nil {
+			log.Printf("Error updating categories for draft %d: %v", req.PostID, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save draft"})
+			return
+		}
+	}
+
+	if req.Tags == nil {
+		tags, err = utils.GetExplicitPostTags(tx, req.PostID)
+		if err != nil {
+			log.Printf("Error loading tags for draft %d: %v", req.PostID, err)
+		}
+	}
+	if err := utils.SetPostTags(tx, req.PostID, tags, utils.ExtractTags(content)); err != nil {
+		log.Printf("Error updating tags for draft %d: %v", req.PostID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save draft"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing draft %d: %v", req.PostID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save draft"})
+		return
+	}
+
+	if newStatus == utils.PostStatusPublished {
+		log.Printf("Draft %d published by user %s", req.PostID, userID)
+		ah.AnnouncePost(req.PostID, userID)
+	}
+
+	response := map[string]interface{}{
+		"success": true,
+		"postId":  req.PostID,
+		"status":  newStatus,
+		"savedAt": now.Format(time.RFC3339),
+	}
+	if publishAt.Valid {
+		response["publishAt"] = publishAt.Time.Format(time.RFC3339)
+	}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,462 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	handlers "forum/authentication"
+	"forum/utils"
+)
+
+// feedTimeFormat is the UTC timestamp format used in feed cursors
+const feedTimeFormat = "2006-01-02 15:04:05"
+
+// feedCursor marks a position in a ranked feed
+// Scores depend on the current time, so the cursor pins the time the first
+// page was ranked at; later pages use the same clock and skip newer posts.
+type feedCursor struct {
+	AsOf  string  `json:"asOf"`
+	Score float64 `json:"score"`
+	ID    int64   `json:"id"`
+}
+
+// encode serializes the cursor as an opaque URL-safe string
+func (c feedCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeFeedCursor parses a cursor produced by feedCursor.encode
+func decodeFeedCursor(value string) (feedCursor, error) {
+	var cursor feedCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor, fmt.Errorf("invalid cursor")
+	}
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return cursor, fmt.Errorf("invalid cursor")
+	}
+	if _, err := time.Parse(feedTimeFormat, cursor.AsOf); err != nil {
+		return cursor, fmt.Errorf("invalid cursor")
+	}
+	return cursor, nil
+}
+
+// handleFeed returns a page of ranked posts
+// Query parameters:
+// - view: "following" (default) for posts from followed users, categories and tags, or "all"
+// - cursor: the nextCursor of the previous page
+// - limit: page size (default 20, max 50)
+// Posts are ranked by (likes + 2*comments + 1) / (age in hours + 2)^2 so new
+// posts surface quickly and engagement keeps them up for longer.
+func (ah *APIHandler) handleFeed(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	userID := r.Context().Value("userID").(string)
+
+	view := r.URL.Query().Get("view")
+	if view == "" {
+		view = "following"
+	}
+	if view != "following" && view != "all" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "view must be 'following' or 'all'"})
+		return
+	}
+
+	_, limit, _ := parsePagination(r, 20, 50)
+
+	cursor := feedCursor{AsOf: time.Now().UTC().Format(feedTimeFormat)}
+	hasCursor := false
+	if value := r.URL.Query().Get("cursor"); value != "" {
+		var err error
+		cursor, err = decodeFeedCursor(value)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		hasCursor = true
+	}
+
+	posts, scores, err := ah.getFeedPage(userID, view == "following", cursor, hasCursor, limit+1)
+	if err != nil {
+		log.Printf("Error loading feed for user %s: %v", userID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load feed"})
+		return
+	}
+
+	markBookmarkedPosts(userID, posts)
+	attachPostMedia(userID, posts)
+
+	nextCursor := ""
+	if len(posts) > limit {
+		posts = posts[:limit]
+		last := posts[limit-1]
+		nextCursor = feedCursor{AsOf: cursor.AsOf, Score: scores[limit-1], ID: last.ID}.encode()
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"view":       view,
+		"posts":      posts,
+		"nextCursor": nextCursor,
+	})
+}
+
+// getFeedPage loads ranked posts after the cursor position
+// @param userID - The user the feed is for
+// @param following - Only include posts from the user's follows and subscriptions
+// @param cursor - The ranking time and, when hasCursor is set, the last post seen
+// @param hasCursor - Whether to start after the cursor's score and ID
+// @param limit - Maximum number of posts to return
+// @returns []utils.Post - The posts in rank order, never nil
+// @returns []float64 - The score of each returned post
+// @returns error - Any database error
+func (ah *APIHandler) getFeedPage(userID string, following bool, cursor feedCursor, hasCursor bool, limit int) ([]utils.Post, []float64, error) {
+	sourceFilter := ""
+	args := []interface{}{cursor.AsOf, cursor.AsOf, userID}
+	if following {
+		sourceFilter = `
+			AND p.user_id != ?
+			AND (
+				p.user_id IN (SELECT followed_id FROM follows WHERE follower_id = ?)
+				OR EXISTS (
+					SELECT 1 FROM post_categories pc
+					JOIN subscriptions s ON s.target_type = 'category' AND s.target_id = pc.category_id
+					WHERE pc.post_id = p.id AND s.user_id = ?)
+				OR EXISTS (
+					SELECT 1 FROM post_tags pt
+					JOIN subscriptions s ON s.target_type = 'tag' AND s.target_id = pt.tag_id
+					WHERE pt.post_id = p.id AND s.user_id = ?)
+			)`
+		args = append(args, userID, userID, userID, userID)
+	}
+	args = append(args, hasCursor, cursor.Score, cursor.Score, cursor.ID, limit)
+
+	rows, err := utils.GlobalDB.Query(`
+		SELECT id, title, content, imagepath, post_at, user_id, nickname, profile_pic,
+		       likes, dislikes, comments, score
+		FROM (
+			SELECT *, (likes + 2 * comments + 1.0) / ((age_hours + 2) * (age_hours + 2)) AS score
+			FROM (
+				SELECT p.id, p.title, p.content, p.imagepath, p.post_at, p.user_id,
+				       u.nickname, u.profile_pic,
+				       (SELECT COUNT(*) FROM reaction WHERE post_id = p.id AND like = 1) AS likes,
+				       (SELECT COUNT(*) FROM reaction WHERE post_id = p.id AND like = 0) AS dislikes,
+				       (SELECT COUNT(*) FROM comments WHERE post_id = p.id) AS comments,
+				       MAX(0, (julianday(?) - julianday(p.post_at)) * 24) AS age_hours
+				FROM posts p
+				JOIN users u ON p.user_id = u.id
+				WHERE p.status = 'published' AND julianday(p.post_at) <= julianday(?)
+				AND p.user_id NOT IN (`+utils.HiddenUsersQuery+`)`+sourceFilter+`
+			)
+		)
+		WHERE NOT ? OR score < ? OR (score = ? AND id < ?)
+		ORDER BY score DESC, id DESC
+		LIMIT ?
+	`, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	posts := []utils.Post{}
+	var scores []float64
+	for rows.Next() {
+		var post utils.Post
+		var imagePath, profilePic sql.NullString
+		var postTime time.Time
+		var score float64
+
+		err := rows.Scan(
+			&post.ID, &post.Title, &post.Content, &imagePath, &postTime, &post.UserID,
+			&post.Username, &profilePic, &post.Likes, &post.Dislikes, &post.Comments, &score,
+		)
+		if err != nil {
+			log.Printf("Error scanning feed post: %v", err)
+			continue
+		}
+
+		post.ImagePath = imagePath.String
+		post.ProfilePic = profilePic.String
+		post.PostTime = FormatTimeAgo(postTime)
+
+		categories, err := ah.postHandler.getPostCategories(post.ID)
+		if err != nil {
+			log.Printf("Error getting categories for post %d: %v", post.ID, err)
+			categories = []utils.Category{}
+		}
+		post.Categories = categories
+
+		posts = append(posts, post)
+		scores = append(scores, score)
+	}
+	renderPostsContent(posts)
+
+	return posts, scores, rows.Err()
+}
+
+// handleSubscriptions lists what the current user follows
+// Returns the followed categories, tags and users
+func (ah *APIHandler) handleSubscriptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	userID := r.Context().Value("userID").(string)
+
+	categories := []utils.Category{}
+	tags := []utils.Tag{}
+	users := []map[string]string{}
+
+	rows, err := utils.GlobalDB.Query(`
+		SELECT c.id, c.name FROM subscriptions s
+		JOIN categories c ON c.id = s.target_id
+		WHERE s.user_id = ? AND s.target_type = 'category'
+		ORDER BY c.position, c.id
+	`, userID)
+	if err == nil {
+		for rows.Next() {
+			var category utils.Category
+			if rows.Scan(&category.ID, &category.Name) == nil {
+				categories = append(categories, category)
+			}
+		}
+		rows.Close()
+	}
+
+	if err == nil {
+		rows, err = utils.GlobalDB.Query(`
+			SELECT t.id, t.name, t.usage_count FROM subscriptions s
+			JOIN tags t ON t.id = s.target_id
+			WHERE s.user_id = ? AND s.target_type = 'tag'
+			ORDER BY t.name
+		`, userID)
+		if err == nil {
+			tags, err = scanTags(rows)
+			rows.Close()
+		}
+	}
+
+	if err == nil {
+		rows, err = utils.GlobalDB.Query(`
+			SELECT u.id, u.nickname, COALESCE(u.profile_pic, '') FROM follows f
+			JOIN users u ON u.id = f.followed_id
+			WHERE f.follower_id = ?
+			ORDER BY u.nickname
+		`, userID)
+		if err == nil {
+			for rows.Next() {
+				var id, nickname, profilePic string
+				if rows.Scan(&id, &nickname, &profilePic) == nil {
+					users = append(users, map[string]string{"id": id, "nickname": nickname, "profilePic": profilePic})
+				}
+			}
+			rows.Close()
+		}
+	}
+
+	if err != nil {
+		log.Printf("Error loading subscriptions for user %s: %v", userID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load subscriptions"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"categories": categories,
+		"tags":       tags,
+		"users":      users,
+	})
+}
+
+// handleSubscriptionChange follows or unfollows a category, tag or user
+// Accepts POST requests to /api/subscriptions/add and /api/subscriptions/remove
+// with {type: "category", category_id}, {type: "tag", tag} or {type: "user", user_id}
+func (ah *APIHandler) handleSubscriptionChange(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	userID := r.Context().Value("userID").(string)
+	subscribe := r.URL.Path == "/api/subscriptions/add"
+
+	var req struct {
+		Type       string `json:"type"`
+		CategoryID int64  `json:"category_id"`
+		Tag        string `json:"tag"`
+		UserID     string `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+		return
+	}
+
+	var status int
+	var err error
+	switch req.Type {
+	case "category":
+		status, err = setCategorySubscription(userID, req.CategoryID, subscribe)
+	case "tag":
+		status, err = setTagSubscription(userID, req.Tag, subscribe)
+	case "user":
+		status, err = setFollow(userID, req.UserID, subscribe)
+	default:
+		status, err = http.StatusBadRequest, fmt.Errorf("type must be 'category', 'tag' or 'user'")
+	}
+
+	if err != nil {
+		if status == http.StatusInternalServerError {
+			log.Printf("Error updating subscription for user %s: %v", userID, err)
+			err = fmt.Errorf("Failed to update subscription")
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"subscribed": subscribe,
+	})
+}
+
+// setCategorySubscription subscribes a user to a category or removes the subscription
+// @returns int - The HTTP status to respond with
+// @returns error - Any error that occurred
+func setCategorySubscription(userID string, categoryID int64, subscribe bool) (int, error) {
+	var exists bool
+	err := utils.GlobalDB.QueryRow("SELECT EXISTS(SELECT 1 FROM categories WHERE id = ?)", categoryID).Scan(&exists)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !exists {
+		return http.StatusNotFound, fmt.Errorf("Category not found")
+	}
+	return setSubscription(userID, "category", categoryID, subscribe)
+}
+
+// setTagSubscription subscribes a user to a tag or removes the subscription
+// Tags that have not been used yet are created so they can be followed ahead of time
+// @returns int - The HTTP status to respond with
+// @returns error - Any error that occurred
+func setTagSubscription(userID, name string, subscribe bool) (int, error) {
+	tag, err := utils.NormalizeTag(name)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if subscribe {
+		if _, err := utils.GlobalDB.Exec("INSERT OR IGNORE INTO tags (name) VALUES (?)", tag); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+
+	var tagID int64
+	err = utils.GlobalDB.QueryRow("SELECT id FROM tags WHERE name = ?", tag).Scan(&tagID)
+	if err == sql.ErrNoRows {
+		return http.StatusOK, nil
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return setSubscription(userID, "tag", tagID, subscribe)
+}
+
+// setSubscription inserts or deletes a subscriptions row
+func setSubscription(userID, targetType string, targetID int64, subscribe bool) (int, error) {
+	query := "DELETE FROM subscriptions WHERE user_id = ? AND target_type = ? AND target_id = ?"
+	if subscribe {
+		query = "INSERT OR IGNORE INTO subscriptions (user_id, target_type, target_id) VALUES (?, ?, ?)"
+	}
+	if _, err := utils.GlobalDB.Exec(query, userID, targetType, targetID); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// pushPostToSubscribers sends a newly published post over the main WebSocket
+// to every online user who follows its author, one of its categories or one of its tags
+// Users who blocked or muted the author are skipped. Connections watching
+// one of the post's category topics are told the post's ID, which they load
+// through the API so blocks apply there.
+// @param postID - The new post
+// @param authorID - The post author, who is never notified
+func (ah *APIHandler) pushPostToSubscribers(postID int64, authorID string) {
+	rows, err := utils.GlobalDB.Query(`
+		SELECT follower_id FROM follows WHERE followed_id = ?
+		UNION
+		SELECT s.user_id FROM subscriptions s
+		JOIN post_categories pc ON s.target_type = 'category' AND s.target_id = pc.category_id
+		WHERE pc.post_id = ?
+		UNION
+		SELECT s.user_id FROM subscriptions s
+		JOIN post_tags pt ON s.target_type = 'tag' AND s.target_id = pt.tag_id
+		WHERE pt.post_id = ?
+		EXCEPT
+		SELECT blocker_id FROM user_blocks WHERE blocked_id = ?
+	`, authorID, postID, postID, authorID)
+	if err != nil {
+		log.Printf("Error finding subscribers of post %d: %v", postID, err)
+		return
+	}
+
+	var subscribers []string
+	for rows.Next() {
+		var userID string
+		if rows.Scan(&userID) == nil && userID != authorID {
+			subscribers = append(subscribers, userID)
+		}
+	}
+	rows.Close()
+
+	categoryRows, err := utils.GlobalDB.Query("SELECT category_id FROM post_categories WHERE post_id = ?", postID)
+	if err != nil {
+		log.Printf("Error loading categories of post %d: %v", postID, err)
+	} else {
+		for categoryRows.Next() {
+			var categoryID int64
+			if categoryRows.Scan(&categoryID) == nil {
+				handlers.Publish(handlers.CategoryTopic(categoryID), "post_published", map[string]int64{
+					"post_id":     postID,
+					"category_id": categoryID,
+				})
+			}
+		}
+		categoryRows.Close()
+	}
+
+	if len(subscribers) == 0 {
+		return
+	}
+
+	post, _, err := ah.postHandler.getPostByID(postID)
+	if err != nil {
+		log.Printf("Error loading post %d for feed push: %v", postID, err)
+		return
+	}
+
+	message := map[string]interface{}{"post": post}
+	for _, userID := range subscribers {
+		handlers.Publish(handlers.UserTopic(userID), "feed_post", message)
+	}
+}
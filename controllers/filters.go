@@ -27,6 +27,7 @@ func CreatedPosts(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Error fetching posts", http.StatusInternalServerError)
 		return
 	}
+	posts = viewerPosts(r, posts)
 
 	// Fetch all users
 	users, err := getAllUsers()
@@ -56,6 +57,7 @@ func LikedPosts(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Error fetching posts", http.StatusInternalServerError)
 		return
 	}
+	posts = viewerPosts(r, posts)
 
 	// Fetch all users
 	users, err := getAllUsers()
@@ -71,7 +73,7 @@ func LikedPosts(w http.ResponseWriter, r *http.Request) {
 
 func getAllUsers() ([]utils.User, error) {
 	rows, err := utils.GlobalDB.Query(`
-		SELECT id, username, profile_pic, is_online
+		SELECT id, username, profile_pic, ` + utils.VisibleStatusSQL("users") + `
 		FROM users
 		ORDER BY username ASC
 	`)
@@ -83,9 +85,10 @@ func getAllUsers() ([]utils.User, error) {
 	var users []utils.User
 	for rows.Next() {
 		var user utils.User
-		if err := rows.Scan(&user.ID, &user.Nickname, &user.ProfilePic, &user.IsOnline); err != nil {
+		if err := rows.Scan(&user.ID, &user.Nickname, &user.ProfilePic, &user.Status); err != nil {
 			return nil, err
 		}
+		user.IsOnline = user.Status != utils.UserStatusOffline
 		users = append(users, user)
 	}
 
@@ -95,7 +98,7 @@ func getAllUsers() ([]utils.User, error) {
 // getAllUsers fetches all users from the database
 func GetAllUsers(w http.ResponseWriter, r *http.Request) {
 	rows, err := utils.GlobalDB.Query(`
-        SELECT id, username, profile_pic, is_online
+        SELECT id, username, profile_pic, ` + utils.VisibleStatusSQL("users") + `
         FROM users
         ORDER BY username ASC
     `)
@@ -110,6 +113,7 @@ func GetAllUsers(w http.ResponseWriter, r *http.Request) {
 		Username   string `json:"username"`
 		ProfilePic string `json:"profile_pic"`
 		IsOnline   bool   `json:"is_online"`
+		Status     string `json:"status"`
 	}
 
 	for rows.Next() {
@@ -118,11 +122,13 @@ func GetAllUsers(w http.ResponseWriter, r *http.Request) {
 			Username   string `json:"username"`
 			ProfilePic string `json:"profile_pic"`
 			IsOnline   bool   `json:"is_online"`
+			Status     string `json:"status"`
 		}
-		if err := rows.Scan(&user.ID, &user.Username, &user.ProfilePic, &user.IsOnline); err != nil {
+		if err := rows.Scan(&user.ID, &user.Username, &user.ProfilePic, &user.Status); err != nil {
 			http.Error(w, "Failed to parse user data", http.StatusInternalServerError)
 			return
 		}
+		user.IsOnline = user.Status != utils.UserStatusOffline
 		users = append(users, user)
 	}
 
@@ -145,6 +151,7 @@ func CommentedPosts(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Error fetching posts", http.StatusInternalServerError)
 		return
 	}
+	posts = viewerPosts(r, posts)
 
 	users, err := getAllUsers()
 	if err != nil {
@@ -181,7 +188,7 @@ func fetchUserPostsForPosts(userID string) ([]utils.Post, error) {
         JOIN users u ON p.user_id = u.id
         LEFT JOIN post_categories pc ON p.id = pc.post_id
         LEFT JOIN categories c ON pc.category_id = c.id
-        WHERE p.user_id = ?
+        WHERE p.user_id = ? AND p.status = 'published'
         ORDER BY p.post_at DESC
     `, userID)
 	if err != nil {
@@ -252,6 +259,7 @@ func fetchUserPostsForPosts(userID string) ([]utils.Post, error) {
 	for _, post := range postMap {
 		posts = append(posts, post)
 	}
+	renderPostsContent(posts)
 
 	return posts, nil
 }
@@ -265,7 +273,7 @@ func fetchUserPostsForLikes(userID string) ([]utils.Post, error) {
         LEFT JOIN post_categories pc ON p.id = pc.post_id
         LEFT JOIN categories c ON pc.category_id = c.id
         JOIN reaction r ON p.id = r.post_id
-        WHERE r.user_id = ? AND (r.like = 1 OR r.like = 0)
+        WHERE r.user_id = ? AND (r.like = 1 OR r.like = 0) AND p.status = 'published'
         ORDER BY p.post_at DESC
     `, userID)
 	if err != nil {
@@ -319,6 +327,7 @@ func fetchUserPostsForLikes(userID string) ([]utils.Post, error) {
 	for _, post := range postMap {
 		posts = append(posts, post)
 	}
+	renderPostsContent(posts)
 
 	return posts, nil
 }
@@ -332,7 +341,7 @@ func FetchUserPostsForComments(userID string) ([]utils.Post, error) {
 		JOIN comments cm ON p.id = cm.post_id
 		LEFT JOIN post_categories pc ON p.id = pc.post_id
 		LEFT JOIN categories c ON pc.category_id = c.id
-		WHERE cm.user_id = ?
+		WHERE cm.user_id = ? AND p.status = 'published'
 		ORDER BY p.post_at DESC
 	`, userID)
 	if err != nil {
@@ -391,6 +400,7 @@ func FetchUserPostsForComments(userID string) ([]utils.Post, error) {
 	for _, post := range postMap {
 		posts = append(posts, post)
 	}
+	renderPostsContent(posts)
 
 	return posts, nil
 }
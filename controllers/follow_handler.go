@@ -0,0 +1,260 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"forum/utils"
+)
+
+// FollowUser is a user in a followers or following list
+type FollowUser struct {
+	ID         string `json:"id"`
+	Nickname   string `json:"nickname"`
+	ProfilePic string `json:"profilePic"`
+	FollowedAt string `json:"followedAt"`
+	Muted      bool   `json:"muted,omitempty"`
+}
+
+// handleFollowChange follows or unfollows a user
+// Accepts POST requests to /api/users/follow and /api/users/unfollow with {user_id}
+func (ah *APIHandler) handleFollowChange(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	userID := r.Context().Value("userID").(string)
+	follow := r.URL.Path == "/api/users/follow"
+
+	var req struct {
+		UserID string `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+		return
+	}
+
+	status, err := setFollow(userID, req.UserID, follow)
+	if err != nil {
+		if status == http.StatusInternalServerError {
+			log.Printf("Error updating follow from %s to %s: %v", userID, req.UserID, err)
+			err = fmt.Errorf("Failed to update follow")
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	followers, _, err := getFollowCounts(req.UserID)
+	if err != nil {
+		log.Printf("Error counting followers of %s: %v", req.UserID, err)
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":        true,
+		"following":      follow,
+		"follower_count": followers,
+	})
+}
+
+// handleFollowMute mutes or unmutes new_post notifications for a followed user
+// Accepts POST requests to /api/users/follow/mute with {user_id, muted}
+func (ah *APIHandler) handleFollowMute(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	userID := r.Context().Value("userID").(string)
+
+	var req struct {
+		UserID string `json:"user_id"`
+		Muted  bool   `json:"muted"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+		return
+	}
+
+	result, err := utils.GlobalDB.Exec(
+		"UPDATE follows SET muted = ? WHERE follower_id = ? AND followed_id = ?",
+		req.Muted, userID, req.UserID,
+	)
+	if err != nil {
+		log.Printf("Error muting follow from %s to %s: %v", userID, req.UserID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update follow"})
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "You are not following this user"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"muted":   req.Muted,
+	})
+}
+
+// handleFollowList returns a page of a user's followers or of the users they follow
+// Accepts GET requests to /api/users/followers and /api/users/following with
+// id (defaults to the current user), page and limit query parameters
+func (ah *APIHandler) handleFollowList(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	currentUserID := r.Context().Value("userID").(string)
+	userID := r.URL.Query().Get("id")
+	if userID == "" {
+		userID = currentUserID
+	}
+	if err := utils.ValidateUserID(userID); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid user ID format"})
+		return
+	}
+
+	page, limit, offset := parsePagination(r, 20, 100)
+	followers := r.URL.Path == "/api/users/followers"
+
+	// Followers are the follower_id side of rows pointing at the user;
+	// following is the followed_id side of rows the user created
+	listColumn, matchColumn := "follower_id", "followed_id"
+	if !followers {
+		listColumn, matchColumn = "followed_id", "follower_id"
+	}
+
+	rows, err := utils.GlobalDB.Query(`
+		SELECT u.id, u.nickname, u.profile_pic, f.created_at, f.muted
+		FROM follows f
+		JOIN users u ON u.id = f.`+listColumn+`
+		WHERE f.`+matchColumn+` = ?
+		ORDER BY f.created_at DESC, u.nickname ASC
+		LIMIT ? OFFSET ?
+	`, userID, limit, offset)
+	if err != nil {
+		log.Printf("Error querying follows for user %s: %v", userID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get follows"})
+		return
+	}
+	defer rows.Close()
+
+	users := []FollowUser{}
+	for rows.Next() {
+		var user FollowUser
+		var profilePic sql.NullString
+		var followedAt sql.NullTime
+		var muted bool
+		if err := rows.Scan(&user.ID, &user.Nickname, &profilePic, &followedAt, &muted); err != nil {
+			log.Printf("Error scanning follow row: %v", err)
+			continue
+		}
+		user.ProfilePic = profilePic.String
+		if followedAt.Valid {
+			user.FollowedAt = FormatTimeAgo(followedAt.Time)
+		}
+		// Mute settings are private to the follower
+		if !followers && userID == currentUserID {
+			user.Muted = muted
+		}
+		users = append(users, user)
+	}
+
+	followerCount, followingCount, err := getFollowCounts(userID)
+	if err != nil {
+		log.Printf("Error counting follows for user %s: %v", userID, err)
+	}
+	total := followingCount
+	if followers {
+		total = followerCount
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"users":   users,
+		"total":   total,
+		"page":    page,
+		"limit":   limit,
+		"hasMore": offset+len(users) < total,
+	})
+}
+
+// setFollow makes a user follow another user or stop following them
+// @returns int - The HTTP status to respond with
+// @returns error - Any error that occurred
+func setFollow(followerID, followedID string, follow bool) (int, error) {
+	if followedID == followerID {
+		return http.StatusBadRequest, fmt.Errorf("You cannot follow yourself")
+	}
+
+	var exists bool
+	err := utils.GlobalDB.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)", followedID).Scan(&exists)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !exists {
+		return http.StatusNotFound, fmt.Errorf("User not found")
+	}
+
+	// Blocks remove follows in both directions, so they cannot be re-created
+	if follow {
+		blocked, err := utils.IsBlockedEitherWay(utils.GlobalDB, followerID, followedID)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if blocked {
+			return http.StatusForbidden, fmt.Errorf("You cannot follow this user")
+		}
+	}
+
+	query := "DELETE FROM follows WHERE follower_id = ? AND followed_id = ?"
+	if follow {
+		query = "INSERT OR IGNORE INTO follows (follower_id, followed_id) VALUES (?, ?)"
+	}
+	if _, err := utils.GlobalDB.Exec(query, followerID, followedID); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// getFollowCounts counts a user's followers and the users they follow
+// @returns int - Number of followers
+// @returns int - Number of users followed
+// @returns error - Any database error
+func getFollowCounts(userID string) (int, int, error) {
+	var followers, following int
+	err := utils.GlobalDB.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM follows WHERE followed_id = ?),
+			(SELECT COUNT(*) FROM follows WHERE follower_id = ?)
+	`, userID, userID).Scan(&followers, &following)
+	return followers, following, err
+}
+
+// getFollowState reports whether one user follows another and whether that follow is muted
+func getFollowState(followerID, followedID string) (following bool, muted bool) {
+	err := utils.GlobalDB.QueryRow(
+		"SELECT muted FROM follows WHERE follower_id = ? AND followed_id = ?",
+		followerID, followedID,
+	).Scan(&muted)
+	return err == nil, muted
+}
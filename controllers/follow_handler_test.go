@@ -0,0 +1,152 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	handlers "forum/authentication"
+	"forum/utils"
+)
+
+// testUser is a user created by setupForumTestDB
+type testUser struct {
+	ID    string // UUID of the user; the nickname is the map key
+	Token string // Session token
+}
+
+// setupForumTestDB creates the full forum schema in a temporary directory
+// with a signed-in user for each nickname
+func setupForumTestDB(t *testing.T, nicknames ...string) (*sql.DB, map[string]testUser) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The database file is opened relative to the working directory by
+	// every new connection, so the test stays in the temporary directory
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	testDB, err := utils.InitialiseDB()
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() { testDB.Close() })
+	utils.GlobalDB = testDB
+	handlers.GlobalDB = testDB
+
+	users := make(map[string]testUser)
+	for i, nickname := range nicknames {
+		user := testUser{ID: fmt.Sprintf("00000000-0000-4000-8000-%012d", i+1)}
+		_, err := testDB.Exec(
+			"INSERT INTO users (id, nickname, email) VALUES (?, ?, ?)",
+			user.ID, nickname, nickname+"@example.com",
+		)
+		if err != nil {
+			t.Fatalf("Failed to create user %s: %v", nickname, err)
+		}
+		if user.Token, err = utils.CreateSession(testDB, user.ID); err != nil {
+			t.Fatalf("Failed to create session for %s: %v", nickname, err)
+		}
+		users[nickname] = user
+	}
+	return testDB, users
+}
+
+// apiRequest sends a request to the API handler with the given session token
+// and decodes the JSON response into out when it is not nil
+func apiRequest(t *testing.T, method, path, token, body string, out interface{}) int {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(&http.Cookie{Name: "session_token", Value: token})
+
+	rr := httptest.NewRecorder()
+	NewAPIHandler().ServeHTTP(rr, req)
+	if out != nil {
+		if err := json.NewDecoder(rr.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: invalid response: %v", method, path, err)
+		}
+	}
+	return rr.Code
+}
+
+func TestAPIHandler_follows(t *testing.T) {
+	_, users := setupForumTestDB(t, "alice", "bob", "carol")
+	alice, bob, carol := users["alice"], users["bob"], users["carol"]
+	target := func(user testUser) string { return `{"user_id":"` + user.ID + `"}` }
+
+	var followed struct {
+		Following     bool `json:"following"`
+		FollowerCount int  `json:"follower_count"`
+	}
+	if code := apiRequest(t, "POST", "/api/users/follow", alice.Token, target(bob), &followed); code != http.StatusOK {
+		t.Fatalf("follow: got status %v want %v", code, http.StatusOK)
+	}
+	if !followed.Following || followed.FollowerCount != 1 {
+		t.Errorf("follow: got %+v, want following with 1 follower", followed)
+	}
+	if code := apiRequest(t, "POST", "/api/users/follow", alice.Token, target(alice), nil); code != http.StatusBadRequest {
+		t.Errorf("follow self: got status %v want %v", code, http.StatusBadRequest)
+	}
+	if code := apiRequest(t, "POST", "/api/users/follow", alice.Token, `{"user_id":"nobody"}`, nil); code != http.StatusNotFound {
+		t.Errorf("follow unknown user: got status %v want %v", code, http.StatusNotFound)
+	}
+	apiRequest(t, "POST", "/api/users/follow", carol.Token, target(bob), nil)
+
+	var list struct {
+		Users []FollowUser `json:"users"`
+		Total int          `json:"total"`
+	}
+	if code := apiRequest(t, "GET", "/api/users/followers?id="+bob.ID, alice.Token, "", &list); code != http.StatusOK {
+		t.Fatalf("followers: got status %v want %v", code, http.StatusOK)
+	}
+	if list.Total != 2 || len(list.Users) != 2 {
+		t.Errorf("followers of bob: got %+v, want alice and carol", list)
+	}
+
+	// Mutes are stored on the follow and only shown to the follower
+	if code := apiRequest(t, "POST", "/api/users/follow/mute", alice.Token, `{"user_id":"`+bob.ID+`","muted":true}`, nil); code != http.StatusOK {
+		t.Fatalf("mute: got status %v want %v", code, http.StatusOK)
+	}
+	if code := apiRequest(t, "POST", "/api/users/follow/mute", bob.Token, `{"user_id":"`+alice.ID+`","muted":true}`, nil); code != http.StatusNotFound {
+		t.Errorf("mute without following: got status %v want %v", code, http.StatusNotFound)
+	}
+	if following, muted := getFollowState(alice.ID, bob.ID); !following || !muted {
+		t.Errorf("follow state = %v, %v, want following and muted", following, muted)
+	}
+	list.Users = nil
+	apiRequest(t, "GET", "/api/users/following", alice.Token, "", &list)
+	if len(list.Users) != 1 || list.Users[0].ID != bob.ID || !list.Users[0].Muted {
+		t.Errorf("own following list: got %+v, want muted bob", list.Users)
+	}
+	list.Users = nil
+	apiRequest(t, "GET", "/api/users/following?id="+alice.ID, carol.Token, "", &list)
+	if len(list.Users) != 1 || list.Users[0].Muted {
+		t.Errorf("other user's following list: got %+v, want bob without mute", list.Users)
+	}
+
+	if code := apiRequest(t, "POST", "/api/users/unfollow", alice.Token, target(bob), &followed); code != http.StatusOK {
+		t.Fatalf("unfollow: got status %v want %v", code, http.StatusOK)
+	}
+	if followed.Following || followed.FollowerCount != 1 {
+		t.Errorf("unfollow: got %+v, want not following with 1 follower", followed)
+	}
+
+	// Blocks in either direction prevent following
+	apiRequest(t, "POST", "/api/users/block", bob.Token, target(alice), nil)
+	if code := apiRequest(t, "POST", "/api/users/follow", alice.Token, target(bob), nil); code != http.StatusForbidden {
+		t.Errorf("follow blocker: got status %v want %v", code, http.StatusForbidden)
+	}
+	if code := apiRequest(t, "POST", "/api/users/follow", bob.Token, target(alice), nil); code != http.StatusForbidden {
+		t.Errorf("follow blocked user: got status %v want %v", code, http.StatusForbidden)
+	}
+}
@@ -1,14 +1,16 @@
 package controllers
 
 import (
-	"crypto/md5"
-	"fmt"
+	"context"
+	"errors"
 	"io"
 	"log"
+	"mime"
 	"mime/multipart"
+	"net/http"
 	"os"
 	"path/filepath"
-	"time"
+	"strings"
 
 	"forum/utils"
 )
@@ -20,44 +22,164 @@ const (
 
 // ImageHandler handles image upload and processing
 type ImageHandler struct {
-	uploadPath string
+	uploadPath string          // Where images were stored before the blob store, for removing them
+	store      utils.BlobStore // Where new images are stored
 }
 
 func NewImageHandler() *ImageHandler {
-	// Create upload directory if it doesn't exist
-	if err := os.MkdirAll(uploadDir, 0o755); err != nil {
-		log.Printf("Error creating upload directory: %v", err)
-	}
-	return &ImageHandler{uploadPath: uploadDir}
+	return &ImageHandler{uploadPath: uploadDir, store: utils.Blobs}
 }
 
-// ProcessImage handles the image upload process
+// ProcessImage handles the image upload process for post images
+// The image is re-encoded without metadata in every utils.PostImageSizes
+// rendition; the returned path is the full rendition.
 func (ih *ImageHandler) ProcessImage(file multipart.File, header *multipart.FileHeader) (string, error) {
+	return ih.storeRenditions(file, header, utils.PostImageSizes, false)
+}
+
+// ProcessAvatar handles the upload of a profile picture
+// The image is cropped to a centred square and stored in every
+// utils.AvatarSizes rendition; the returned path is the full rendition.
+func (ih *ImageHandler) ProcessAvatar(file multipart.File, header *multipart.FileHeader) (string, error) {
+	return ih.storeRenditions(file, header, utils.AvatarSizes, true)
+}
+
+// storeRenditions validates an uploaded image, renders it in the given sizes
+// and records the renditions
+// @returns string - The public path of the full rendition
+// @returns error - Any validation, processing or storage error
+func (ih *ImageHandler) storeRenditions(file multipart.File, header *multipart.FileHeader, sizes []utils.RenditionSize, square bool) (string, error) {
 	if err := utils.ValidateImage(file, header); err != nil {
 		return "", err
 	}
-	// Generate unique filename
-	ext := filepath.Ext(header.Filename)
-	newFileName := fmt.Sprintf("%x%s", md5.Sum([]byte(time.Now().String())), ext)
 
-	// Create uploads directory if it doesn't exist
-	uploadsDir := "static/uploads"
-	if err := os.MkdirAll(uploadsDir, 0o755); err != nil {
+	data, err := io.ReadAll(io.LimitReader(file, utils.MaxFileSize+1))
+	if err != nil {
+		return "", err
+	}
+	if err := utils.CheckUploadSize(data, utils.MaxFileSize); err != nil {
 		return "", err
 	}
 
-	// Save file
-	filePath := filepath.Join(uploadsDir, newFileName)
-	dst, err := os.Create(filePath)
+	renditions, err := utils.RenderImage(data, sizes, square)
 	if err != nil {
 		return "", err
 	}
-	defer dst.Close()
 
-	if _, err = io.Copy(dst, file); err != nil {
-		os.Remove(filePath)
+	// Content-addressed keys follow the full rendition, so an image uploaded
+	// twice is stored once; the extension follows the re-encoded format
+	var full utils.RenderedImage
+	for _, rendition := range renditions {
+		if rendition.Name == "full" {
+			full = rendition
+		}
+	}
+	key := utils.ContentKey(full.Data, full.Ext)
+	imagePath := utils.MediaURL(key)
+
+	blobs := make([]utils.Blob, 0, len(renditions))
+	blobs = append(blobs, utils.Blob{Key: key, Data: full.Data, ContentType: mime.TypeByExtension(full.Ext)})
+	for _, rendition := range renditions {
+		if rendition.Name != "full" {
+			blobs = append(blobs, utils.Blob{
+				Key:         utils.RenditionPath(key, rendition.Name),
+				Data:        rendition.Data,
+				ContentType: mime.TypeByExtension(rendition.Ext),
+			})
+		}
+	}
+
+	// An image that fails to be saved stays unreferenced and is collected later
+	if _, err := utils.StoreUpload(context.Background(), utils.GlobalDB, ih.store, key, blobs); err != nil {
 		return "", err
 	}
+	if err := utils.SaveImageRenditions(utils.GlobalDB, imagePath, renditions); err != nil {
+		return "", err
+	}
+
+	return imagePath, nil
+}
+
+// uploadErrorResponse maps an image processing error to the response shown to users
+// Rejected uploads get their *utils.UploadError status and message; anything
+// else is an internal error.
+// @param err - The error returned by ProcessImage or ProcessAvatar
+// @returns int - The HTTP status to respond with
+// @returns string - The user-facing message
+func uploadErrorResponse(err error) (int, string) {
+	var uploadErr *utils.UploadError
+	if errors.As(err, &uploadErr) {
+		return uploadErr.Status(), uploadErr.Message()
+	}
+	return http.StatusInternalServerError, "Failed to process image"
+}
 
-	return "/static/uploads/" + newFileName, nil
+// RemoveImage deletes a previously stored upload that is no longer needed
+// Images in the blob store are reference counted and removed by the upload
+// collector once nothing uses them, so only images stored in the upload
+// directory before the blob store are deleted here, and only if no post or
+// profile still uses them. Other paths are ignored so stored values can
+// never be used to delete arbitrary files
+// @param imagePath - The public path returned by ProcessImage
+// @returns error - Any error that occurred while removing the files
+func (ih *ImageHandler) RemoveImage(imagePath string) error {
+	if imagePath == "" || !strings.HasPrefix(imagePath, "/static/uploads/") {
+		return nil
+	}
+
+	fileName := filepath.Base(imagePath)
+	if fileName == "." || fileName == "/" || fileName == ".." {
+		return nil
+	}
+
+	var users int
+	err := utils.GlobalDB.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM posts WHERE imagepath = ?1) + (SELECT COUNT(*) FROM users WHERE profile_pic = ?1)
+	`, imagePath).Scan(&users)
+	if err != nil {
+		return err
+	}
+	if users > 0 {
+		return nil
+	}
+
+	// Remove every rendition, the full one being the image itself; images
+	// stored before processing only have that one
+	var firstErr error
+	for _, sizes := range [][]utils.RenditionSize{utils.PostImageSizes, utils.AvatarSizes} {
+		for _, size := range sizes {
+			renditionName := filepath.Base(utils.RenditionPath(imagePath, size.Name))
+			err := os.Remove(filepath.Join(ih.uploadPath, renditionName))
+			if err != nil && !os.IsNotExist(err) && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if _, err := utils.GlobalDB.Exec("DELETE FROM image_renditions WHERE image_path = ?", imagePath); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+// attachPostImages fills in the renditions of the post images in a listing
+// @param posts - The posts to describe the images of, changed in place
+func attachPostImages(posts []utils.Post) {
+	var paths []string
+	for _, post := range posts {
+		if post.ImagePath != "" {
+			paths = append(paths, post.ImagePath)
+		}
+	}
+	if len(paths) == 0 {
+		return
+	}
+
+	infos, err := utils.GetImageInfo(utils.GlobalDB, paths)
+	if err != nil {
+		log.Printf("Error loading image renditions: %v", err)
+		return
+	}
+	for i := range posts {
+		posts[i].Image = infos[posts[i].ImagePath]
+	}
 }
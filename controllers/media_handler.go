@@ -0,0 +1,89 @@
+package controllers
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"forum/utils"
+)
+
+// signedURLExpiry is how long a redirect to a signed blob URL stays valid
+const signedURLExpiry = 15 * time.Minute
+
+// MediaHandler serves post images and avatars from the blob store
+// Blobs are content addressed, so a URL always names the same bytes and
+// responses can be cached for good.
+type MediaHandler struct {
+	store utils.BlobStore
+}
+
+// NewMediaHandler creates a new media handler for the configured blob store
+func NewMediaHandler() *MediaHandler {
+	return &MediaHandler{store: utils.Blobs}
+}
+
+// ServeHTTP handles HTTP requests for media
+// Routes:
+// - GET /media/{key} - The blob, or a redirect to a signed URL when the store hands them out
+//
+// Chat attachments share the store but are only served to conversation
+// members through /api/chat/attachments, so their keys are not found here.
+func (mh *MediaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key, ok := utils.MediaKey(r.URL.Path)
+	if !ok || strings.HasPrefix(key, utils.ChatAttachmentKeyPrefix) {
+		http.NotFound(w, r)
+		return
+	}
+
+	signedURL, err := mh.store.SignedURL(key, signedURLExpiry)
+	if err != nil {
+		log.Printf("Error signing media URL for %s: %v", key, err)
+	} else if signedURL != "" {
+		w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(int(signedURLExpiry.Seconds()/2)))
+		http.Redirect(w, r, signedURL, http.StatusFound)
+		return
+	}
+
+	etag := `"` + path.Base(key) + `"`
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	content, info, err := mh.store.Open(r.Context(), key)
+	if errors.Is(err, utils.ErrBlobNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Error opening media %s: %v", key, err)
+		http.Error(w, "Failed to load media", http.StatusBadGateway)
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Type", info.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+
+	// Local blobs support range requests; remote blobs are streamed whole
+	if seeker, ok := content.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, key, info.ModTime, seeker)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	if r.Method == http.MethodGet {
+		io.Copy(w, content)
+	}
+}
@@ -0,0 +1,32 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// parsePagination reads the page and limit query parameters
+// Invalid values fall back to the first page and the default limit, and the
+// limit is capped so clients cannot request unbounded pages.
+// @param r - The HTTP request
+// @param defaultLimit - Limit used when none is given
+// @param maxLimit - Largest limit a client may request
+// @returns int - The page number, starting at 1
+// @returns int - The page size
+// @returns int - The row offset for the page
+func parsePagination(r *http.Request, defaultLimit, maxLimit int) (int, int, int) {
+	page := 1
+	limit := defaultLimit
+
+	if p, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && p > 0 {
+		page = p
+	}
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+		limit = l
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+
+	return page, limit, (page - 1) * limit
+}
@@ -0,0 +1,256 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	handlers "forum/authentication"
+	"forum/utils"
+)
+
+// pollRequest is a validated poll submitted with a new post
+type pollRequest struct {
+	question  string
+	options   []string
+	multiple  bool
+	anonymous bool
+	closesAt  sql.NullTime
+}
+
+// parsePostPoll reads the optional poll fields of a post creation form
+// Fields: poll_question, poll_options[], poll_multiple, poll_anonymous and
+// poll_closes_at (RFC3339). A form without a question or options has no poll.
+// @param r - The request with its form already parsed
+// @param opensAt - When the post goes live; the poll must close after it
+// @returns *pollRequest - The poll to create, or nil if none was submitted
+// @returns error - A client-facing error if the poll is invalid
+func parsePostPoll(r *http.Request, opensAt time.Time) (*pollRequest, error) {
+	question := r.FormValue("poll_question")
+	options := r.Form["poll_options[]"]
+	if strings.TrimSpace(question) == "" && len(options) == 0 {
+		return nil, nil
+	}
+
+	question, options, err := utils.ValidatePoll(question, options)
+	if err != nil {
+		return nil, err
+	}
+
+	poll := &pollRequest{
+		question:  question,
+		options:   options,
+		multiple:  isTruthy(r.FormValue("poll_multiple")),
+		anonymous: isTruthy(r.FormValue("poll_anonymous")),
+	}
+
+	if value := r.FormValue("poll_closes_at"); value != "" {
+		closesAt, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, fmt.Errorf("poll_closes_at must be an RFC3339 time")
+		}
+		if !closesAt.After(opensAt) {
+			return nil, fmt.Errorf("poll_closes_at must be after the post is published")
+		}
+		poll.closesAt = sql.NullTime{Time: closesAt.UTC(), Valid: true}
+	}
+
+	return poll, nil
+}
+
+// isTruthy reports whether a form checkbox value is set
+func isTruthy(value string) bool {
+	switch strings.ToLower(value) {
+	case "1", "true", "on", "yes":
+		return true
+	}
+	return false
+}
+
+// handlePoll returns the poll of a post with its results
+// Accepts GET requests to /api/polls?post_id={id}; guests see results without their own votes
+func (ah *APIHandler) handlePoll(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	postID, err := strconv.ParseInt(r.URL.Query().Get("post_id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid post ID"})
+		return
+	}
+	if !isPublishedPost(postID) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Post not found"})
+		return
+	}
+
+	poll, err := utils.GetPostPoll(utils.GlobalDB, postID, viewerID(r))
+	if err != nil {
+		log.Printf("Error loading poll of post %d: %v", postID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get poll"})
+		return
+	}
+	if poll == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Post has no poll"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(poll)
+}
+
+// handlePollVote casts or retracts the current user's vote
+// Accepts POST requests to /api/polls/vote with {poll_id, option_ids}, which
+// replaces any earlier vote, and /api/polls/retract with {poll_id, option_id};
+// an option_id of 0 retracts every vote. The updated results are returned and
+// pushed to all connected clients.
+func (ah *APIHandler) handlePollVote(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	userID := r.Context().Value("userID").(string)
+
+	var req struct {
+		PollID    int64   `json:"poll_id"`
+		OptionIDs []int64 `json:"option_ids"`
+		OptionID  int64   `json:"option_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+		return
+	}
+
+	var postID int64
+	err := utils.GlobalDB.QueryRow("SELECT post_id FROM polls WHERE id = ?", req.PollID).Scan(&postID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error loading poll %d: %v", req.PollID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Database error"})
+		return
+	}
+	if err == sql.ErrNoRows || !isPublishedPost(postID) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Poll not found"})
+		return
+	}
+
+	if r.URL.Path == "/api/polls/retract" {
+		err = utils.RetractVote(utils.GlobalDB, req.PollID, userID, req.OptionID)
+	} else {
+		err = utils.CastVote(utils.GlobalDB, req.PollID, userID, req.OptionIDs)
+	}
+	switch {
+	case err == utils.ErrPollClosed:
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Poll is closed"})
+		return
+	case err == utils.ErrInvalidPollOption:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid poll option"})
+		return
+	case err != nil:
+		log.Printf("Error recording vote of user %s in poll %d: %v", userID, req.PollID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to record vote"})
+		return
+	}
+
+	poll, err := utils.GetPoll(utils.GlobalDB, req.PollID, userID)
+	if err != nil {
+		log.Printf("Error loading poll %d: %v", req.PollID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get poll"})
+		return
+	}
+
+	go broadcastPollResults(req.PollID)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "poll": poll})
+}
+
+// broadcastPollResults pushes a poll's current results to the connections watching its post
+// The results carry no viewer-specific votes; clients keep their own choices.
+func broadcastPollResults(pollID int64) {
+	poll, err := utils.GetPoll(utils.GlobalDB, pollID, "")
+	if err != nil {
+		log.Printf("Error loading poll %d to broadcast: %v", pollID, err)
+		return
+	}
+	handlers.Publish(handlers.PostTopic(poll.PostID), "poll_update", map[string]interface{}{
+		"postId": poll.PostID,
+		"poll":   poll,
+	})
+}
+
+// AnnouncePollClosed notifies a poll's creator that voting has ended and
+// pushes the final results to connected clients
+// Called by the poll closer once a poll's close time has passed.
+// @param poll - The poll that has closed
+func (ah *APIHandler) AnnouncePollClosed(poll utils.ClosedPoll) {
+	handlers.NotifyPollClosed(poll.UserID, poll.PostID)
+	broadcastPollResults(poll.PollID)
+}
+
+// attachPostPolls loads the poll of every post in a listing that has one
+// @param userID - The viewer whose votes fill MyVotes, or "" for guests
+// @param posts - The posts to attach polls to, changed in place
+func attachPostPolls(userID string, posts []utils.Post) {
+	if len(posts) == 0 {
+		return
+	}
+
+	placeholders := make([]string, len(posts))
+	args := make([]interface{}, len(posts))
+	index := make(map[int64][]int, len(posts))
+	for i, post := range posts {
+		placeholders[i] = "?"
+		args[i] = post.ID
+		index[post.ID] = append(index[post.ID], i)
+	}
+
+	rows, err := utils.GlobalDB.Query(
+		"SELECT id FROM polls WHERE post_id IN ("+strings.Join(placeholders, ",")+")",
+		args...,
+	)
+	if err != nil {
+		log.Printf("Error finding polls: %v", err)
+		return
+	}
+	var pollIDs []int64
+	for rows.Next() {
+		var pollID int64
+		if rows.Scan(&pollID) == nil {
+			pollIDs = append(pollIDs, pollID)
+		}
+	}
+	rows.Close()
+
+	for _, pollID := range pollIDs {
+		poll, err := utils.GetPoll(utils.GlobalDB, pollID, userID)
+		if err != nil {
+			log.Printf("Error loading poll %d: %v", pollID, err)
+			continue
+		}
+		for _, i := range index[poll.PostID] {
+			posts[i].Poll = poll
+		}
+	}
+}
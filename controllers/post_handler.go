@@ -238,6 +238,7 @@ func (ph *PostHandler) handleGetPosts(w http.ResponseWriter, r *http.Request) {
 		utils.RenderErrorPage(w, http.StatusInternalServerError, utils.ErrTemplateExec)
 		return
 	}
+	posts = viewerPosts(r, posts)
 
 	users, err := ph.getAllUsers()
 	if err != nil {
@@ -298,6 +299,7 @@ func (ph *PostHandler) getAllPosts() ([]utils.Post, error) {
                u.profile_pic
         FROM posts p
         JOIN users u ON p.user_id = u.id
+        WHERE p.status = 'published'
         ORDER BY p.post_at DESC
     `
 
@@ -346,6 +348,7 @@ func (ph *PostHandler) getAllPosts() ([]utils.Post, error) {
 
 		posts = append(posts, post)
 	}
+	renderPostsContent(posts)
 
 	// If no posts were found, return an empty array rather than nil
 	if posts == nil {
@@ -392,16 +395,11 @@ func (ph *PostHandler) handleCreatePost(w http.ResponseWriter, r *http.Request)
 	if err == nil {
 		defer file.Close()
 
-		// Check file size
-		if header.Size > 20<<20 { // 20 MB
-			data.ErrorMessage = "Image size must be less than 20MB"
-			tmpl.Execute(w, data)
-			return
-		}
-
+		// Size and content are validated while processing
 		imagePath, err = ph.imageHandler.ProcessImage(file, header)
 		if err != nil {
-			data.ErrorMessage = "Error processing image: " + err.Error()
+			log.Printf("Error processing image: %v", err)
+			_, data.ErrorMessage = uploadErrorResponse(err)
 			tmpl.Execute(w, data)
 			return
 		}
@@ -451,6 +449,87 @@ func getCategoryIDByName(name string) (int, error) {
 	return id, nil
 }
 
+// renderPostContent fills in the raw Markdown, rendered HTML, mentions and tags of a post
+func renderPostContent(post *utils.Post) {
+	posts := []utils.Post{*post}
+	renderPostsContent(posts)
+	*post = posts[0]
+}
+
+// renderPostsContent fills in the raw Markdown, rendered HTML, mentions and tags
+// of a page of posts, looking up the mentions and tags of the whole page at once
+func renderPostsContent(posts []utils.Post) {
+	contents := make([]string, len(posts))
+	ids := make([]int64, len(posts))
+	for i := range posts {
+		contents[i] = posts[i].Content
+		ids[i] = posts[i].ID
+	}
+
+	mentions, err := utils.ResolveMentionsBatch(utils.GlobalDB, contents)
+	if err != nil {
+		log.Printf("Error resolving mentions: %v", err)
+	}
+	tags, err := utils.GetPostsTags(utils.GlobalDB, ids)
+	if err != nil {
+		log.Printf("Error getting post tags: %v", err)
+	}
+
+	for i := range posts {
+		post := &posts[i]
+		post.ContentRaw = post.Content
+		post.ContentHTML = utils.RenderContent(post.Content)
+		post.Mentions = []utils.MentionSpan{}
+		if mentions != nil {
+			post.Mentions = mentions[i]
+		}
+		post.Tags = tags[post.ID]
+		if post.Tags == nil {
+			post.Tags = []string{}
+		}
+	}
+}
+
+// renderCommentContent fills in the raw Markdown, rendered HTML and mentions of a comment
+func renderCommentContent(comment *utils.Comment) {
+	comment.ContentRaw = comment.Content
+	comment.ContentHTML = utils.RenderContent(comment.Content)
+	comment.Mentions = contentMentions(comment.Content)
+}
+
+// contentMentions resolves the @mention spans in content, logging lookup failures
+func contentMentions(content string) []utils.MentionSpan {
+	mentions, err := utils.ResolveMentions(utils.GlobalDB, content)
+	if err != nil {
+		log.Printf("Error resolving mentions: %v", err)
+		return []utils.MentionSpan{}
+	}
+	return mentions
+}
+
+// saveContentMentions records the mentions in a post or comment and returns
+// the users that should be notified. Failures are logged rather than failing
+// the request since mentions are secondary to the content itself.
+// @param db - Database or transaction to write to
+// @param sourceType - utils.MentionSourcePost or utils.MentionSourceComment
+// @param sourceID - ID of the post or comment
+// @param actorID - ID of the author
+// @param content - The raw content
+// @returns []string - IDs of newly mentioned users
+func saveContentMentions(db utils.DBExecutor, sourceType string, sourceID int64, actorID, content string) []string {
+	mentions, err := utils.ResolveMentions(db, content)
+	if err != nil {
+		log.Printf("Error resolving mentions for %s %d: %v", sourceType, sourceID, err)
+		return nil
+	}
+	added, err := utils.SaveMentions(db, sourceType, sourceID, actorID, mentions)
+	if err != nil {
+		log.Printf("Error saving mentions for %s %d: %v", sourceType, sourceID, err)
+		return nil
+	}
+	return added
+}
+
 func FormatTimeAgo(t time.Time) string {
 	now := time.Now()
 	diff := now.Sub(t)
@@ -571,6 +650,7 @@ func (ph *PostHandler) getCommentsForPost(postID int64) ([]utils.Comment, error)
 			return nil, err
 		}
 		comment.CommentTime = commentTime
+		renderCommentContent(&comment)
 		comments = append(comments, comment)
 	}
 
@@ -601,6 +681,7 @@ func (ph *PostHandler) getPostByID(postID int64) (*utils.Post, []utils.Comment,
 		return nil, nil, err
 	}
 	post.PostTime = FormatTimeAgo(postTime)
+	renderPostContent(post)
 
 	// Get categories for the post
 	categories, err := ph.getPostCategories(postID)
@@ -1149,7 +1230,7 @@ func (ph *PostHandler) getPostsByCategoryName(categoryName string) ([]utils.Post
         JOIN users u ON p.user_id = u.id
         JOIN post_categories pc ON p.id = pc.post_id
         JOIN categories c ON pc.category_id = c.id
-        WHERE c.name = ?
+        WHERE c.name = ? AND p.status = 'published'
         ORDER BY p.post_at DESC
     `, categoryName)
 	if err != nil {
@@ -1243,6 +1324,7 @@ func (ph *PostHandler) scanPosts(rows *sql.Rows) ([]utils.Post, error) {
 	for _, post := range postMap {
 		posts = append(posts, post)
 	}
+	renderPostsContent(posts)
 	return posts, nil
 }
 
@@ -1278,7 +1360,7 @@ func (ph *PostHandler) getUserProfile(userID string) (*ProfileData, error) {
 	err = utils.GlobalDB.QueryRow(`
         SELECT COUNT(*)
         FROM posts
-        WHERE user_id = ?
+        WHERE user_id = ? AND status = 'published'
     `, userID).Scan(&profile.PostCount)
 	if err != nil {
 		return nil, fmt.Errorf("error getting post count: %v", err)
@@ -362,3 +362,45 @@ func TestGetCategoryIDByName(t *testing.T) {
 		t.Fatalf("Failed to clean up test categories: %v", err)
 	}
 }
+
+func TestParsePostSchedule(t *testing.T) {
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		status     string
+		publishAt  string
+		wantStatus string
+		wantTime   bool
+		wantErr    bool
+	}{
+		{"Default publishes", "", "", utils.PostStatusPublished, false, false},
+		{"Draft", "draft", "2026-05-02T12:00:00Z", utils.PostStatusDraft, false, false},
+		{"Scheduled at current time", "scheduled", "2026-05-01T14:00:00+02:00", "", false, true},
+		{"Scheduled in future", "scheduled", "2026-05-01T15:00:00+02:00", utils.PostStatusScheduled, true, false},
+		{"Scheduled without time", "scheduled", "", "", false, true},
+		{"Scheduled bad time", "scheduled", "tomorrow", "", false, true},
+		{"Unknown status", "archived", "", "", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, publishAt, err := parsePostSchedule(tt.status, tt.publishAt, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePostSchedule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if status != tt.wantStatus {
+				t.Errorf("parsePostSchedule() status = %q, want %q", status, tt.wantStatus)
+			}
+			if publishAt.Valid != tt.wantTime {
+				t.Errorf("parsePostSchedule() publishAt.Valid = %v, want %v", publishAt.Valid, tt.wantTime)
+			}
+			if publishAt.Valid && publishAt.Time.Location() != time.UTC {
+				t.Errorf("parsePostSchedule() publishAt not in UTC: %v", publishAt.Time)
+			}
+		})
+	}
+}
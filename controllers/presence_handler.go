@@ -0,0 +1,61 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	handlers "forum/authentication"
+	"forum/utils"
+)
+
+// handlePresenceStatus returns or sets the status the current user chose
+// Accepts:
+//   - GET /api/presence/status
+//   - POST /api/presence/status with {status, text, emoji, expires_at}
+//
+// status is online, away, dnd or invisible; expires_at, in RFC 3339, resets
+// it to online without text. Others see the change over the presence topics;
+// the user's own connections get it as presence_status.
+func (ah *APIHandler) handlePresenceStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	userID := r.Context().Value("userID").(string)
+
+	switch r.Method {
+	case http.MethodGet:
+		status, err := utils.GetUserStatus(utils.GlobalDB, userID)
+		if err != nil {
+			log.Printf("Error loading status of user %s: %v", userID, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get status"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": status})
+	case http.MethodPost:
+		var status utils.UserStatus
+		if err := json.NewDecoder(r.Body).Decode(&status); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+			return
+		}
+		if err := utils.SetUserStatus(utils.GlobalDB, userID, &status); err != nil {
+			switch {
+			case errors.Is(err, utils.ErrInvalidUserStatus), errors.Is(err, utils.ErrInvalidStatusText),
+				errors.Is(err, utils.ErrInvalidStatusEmoji), errors.Is(err, utils.ErrInvalidStatusExpiry):
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			default:
+				log.Printf("Error storing status of user %s: %v", userID, err)
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update status"})
+			}
+			return
+		}
+		handlers.SetPresenceStatus(userID, &status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "status": status})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+	}
+}
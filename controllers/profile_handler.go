@@ -5,8 +5,6 @@ import (
 	"html/template"
 	"log"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strings"
 
 	"forum/utils"
@@ -81,7 +79,7 @@ func (ph *ProfileHandler) displayUserProfile(w http.ResponseWriter, targetUserID
 	err = utils.GlobalDB.QueryRow(`
         SELECT COUNT(*) 
         FROM posts 
-        WHERE user_id = ?
+        WHERE user_id = ? AND status = 'published'
     `, targetUserID).Scan(&profile.PostCount)
 	if err != nil {
 		log.Printf("Error getting post count: %v", err)
@@ -177,20 +175,6 @@ func (ph *ProfileHandler) handleProfileUpdate(w http.ResponseWriter, r *http.Req
 	}
 	defer file.Close()
 
-	// Validate file size explicitly
-	if header.Size > 20<<20 {
-		profile.ErrorMessage = "Image size must be less than 20MB"
-		tmpl.Execute(w, profile)
-		return
-	}
-
-	// Validate file type
-	if !isValidImageType(header.Header.Get("Content-Type")) {
-		profile.ErrorMessage = "Invalid file type. Please upload an image (JPEG, PNG, GIF)"
-		tmpl.Execute(w, profile)
-		return
-	}
-
 	// Get old profile pic path
 	var oldImagePath sql.NullString
 	err = utils.GlobalDB.QueryRow("SELECT profile_pic FROM users WHERE id = ?", userID).Scan(&oldImagePath)
@@ -201,9 +185,11 @@ func (ph *ProfileHandler) handleProfileUpdate(w http.ResponseWriter, r *http.Req
 	}
 
 	// Process new image
-	imagePath, err := ph.imageHandler.ProcessImage(file, header)
+	// Size and content are validated while processing
+	imagePath, err := ph.imageHandler.ProcessAvatar(file, header)
 	if err != nil {
-		profile.ErrorMessage = "Error processing image: " + err.Error()
+		log.Printf("Error processing profile picture: %v", err)
+		_, profile.ErrorMessage = uploadErrorResponse(err)
 		tmpl.Execute(w, profile)
 		return
 	}
@@ -215,17 +201,16 @@ func (ph *ProfileHandler) handleProfileUpdate(w http.ResponseWriter, r *http.Req
         WHERE id = ?
     `, imagePath, userID)
 	if err != nil {
-		// Clean up new image if database update fails
-		os.Remove(imagePath)
+		// The unused new image is left to the upload collector
 		profile.ErrorMessage = "Error updating profile picture in database"
 		tmpl.Execute(w, profile)
 		return
 	}
 
-	// Delete old profile pic if it exists
-	if oldImagePath.Valid && oldImagePath.String != "" {
-		oldPath := filepath.Join("uploads", filepath.Base(oldImagePath.String))
-		if err := os.Remove(oldPath); err != nil {
+	// Delete old profile pic if it exists; pictures in the blob store are
+	// released by the update and collected once nothing uses them
+	if oldImagePath.Valid && oldImagePath.String != "" && oldImagePath.String != imagePath {
+		if err := ph.imageHandler.RemoveImage(oldImagePath.String); err != nil {
 			log.Printf("Error removing old profile picture: %v", err)
 		}
 	}
@@ -233,11 +218,3 @@ func (ph *ProfileHandler) handleProfileUpdate(w http.ResponseWriter, r *http.Req
 	// Redirect back to profile page
 	http.Redirect(w, r, "/profile/"+userID, http.StatusSeeOther)
 }
-func isValidImageType(contentType string) bool {
-	validTypes := map[string]bool{
-		"image/jpeg": true,
-		"image/png":  true,
-		"image/gif":  true,
-	}
-	return validTypes[contentType]
-}
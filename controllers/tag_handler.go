@@ -0,0 +1,249 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"forum/utils"
+)
+
+// TagHandler serves free-form tag pages, autocomplete and trending tags
+// Categories remain the curated top-level taxonomy; tags are user supplied
+type TagHandler struct {
+	postHandler *PostHandler
+}
+
+// NewTagHandler creates a new tag handler instance
+func NewTagHandler() *TagHandler {
+	return &TagHandler{
+		postHandler: NewPostHandler(),
+	}
+}
+
+// ServeHTTP handles HTTP requests for tags
+// Routes:
+// - GET /api/tags?name={tag}&page={n}&limit={n} - Tag details and its posts, newest first
+// - GET /api/tags/autocomplete?q={prefix} - Tags starting with a prefix, most used first
+// - GET /api/tags/trending?days={n}&limit={n} - Tags used most often in recent posts
+func (th *TagHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	switch r.URL.Path {
+	case "/api/tags":
+		th.handleTagPage(w, r)
+	case "/api/tags/autocomplete":
+		th.handleAutocomplete(w, r)
+	case "/api/tags/trending":
+		th.handleTrending(w, r)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not found"})
+	}
+}
+
+// handleTagPage returns a tag and a page of the posts carrying it
+func (th *TagHandler) handleTagPage(w http.ResponseWriter, r *http.Request) {
+	name, err := utils.NormalizeTag(r.URL.Query().Get("name"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	var tag utils.Tag
+	err = utils.GlobalDB.QueryRow(
+		"SELECT id, name, usage_count FROM tags WHERE name = ?", name,
+	).Scan(&tag.ID, &tag.Name, &tag.UsageCount)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Tag not found"})
+		return
+	} else if err != nil {
+		log.Printf("Error querying tag %s: %v", name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get tag"})
+		return
+	}
+
+	page, limit, offset := parsePagination(r, 20, 100)
+
+	viewer := viewerID(r)
+	posts, err := th.getPostsByTag(tag.ID, viewer, limit, offset)
+	if err != nil {
+		log.Printf("Error querying posts for tag %s: %v", name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get posts"})
+		return
+	}
+	markBookmarkedPosts(viewer, posts)
+	attachPostMedia(viewer, posts)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"tag":     tag,
+		"posts":   posts,
+		"page":    page,
+		"limit":   limit,
+		"hasMore": offset+len(posts) < tag.UsageCount,
+	})
+}
+
+// getPostsByTag fetches a page of posts carrying a tag, newest first
+// @param tagID - The tag to filter by
+// @param viewerID - The signed-in user whose blocked and muted users are skipped, or ""
+// @param limit - Maximum number of posts to return
+// @param offset - Number of posts to skip
+// @returns []utils.Post - The posts, never nil
+// @returns error - Any database error
+func (th *TagHandler) getPostsByTag(tagID int64, viewerID string, limit, offset int) ([]utils.Post, error) {
+	rows, err := utils.GlobalDB.Query(`
+		SELECT p.id, p.title, p.content, p.imagepath, p.post_at, p.user_id,
+			   u.nickname, u.profile_pic,
+			   (SELECT COUNT(*) FROM reaction WHERE post_id = p.id AND like = 1) as likes,
+			   (SELECT COUNT(*) FROM reaction WHERE post_id = p.id AND like = 0) as dislikes,
+			   (SELECT COUNT(*) FROM comments WHERE post_id = p.id) as comments
+		FROM posts p
+		JOIN users u ON p.user_id = u.id
+		JOIN post_tags pt ON p.id = pt.post_id
+		WHERE pt.tag_id = ? AND p.status = 'published'
+		AND p.user_id NOT IN (`+utils.HiddenUsersQuery+`)
+		ORDER BY p.post_at DESC, p.id DESC
+		LIMIT ? OFFSET ?
+	`, tagID, viewerID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	posts := []utils.Post{}
+	for rows.Next() {
+		var post utils.Post
+		var imagePath, profilePic sql.NullString
+
+		err := rows.Scan(
+			&post.ID, &post.Title, &post.Content, &imagePath, &post.PostTime, &post.UserID,
+			&post.Username, &profilePic, &post.Likes, &post.Dislikes, &post.Comments,
+		)
+		if err != nil {
+			log.Printf("Error scanning post row: %v", err)
+			continue
+		}
+
+		post.ImagePath = imagePath.String
+		post.ProfilePic = profilePic.String
+
+		categories, err := th.postHandler.getPostCategories(post.ID)
+		if err != nil {
+			log.Printf("Error getting categories for post %d: %v", post.ID, err)
+			categories = []utils.Category{}
+		}
+		post.Categories = categories
+
+		posts = append(posts, post)
+	}
+	renderPostsContent(posts)
+
+	return posts, rows.Err()
+}
+
+// handleAutocomplete returns up to ten tags starting with the q parameter
+func (th *TagHandler) handleAutocomplete(w http.ResponseWriter, r *http.Request) {
+	prefix := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(r.URL.Query().Get("q")), "#"))
+	if len(prefix) > 30 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Query too long"})
+		return
+	}
+
+	tags := []utils.Tag{}
+	if prefix == "" {
+		json.NewEncoder(w).Encode(tags)
+		return
+	}
+
+	// Escape LIKE wildcards; tags may legitimately contain underscores
+	escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix)
+
+	rows, err := utils.GlobalDB.Query(`
+		SELECT id, name, usage_count
+		FROM tags
+		WHERE name LIKE ? ESCAPE '\' AND usage_count > 0
+		ORDER BY CASE WHEN name = ? THEN 0 ELSE 1 END, usage_count DESC, name ASC
+		LIMIT 10
+	`, escaped+"%", prefix)
+	if err != nil {
+		log.Printf("Error querying tag autocomplete: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get tags"})
+		return
+	}
+	defer rows.Close()
+
+	tags, err = scanTags(rows)
+	if err != nil {
+		log.Printf("Error scanning tags: %v", err)
+	}
+	json.NewEncoder(w).Encode(tags)
+}
+
+// handleTrending returns the tags applied to the most posts in the last few days
+// Defaults to a 7 day window and 10 tags
+func (th *TagHandler) handleTrending(w http.ResponseWriter, r *http.Request) {
+	days := 7
+	if d, err := strconv.Atoi(r.URL.Query().Get("days")); err == nil && d > 0 && d <= 90 {
+		days = d
+	}
+	_, limit, _ := parsePagination(r, 10, 50)
+
+	rows, err := utils.GlobalDB.Query(`
+		SELECT t.id, t.name, COUNT(*) AS recent
+		FROM post_tags pt
+		JOIN tags t ON t.id = pt.tag_id
+		JOIN posts p ON p.id = pt.post_id
+		WHERE pt.created_at >= datetime('now', ?) AND p.status = 'published'
+		GROUP BY t.id
+		ORDER BY recent DESC, t.usage_count DESC, t.name ASC
+		LIMIT ?
+	`, "-"+strconv.Itoa(days)+" days", limit)
+	if err != nil {
+		log.Printf("Error querying trending tags: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get trending tags"})
+		return
+	}
+	defer rows.Close()
+
+	// usageCount here is the number of posts tagged within the window
+	tags, err := scanTags(rows)
+	if err != nil {
+		log.Printf("Error scanning tags: %v", err)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"days": days,
+		"tags": tags,
+	})
+}
+
+// scanTags reads id, name and count columns into tags
+// @returns []utils.Tag - The scanned tags, never nil
+// @returns error - Any scan error
+func scanTags(rows *sql.Rows) ([]utils.Tag, error) {
+	tags := []utils.Tag{}
+	for rows.Next() {
+		var tag utils.Tag
+		if err := rows.Scan(&tag.ID, &tag.Name, &tag.UsageCount); err != nil {
+			return tags, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
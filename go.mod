@@ -7,4 +7,5 @@ require (
 	github.com/gorilla/websocket v1.5.3
 	github.com/mattn/go-sqlite3 v1.14.24
 	golang.org/x/crypto v0.32.0
+	golang.org/x/image v0.25.0
 )
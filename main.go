@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"strings"
+	"time"
 
 	handlers "forum/authentication"
 	"forum/controllers"
@@ -24,54 +29,140 @@ func main() {
 	handlers.InitDB(db)
 	utils.InitSessionManager(utils.GlobalDB)
 
+	// Store uploads on local disk or in an S3-compatible bucket
+	store, err := utils.OpenBlobStore(os.Getenv)
+	if err != nil {
+		log.Fatalf("Invalid blob store settings: %v", err)
+	}
+	utils.Blobs = store
+
+	// "forum migrate-uploads [-dry-run]" moves uploads from local disk into the blob store
+	if len(os.Args) > 1 && os.Args[1] == "migrate-uploads" {
+		migrateUploads(db, os.Args[2:])
+		return
+	}
+
+	// "forum gc-uploads [-dry-run] [-grace 24h]" removes orphaned uploads and reports disk usage
+	if len(os.Args) > 1 && os.Args[1] == "gc-uploads" {
+		collectUploads(db, os.Args[2:])
+		return
+	}
+
+	// Nobody is connected yet; the presence tracker marks users online as they connect
+	if err := utils.ResetOnlineUsers(db); err != nil {
+		log.Printf("Failed to reset online users: %v", err)
+	}
+
+	// Publish scheduled posts once they are due
+	apiHandler := controllers.NewAPIHandler()
+	utils.StartPostScheduler(context.Background(), db, time.Minute, func(post utils.PublishedPost) {
+		apiHandler.AnnouncePost(post.ID, post.UserID)
+	})
+
+	// Tell poll creators when voting ends
+	utils.StartPollCloser(context.Background(), db, time.Minute, apiHandler.AnnouncePollClosed)
+
+	// Remove uploads nothing has used for a day
+	utils.StartUploadCollector(context.Background(), db, utils.Blobs, time.Hour, uploadGCOptions(utils.UploadGCGrace, false))
+
+	// Apply attachment size and type limits
+	if err := utils.LoadAttachmentPolicies(os.Getenv); err != nil {
+		log.Fatalf("Invalid attachment settings: %v", err)
+	}
+
+	// Grant the admin role to the accounts listed in ADMIN_EMAILS
+	if promoted, err := utils.PromoteAdmins(db, os.Getenv("ADMIN_EMAILS")); err != nil {
+		log.Printf("Failed to promote admins: %v", err)
+	} else if promoted > 0 {
+		log.Printf("Promoted %d user(s) to admin", promoted)
+	}
+
+	registerRoutes(http.DefaultServeMux, apiHandler)
+
+	fmt.Println("Server opened at port 8000...http://localhost:8000/")
+	log.Fatal(http.ListenAndServe(":8000", nil))
+}
+
+// registerRoutes registers the forum's routes
+// @param mux - The mux to register them on
+// @param apiHandler - The API handler, shared with the background jobs
+func registerRoutes(mux *http.ServeMux, apiHandler *controllers.APIHandler) {
 	// Auth routes - OAuth providers
-	http.HandleFunc("/auth/github", handlers.HandleGitHubLogin)
-	http.HandleFunc("/auth/github/callback", handlers.HandleGitHubCallback)
-	http.HandleFunc("/auth/google", handlers.HandleGoogleLogin)
-	http.HandleFunc("/auth/google/callback", handlers.HandleGoogleCallback)
+	mux.HandleFunc("/auth/github", handlers.HandleGitHubLogin)
+	mux.HandleFunc("/auth/github/callback", handlers.HandleGitHubCallback)
+	mux.HandleFunc("/auth/google", handlers.HandleGoogleLogin)
+	mux.HandleFunc("/auth/google/callback", handlers.HandleGoogleCallback)
 
 	// Static file serving
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+
+	// Uploaded images, served from the blob store
+	mux.Handle("/media/", controllers.NewMediaHandler())
 
 	// API Routes
-	apiHandler := controllers.NewAPIHandler()
-	http.Handle("/api/", apiHandler)
-	http.HandleFunc("/api/user-status", controllers.GetUserStatus)
+	mux.Handle("/api/", apiHandler)
+	mux.HandleFunc("/api/user-status", controllers.GetUserStatus)
 
 	// Auth routes
-	http.Handle("/login", apiHandler)
-	http.Handle("/register", apiHandler)
+	mux.Handle("/login", apiHandler)
+	mux.Handle("/register", apiHandler)
 
 	// Signout route
-	http.HandleFunc("/signout", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/signout", func(w http.ResponseWriter, r *http.Request) {
 		log.Println("Signout request received")
 		apiHandler.HandleSignout(w, r)
 	})
 
 	// WebSocket routes
-	http.HandleFunc("/ws", handlers.HandleWebSocket)
-	http.HandleFunc("/ws/chat", handlers.HandleChatWebSocket)
-	http.HandleFunc("/api/users/refresh", handlers.TriggerUsersListBroadcast)
+	mux.HandleFunc("/ws", handlers.HandleWebSocket)
+	mux.HandleFunc("/ws/chat", handlers.HandleChatWebSocket)
 
 	// User routes
-	http.HandleFunc("/api/users/", handlers.GetUserHandler)
+	mux.HandleFunc("/api/users/", handlers.GetUserHandler)
+
+	// Profile routes live under /api/users/ but are served by the API handler
+	mux.Handle("/api/users/profile", apiHandler)
+	mux.Handle("/api/users/profile-pic", apiHandler)
+	mux.Handle("/api/users/stats", apiHandler)
+
+	// Follow routes live under /api/users/ but are served by the API handler
+	mux.Handle("/api/users/follow", apiHandler)
+	mux.Handle("/api/users/unfollow", apiHandler)
+	mux.Handle("/api/users/follow/mute", apiHandler)
+	mux.Handle("/api/users/followers", apiHandler)
+	mux.Handle("/api/users/following", apiHandler)
+
+	// Block and mute routes, also served by the API handler
+	mux.Handle("/api/users/block", apiHandler)
+	mux.Handle("/api/users/unblock", apiHandler)
+	mux.Handle("/api/users/mute", apiHandler)
+	mux.Handle("/api/users/unmute", apiHandler)
+	mux.Handle("/api/users/blocked", apiHandler)
 
 	// Chat routes
-	http.HandleFunc("/api/chat/history", handlers.GetChatHistoryHandler)
-	http.HandleFunc("/api/chat/send", handlers.SendMessageHandler)
-	http.HandleFunc("/api/chat/users", handlers.GetChatUsersHandler)
-	http.HandleFunc("/api/chat/mark-read", handlers.MarkMessagesAsReadHandler)
+	mux.HandleFunc("/api/chat/history", handlers.GetChatHistoryHandler)
+	mux.HandleFunc("/api/chat/send", handlers.SendMessageHandler)
+	mux.HandleFunc("/api/chat/users", handlers.GetChatUsersHandler)
+	mux.HandleFunc("/api/chat/mark-read", handlers.MarkMessagesAsReadHandler)
+	mux.Handle("/api/chat/edit", apiHandler)
+	mux.Handle("/api/chat/delete", apiHandler)
+	mux.Handle("/api/chat/react", apiHandler)
 
 	// Notification routes
 	notificationHandler := controllers.NewNotificationHandler()
-	http.Handle("/notifications", notificationHandler)
-	http.Handle("/api/notifications", notificationHandler)
-	http.Handle("/api/notifications/count", notificationHandler)
-	http.Handle("/notifications/mark-read", notificationHandler)
-	http.Handle("/notifications/mark-all-read", notificationHandler)
+	mux.Handle("/notifications", notificationHandler)
+	mux.Handle("/api/notifications", notificationHandler)
+	mux.Handle("/api/notifications/count", notificationHandler)
+	mux.Handle("/notifications/mark-read", notificationHandler)
+	mux.Handle("/notifications/mark-all-read", notificationHandler)
+
+	// Tag routes
+	tagHandler := controllers.NewTagHandler()
+	mux.Handle("/api/tags", tagHandler)
+	mux.Handle("/api/tags/", tagHandler)
 
 	// SPA catch-all route - serve index.html for all other routes
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if strings.HasPrefix(r.URL.Path, "/api/") ||
 			strings.HasPrefix(r.URL.Path, "/static/") ||
 			strings.HasPrefix(r.URL.Path, "/auth/") ||
@@ -83,7 +174,76 @@ func main() {
 		}
 		http.ServeFile(w, r, "templates/index.html")
 	})
+}
 
-	fmt.Println("Server opened at port 8000...http://localhost:8000/")
-	log.Fatal(http.ListenAndServe(":8000", nil))
+// migrateUploads runs the migrate-uploads command
+// Post images, avatars and attachments stored on local disk are copied into
+// the configured blob store and the database is pointed at them. With
+// -dry-run it only reports what would be moved.
+// @param db - Database connection
+// @param args - The command's arguments
+func migrateUploads(db *sql.DB, args []string) {
+	flags := flag.NewFlagSet("migrate-uploads", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "report what would be moved without moving it")
+	flags.Parse(args)
+
+	report, err := utils.MigrateUploads(context.Background(), db, utils.Blobs, "static/uploads", "uploads/attachments", *dryRun)
+	for _, path := range report.Missing {
+		log.Printf("Missing file for %s, left unchanged", path)
+	}
+	verb := "Moved"
+	if *dryRun {
+		verb = "Would move"
+	}
+	fmt.Printf("%s %d image(s) and %d attachment(s): %d blob(s), %d bytes\n",
+		verb, report.Images, report.Attachments, report.Blobs, report.Bytes)
+	if err != nil {
+		log.Fatalf("Migration failed: %v", err)
+	}
+	if !*dryRun && report.Blobs > 0 {
+		fmt.Println("The old files were left in place and can be removed once the migration is checked.")
+	}
+}
+
+// uploadGCOptions returns the upload collector settings, including the
+// directories uploads were stored in before the blob store
+func uploadGCOptions(grace time.Duration, dryRun bool) utils.UploadGCOptions {
+	return utils.UploadGCOptions{
+		Grace:         grace,
+		DryRun:        dryRun,
+		ImageDir:      "static/uploads",
+		AttachmentDir: "uploads/attachments",
+	}
+}
+
+// collectUploads runs the gc-uploads command
+// Orphaned uploads past the grace period are listed and removed, followed by
+// the disk usage of the blob store and the old upload directories. With
+// -dry-run nothing is removed.
+// @param db - Database connection
+// @param args - The command's arguments
+func collectUploads(db *sql.DB, args []string) {
+	flags := flag.NewFlagSet("gc-uploads", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "report orphaned uploads without removing them")
+	grace := flags.Duration("grace", utils.UploadGCGrace, "how long an upload must be unused before it is removed")
+	flags.Parse(args)
+
+	report, err := utils.CollectUploads(context.Background(), db, utils.Blobs, uploadGCOptions(*grace, *dryRun))
+	if err != nil {
+		log.Fatalf("Upload collection failed: %v", err)
+	}
+
+	for _, orphan := range report.Orphaned {
+		fmt.Printf("orphaned %10d bytes  unused since %s  %s\n",
+			orphan.Size, orphan.UnreferencedAt.Format(time.RFC3339), orphan.Key)
+	}
+	verb := "Removed"
+	if *dryRun {
+		verb = "Would remove"
+	}
+	fmt.Printf("%s %d unsent chat attachment(s)\n", verb, report.Unsent)
+	fmt.Printf("%s %d orphaned upload(s), %d bytes\n", verb, len(report.Orphaned), report.OrphanedBytes)
+	fmt.Printf("Blob store: %d upload(s), %d bytes, %d unused within the grace period\n",
+		report.Uploads, report.Bytes, report.Pending)
+	fmt.Printf("Old upload directories: %d file(s), %d bytes\n", report.LegacyFiles, report.LegacyBytes)
 }
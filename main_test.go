@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	handlers "forum/authentication"
+	"forum/controllers"
+	"forum/utils"
+)
+
+func TestRegisterRoutes_profile(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	db, err := utils.InitialiseDB()
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	handlers.InitDB(db)
+
+	alice, bob := "00000000-0000-4000-8000-000000000001", "00000000-0000-4000-8000-000000000002"
+	_, err = db.Exec(`
+		INSERT INTO users (id, nickname, email, first_name, last_name, age, gender) VALUES
+			(?, 'alice', 'alice@example.com', 'Alice', 'A', 30, 'female'),
+			(?, 'bob', 'bob@example.com', 'Bob', 'B', 30, 'male');
+		INSERT INTO follows (follower_id, followed_id) VALUES (?, ?);
+	`, alice, bob, alice, bob)
+	if err != nil {
+		t.Fatalf("Failed to insert test data: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	registerRoutes(mux, controllers.NewAPIHandler())
+
+	type followCounts struct {
+		FollowerCount  int `json:"follower_count"`
+		FollowingCount int `json:"following_count"`
+	}
+	var profile struct {
+		Profile followCounts `json:"profile"`
+	}
+	var stats followCounts
+	tests := []struct {
+		path   string
+		out    interface{}
+		counts *followCounts
+	}{
+		{"/api/users/profile?id=" + bob, &profile, &profile.Profile},
+		{"/api/users/stats?id=" + bob, &stats, &stats},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest("GET", tt.path, nil))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("got status %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+			}
+			if err := json.NewDecoder(rr.Body).Decode(tt.out); err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+			if tt.counts.FollowerCount != 1 || tt.counts.FollowingCount != 0 {
+				t.Errorf("got %+v, want 1 follower and 0 following", *tt.counts)
+			}
+		})
+	}
+
+	// Other paths under /api/users/ are still single users
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/users/"+alice, nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("/api/users/{id}: got status %v want %v", rr.Code, http.StatusOK)
+	}
+}
@@ -11,12 +11,18 @@ class ChatComponent {
         this.socket = null; // WebSocket connection
         this.isTyping = false; // Typing indicator state
         this.typingTimer = null; // Timer for typing indicator
-        this.page = 1;
         this.messagesPerPage = 10;
         this.hasMoreMessages = true;
         this.isLoadingMore = false;
         this.scrollThrottleTimer = null;
         this.statusEventUnsubscribe = null; // For event bus cleanup
+        this.pendingMessages = new Map(); // Messages awaiting an ack, by client_msg_id
+        this.lastMessageId = 0; // Newest saved message seen, used to resume after reconnecting
+        this.editWindowMs = 15 * 60 * 1000; // How long the server allows edits after sending
+        this.quickReactions = ['👍', '❤️', '😂', '😮', '😢'];
+        this.pendingAttachments = []; // Uploaded attachments to send with the next message
+        this.showingLatest = true; // False while showing older messages around a search result
+        this.searchTimer = null; // Debounces searching while typing
     }
 
     async fetchMessageHistory(loadMore = false) {
@@ -38,10 +44,14 @@ class ChatComponent {
                 }
             }
 
-            console.log(`Fetching message history between ${this.currentUserId} and ${this.otherUserId}, page ${this.page}`);
+            // Older pages are anchored on the oldest message shown, so new
+            // messages arriving meanwhile never shift them
+            const oldest = this.messages.find(message => typeof message.id === 'number');
+            const anchor = loadMore && oldest ? `&before=${oldest.id}` : '';
+            console.log(`Fetching message history between ${this.currentUserId} and ${this.otherUserId}${anchor}`);
             const timestamp = new Date().getTime();
             const response = await fetch(
-                `/api/chat/history?user1=${this.currentUserId}&user2=${this.otherUserId}&page=${this.page}&limit=${this.messagesPerPage}&_=${timestamp}`,
+                `/api/chat/history?user1=${this.currentUserId}&user2=${this.otherUserId}&limit=${this.messagesPerPage}${anchor}&_=${timestamp}`,
                 {
                     credentials: 'include',
                     headers: {
@@ -72,6 +82,8 @@ class ChatComponent {
             } else {
                 // Replace messages on initial load
                 this.messages = newMessages;
+                this.showingLatest = true;
+                this.trackLastMessageId(newMessages);
             }
 
             // Log each message for debugging
@@ -228,7 +240,6 @@ class ChatComponent {
         await this.fetchOtherUserName();
 
         // Fetch message history
-        this.page = 1; // Reset to first page
         const historyLoaded = await this.fetchMessageHistory();
 
         if (!historyLoaded) {
@@ -261,6 +272,9 @@ class ChatComponent {
         // Setup typing event listener
         this.setupTypingListener();
 
+        // Setup edit, delete and reaction controls on messages
+        this.setupMessageActions();
+
         // Add event listener for page unload to clean up resources
         window.addEventListener('beforeunload', () => {
             this.cleanup();
@@ -275,11 +289,24 @@ class ChatComponent {
                         <i class="fas fa-arrow-left"></i> Back
                     </button>
                     <h2>Chat with ${this.otherUserName}</h2>
+                    <button class="chat-search-toggle" title="Search this conversation"
+                        onclick="window.chatComponent.toggleSearch()">
+                        <i class="fas fa-search"></i>
+                    </button>
                     <div class="chat-status" id="connection-status">
                         <span class="status-indicator offline"></span>
                         <span class="status-text">Offline</span>
                     </div>
                 </div>
+                <div class="chat-search" id="chat-search" hidden>
+                    <input type="search" id="chat-search-input" placeholder="Search messages..."
+                        oninput="window.chatComponent.handleSearchInput(this.value)">
+                    <div class="chat-search-results" id="chat-search-results"></div>
+                </div>
+                <button class="chat-latest-button" id="chat-latest-button" hidden
+                    onclick="window.chatComponent.fetchMessageHistory()">
+                    <i class="fas fa-arrow-down"></i> Back to latest messages
+                </button>
                 <div class="messages-container" id="messages-container">
                     <!-- Messages will be dynamically loaded here -->
                     <div class="loading-messages">
@@ -295,7 +322,14 @@ class ChatComponent {
                         <span class="dot"></span>
                     </div>
                 </div>
+                <div class="chat-attachment-previews" id="chat-attachment-previews" hidden></div>
                 <div class="message-input-container">
+                    <button id="attach-file-btn" type="button" title="Attach images or files"
+                        onclick="document.getElementById('chat-file-input').click()">
+                        <i class="fas fa-paperclip"></i>
+                    </button>
+                    <input type="file" id="chat-file-input" multiple hidden
+                        onchange="window.chatComponent.handleAttachmentSelect(this)">
                     <textarea
                         id="message-input"
                         placeholder="Type your message here..."
@@ -317,17 +351,21 @@ class ChatComponent {
 
         // Create WebSocket connection
         // The order of user1 and user2 is important - user1 is the current user, user2 is the chat partner
-        this.socket = new WebSocket(`${protocol}//${host}/ws/chat?user1=${this.currentUserId}&user2=${this.otherUserId}`);
+        // since replays anything saved after the newest message we have seen
+        this.socket = new WebSocket(`${protocol}//${host}/ws/chat?user1=${this.currentUserId}&user2=${this.otherUserId}&since=${this.lastMessageId}`);
 
         // Connection opened
         this.socket.addEventListener('open', () => {
             console.log('WebSocket connection established for chat with', this.otherUserId);
             this.updateConnectionStatus(true);
+
+            // Retry messages that were never acked; the server drops duplicates
+            this.pendingMessages.forEach(message => this.sendChatMessage(message));
         });
 
         // Listen for messages
         this.socket.addEventListener('message', (event) => {
-            const data = JSON.parse(event.data);
+            const data = websocketService.parseEnvelope(event.data);
             console.log('Received WebSocket message:', data);
 
             // Validate that the message is intended for this chat
@@ -338,7 +376,7 @@ class ChatComponent {
                 // Only process messages that are part of this conversation
                 if ((sender === this.currentUserId && recipient === this.otherUserId) ||
                     (sender === this.otherUserId && recipient === this.currentUserId)) {
-                    this.handleIncomingMessage(data.message);
+                    this.handleIncomingMessage(data.message, data.replayed);
                 } else {
                     console.log('Ignoring message not related to this chat');
                 }
@@ -357,6 +395,32 @@ class ChatComponent {
                         isTyping: data.type === 'typing'
                     });
                 }
+            } else if (data.type === 'message_edited' && data.message) {
+                this.handleMessageEdited(data.message);
+            } else if (data.type === 'message_deleted') {
+                this.handleMessageDeleted(data);
+            } else if (data.type === 'reaction') {
+                this.handleReaction(data);
+            } else if (data.type === 'ack') {
+                this.handleAck(data);
+            } else if (data.type === 'receipt') {
+                this.handleReceipt(data);
+            } else if (data.type === 'resumed') {
+                if (data.has_more) {
+                    this.socket.send(JSON.stringify({ type: 'resume', since: data.last_id }));
+                } else if (data.last_id > data.since) {
+                    this.markMessagesAsRead();
+                }
+            } else if (data.type === 'error') {
+                console.error('Chat error:', data.error);
+                if (data.message_id && data.action) {
+                    this.showMessageError(data.message_id, data.error);
+                }
+                // A rejected message will not succeed on retry
+                if (data.client_msg_id) {
+                    this.pendingMessages.delete(data.client_msg_id);
+                    this.showMessageError(data.client_msg_id, data.error);
+                }
             } else {
                 console.log('Unknown message type:', data.type);
             }
@@ -557,7 +621,8 @@ class ChatComponent {
         if (!messageInput) return;
 
         const content = messageInput.value.trim();
-        if (!content) return;
+        const attachments = this.pendingAttachments;
+        if (!content && attachments.length === 0) return;
 
         try {
             console.log(`Sending message to ${this.otherUserId}: ${content}`);
@@ -567,11 +632,15 @@ class ChatComponent {
                 sender_id: this.currentUserId,
                 receiver_id: this.otherUserId,
                 content,
+                client_msg_id: this.newClientMsgId(),
+                attachment_ids: attachments.map(attachment => attachment.id),
                 timestamp: new Date().toISOString()
             };
 
-            // Clear the input after sending
+            // Clear the input and attachments after sending
             messageInput.value = '';
+            this.pendingAttachments = [];
+            this.renderAttachmentPreviews();
 
             // Stop typing indicator
             this.isTyping = false;
@@ -586,42 +655,27 @@ class ChatComponent {
             // Explicitly hide the typing indicator immediately when sending a message
             this.showTypingIndicator(false, true);
 
-            // Add message to UI immediately for better UX
-            const tempId = Date.now(); // Temporary ID
+            // Add message to UI immediately for better UX; it is keyed by its
+            // client_msg_id until the server acks it with the saved ID
             const uiMessage = {
-                id: tempId,
+                id: messageObj.client_msg_id,
+                client_msg_id: messageObj.client_msg_id,
                 sender: this.currentUserId,
                 recipient: this.otherUserId,
                 content,
-                timestamp: messageObj.timestamp
+                attachment_ids: messageObj.attachment_ids,
+                attachments,
+                timestamp: messageObj.timestamp,
+                status: 'pending'
             };
             this.addMessageToUI(uiMessage, true);
+            this.updateMessageStatus(uiMessage.id, 'pending');
+            this.pendingMessages.set(uiMessage.client_msg_id, uiMessage);
 
-            // Trigger a refresh of the users list to update unread counts
-            // This ensures the unread count appears for the recipient
-            setTimeout(() => {
-                eventBus.emit('refresh_users_list');
-            }, 500);
-
-            // Simulate status updates (in a real app, these would come from the server)
-            this.simulateMessageStatusUpdates(tempId);
-
-            // Refresh the users list to update the sorting based on last message
-            this.refreshUsersNav();
+            // The users list is updated by the conversation_summary pushed once the message is saved
 
             // Send message via WebSocket if connected
-            if (this.socket && this.socket.readyState === WebSocket.OPEN) {
-                console.log('Sending message via WebSocket');
-                this.socket.send(JSON.stringify({
-                    type: 'message',
-                    message: {
-                        sender: this.currentUserId,
-                        recipient: this.otherUserId,
-                        content,
-                        timestamp: messageObj.timestamp
-                    }
-                }));
-            } else {
+            if (!this.sendChatMessage(uiMessage)) {
                 // Fallback to REST API if WebSocket is not connected
                 console.log('WebSocket not connected, using REST API fallback');
                 const response = await fetch('/api/chat/send', {
@@ -642,16 +696,9 @@ class ChatComponent {
                 const result = await response.json();
                 console.log('Message sent successfully via REST API:', result);
 
-                // If the message was sent via REST API, add it to our messages array
+                // The saved message acks the pending one
                 if (result.success && result.message) {
-                    const savedMessage = {
-                        id: result.message.id,
-                        sender: result.message.sender_id,
-                        recipient: result.message.receiver_id,
-                        content: result.message.content,
-                        timestamp: result.message.sent_at
-                    };
-                    this.messages.push(savedMessage);
+                    this.handleAck(result.message);
                 }
             }
         } catch (error) {
@@ -675,36 +722,128 @@ class ChatComponent {
         }
     }
 
-    handleIncomingMessage(message) {
+    /**
+     * Generate an idempotency key for a new message
+     * @returns {string} - A key unique to this message
+     */
+    newClientMsgId() {
+        if (window.crypto && typeof window.crypto.randomUUID === 'function') {
+            return window.crypto.randomUUID();
+        }
+        return `${Date.now().toString(36)}-${Math.random().toString(36).slice(2)}`;
+    }
+
+    /**
+     * Send a message over the chat WebSocket
+     * The message stays pending until acked and is sent again on reconnect.
+     * @param {Object} message - The pending message
+     * @returns {boolean} - True if the message was sent
+     */
+    sendChatMessage(message) {
+        if (!this.socket || this.socket.readyState !== WebSocket.OPEN) {
+            return false;
+        }
+        this.socket.send(JSON.stringify({
+            type: 'message',
+            message: {
+                client_msg_id: message.client_msg_id,
+                recipient: message.recipient,
+                content: message.content,
+                attachment_ids: message.attachment_ids
+            }
+        }));
+        return true;
+    }
+
+    /**
+     * Handle the server's confirmation that a message was saved
+     * @param {Object} ack - The ack, with client_msg_id, the saved id and the server timestamp
+     */
+    handleAck(ack) {
+        const pending = this.pendingMessages.get(ack.client_msg_id);
+        if (!pending) return;
+        this.pendingMessages.delete(ack.client_msg_id);
+
+        // Re-key the message from its client_msg_id to the saved ID
+        document.querySelectorAll(`[data-id="${ack.client_msg_id}"], [data-message-id="${ack.client_msg_id}"]`).forEach(element => {
+            if (element.dataset.id) element.dataset.id = ack.id;
+            if (element.dataset.messageId) element.dataset.messageId = ack.id;
+        });
+        pending.id = ack.id;
+        pending.timestamp = ack.timestamp;
+        pending.status = ack.status || 'sent';
+        this.messages.push(pending);
+        this.trackLastMessageId([pending]);
+        this.updateMessageStatus(ack.id, pending.status);
+    }
+
+    /**
+     * Handle a delivered or read receipt for messages we sent
+     * @param {Object} receipt - The receipt, with status and message_ids
+     */
+    handleReceipt(receipt) {
+        if (receipt.sender_id !== this.currentUserId) return;
+        const ids = new Set(receipt.message_ids);
+        this.messages.forEach(message => {
+            if (ids.has(message.id) && message.status !== 'read') {
+                message.status = receipt.status;
+            }
+        });
+        receipt.message_ids.forEach(id => this.updateMessageStatus(id, receipt.status));
+    }
+
+    /**
+     * Remember the newest saved message ID, to resume from after reconnecting
+     * @param {Array} messages - Messages that were just received
+     */
+    trackLastMessageId(messages) {
+        messages.forEach(message => {
+            if (typeof message.id === 'number' && message.id > this.lastMessageId) {
+                this.lastMessageId = message.id;
+            }
+        });
+    }
+
+    handleIncomingMessage(message, replayed = false) {
         console.log('Handling incoming message:', message);
 
+        // Messages replayed on reconnect may already be shown
+        if (this.messages.some(existing => existing.id === message.id)) {
+            if (message.sender === this.currentUserId) {
+                this.updateMessageStatus(message.id, message.status || 'sent');
+            }
+            return;
+        }
+
         // Verify this message belongs to the current chat conversation
         if ((message.sender === this.currentUserId && message.recipient === this.otherUserId) ||
             (message.sender === this.otherUserId && message.recipient === this.currentUserId)) {
+            this.trackLastMessageId([message]);
 
-            // Add the new message to our messages array
-            this.messages.push(message);
-
-            // Add message to the UI
+            // While older messages are shown, new ones appear on returning to the latest
             const isSent = message.sender === this.currentUserId;
-            this.addMessageToUI(message, isSent);
+            if (this.showingLatest) {
+                this.messages.push(message);
+                this.addMessageToUI(message, isSent);
+                if (isSent) {
+                    this.updateMessageStatus(message.id, message.status || 'sent');
+                }
+            }
 
             // No notification sound for messages as per user request
 
+            // Confirm delivery; replayed messages are marked read once the replay ends
+            if (message.sender === this.otherUserId && this.socket && this.socket.readyState === WebSocket.OPEN) {
+                this.socket.send(JSON.stringify({ type: 'delivered', message_ids: [message.id] }));
+            }
+
             // If the message is from the other user and we're viewing the chat, mark it as read
-            if (message.sender === this.otherUserId) {
+            if (message.sender === this.otherUserId && !replayed) {
                 // Only mark as read if this is a message we received, not one we sent
                 this.markMessagesAsRead();
             }
-
-            // Refresh the users list to update the sorting based on last message
-            this.refreshUsersNav();
         } else {
             console.log('Ignoring message not related to this chat conversation');
-
-            // Even if the message is not for this chat, we should refresh the users list
-            // to update the sorting for the sender in the users navigation
-            this.refreshUsersNav();
         }
     }
 
@@ -733,12 +872,6 @@ class ChatComponent {
 
             const result = await response.json();
             console.log('Messages marked as read:', result);
-
-            // Only refresh the users list if messages were actually marked as read
-            if (result.rowsAffected > 0) {
-                // Refresh the users list to update unread counts
-                eventBus.emit('refresh_users_list');
-            }
         } catch (error) {
             console.error('Error marking messages as read:', error);
         }
@@ -787,9 +920,15 @@ class ChatComponent {
 
         // Set message content with status indicator for sent messages
         messageDiv.innerHTML = `
-            <div class="message-content">${this.formatMessageContent(message.content)}</div>
+            <div class="message-content">
+                <div class="message-text">${this.messageTextHTML(message)}</div>
+                <div class="message-attachments">${this.attachmentsHTML(message)}</div>
+                <div class="message-reactions">${this.reactionsHTML(message)}</div>
+            </div>
+            <div class="message-actions">${this.messageActionsHTML(message, isSent)}</div>
             <div class="message-time">
                 ${formattedTime}
+                <span class="message-edited"${message.edited && !message.deleted ? '' : ' hidden'}>(edited)</span>
                 ${isSent ? `<span class="message-status sent" data-message-id="${message.id}">
                     <i class="fas fa-check"></i>
                 </span>` : ''}
@@ -822,10 +961,16 @@ class ChatComponent {
         }, 300);
     }
 
+    /**
+     * Escape plain message text and make its URLs clickable
+     * Only used for messages the server has not rendered yet, such as our
+     * own messages awaiting an ack.
+     * @param {string} content - The raw text
+     * @returns {string} - Safe HTML
+     */
     formatMessageContent(content) {
-        // Basic formatting: Convert URLs to clickable links
-        return content.replace(
-            /(https?:\/\/[^\s]+)/g,
+        return this.escapeHtml(content).replace(
+            /(https?:\/\/[^\s&]+)/g,
             '<a href="$1" target="_blank" rel="noopener noreferrer">$1</a>'
         );
     }
@@ -834,6 +979,9 @@ class ChatComponent {
         const messagesContainer = document.getElementById('messages-container');
         if (!messagesContainer) return;
 
+        const latestButton = document.getElementById('chat-latest-button');
+        if (latestButton) latestButton.hidden = this.showingLatest;
+
         // Clear messages container
         messagesContainer.innerHTML = '';
 
@@ -857,24 +1005,9 @@ class ChatComponent {
             const isSent = message.sender === this.currentUserId;
             this.addMessageToUI(message, isSent);
 
-            // For sent messages, update status based on position
-            // This simulates different statuses for demonstration
+            // For sent messages, show the delivery status the server recorded
             if (isSent) {
-                // Use setTimeout to stagger the animations
-                setTimeout(() => {
-                    // Messages at the end are "sent", older ones are "delivered" or "read"
-                    const totalMessages = this.messages.length;
-                    if (index >= totalMessages - 1) {
-                        // Most recent message is just "sent"
-                        this.updateMessageStatus(message.id, 'sent');
-                    } else if (index >= totalMessages - 2) {
-                        // Second most recent is "delivered"
-                        this.updateMessageStatus(message.id, 'delivered');
-                    } else {
-                        // Older messages are "read"
-                        this.updateMessageStatus(message.id, 'read');
-                    }
-                }, index * 100); // Stagger the animations
+                this.updateMessageStatus(message.id, message.status || 'sent');
             }
         });
 
@@ -894,7 +1027,7 @@ class ChatComponent {
 
         statusElements.forEach(element => {
             // Remove previous status classes
-            element.classList.remove('sent', 'delivered', 'read');
+            element.classList.remove('pending', 'sent', 'delivered', 'read');
 
             // Add new status class
             element.classList.add(status);
@@ -904,7 +1037,9 @@ class ChatComponent {
 
             // Update the icon based on status
             let icon = 'fa-check';
-            if (status === 'delivered') {
+            if (status === 'pending') {
+                icon = 'fa-clock';
+            } else if (status === 'delivered') {
                 icon = 'fa-check-double';
             } else if (status === 'read') {
                 icon = 'fa-check-double';
@@ -919,17 +1054,449 @@ class ChatComponent {
         });
     }
 
-    // Simulate status updates for demo purposes
-    simulateMessageStatusUpdates(messageId) {
-        // Simulate delivered status after a short delay
-        setTimeout(() => {
-            this.updateMessageStatus(messageId, 'delivered');
+    /**
+     * The text of a message, or a tombstone once it is deleted for everyone
+     * Content is stored as written, so it is never inserted as HTML: the
+     * server's sanitized content_html is shown, or the escaped text.
+     * @param {Object} message - The message
+     * @returns {string} - HTML for the message text
+     */
+    messageTextHTML(message) {
+        if (message.deleted) {
+            return '<em class="message-tombstone"><i class="fas fa-ban"></i> This message was deleted</em>';
+        }
+        if (message.content_html) {
+            return message.content_html;
+        }
+        return this.formatMessageContent(message.content || '');
+    }
 
-            // Simulate read status after another delay
-            setTimeout(() => {
-                this.updateMessageStatus(messageId, 'read');
-            }, 2000);
-        }, 1000);
+    /**
+     * The attachments of a message: image thumbnails that open the full
+     * image, and download links for other files
+     * @param {Object} message - The message, with attachments from the server
+     * @returns {string} - HTML for the attachments
+     */
+    attachmentsHTML(message) {
+        if (message.deleted || !message.attachments) return '';
+        return message.attachments.map(attachment => {
+            const name = this.escapeHtml(attachment.fileName);
+            if (attachment.kind === 'image') {
+                return `<a class="message-image" href="${attachment.url}" target="_blank" rel="noopener">
+                    <img src="${attachment.url}&size=thumb" alt="${name}" loading="lazy">
+                </a>`;
+            }
+            return `<a class="message-file" href="${attachment.downloadUrl}">
+                <i class="fas fa-file"></i> <span>${name}</span>
+                <span class="message-file-size">${this.formatFileSize(attachment.size)}</span>
+            </a>`;
+        }).join('');
+    }
+
+    /**
+     * Upload chosen files so they can be sent with the next message
+     * Files are uploaded straight away; the server checks them and keeps them
+     * private to us until the message is sent.
+     * @param {HTMLInputElement} input - The file input
+     */
+    async handleAttachmentSelect(input) {
+        const files = Array.from(input.files || []);
+        input.value = '';
+        if (files.length === 0) return;
+
+        const formData = new FormData();
+        files.forEach(file => formData.append('attachments[]', file));
+        try {
+            const response = await fetch('/api/chat/attachments/upload', {
+                method: 'POST',
+                credentials: 'include',
+                body: formData
+            });
+            const result = await response.json();
+            if (!response.ok) {
+                throw new Error(result.error || 'Failed to upload attachments');
+            }
+            this.pendingAttachments = [...this.pendingAttachments, ...result.attachments];
+            this.renderAttachmentPreviews();
+        } catch (error) {
+            console.error('Error uploading attachments:', error);
+            const previews = document.getElementById('chat-attachment-previews');
+            if (previews) {
+                previews.hidden = false;
+                const note = document.createElement('div');
+                note.className = 'message-error';
+                note.textContent = error.message;
+                previews.appendChild(note);
+                setTimeout(() => {
+                    note.remove();
+                    previews.hidden = this.pendingAttachments.length === 0;
+                }, 4000);
+            }
+        }
+    }
+
+    /**
+     * Show the attachments waiting to be sent, each with a remove button
+     */
+    renderAttachmentPreviews() {
+        const previews = document.getElementById('chat-attachment-previews');
+        if (!previews) return;
+        previews.hidden = this.pendingAttachments.length === 0;
+        previews.innerHTML = this.pendingAttachments.map(attachment => `
+            <div class="attachment-preview" data-attachment-id="${attachment.id}">
+                ${attachment.kind === 'image'
+                    ? `<img src="${attachment.url}&size=thumb" alt="">`
+                    : '<i class="fas fa-file"></i>'}
+                <span>${this.escapeHtml(attachment.fileName)}</span>
+                <button type="button" title="Remove" onclick="window.chatComponent.removePendingAttachment(${attachment.id})">
+                    <i class="fas fa-times"></i>
+                </button>
+            </div>
+        `).join('');
+    }
+
+    /**
+     * Stop an uploaded attachment from being sent; the server drops it later
+     * @param {number} id - The attachment ID
+     */
+    removePendingAttachment(id) {
+        this.pendingAttachments = this.pendingAttachments.filter(attachment => attachment.id !== id);
+        this.renderAttachmentPreviews();
+    }
+
+    formatFileSize(bytes) {
+        if (bytes < 1024) return `${bytes} B`;
+        if (bytes < 1024 * 1024) return `${(bytes / 1024).toFixed(1)} KB`;
+        return `${(bytes / (1024 * 1024)).toFixed(1)} MB`;
+    }
+
+    // Helper method to escape HTML special characters
+    escapeHtml(unsafe) {
+        if (typeof unsafe !== 'string') return '';
+        return unsafe
+            .replace(/&/g, "&amp;")
+            .replace(/</g, "&lt;")
+            .replace(/>/g, "&gt;")
+            .replace(/"/g, "&quot;")
+            .replace(/'/g, "&#039;");
+    }
+
+    /**
+     * The reaction chips of a message; our own reactions are highlighted
+     * @param {Object} message - The message, with reactions from the server
+     * @returns {string} - HTML for the reactions
+     */
+    reactionsHTML(message) {
+        if (message.deleted || !message.reactions) return '';
+        return message.reactions.map(reaction => {
+            const mine = reaction.user_ids.includes(this.currentUserId);
+            return `<button class="reaction-chip${mine ? ' mine' : ''}" data-action="react" data-emoji="${reaction.emoji}">
+                ${reaction.emoji} <span class="reaction-count">${reaction.count}</span>
+            </button>`;
+        }).join('');
+    }
+
+    /**
+     * The controls shown on a message: quick reactions, and edit and delete
+     * Edit is only offered to the sender while the server still allows it.
+     * @param {Object} message - The message
+     * @param {boolean} isSent - Whether we sent the message
+     * @returns {string} - HTML for the controls
+     */
+    messageActionsHTML(message, isSent) {
+        if (message.deleted) return '';
+        const reactions = this.quickReactions
+            .map(emoji => `<button class="message-action" data-action="react" data-emoji="${emoji}" title="React ${emoji}">${emoji}</button>`)
+            .join('');
+        const sentAt = new Date(message.timestamp).getTime();
+        const editable = isSent && !isNaN(sentAt) && Date.now() - sentAt < this.editWindowMs;
+        return `
+            ${reactions}
+            ${editable ? '<button class="message-action" data-action="edit" title="Edit"><i class="fas fa-pen"></i></button>' : ''}
+            <button class="message-action" data-action="delete" title="Delete"><i class="fas fa-trash"></i></button>
+        `;
+    }
+
+    /**
+     * Redraw the text, reactions and controls of a message already shown
+     * @param {Object} message - The message as stored in this.messages
+     */
+    refreshMessageElement(message) {
+        const messageDiv = document.querySelector(`#messages-container .message[data-id="${message.id}"]`);
+        if (!messageDiv) return;
+        const isSent = message.sender === this.currentUserId;
+        messageDiv.classList.toggle('deleted', !!message.deleted);
+        messageDiv.querySelector('.message-text').innerHTML = this.messageTextHTML(message);
+        messageDiv.querySelector('.message-attachments').innerHTML = this.attachmentsHTML(message);
+        messageDiv.querySelector('.message-reactions').innerHTML = this.reactionsHTML(message);
+        messageDiv.querySelector('.message-actions').innerHTML = this.messageActionsHTML(message, isSent);
+        messageDiv.querySelector('.message-edited').hidden = !message.edited || !!message.deleted;
+    }
+
+    /**
+     * Handle clicks on message controls and reaction chips
+     */
+    setupMessageActions() {
+        const messagesContainer = document.getElementById('messages-container');
+        if (!messagesContainer) return;
+
+        messagesContainer.addEventListener('click', (event) => {
+            const button = event.target.closest('[data-action]');
+            const messageDiv = button && button.closest('.message');
+            if (!messageDiv) return;
+
+            // Messages still waiting for an ack have no ID to change yet
+            const message = this.messages.find(m => String(m.id) === messageDiv.dataset.id);
+            if (!message || typeof message.id !== 'number') return;
+
+            if (button.dataset.action === 'react') {
+                this.toggleReaction(message, button.dataset.emoji);
+            } else if (button.dataset.action === 'edit') {
+                this.startEditing(message, messageDiv);
+            } else if (button.dataset.action === 'delete') {
+                this.deleteMessage(message);
+            }
+        });
+    }
+
+    /**
+     * Send an edit, delete or react request
+     * Uses the chat WebSocket when it is open and the HTTP API otherwise; the
+     * result arrives as a WebSocket event either way.
+     * @param {string} type - 'edit', 'delete' or 'react'
+     * @param {Object} change - The request data, with message_id
+     */
+    async sendMessageChange(type, change) {
+        if (this.socket && this.socket.readyState === WebSocket.OPEN) {
+            this.socket.send(JSON.stringify({ type, ...change }));
+            return;
+        }
+        try {
+            const response = await fetch(`/api/chat/${type}`, {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                credentials: 'include',
+                body: JSON.stringify({ user_id: this.currentUserId, ...change })
+            });
+            if (!response.ok) {
+                this.showMessageError(change.message_id, (await response.text()).trim());
+            }
+        } catch (error) {
+            console.error(`Error sending ${type}:`, error);
+        }
+    }
+
+    /**
+     * Replace a message's text with an editor until it is saved or cancelled
+     * Enter saves, Shift+Enter adds a line and Escape cancels.
+     * @param {Object} message - The message to edit
+     * @param {HTMLElement} messageDiv - Its element
+     */
+    startEditing(message, messageDiv) {
+        const textEl = messageDiv.querySelector('.message-text');
+        if (textEl.querySelector('.message-edit-input')) return;
+
+        textEl.innerHTML = '<textarea class="message-edit-input"></textarea>';
+        const input = textEl.querySelector('.message-edit-input');
+        input.value = message.content_raw || message.content;
+        input.focus();
+
+        const finish = (save) => {
+            const content = input.value.trim();
+            textEl.innerHTML = this.messageTextHTML(message);
+            if (save && content && content !== message.content) {
+                this.sendMessageChange('edit', { message_id: message.id, content });
+            }
+        };
+        input.addEventListener('keydown', (event) => {
+            if (event.key === 'Enter' && !event.shiftKey) {
+                event.preventDefault();
+                finish(true);
+            } else if (event.key === 'Escape') {
+                finish(false);
+            }
+        });
+        input.addEventListener('blur', () => finish(false), { once: true });
+    }
+
+    /**
+     * Delete a message, for everyone if we sent it and the user agrees, else only for us
+     * @param {Object} message - The message to delete
+     */
+    deleteMessage(message) {
+        let deleteFor = 'me';
+        if (message.sender === this.currentUserId) {
+            if (confirm('Delete this message for everyone?\n\nCancel to choose deleting it only for you.')) {
+                deleteFor = 'everyone';
+            } else if (!confirm('Delete this message only for you?')) {
+                return;
+            }
+        } else if (!confirm('Delete this message for you?')) {
+            return;
+        }
+        this.sendMessageChange('delete', { message_id: message.id, for: deleteFor });
+    }
+
+    /**
+     * Add our reaction with an emoji, or remove it if we already reacted with it
+     * @param {Object} message - The message
+     * @param {string} emoji - The reaction
+     */
+    toggleReaction(message, emoji) {
+        const existing = (message.reactions || []).find(reaction => reaction.emoji === emoji);
+        const remove = !!existing && existing.user_ids.includes(this.currentUserId);
+        this.sendMessageChange('react', { message_id: message.id, emoji, remove });
+    }
+
+    /**
+     * Show the new content of an edited message
+     * @param {Object} edited - The message with its edited content
+     */
+    handleMessageEdited(edited) {
+        const message = this.messages.find(m => m.id === edited.id);
+        if (!message) return;
+        Object.assign(message, {
+            content: edited.content,
+            content_raw: edited.content_raw,
+            content_html: edited.content_html,
+            mentions: edited.mentions,
+            edited: true,
+            edited_at: edited.edited_at
+        });
+        this.refreshMessageElement(message);
+    }
+
+    /**
+     * Turn a message deleted for everyone into a tombstone, or remove one deleted for us
+     * @param {Object} deletion - The deletion, with message_id and for
+     */
+    handleMessageDeleted(deletion) {
+        const index = this.messages.findIndex(m => m.id === deletion.message_id);
+        if (index === -1) return;
+
+        if (deletion.for === 'me') {
+            this.messages.splice(index, 1);
+            const messageDiv = document.querySelector(`#messages-container .message[data-id="${deletion.message_id}"]`);
+            if (messageDiv) messageDiv.remove();
+            return;
+        }
+        const message = this.messages[index];
+        Object.assign(message, { content: '', content_raw: '', content_html: '', deleted: true, reactions: [], attachments: [] });
+        this.refreshMessageElement(message);
+    }
+
+    /**
+     * Show a message's reactions after someone reacted
+     * @param {Object} update - The update, with message_id and every reaction on the message
+     */
+    handleReaction(update) {
+        const message = this.messages.find(m => m.id === update.message_id);
+        if (!message) return;
+        message.reactions = update.reactions;
+        this.refreshMessageElement(message);
+    }
+
+    /**
+     * Briefly show why a change to a message was refused
+     * @param {number} messageId - The message
+     * @param {string} error - The reason from the server
+     */
+    showMessageError(messageId, error) {
+        const messageDiv = document.querySelector(`#messages-container .message[data-id="${messageId}"]`);
+        if (!messageDiv) return;
+        const note = document.createElement('div');
+        note.className = 'message-error';
+        note.textContent = error;
+        messageDiv.appendChild(note);
+        setTimeout(() => note.remove(), 4000);
+    }
+
+    /**
+     * Show or hide the search bar
+     */
+    toggleSearch() {
+        const search = document.getElementById('chat-search');
+        if (!search) return;
+        search.hidden = !search.hidden;
+        if (!search.hidden) {
+            document.getElementById('chat-search-input').focus();
+        }
+    }
+
+    /**
+     * Search this conversation shortly after the user stops typing
+     * @param {string} query - The search as typed
+     */
+    handleSearchInput(query) {
+        clearTimeout(this.searchTimer);
+        this.searchTimer = setTimeout(() => this.searchMessages(query), 300);
+    }
+
+    /**
+     * Search this conversation and list the matching messages, newest first
+     * @param {string} query - The search as typed
+     */
+    async searchMessages(query) {
+        const resultsEl = document.getElementById('chat-search-results');
+        if (!resultsEl) return;
+        if (!query.trim()) {
+            resultsEl.innerHTML = '';
+            return;
+        }
+
+        try {
+            const response = await fetch(
+                `/api/chat/search?with=${encodeURIComponent(this.otherUserId)}&q=${encodeURIComponent(query)}`,
+                { credentials: 'include' }
+            );
+            const data = await response.json();
+            if (!response.ok) {
+                throw new Error(data.error || 'Search failed');
+            }
+            if (data.results.length === 0) {
+                resultsEl.innerHTML = '<div class="chat-search-empty">No messages found</div>';
+                return;
+            }
+            // Snippets are escaped by the server, with matches in <mark>
+            resultsEl.innerHTML = data.results.map(result => `
+                <button class="chat-search-result" onclick="window.chatComponent.jumpToMessage(${result.message_id})">
+                    <span class="chat-search-snippet">${result.snippet}</span>
+                    <span class="chat-search-time">${new Date(result.timestamp).toLocaleString()}</span>
+                </button>
+            `).join('');
+        } catch (error) {
+            console.error('Error searching messages:', error);
+            resultsEl.innerHTML = `<div class="chat-search-empty">${this.escapeHtml(error.message)}</div>`;
+        }
+    }
+
+    /**
+     * Show a message with the messages around it, e.g. to open a search result
+     * @param {number} messageId - The message to show
+     */
+    async jumpToMessage(messageId) {
+        try {
+            const response = await fetch(
+                `/api/chat/history?user1=${this.currentUserId}&user2=${this.otherUserId}&around=${messageId}&limit=${this.messagesPerPage * 2}`,
+                { credentials: 'include' }
+            );
+            if (!response.ok) {
+                throw new Error(`Failed to load message: ${response.status}`);
+            }
+            this.messages = await response.json();
+            this.hasMoreMessages = true;
+            this.showingLatest = this.messages.length === 0 || this.messages[this.messages.length - 1].id === this.lastMessageId;
+            this.renderMessages();
+
+            const messageDiv = document.querySelector(`#messages-container .message[data-id="${messageId}"]`);
+            if (messageDiv) {
+                messageDiv.scrollIntoView({ block: 'center' });
+                messageDiv.classList.add('highlighted');
+                setTimeout(() => messageDiv.classList.remove('highlighted'), 2000);
+            }
+        } catch (error) {
+            console.error('Error jumping to message:', error);
+        }
     }
 
     // Clean up resources when navigating away
@@ -1016,29 +1583,12 @@ class ChatComponent {
 
                 // Check if we're near the top and have more messages to load
                 if (messagesContainer.scrollTop < 50 && this.hasMoreMessages && !this.isLoadingMore) {
-                    this.page++;
                     this.fetchMessageHistory(true);
                 }
             }, 2000); // 200ms throttle
         });
     }
 
-    // Refresh the users navigation component to update sorting
-    refreshUsersNav() {
-        console.log('Chat component is triggering users nav refresh to update sorting');
-
-        // Check if the global usersNavComponent exists
-        if (window.usersNavComponent && typeof window.usersNavComponent.refreshUsersList === 'function') {
-            console.log('Calling refreshUsersList to update user order based on latest messages');
-            window.usersNavComponent.refreshUsersList();
-        } else {
-            console.warn('UsersNavComponent not available for refresh');
-
-            // Emit an event for any component that might be listening
-            eventBus.emit('refresh_users_list');
-        }
-    }
-
     renderAdditionalMessages(newMessages) {
         const messagesContainer = document.getElementById('messages-container');
         if (!messagesContainer) return;
@@ -1091,9 +1641,15 @@ class ChatComponent {
 
         // Set message content with status indicator for sent messages
         messageDiv.innerHTML = `
-            <div class="message-content">${this.formatMessageContent(message.content)}</div>
+            <div class="message-content">
+                <div class="message-text">${this.messageTextHTML(message)}</div>
+                <div class="message-attachments">${this.attachmentsHTML(message)}</div>
+                <div class="message-reactions">${this.reactionsHTML(message)}</div>
+            </div>
+            <div class="message-actions">${this.messageActionsHTML(message, isSent)}</div>
             <div class="message-time">
                 ${formattedTime}
+                <span class="message-edited"${message.edited && !message.deleted ? '' : ' hidden'}>(edited)</span>
                 ${isSent ? `<span class="message-status sent" data-message-id="${message.id}">
                     <i class="fas fa-check"></i>
                 </span>` : ''}
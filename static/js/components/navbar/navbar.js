@@ -168,7 +168,7 @@ class NavbarComponent {
             // Define the message handler
             const handleWebSocketMessage = (event) => {
                 try {
-                    const data = JSON.parse(event.data);
+                    const data = websocketService.parseEnvelope(event.data);
                     console.log('NavbarComponent: Received WebSocket message:', data);
 
                     // Handle notification events
@@ -340,9 +340,9 @@ class ProfileComponent {
         console.log('File selected for upload:', file.name, 'Size:', file.size, 'Type:', file.type);
 
         // Validate file type and size on the client side
-        const validTypes = ['image/jpeg', 'image/png', 'image/gif', 'image/jpg'];
+        const validTypes = ['image/jpeg', 'image/png', 'image/gif', 'image/jpg', 'image/webp'];
         if (!validTypes.includes(file.type)) {
-            alert('Please select a valid image file (JPEG, PNG, or GIF)');
+            alert('Please select a valid image file (JPEG, PNG, GIF, or WebP)');
             return;
         }
 
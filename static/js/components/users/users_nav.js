@@ -11,6 +11,10 @@ class UsersNavComponent {
         this.typingTimers = new Map(); // Timers to auto-clear typing status
         this.typingEventUnsubscribe = null; // For event bus cleanup
         this.refreshEventUnsubscribe = null; // For event bus cleanup
+        this.summaryEventUnsubscribe = null; // For event bus cleanup
+        this.presenceStatusUnsubscribe = null; // For event bus cleanup
+        this.myStatus = { status: 'online' }; // The status the current user chose
+        this.presencePickerOpen = false;
     }
 
 
@@ -25,15 +29,20 @@ class UsersNavComponent {
             <div class="users-filter-container">
                 <div class="users-nav-header">
                     <h3><i class="fas fa-users"></i> Users</h3>
+                    <button class="refresh-btn" id="presence-status-btn" title="Set your status" onclick="window.usersNavComponent.togglePresencePicker()">
+                        ${this.myStatus.emoji ? this.escapeHtml(this.myStatus.emoji) : `<span class="status-indicator inline ${this.myStatus.status === 'invisible' ? 'offline' : this.myStatus.status}"></span>`}
+                    </button>
                     <button class="refresh-btn" id="refresh-users-btn" title="Refresh users list" onclick="window.usersNavComponent.refreshUsersList(true)">
                         <i class="fas fa-sync-alt"></i>
                     </button>
                 </div>
+                ${this.presencePickerOpen ? this.renderPresencePicker() : ''}
                 <ul class="users-list">
                     ${filteredUsers.map(user => {
             const userId = user.ID || user.id;
             const userName = user.UserName || user.userName || user.Nickname || user.nickname || user.username || 'Unknown User';
             const isOnline = user.isOnline || user.is_online || false;
+            const presence = this.presenceOf(user);
             const unreadCount = user.unreadCount || 0;
 
             // Get last message time if available
@@ -88,7 +97,7 @@ class UsersNavComponent {
                         <i class="fas fa-user"></i>
                     </div>`
                 }
-                            <span class="status-indicator ${isOnline ? 'online' : 'offline'}"></span>
+                            <span class="status-indicator ${presence}"></span>
                         </div>
                         <div class="user-info">
                             <div class="user-info-row">
@@ -103,10 +112,12 @@ class UsersNavComponent {
                             <span class="status" id="status-${userId}">
                                 ${this.typingUsers.has(userId) ?
                                     '<span class="typing-indicator-text">typing<span class="typing-dots"><span class="dot"></span><span class="dot"></span><span class="dot"></span></span></span>' :
-                                    isOnline ? '<span class="status-text online"><i class="fas fa-circle"></i> Online</span>' :
-                                    '<span class="status-text offline"><i class="fas fa-circle"></i> Offline</span>'
+                                    this.statusHtml(user)
                                 }
                             </span>
+                            ${user.lastMessagePreview ?
+                                `<span class="last-message-preview">${this.escapeHtml(user.lastMessagePreview)}</span>` :
+                                ''}
                         </div>
                     </a>
                 </li>
@@ -143,6 +154,14 @@ class UsersNavComponent {
             this.refreshUsersList(false);
         });
 
+        // Update one user at a time as their conversation changes
+        this.summaryEventUnsubscribe = eventBus.on('conversation_summary', (summary) => {
+            if (this.applyConversationSummary(summary)) {
+                this.sortUsers();
+                this.container.innerHTML = this.render();
+            }
+        });
+
         // If we don't have users data yet, fetch it
         if (!this.users || this.users.length === 0) {
             this.fetchUsers().then(() => {
@@ -169,6 +188,9 @@ class UsersNavComponent {
             // Filter out current user
             this.users = users.filter(user => user.id !== this.currentUserId);
 
+            // Add last message previews from the conversation list
+            await this.fetchConversationSummaries();
+
             // Preserve unread counts from previous state if they exist
             // This prevents the unread count from disappearing when refreshing
             if (this.users && this.users.length > 0) {
@@ -194,6 +216,161 @@ class UsersNavComponent {
         }
     }
 
+    /**
+     * Fetch the current user's conversations and apply them to the users list
+     * Failures leave the list without previews.
+     */
+    async fetchConversationSummaries() {
+        try {
+            const response = await fetch('/api/conversations?limit=50', { credentials: 'include' });
+            if (!response.ok) {
+                throw new Error(`Failed to fetch conversations: ${response.status}`);
+            }
+            const data = await response.json();
+            data.conversations.forEach(summary => this.applyConversationSummary(summary));
+        } catch (error) {
+            console.error('Error fetching conversations:', error);
+        }
+    }
+
+    /**
+     * Apply a direct conversation's summary to the user it is with
+     * @param {Object} summary - A conversation from /api/conversations or a conversation_summary push
+     * @returns {boolean} - True if a user in the list changed
+     */
+    applyConversationSummary(summary) {
+        if (!summary || summary.kind !== 'direct' || !summary.peer) return false;
+
+        const user = this.findUserById(summary.peer.id);
+        if (!user) return false;
+
+        user.unreadCount = summary.unreadCount;
+        user.isOnline = summary.peer.isOnline;
+        const last = summary.lastMessage;
+        if (last) {
+            let preview = last.deleted ? 'Message deleted' :
+                last.snippet || (last.attachments > 0 ? 'Attachment' : '');
+            if (last.senderId === this.currentUserId) {
+                preview = `You: ${preview}`;
+            }
+            user.lastMessageTime = last.sentAt;
+            user.lastMessagePreview = preview;
+        } else {
+            user.lastMessagePreview = '';
+        }
+        return true;
+    }
+
+    // Escape text before showing it as HTML
+    escapeHtml(text) {
+        const div = document.createElement('div');
+        div.textContent = text;
+        return div.innerHTML;
+    }
+
+    /**
+     * The presence class of a user: online, away, dnd or offline
+     * @param {Object} user - A user in the list
+     * @returns {string} - The class for their status indicator and text
+     */
+    presenceOf(user) {
+        return user.presenceStatus || (user.isOnline || user.is_online ? 'online' : 'offline');
+    }
+
+    /**
+     * Render a user's status, showing their custom status if they set one
+     * @param {Object} user - A user in the list
+     * @returns {string} - The status HTML
+     */
+    statusHtml(user) {
+        const presence = this.presenceOf(user);
+        const labels = { online: 'Online', away: 'Away', dnd: 'Do not disturb', offline: 'Offline' };
+        const custom = [user.statusEmoji, user.statusText].filter(Boolean).join(' ');
+        return `<span class="status-text ${presence}" title="${labels[presence]}"><i class="fas fa-circle"></i> ${custom ? this.escapeHtml(custom) : labels[presence]}</span>`;
+    }
+
+    // Render the form for the current user to choose their status
+    renderPresencePicker() {
+        const status = this.myStatus;
+        const quote = text => this.escapeHtml(text || '').replace(/"/g, '&quot;');
+        const options = [['online', 'Online'], ['away', 'Away'], ['dnd', 'Do not disturb'], ['invisible', 'Invisible']];
+        return `
+            <form class="presence-picker" onsubmit="event.preventDefault(); window.usersNavComponent.savePresenceStatus(this)">
+                <div class="presence-picker-row">
+                    <input name="emoji" class="presence-emoji" maxlength="8" placeholder="🙂" value="${quote(status.emoji)}">
+                    <input name="text" maxlength="100" placeholder="What's your status?" value="${quote(status.text)}">
+                </div>
+                <div class="presence-picker-row">
+                    <select name="status">
+                        ${options.map(([value, label]) =>
+                            `<option value="${value}" ${status.status === value ? 'selected' : ''}>${label}</option>`).join('')}
+                    </select>
+                    <select name="expires">
+                        <option value="">Don't clear</option>
+                        <option value="30">30 minutes</option>
+                        <option value="60">1 hour</option>
+                        <option value="240">4 hours</option>
+                        <option value="1440">1 day</option>
+                    </select>
+                    <button type="submit">Save</button>
+                </div>
+                ${status.expires_at ? `<small>Clears at ${new Date(status.expires_at).toLocaleString()}</small>` : ''}
+            </form>`;
+    }
+
+    togglePresencePicker() {
+        this.presencePickerOpen = !this.presencePickerOpen;
+        this.container.innerHTML = this.render();
+    }
+
+    // Load the status the current user chose
+    async fetchPresenceStatus() {
+        try {
+            const response = await fetch('/api/presence/status', { credentials: 'include' });
+            if (!response.ok) {
+                throw new Error(`Failed to fetch status: ${response.status}`);
+            }
+            const data = await response.json();
+            this.myStatus = data.status;
+            this.container.innerHTML = this.render();
+        } catch (error) {
+            console.error('Error fetching status:', error);
+        }
+    }
+
+    /**
+     * Save the status chosen in the presence picker
+     * Other users and this user's other tabs are told over the WebSocket.
+     * @param {HTMLFormElement} form - The presence picker
+     */
+    async savePresenceStatus(form) {
+        const minutes = parseInt(form.elements.expires.value, 10);
+        const status = {
+            status: form.elements.status.value,
+            text: form.elements.text.value,
+            emoji: form.elements.emoji.value.trim(),
+            expires_at: minutes ? new Date(Date.now() + minutes * 60000).toISOString() : null
+        };
+        try {
+            const response = await fetch('/api/presence/status', {
+                method: 'POST',
+                credentials: 'include',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify(status)
+            });
+            const data = await response.json();
+            if (!response.ok) {
+                throw new Error(data.error || `Failed to save status: ${response.status}`);
+            }
+            this.myStatus = data.status;
+            this.presencePickerOpen = false;
+            this.container.innerHTML = this.render();
+        } catch (error) {
+            console.error('Error saving status:', error);
+            alert(error.message);
+        }
+    }
+
     // Helper method to find a user by ID in the current users array
     findUserById(userId) {
         if (!this.users) return null;
@@ -378,48 +555,20 @@ class UsersNavComponent {
         // Set up event listeners for WebSocket events
         this.userStatusUnsubscribe = eventBus.on('user_status_change', (data) => {
             console.log('Received user_status_change event:', data);
-            this.updateUserStatus(data.userId, data.isOnline);
+            this.updateUserStatus(data.userId, data.isOnline, data);
         });
 
+        this.presenceStatusUnsubscribe = eventBus.on('presence_status', (status) => {
+            this.myStatus = status;
+            this.container.innerHTML = this.render();
+        });
+        this.fetchPresenceStatus();
+
         this.userSignupUnsubscribe = eventBus.on('user_signup', (data) => {
             console.log('Received user_signup event:', data);
             this.addNewUser(data);
         });
 
-        this.usersListUpdateUnsubscribe = eventBus.on('users_list_update', (users) => {
-            console.log('Received users_list_update event:', users);
-
-            // Store current users to preserve unread counts
-            const currentUsers = this.users ? [...this.users] : [];
-
-            // Filter out current user
-            const filteredUsers = users.filter(user => {
-                const userId = user.ID || user.id;
-                return userId !== this.currentUserId;
-            });
-
-            // Preserve unread counts from current state
-            if (currentUsers.length > 0 && filteredUsers.length > 0) {
-                filteredUsers.forEach(user => {
-                    const userId = user.ID || user.id;
-                    // Find the user in the current list
-                    const currentUser = currentUsers.find(u => {
-                        const id = u.ID || u.id;
-                        return id === userId;
-                    });
-
-                    // If the user exists and has an unread count, preserve it
-                    if (currentUser && currentUser.unreadCount && currentUser.unreadCount > 0) {
-                        console.log(`Preserving unread count for user ${userId} in users_list_update: ${currentUser.unreadCount}`);
-                        user.unreadCount = currentUser.unreadCount;
-                    }
-                });
-            }
-
-            this.users = filteredUsers;
-            this.container.innerHTML = this.render();
-        });
-
         // Initialize the WebSocket service if not already initialized
         if (!websocketService.connected) {
             websocketService.initialize()
@@ -478,6 +627,16 @@ class UsersNavComponent {
             this.refreshEventUnsubscribe = null;
         }
 
+        if (this.presenceStatusUnsubscribe) {
+            this.presenceStatusUnsubscribe();
+            this.presenceStatusUnsubscribe = null;
+        }
+
+        if (this.summaryEventUnsubscribe) {
+            this.summaryEventUnsubscribe();
+            this.summaryEventUnsubscribe = null;
+        }
+
         // Unsubscribe from WebSocket events
         if (this.userStatusUnsubscribe) {
             this.userStatusUnsubscribe();
@@ -489,10 +648,6 @@ class UsersNavComponent {
             this.userSignupUnsubscribe = null;
         }
 
-        if (this.usersListUpdateUnsubscribe) {
-            this.usersListUpdateUnsubscribe();
-            this.usersListUpdateUnsubscribe = null;
-        }
 
         if (this.container) {
             this.container.innerHTML = '';
@@ -539,6 +694,7 @@ class UsersNavComponent {
 
         const userLink = userElement.querySelector('.user-link');
         const isOnline = userElement.getAttribute('data-online') === 'true';
+        const user = this.users.find(u => (u.ID || u.id) === userId) || { isOnline };
 
         if (isTyping) {
             // Update status text
@@ -552,9 +708,7 @@ class UsersNavComponent {
             }
         } else {
             // Update status text
-            statusElement.innerHTML = isOnline ?
-                '<span class="status-text online"><i class="fas fa-circle"></i> Online</span>' :
-                '<span class="status-text offline"><i class="fas fa-circle"></i> Offline</span>';
+            statusElement.innerHTML = this.statusHtml(user);
 
             // Remove is-typing class from the user link
             if (userLink) {
@@ -563,8 +717,14 @@ class UsersNavComponent {
         }
     }
 
-    updateUserStatus(userId, isOnline) {
-        console.log(`Updating user ${userId} status to ${isOnline ? 'online' : 'offline'}`);
+    /**
+     * Update a user's presence in the list
+     * @param {string} userId - The user
+     * @param {boolean} isOnline - Whether they are online, away or in do not disturb
+     * @param {Object} presence - Their status, custom text and emoji, if known
+     */
+    updateUserStatus(userId, isOnline, presence = {}) {
+        console.log(`Updating user ${userId} status to ${presence.status || (isOnline ? 'online' : 'offline')}`);
 
         // Update our internal users array
         const userIndex = this.users.findIndex(user => {
@@ -572,8 +732,9 @@ class UsersNavComponent {
             return id === userId;
         });
 
+        let user = { isOnline, presenceStatus: presence.status, statusText: presence.text, statusEmoji: presence.emoji };
         if (userIndex !== -1) {
-            this.users[userIndex].isOnline = isOnline;
+            user = Object.assign(this.users[userIndex], user);
         }
 
         // Find the user element in the DOM
@@ -582,18 +743,16 @@ class UsersNavComponent {
             // Update the data-online attribute
             userElement.setAttribute('data-online', isOnline);
 
-            // Update the status text
+            // Update the status text, unless the user is typing
             const statusElement = userElement.querySelector('.status');
-            if (statusElement) {
-                statusElement.innerHTML = isOnline ?
-                    '<span class="status-text online"><i class="fas fa-circle"></i> Online</span>' :
-                    '<span class="status-text offline"><i class="fas fa-circle"></i> Offline</span>';
+            if (statusElement && !this.typingUsers.has(userId)) {
+                statusElement.innerHTML = this.statusHtml(user);
             }
 
             // Update the status indicator
             const statusIndicator = userElement.querySelector('.status-indicator');
             if (statusIndicator) {
-                statusIndicator.className = `status-indicator ${isOnline ? 'online' : 'offline'}`;
+                statusIndicator.className = `status-indicator ${this.presenceOf(user)}`;
             }
 
             // If we're filtering by online users, show/hide accordingly
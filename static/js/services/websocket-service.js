@@ -15,6 +15,27 @@ class WebSocketService {
         this.userStatuses = new Map(); // Track user statuses
         this.currentUserId = null;
         this.pendingMessages = []; // Store messages that couldn't be sent due to disconnection
+        this.topics = new Set(['presence']); // Topics to subscribe to on every connection
+
+        // Heartbeats keep us shown online while the user is active; the
+        // server shows us away once they stop
+        this.heartbeatInterval = 60000; // 1 minute
+        this.lastActivity = Date.now();
+        ['mousemove', 'keydown', 'click', 'scroll', 'touchstart'].forEach(type =>
+            document.addEventListener(type, () => { this.lastActivity = Date.now(); }, { passive: true }));
+        setInterval(() => {
+            if (this.connected && !document.hidden && Date.now() - this.lastActivity < this.heartbeatInterval) {
+                this.sendPresence();
+            }
+        }, this.heartbeatInterval);
+
+        // Tell other users we are away while the page is hidden
+        document.addEventListener('visibilitychange', () => {
+            this.lastActivity = Date.now();
+            if (this.connected) {
+                this.sendPresence();
+            }
+        });
     }
 
     /**
@@ -51,6 +72,12 @@ class WebSocketService {
                 this.connected = true;
                 this.reconnectAttempts = 0;
 
+                // Subscriptions do not survive a reconnect
+                this.topics.forEach(topic => this.send({ type: 'subscribe', topic }));
+                if (document.hidden) {
+                    this.sendPresence();
+                }
+
                 // Send any pending messages
                 if (this.pendingMessages.length > 0) {
                     console.log(`Sending ${this.pendingMessages.length} pending messages`);
@@ -94,7 +121,7 @@ class WebSocketService {
      */
     handleMessage(event) {
         try {
-            const data = JSON.parse(event.data);
+            const data = this.parseEnvelope(event.data);
             console.log('Received WebSocket message type:', data.type);
 
             // Special handling for notification events
@@ -114,18 +141,26 @@ class WebSocketService {
             }
 
             switch (data.type) {
-                case 'user_status':
-                    this.handleUserStatus(data);
+                case 'presence':
+                case 'presence_snapshot':
+                    this.handlePresence(data);
+                    break;
+                case 'presence_status':
+                    eventBus.emit('presence_status', {
+                        status: data.status,
+                        text: data.text,
+                        emoji: data.emoji,
+                        expires_at: data.expires_at
+                    });
                     break;
                 case 'new_user':
                     this.handleNewUser(data);
                     break;
                 case 'message':
-                case 'refresh_users':
                     this.handleRefreshUsers(data);
                     break;
-                case 'users_list':
-                    this.handleUsersList(data);
+                case 'conversation_summary':
+                    this.handleConversationSummary(data);
                     break;
                 case 'typing':
                 case 'stop_typing':
@@ -139,6 +174,43 @@ class WebSocketService {
         }
     }
 
+    /**
+     * Parse a message from the server
+     * Payloads arrive in versioned envelopes; they are flattened so handlers
+     * can keep reading fields next to the type.
+     * @param {string} text - The raw message
+     * @returns {Object} - The payload with its type and topic
+     */
+    parseEnvelope(text) {
+        const envelope = JSON.parse(text);
+        if (!envelope.v) {
+            return envelope;
+        }
+        return { ...envelope.data, type: envelope.type, topic: envelope.topic };
+    }
+
+    /**
+     * Subscribe to a topic such as post:12 or category:3
+     * @param {string} topic - The topic to subscribe to
+     */
+    subscribe(topic) {
+        this.topics.add(topic);
+        if (this.connected) {
+            this.send({ type: 'subscribe', topic });
+        }
+    }
+
+    /**
+     * Unsubscribe from a topic
+     * @param {string} topic - The topic to unsubscribe from
+     */
+    unsubscribe(topic) {
+        this.topics.delete(topic);
+        if (this.connected) {
+            this.send({ type: 'unsubscribe', topic });
+        }
+    }
+
     /**
      * Handle typing status updates
      * @param {Object} data - The typing status data
@@ -156,22 +228,43 @@ class WebSocketService {
     }
 
     /**
-     * Handle user status updates
-     * @param {Object} data - The status update data
+     * Handle presence changes and the snapshot sent on subscribing
+     * Only users whose status changed are sent; a snapshot lists the users
+     * online, away or in do not disturb, so anyone it leaves out is offline.
+     * @param {Object} data - The users and their status
      */
-    handleUserStatus(data) {
-        console.log('Received status update:', data);
-
-        // Store the user status
-        this.userStatuses.set(data.user_id, data.is_online);
+    handlePresence(data) {
+        const users = data.users || [];
+        if (data.type === 'presence_snapshot' && data.topic === 'presence') {
+            const listed = new Set(users.map(user => user.user_id));
+            this.userStatuses.forEach((isOnline, userId) => {
+                if (isOnline && !listed.has(userId)) {
+                    users.push({ user_id: userId, status: 'offline' });
+                }
+            });
+        }
 
-        // Emit an event for components to listen to
-        eventBus.emit('user_status_change', {
-            userId: data.user_id,
-            isOnline: data.is_online
+        users.forEach(user => {
+            const isOnline = user.status !== 'offline';
+            this.userStatuses.set(user.user_id, isOnline);
+            eventBus.emit('user_status_change', {
+                userId: user.user_id,
+                isOnline,
+                status: user.status,
+                text: user.text || '',
+                emoji: user.emoji || '',
+                lastSeen: user.last_seen || null
+            });
         });
     }
 
+    /**
+     * Send a heartbeat: online while the tab is visible, away while hidden
+     */
+    sendPresence() {
+        this.send({ type: 'presence', status: document.hidden ? 'away' : 'online' });
+    }
+
     /**
      * Handle new user notifications
      * @param {Object} data - The new user data
@@ -199,6 +292,17 @@ class WebSocketService {
         eventBus.emit('refresh_users_list');
     }
 
+    /**
+     * Handle a conversation's new entry in the conversation list
+     * Sent when a message is sent, edited, deleted or read, so the list
+     * updates one entry instead of being fetched again.
+     * @param {Object} data - The conversation summary
+     */
+    handleConversationSummary(data) {
+        const { type, topic, ...summary } = data;
+        eventBus.emit('conversation_summary', summary);
+    }
+
     /**
      * Handle new notifications
      * @param {Object} data - The notification data
@@ -255,27 +359,6 @@ class WebSocketService {
         }
     }
 
-    /**
-     * Handle users list updates
-     * @param {Object} data - The users list data
-     */
-    handleUsersList(data) {
-        console.log('Received users list update:', data);
-
-        // Update user statuses from the list
-        if (data.users && Array.isArray(data.users)) {
-            data.users.forEach(user => {
-                if (user.ID || user.id) {
-                    const userId = user.ID || user.id;
-                    this.userStatuses.set(userId, user.isOnline || user.is_online || false);
-                }
-            });
-        }
-
-        // Emit an event for the users_nav component
-        eventBus.emit('users_list_update', data.users);
-    }
-
     // Notification sound removed as per user request
 
     /**
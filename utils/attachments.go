@@ -0,0 +1,343 @@
+package utils
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Attachment kinds
+// Images are shown in the post's gallery; files are offered as downloads.
+const (
+	AttachmentKindImage = "image"
+	AttachmentKindFile  = "file"
+)
+
+// Attachment is an image or file uploaded with a post
+type Attachment struct {
+	ID          int64      `json:"id"`               // Unique identifier
+	PostID      int64      `json:"postId"`           // The post the attachment belongs to
+	Kind        string     `json:"kind"`             // "image" or "file"
+	FileName    string     `json:"fileName"`         // Original file name, used for downloads
+	ContentType string     `json:"contentType"`      // MIME type the file is served with
+	Size        int64      `json:"size"`             // Size in bytes
+	Width       int        `json:"width,omitempty"`  // Image width in pixels
+	Height      int        `json:"height,omitempty"` // Image height in pixels
+	Checksum    string     `json:"checksum"`         // SHA-256 of the content, hex encoded
+	Position    int        `json:"position"`         // Order in the post's gallery
+	URL         string     `json:"url"`              // Inline URL, for showing images
+	DownloadURL string     `json:"downloadUrl"`      // URL that downloads the file under its original name
+	StoragePath string     `json:"-"`                // Where the content is stored
+	Image       *ImageInfo `json:"image,omitempty"`  // Renditions of an image attachment
+}
+
+// AttachmentPolicy limits the size and types of one kind of attachment
+type AttachmentPolicy struct {
+	Kind    string
+	MaxSize int64             // Maximum size in bytes
+	Types   map[string]string // Allowed extensions and the content type served for each
+}
+
+// Attachment policies, adjustable at startup with LoadAttachmentPolicies
+var (
+	ImageAttachmentPolicy = AttachmentPolicy{
+		Kind:    AttachmentKindImage,
+		MaxSize: 10 << 20,
+		Types: map[string]string{
+			".jpg":  "image/jpeg",
+			".jpeg": "image/jpeg",
+			".png":  "image/png",
+			".gif":  "image/gif",
+			".webp": "image/webp",
+		},
+	}
+	FileAttachmentPolicy = AttachmentPolicy{
+		Kind:    AttachmentKindFile,
+		MaxSize: 20 << 20,
+		Types: map[string]string{
+			".pdf":  "application/pdf",
+			".txt":  "text/plain; charset=utf-8",
+			".md":   "text/markdown; charset=utf-8",
+			".csv":  "text/csv; charset=utf-8",
+			".json": "application/json",
+			".log":  "text/plain; charset=utf-8",
+			".go":   "text/plain; charset=utf-8",
+			".py":   "text/plain; charset=utf-8",
+			".js":   "text/plain; charset=utf-8",
+			".ts":   "text/plain; charset=utf-8",
+			".java": "text/plain; charset=utf-8",
+			".c":    "text/plain; charset=utf-8",
+			".h":    "text/plain; charset=utf-8",
+			".cpp":  "text/plain; charset=utf-8",
+			".rs":   "text/plain; charset=utf-8",
+			".rb":   "text/plain; charset=utf-8",
+			".sh":   "text/plain; charset=utf-8",
+			".sql":  "text/plain; charset=utf-8",
+			".yaml": "text/plain; charset=utf-8",
+			".yml":  "text/plain; charset=utf-8",
+			".html": "text/plain; charset=utf-8",
+			".css":  "text/plain; charset=utf-8",
+		},
+	}
+	MaxAttachmentsPerPost = 10
+)
+
+// LoadAttachmentPolicies applies attachment limits from the environment
+// Variables: ATTACHMENT_MAX_IMAGE_MB, ATTACHMENT_MAX_FILE_MB,
+// ATTACHMENT_MAX_PER_POST and ATTACHMENT_FILE_TYPES (a comma-separated list
+// of extensions that narrows the allowed file types). Unset variables keep
+// the defaults.
+// @param getenv - Looks up an environment variable, usually os.Getenv
+// @returns error - An error naming the first invalid variable
+func LoadAttachmentPolicies(getenv func(string) string) error {
+	limits := []struct {
+		name   string
+		target *int64
+		scale  int64
+	}{
+		{"ATTACHMENT_MAX_IMAGE_MB", &ImageAttachmentPolicy.MaxSize, 1 << 20},
+		{"ATTACHMENT_MAX_FILE_MB", &FileAttachmentPolicy.MaxSize, 1 << 20},
+	}
+	for _, limit := range limits {
+		value := getenv(limit.name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("%s must be a positive number", limit.name)
+		}
+		*limit.target = n * limit.scale
+	}
+
+	if value := getenv("ATTACHMENT_MAX_PER_POST"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("ATTACHMENT_MAX_PER_POST must be a non-negative number")
+		}
+		MaxAttachmentsPerPost = n
+	}
+
+	if value := getenv("ATTACHMENT_FILE_TYPES"); value != "" {
+		allowed := make(map[string]string)
+		for _, ext := range strings.Split(value, ",") {
+			ext = strings.ToLower(strings.TrimSpace(ext))
+			if ext == "" {
+				continue
+			}
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			contentType, ok := FileAttachmentPolicy.Types[ext]
+			if !ok {
+				return fmt.Errorf("ATTACHMENT_FILE_TYPES: unsupported file type %s", ext)
+			}
+			allowed[ext] = contentType
+		}
+		FileAttachmentPolicy.Types = allowed
+	}
+
+	return nil
+}
+
+// AttachmentPolicyFor finds the policy that accepts a file name
+// @param fileName - The uploaded file name
+// @returns AttachmentPolicy - The policy for the file's kind
+// @returns string - The content type the file is served with
+// @returns error - A client-facing error if the type is not allowed
+func AttachmentPolicyFor(fileName string) (AttachmentPolicy, string, error) {
+	ext := strings.ToLower(filepath.Ext(fileName))
+	for _, policy := range []AttachmentPolicy{ImageAttachmentPolicy, FileAttachmentPolicy} {
+		if contentType, ok := policy.Types[ext]; ok {
+			return policy, contentType, nil
+		}
+	}
+	return AttachmentPolicy{}, "", fmt.Errorf("File type %q is not allowed", ext)
+}
+
+// CheckFileContent checks that the start of a file attachment matches its type
+// Only the content is trusted: PDFs must carry the PDF signature and text
+// types must not contain NUL bytes, which rules out renamed binaries.
+// @param head - The first bytes of the file, up to 512
+// @param contentType - The content type chosen from the file's extension
+// @returns error - An *UploadError of kind UploadInvalidType if the content does not match
+func CheckFileContent(head []byte, contentType string) error {
+	switch {
+	case contentType == "application/pdf":
+		if !bytes.HasPrefix(head, []byte("%PDF-")) {
+			return uploadError(UploadInvalidType, "missing PDF signature")
+		}
+	case strings.HasPrefix(contentType, "text/"), contentType == "application/json":
+		if bytes.IndexByte(head, 0) >= 0 {
+			return uploadError(UploadInvalidType, "binary content in a text file")
+		}
+	}
+	return nil
+}
+
+// CreateAttachment records a stored attachment at the end of a post's gallery
+// @param db - Database connection or transaction
+// @param attachment - The attachment; PostID, Kind, FileName, ContentType,
+// Size, Checksum and StoragePath must be set
+// @returns int64 - The new attachment ID
+// @returns error - Any database error
+func CreateAttachment(db DBExecutor, attachment *Attachment) (int64, error) {
+	result, err := db.Exec(`
+		INSERT INTO attachments (post_id, kind, file_name, content_type, size, width, height,
+		                         checksum, storage_path, position)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?,
+		        (SELECT COALESCE(MAX(position) + 1, 0) FROM attachments WHERE post_id = ?))
+	`, attachment.PostID, attachment.Kind, attachment.FileName, attachment.ContentType, attachment.Size,
+		attachment.Width, attachment.Height, attachment.Checksum, attachment.StoragePath, attachment.PostID)
+	if err != nil {
+		return 0, fmt.Errorf("error creating attachment: %v", err)
+	}
+	return result.LastInsertId()
+}
+
+// GetAttachment loads one attachment
+// @param db - Database connection
+// @param id - The attachment ID
+// @returns *Attachment - The attachment with its URLs
+// @returns error - sql.ErrNoRows if it does not exist, or any database error
+func GetAttachment(db *sql.DB, id int64) (*Attachment, error) {
+	rows, err := db.Query(attachmentSelect+" WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	attachments, err := scanAttachments(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(attachments) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &attachments[0], nil
+}
+
+// GetPostAttachments loads the attachments of several posts in gallery order
+// @param db - Database connection
+// @param postIDs - The posts to load attachments for
+// @returns map[int64][]Attachment - Attachments keyed by post ID
+// @returns error - Any database error
+func GetPostAttachments(db *sql.DB, postIDs []int64) (map[int64][]Attachment, error) {
+	byPost := make(map[int64][]Attachment)
+	if len(postIDs) == 0 {
+		return byPost, nil
+	}
+
+	placeholders := make([]string, len(postIDs))
+	args := make([]interface{}, len(postIDs))
+	for i, id := range postIDs {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+
+	rows, err := db.Query(
+		attachmentSelect+" WHERE post_id IN ("+strings.Join(placeholders, ",")+") ORDER BY post_id, position, id",
+		args...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error loading attachments: %v", err)
+	}
+	attachments, err := scanAttachments(rows)
+	if err != nil {
+		return nil, err
+	}
+	for _, attachment := range attachments {
+		byPost[attachment.PostID] = append(byPost[attachment.PostID], attachment)
+	}
+	return byPost, nil
+}
+
+// ReorderAttachments sets the gallery order of a post's attachments
+// @param db - Database connection
+// @param postID - The post
+// @param ids - Every attachment ID of the post, in the new order
+// @returns error - An error if the IDs do not match the post's attachments
+func ReorderAttachments(db *sql.DB, postID int64, ids []int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var count int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM attachments WHERE post_id = ?", postID).Scan(&count); err != nil {
+		return err
+	}
+	seen := make(map[int64]bool)
+	for _, id := range ids {
+		seen[id] = true
+	}
+	if len(seen) != count || len(ids) != count {
+		return fmt.Errorf("the new order must list every attachment of the post once")
+	}
+
+	for position, id := range ids {
+		result, err := tx.Exec(
+			"UPDATE attachments SET position = ? WHERE id = ? AND post_id = ?", position, id, postID,
+		)
+		if err != nil {
+			return err
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			return fmt.Errorf("attachment %d does not belong to the post", id)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// attachmentImageInfo describes the renditions stored for an image attachment
+// Image attachments are stored in every PostImageSizes rendition, the full
+// one being the attachment itself.
+func attachmentImageInfo(a Attachment) *ImageInfo {
+	var renditions []ImageRendition
+	for _, size := range PostImageSizes {
+		width, height := a.Width, a.Height
+		if width > size.MaxWidth {
+			width, height = size.MaxWidth, a.Height*size.MaxWidth/a.Width
+			if height < 1 {
+				height = 1
+			}
+		}
+		url := a.URL
+		if size.Name != "full" {
+			url += "&size=" + size.Name
+		}
+		renditions = append(renditions, ImageRendition{Name: size.Name, URL: url, Width: width, Height: height})
+	}
+	return NewImageInfo(renditions)
+}
+
+// attachmentSelect selects the columns read by scanAttachments
+const attachmentSelect = `
+	SELECT id, post_id, kind, file_name, content_type, size, width, height,
+	       checksum, storage_path, position
+	FROM attachments`
+
+// scanAttachments reads attachment rows and fills in their URLs
+func scanAttachments(rows *sql.Rows) ([]Attachment, error) {
+	defer rows.Close()
+
+	var attachments []Attachment
+	for rows.Next() {
+		var a Attachment
+		err := rows.Scan(&a.ID, &a.PostID, &a.Kind, &a.FileName, &a.ContentType, &a.Size, &a.Width, &a.Height,
+			&a.Checksum, &a.StoragePath, &a.Position)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning attachment: %v", err)
+		}
+		a.URL = fmt.Sprintf("/api/attachments/view?id=%d", a.ID)
+		a.DownloadURL = fmt.Sprintf("/api/attachments/download?id=%d", a.ID)
+		if a.Kind == AttachmentKindImage && a.Width > 0 {
+			a.Image = attachmentImageInfo(a)
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestAttachmentPolicyFor(t *testing.T) {
+	tests := []struct {
+		name     string
+		fileName string
+		wantKind string
+		wantType string
+		wantErr  bool
+	}{
+		{"WebP image", "photo.WEBP", AttachmentKindImage, "image/webp", false},
+		{"PDF", "report.pdf", AttachmentKindFile, "application/pdf", false},
+		{"Code is served as text", "main.go", AttachmentKindFile, "text/plain; charset=utf-8", false},
+		{"Executable", "setup.exe", "", "", true},
+		{"No extension", "README", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, contentType, err := AttachmentPolicyFor(tt.fileName)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AttachmentPolicyFor(%q) error = %v, wantErr %v", tt.fileName, err, tt.wantErr)
+			}
+			if policy.Kind != tt.wantKind || contentType != tt.wantType {
+				t.Errorf("AttachmentPolicyFor(%q) = %s, %s, want %s, %s",
+					tt.fileName, policy.Kind, contentType, tt.wantKind, tt.wantType)
+			}
+		})
+	}
+}
+
+func TestLoadAttachmentPolicies(t *testing.T) {
+	image, file, maxCount := ImageAttachmentPolicy, FileAttachmentPolicy, MaxAttachmentsPerPost
+	defer func() {
+		ImageAttachmentPolicy, FileAttachmentPolicy, MaxAttachmentsPerPost = image, file, maxCount
+	}()
+
+	env := map[string]string{
+		"ATTACHMENT_MAX_IMAGE_MB": "5",
+		"ATTACHMENT_MAX_PER_POST": "3",
+		"ATTACHMENT_FILE_TYPES":   "pdf, .txt",
+	}
+	if err := LoadAttachmentPolicies(func(key string) string { return env[key] }); err != nil {
+		t.Fatalf("LoadAttachmentPolicies() error = %v", err)
+	}
+	if ImageAttachmentPolicy.MaxSize != 5<<20 || MaxAttachmentsPerPost != 3 || len(FileAttachmentPolicy.Types) != 2 {
+		t.Errorf("LoadAttachmentPolicies() = %d bytes, %d per post, %d file types",
+			ImageAttachmentPolicy.MaxSize, MaxAttachmentsPerPost, len(FileAttachmentPolicy.Types))
+	}
+
+	env = map[string]string{"ATTACHMENT_FILE_TYPES": "exe"}
+	if err := LoadAttachmentPolicies(func(key string) string { return env[key] }); err == nil {
+		t.Error("LoadAttachmentPolicies() accepted an unsupported file type")
+	}
+}
@@ -0,0 +1,228 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// UploadMigration reports what MigrateUploads moved
+type UploadMigration struct {
+	Images      int      // Post images and avatars moved
+	Attachments int      // Attachments moved
+	Blobs       int      // Blobs written, including renditions
+	Bytes       int64    // Total size of the blobs written
+	Missing     []string // Stored paths whose files no longer exist
+}
+
+// MigrateUploads copies uploads stored on local disk into a blob store
+// Post images and avatars stored under /static/uploads/ and attachments
+// stored in attachmentDir are written under content-addressed keys, with
+// their renditions, and the database is pointed at the new keys. The old
+// files are left in place so they can be removed once the move is checked.
+// Values that are already migrated are skipped, so the migration can be run
+// again after a partial failure.
+// @param ctx - Context for the blob store requests
+// @param db - Database connection
+// @param store - The store to move uploads into
+// @param imageDir - The directory /static/uploads/ is served from
+// @param attachmentDir - The directory attachments were stored in
+// @param dryRun - Report what would be moved without writing anything
+// @returns UploadMigration - What was moved, or would be moved in a dry run
+// @returns error - The first storage or database error
+func MigrateUploads(ctx context.Context, db *sql.DB, store BlobStore, imageDir, attachmentDir string, dryRun bool) (UploadMigration, error) {
+	var report UploadMigration
+
+	imagePaths, err := queryStrings(db, `
+		SELECT imagepath FROM posts WHERE imagepath LIKE '/static/uploads/%'
+		UNION
+		SELECT profile_pic FROM users WHERE profile_pic LIKE '/static/uploads/%'
+	`)
+	if err != nil {
+		return report, fmt.Errorf("error listing images: %v", err)
+	}
+	for _, imagePath := range imagePaths {
+		if err := migrateImage(ctx, db, store, imageDir, imagePath, dryRun, &report); err != nil {
+			return report, err
+		}
+	}
+
+	rows, err := db.Query("SELECT id, kind, storage_path FROM attachments WHERE storage_path NOT LIKE '%/%'")
+	if err != nil {
+		return report, fmt.Errorf("error listing attachments: %v", err)
+	}
+	var attachments []Attachment
+	for rows.Next() {
+		var a Attachment
+		if err := rows.Scan(&a.ID, &a.Kind, &a.StoragePath); err != nil {
+			rows.Close()
+			return report, fmt.Errorf("error scanning attachment: %v", err)
+		}
+		attachments = append(attachments, a)
+	}
+	rows.Close()
+	for _, attachment := range attachments {
+		if err := migrateAttachment(ctx, db, store, attachmentDir, attachment, dryRun, &report); err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// migrateImage moves one image and its renditions into the store
+func migrateImage(ctx context.Context, db *sql.DB, store BlobStore, imageDir, imagePath string, dryRun bool, report *UploadMigration) error {
+	data, err := os.ReadFile(filepath.Join(imageDir, path.Base(imagePath)))
+	if os.IsNotExist(err) {
+		report.Missing = append(report.Missing, imagePath)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error reading %s: %v", imagePath, err)
+	}
+	key := ContentKey(data, path.Ext(imagePath))
+	newPath := MediaURL(key)
+
+	// Images uploaded before processing existed only have the full file
+	renditions := []ImageRendition{{Name: "full", URL: imagePath}}
+	rows, err := db.Query("SELECT name, path, width, height FROM image_renditions WHERE image_path = ?", imagePath)
+	if err != nil {
+		return fmt.Errorf("error loading renditions of %s: %v", imagePath, err)
+	}
+	for rows.Next() {
+		var rendition ImageRendition
+		if err := rows.Scan(&rendition.Name, &rendition.URL, &rendition.Width, &rendition.Height); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning rendition of %s: %v", imagePath, err)
+		}
+		if rendition.Name == "full" {
+			renditions[0] = rendition
+		} else {
+			renditions = append(renditions, rendition)
+		}
+	}
+	rows.Close()
+
+	var blobs []Blob
+	for _, rendition := range renditions {
+		content := data
+		if rendition.Name != "full" {
+			content, err = os.ReadFile(filepath.Join(imageDir, path.Base(rendition.URL)))
+			if err != nil {
+				return fmt.Errorf("error reading %s: %v", rendition.URL, err)
+			}
+		}
+		renditionKey := RenditionPath(key, rendition.Name)
+		blobs = append(blobs, Blob{Key: renditionKey, Data: content, ContentType: blobContentType(renditionKey)})
+	}
+	report.Images++
+	if err := storeMigratedUpload(ctx, db, store, key, blobs, dryRun, report); err != nil || dryRun {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, rendition := range renditions {
+		if rendition.Width == 0 {
+			continue // A legacy image without recorded renditions
+		}
+		_, err := tx.Exec(`
+			INSERT INTO image_renditions (image_path, name, path, width, height)
+			VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (image_path, name) DO UPDATE SET
+				path = excluded.path, width = excluded.width, height = excluded.height
+		`, newPath, rendition.Name, RenditionPath(newPath, rendition.Name), rendition.Width, rendition.Height)
+		if err != nil {
+			return fmt.Errorf("error saving renditions of %s: %v", newPath, err)
+		}
+	}
+	statements := []string{
+		"DELETE FROM image_renditions WHERE image_path = ?2",
+		"UPDATE posts SET imagepath = ?1 WHERE imagepath = ?2",
+		"UPDATE users SET profile_pic = ?1 WHERE profile_pic = ?2",
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, newPath, imagePath); err != nil {
+			return fmt.Errorf("error pointing %s at %s: %v", imagePath, newPath, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// migrateAttachment moves one attachment, and the renditions of an image, into the store
+func migrateAttachment(ctx context.Context, db *sql.DB, store BlobStore, attachmentDir string, attachment Attachment, dryRun bool, report *UploadMigration) error {
+	data, err := os.ReadFile(filepath.Join(attachmentDir, filepath.Base(attachment.StoragePath)))
+	if os.IsNotExist(err) {
+		report.Missing = append(report.Missing, attachment.StoragePath)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error reading attachment %d: %v", attachment.ID, err)
+	}
+	key := ContentKey(data, path.Ext(attachment.StoragePath))
+
+	blobs := []Blob{{Key: key, Data: data, ContentType: blobContentType(key)}}
+	if attachment.Kind == AttachmentKindImage {
+		for _, size := range PostImageSizes {
+			if size.Name == "full" {
+				continue
+			}
+			oldPath := filepath.Join(attachmentDir, filepath.Base(RenditionPath(attachment.StoragePath, size.Name)))
+			content, err := os.ReadFile(oldPath)
+			if os.IsNotExist(err) {
+				continue // Stored before renditions existed
+			} else if err != nil {
+				return fmt.Errorf("error reading %s: %v", oldPath, err)
+			}
+			renditionKey := RenditionPath(key, size.Name)
+			blobs = append(blobs, Blob{Key: renditionKey, Data: content, ContentType: blobContentType(renditionKey)})
+		}
+	}
+	report.Attachments++
+	if err := storeMigratedUpload(ctx, db, store, key, blobs, dryRun, report); err != nil || dryRun {
+		return err
+	}
+
+	if _, err := db.Exec("UPDATE attachments SET storage_path = ? WHERE id = ?", key, attachment.ID); err != nil {
+		return fmt.Errorf("error pointing attachment %d at %s: %v", attachment.ID, key, err)
+	}
+	return nil
+}
+
+// storeMigratedUpload counts an upload's blobs and stores them unless this is a dry run
+// The full blob must come first, as StoreUpload expects.
+func storeMigratedUpload(ctx context.Context, db *sql.DB, store BlobStore, key string, blobs []Blob, dryRun bool, report *UploadMigration) error {
+	for _, blob := range blobs {
+		report.Blobs++
+		report.Bytes += int64(len(blob.Data))
+	}
+	if dryRun {
+		return nil
+	}
+	_, err := StoreUpload(ctx, db, store, key, blobs)
+	return err
+}
+
+// queryStrings runs a query returning one text column
+func queryStrings(db *sql.DB, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
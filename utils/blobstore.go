@@ -0,0 +1,254 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// MediaURLPrefix is the public path blobs are served under, e.g. /media/ab/abcd….jpg
+const MediaURLPrefix = "/media/"
+
+// ErrBlobNotFound is returned when a blob does not exist in the store
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobInfo describes a stored blob
+type BlobInfo struct {
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+}
+
+// BlobStore stores uploaded files under keys such as "ab/abcd….jpg"
+// Keys are made with ContentKey, so equal content is stored once.
+type BlobStore interface {
+	// Put stores data under a key, replacing any existing blob
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	// Open returns the content of a blob; it returns ErrBlobNotFound if the
+	// blob does not exist. The reader is an io.ReadSeeker when the store
+	// supports range requests.
+	Open(ctx context.Context, key string) (io.ReadCloser, BlobInfo, error)
+	// Stat describes a blob without reading it
+	Stat(ctx context.Context, key string) (BlobInfo, error)
+	// Delete removes a blob; deleting a missing blob is not an error
+	Delete(ctx context.Context, key string) error
+	// SignedURL returns a URL the blob can be read from directly for a
+	// limited time, or "" if the store can only be read through the server
+	SignedURL(key string, expiry time.Duration) (string, error)
+}
+
+// Blobs is the store uploads are kept in, chosen at startup with OpenBlobStore
+var Blobs BlobStore = NewLocalBlobStore(defaultBlobDir)
+
+// defaultBlobDir is where the local store keeps blobs unless BLOB_LOCAL_DIR is set
+const defaultBlobDir = "uploads/blobs"
+
+// ContentKey builds the content-addressed key for a blob
+// The key is the SHA-256 of the content, fanned out by its first two
+// characters, with the file extension kept for the content type.
+// @param data - The blob content
+// @param ext - The file extension including the dot, e.g. ".jpg"
+// @returns string - The key, e.g. "ab/abcd….jpg"
+func ContentKey(data []byte, ext string) string {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	return hash[:2] + "/" + hash + strings.ToLower(ext)
+}
+
+// MediaURL returns the public URL a blob is served under
+// @param key - The blob key
+// @returns string - The URL path, e.g. /media/ab/abcd….jpg
+func MediaURL(key string) string {
+	return MediaURLPrefix + key
+}
+
+// MediaKey extracts the blob key from a URL returned by MediaURL
+// @param url - A stored image path
+// @returns string - The blob key
+// @returns bool - False if the path is not a valid media URL
+func MediaKey(url string) (string, bool) {
+	if !strings.HasPrefix(url, MediaURLPrefix) {
+		return "", false
+	}
+	key := strings.TrimPrefix(url, MediaURLPrefix)
+	return key, ValidBlobKey(key)
+}
+
+// ValidBlobKey reports whether a key is safe to use as a blob key
+// Keys are relative slash-separated paths of lowercase letters, digits, dots,
+// dashes and underscores, so they can never escape the store's directory.
+// @param key - The key to check
+// @returns bool - True if the key is valid
+func ValidBlobKey(key string) bool {
+	if key == "" || len(key) > 256 || path.Clean(key) != key || strings.HasPrefix(key, "/") {
+		return false
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.ContainsRune("._-/", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// blobContentType guesses the content type of a blob from its key
+func blobContentType(key string) string {
+	if contentType := mime.TypeByExtension(path.Ext(key)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// OpenBlobStore creates the blob store configured in the environment
+// BLOB_STORE selects "local" (the default) or "s3". The local store keeps
+// blobs under BLOB_LOCAL_DIR (default uploads/blobs). The S3 store needs
+// S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY, and
+// reads S3_REGION (default us-east-1), S3_PATH_STYLE ("true" for MinIO-style
+// servers) and S3_SIGNED_URLS ("true" to redirect reads to signed URLs
+// instead of proxying them).
+// @param getenv - Looks up an environment variable, usually os.Getenv
+// @returns BlobStore - The configured store
+// @returns error - An error naming the first missing or invalid variable
+func OpenBlobStore(getenv func(string) string) (BlobStore, error) {
+	switch kind := getenv("BLOB_STORE"); kind {
+	case "", "local":
+		dir := getenv("BLOB_LOCAL_DIR")
+		if dir == "" {
+			dir = defaultBlobDir
+		}
+		return NewLocalBlobStore(dir), nil
+	case "s3":
+		config := S3Config{
+			Endpoint:        getenv("S3_ENDPOINT"),
+			Region:          getenv("S3_REGION"),
+			Bucket:          getenv("S3_BUCKET"),
+			AccessKeyID:     getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: getenv("S3_SECRET_ACCESS_KEY"),
+			PathStyle:       getenv("S3_PATH_STYLE") == "true",
+			SignedURLs:      getenv("S3_SIGNED_URLS") == "true",
+		}
+		return NewS3BlobStore(config)
+	default:
+		return nil, fmt.Errorf("BLOB_STORE: unknown store %q", kind)
+	}
+}
+
+// LocalBlobStore keeps blobs as files under a directory
+type LocalBlobStore struct {
+	Dir string
+}
+
+// NewLocalBlobStore creates a store that keeps blobs under a directory
+// The directory is created when the first blob is stored.
+// @param dir - The directory to store blobs in
+// @returns *LocalBlobStore - The store
+func NewLocalBlobStore(dir string) *LocalBlobStore {
+	return &LocalBlobStore{Dir: dir}
+}
+
+// path returns the file a key is stored in
+func (s *LocalBlobStore) path(key string) (string, error) {
+	if !ValidBlobKey(key) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes a blob to a temporary file and renames it into place, so
+// readers never see a partly written blob
+func (s *LocalBlobStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	file, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(file), ".upload-*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, bytes.NewReader(data))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error storing blob %s: %v", key, err)
+	}
+	return nil
+}
+
+// Open returns the blob's file, which supports seeking
+func (s *LocalBlobStore) Open(ctx context.Context, key string) (io.ReadCloser, BlobInfo, error) {
+	file, err := s.path(key)
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, BlobInfo{}, ErrBlobNotFound
+	} else if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, BlobInfo{}, err
+	}
+	return f, BlobInfo{Size: stat.Size(), ContentType: blobContentType(key), ModTime: stat.ModTime()}, nil
+}
+
+// Stat describes the blob's file
+func (s *LocalBlobStore) Stat(ctx context.Context, key string) (BlobInfo, error) {
+	file, err := s.path(key)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	stat, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return BlobInfo{}, ErrBlobNotFound
+	} else if err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{Size: stat.Size(), ContentType: blobContentType(key), ModTime: stat.ModTime()}, nil
+}
+
+// Delete removes the blob's file
+func (s *LocalBlobStore) Delete(ctx context.Context, key string) error {
+	file, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// SignedURL returns "": local blobs are always read through the server
+func (s *LocalBlobStore) SignedURL(key string, expiry time.Duration) (string, error) {
+	return "", nil
+}
@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Kinds of user_blocks rows
+// A block stops all contact in both directions and hides the blocked user's
+// content; a mute only hides their content from the muting user.
+const (
+	BlockKindBlock = "block"
+	BlockKindMute  = "mute"
+)
+
+// HiddenUsersQuery selects the users whose content a viewer should not see
+// It is meant for NOT IN filters and takes the viewer's ID as its only parameter.
+const HiddenUsersQuery = "SELECT blocked_id FROM user_blocks WHERE blocker_id = ?"
+
+// HasBlocked reports whether one user has blocked another
+// Mutes are not counted; they never affect the muted user.
+// @param db - Database connection
+// @param blockerID - The user who may have blocked
+// @param blockedID - The user who may be blocked
+// @returns bool - True if blockerID blocked blockedID
+// @returns error - Any database error
+func HasBlocked(db *sql.DB, blockerID, blockedID string) (bool, error) {
+	var blocked bool
+	err := db.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM user_blocks
+			WHERE blocker_id = ? AND blocked_id = ? AND kind = ?
+		)
+	`, blockerID, blockedID, BlockKindBlock).Scan(&blocked)
+	if err != nil {
+		return false, fmt.Errorf("error checking block: %v", err)
+	}
+	return blocked, nil
+}
+
+// IsBlockedEitherWay reports whether either of two users has blocked the other
+// Used for direct contact such as chat messages and typing indicators.
+// @param db - Database connection
+// @param userA - One user
+// @param userB - The other user
+// @returns bool - True if a block exists in either direction
+// @returns error - Any database error
+func IsBlockedEitherWay(db *sql.DB, userA, userB string) (bool, error) {
+	var blocked bool
+	err := db.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM user_blocks
+			WHERE kind = ?
+			AND ((blocker_id = ? AND blocked_id = ?) OR (blocker_id = ? AND blocked_id = ?))
+		)
+	`, BlockKindBlock, userA, userB, userB, userA).Scan(&blocked)
+	if err != nil {
+		return false, fmt.Errorf("error checking block: %v", err)
+	}
+	return blocked, nil
+}
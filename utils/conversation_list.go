@@ -0,0 +1,176 @@
+package utils
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MaxPreviewLength is the most characters of a message shown in a conversation list
+const MaxPreviewLength = 100
+
+// MaxConversationPage is the most conversations ListConversations returns at once
+const MaxConversationPage = 100
+
+// ConversationSummary is one entry of a user's conversation list
+type ConversationSummary struct {
+	ID           int64             `json:"id"`             // Conversation ID
+	Kind         string            `json:"kind"`           // ConversationKindDirect or ConversationKindGroup
+	Title        string            `json:"title"`          // Group title, empty for direct conversations
+	Peer         *ConversationPeer `json:"peer,omitempty"` // The other participant of a direct conversation
+	LastMessage  *MessagePreview   `json:"lastMessage"`    // The newest message the user can see, nil if none
+	UnreadCount  int               `json:"unreadCount"`    // Messages from others past the user's read pointer
+	LastActivity time.Time         `json:"lastActivity"`   // When the last message was sent, or the conversation created
+}
+
+// ConversationPeer is the other participant of a direct conversation with their presence
+type ConversationPeer struct {
+	ID         string     `json:"id"`
+	Nickname   string     `json:"nickname"`
+	ProfilePic string     `json:"profilePic,omitempty"`
+	IsOnline   bool       `json:"isOnline"`
+	Status     string     `json:"status"` // Status shown to others: online, away, dnd or offline
+	LastSeen   *time.Time `json:"lastSeen,omitempty"`
+}
+
+// MessagePreview is the start of the last message of a conversation
+type MessagePreview struct {
+	ID             int64     `json:"id"`
+	SenderID       string    `json:"senderId"`
+	SenderNickname string    `json:"senderNickname"`
+	Snippet        string    `json:"snippet"`     // Plain text, whitespace collapsed, at most MaxPreviewLength characters
+	SentAt         time.Time `json:"sentAt"`      // Server time the message was sent
+	Deleted        bool      `json:"deleted"`     // Deleted for everyone; the snippet is empty
+	Attachments    int       `json:"attachments"` // How many attachments the message carries
+}
+
+// conversationSummarySelect lists a member's conversations with one row each
+// The newest visible message of each conversation is found through
+// idx_messages_conversation_sent_at and unread messages through
+// idx_messages_conversation_id, so the cost grows with the user's
+// conversations rather than with every user or message. Direct
+// conversations without a visible message are left out unless one
+// conversation is asked for (?2).
+var conversationSummarySelect = `
+	WITH listed AS (
+		SELECT cm.conversation_id, cm.last_read_message_id,
+			(SELECT m.id FROM messages m
+				WHERE m.conversation_id = cm.conversation_id
+				AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = ?1)
+				ORDER BY m.sent_at DESC, m.id DESC LIMIT 1) AS last_message_id
+		FROM conversation_members cm
+		WHERE cm.user_id = ?1 AND (?2 = 0 OR cm.conversation_id = ?2)
+	), ranked AS (
+		SELECT l.conversation_id, l.last_read_message_id, l.last_message_id,
+			COALESCE(m.sent_at, c.created_at) AS activity
+		FROM listed l
+		JOIN conversations c ON c.id = l.conversation_id
+		LEFT JOIN messages m ON m.id = l.last_message_id
+		WHERE ?2 != 0 OR c.kind = 'group' OR l.last_message_id IS NOT NULL
+	)
+	SELECT c.id, c.kind, c.title, c.created_at,
+		COALESCE(m.id, 0), COALESCE(m.sender_id, ''), COALESCE(su.nickname, ''), COALESCE(m.content, ''),
+		m.sent_at, COALESCE(m.deleted_at IS NOT NULL, 0),
+		(SELECT COUNT(*) FROM message_attachments a WHERE a.message_id = m.id),
+		(SELECT COUNT(*) FROM messages u
+			WHERE u.conversation_id = r.conversation_id AND u.id > r.last_read_message_id AND u.sender_id != ?1),
+		COALESCE(p.id, ''), COALESCE(p.nickname, ''), COALESCE(p.profile_pic, ''), ` + VisibleStatusSQL("p") + `, p.last_seen
+	FROM ranked r
+	JOIN conversations c ON c.id = r.conversation_id
+	LEFT JOIN messages m ON m.id = r.last_message_id
+	LEFT JOIN users su ON su.id = m.sender_id
+	LEFT JOIN users p ON c.kind = 'direct' AND p.id = (SELECT pm.user_id FROM conversation_members pm
+		WHERE pm.conversation_id = c.id AND pm.user_id != ?1 LIMIT 1)
+	WHERE ?3 = 0 OR (r.activity, r.conversation_id) < (SELECT activity, conversation_id FROM ranked WHERE conversation_id = ?3)
+	ORDER BY r.activity DESC, r.conversation_id DESC
+	LIMIT ?4`
+
+// ListConversations lists a user's conversations, most recently active first
+// Each conversation comes with its last message, the user's unread count and,
+// for direct conversations, the other participant's presence. Direct
+// conversations are listed once a message the user can see was sent in them;
+// groups are listed from when the user joins.
+// @param db - Database connection
+// @param userID - The member whose conversations are listed
+// @param beforeID - Only list conversations after this one, for the next page; 0 for the first page
+// @param limit - The most conversations to return, capped at MaxConversationPage
+// @returns []ConversationSummary - The conversations
+// @returns error - Any database error
+func ListConversations(db *sql.DB, userID string, beforeID int64, limit int) ([]ConversationSummary, error) {
+	if limit <= 0 || limit > MaxConversationPage {
+		limit = MaxConversationPage
+	}
+	rows, err := db.Query(conversationSummarySelect, userID, 0, beforeID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error listing conversations: %v", err)
+	}
+	return scanConversationSummaries(rows)
+}
+
+// GetConversationSummary loads one conversation as it appears in a member's list
+// Unlike ListConversations, direct conversations without a visible message
+// are returned too, without a last message.
+// @param db - Database connection
+// @param userID - The member
+// @param conversationID - The conversation
+// @returns *ConversationSummary - The conversation
+// @returns error - ErrNotConversationMember or any database error
+func GetConversationSummary(db *sql.DB, userID string, conversationID int64) (*ConversationSummary, error) {
+	rows, err := db.Query(conversationSummarySelect, userID, conversationID, 0, 1)
+	if err != nil {
+		return nil, fmt.Errorf("error loading conversation summary: %v", err)
+	}
+	summaries, err := scanConversationSummaries(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(summaries) == 0 {
+		return nil, ErrNotConversationMember
+	}
+	return &summaries[0], nil
+}
+
+// scanConversationSummaries reads rows selected with conversationSummarySelect
+func scanConversationSummaries(rows *sql.Rows) ([]ConversationSummary, error) {
+	defer rows.Close()
+
+	summaries := []ConversationSummary{}
+	for rows.Next() {
+		var s ConversationSummary
+		var last MessagePreview
+		var peer ConversationPeer
+		var sentAt, lastSeen sql.NullTime
+		err := rows.Scan(&s.ID, &s.Kind, &s.Title, &s.LastActivity,
+			&last.ID, &last.SenderID, &last.SenderNickname, &last.Snippet, &sentAt, &last.Deleted, &last.Attachments,
+			&s.UnreadCount,
+			&peer.ID, &peer.Nickname, &peer.ProfilePic, &peer.Status, &lastSeen)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning conversation summary: %v", err)
+		}
+		if last.ID != 0 {
+			last.SentAt = sentAt.Time
+			last.Snippet = messagePreview(last.Snippet)
+			s.LastMessage = &last
+			s.LastActivity = last.SentAt
+		}
+		if peer.ID != "" {
+			if lastSeen.Valid {
+				peer.LastSeen = &lastSeen.Time
+			}
+			peer.IsOnline = peer.Status != UserStatusOffline
+			s.Peer = &peer
+		}
+		summaries = append(summaries, s)
+	}
+	return summaries, rows.Err()
+}
+
+// messagePreview collapses whitespace and shortens content to MaxPreviewLength characters
+func messagePreview(content string) string {
+	preview := []rune(strings.Join(strings.Fields(content), " "))
+	if len(preview) <= MaxPreviewLength {
+		return string(preview)
+	}
+	return strings.TrimSpace(string(preview[:MaxPreviewLength-1])) + "…"
+}
@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestListConversations(t *testing.T) {
+	db := setupMessagesDB(t)
+	withBob := directConversation(t, db, "alice", "bob")
+	withCarol := directConversation(t, db, "alice", "carol")
+	directConversation(t, db, "alice", "dave") // No messages, so not listed
+	group, _ := CreateGroupConversation(db, "alice", "Team", []string{"bob", "carol"})
+
+	SaveMessage(db, withBob, "alice", "bob", "hi bob", "")
+	SaveMessage(db, withBob, "bob", "alice", "hello", "")
+	SaveMessage(db, withBob, "bob", "alice", "  are\nyou   there? "+strings.Repeat("x", 200), "")
+	fromCarol, _, _ := SaveMessage(db, withCarol, "carol", "alice", "secret", "")
+	HideMessage(db, fromCarol.ID, "alice")
+	SaveMessage(db, withCarol, "carol", "alice", "visible", "")
+	db.Exec("UPDATE messages SET sent_at = '2020-01-01 00:00:00' WHERE conversation_id = ?", withCarol)
+	db.Exec("UPDATE conversations SET created_at = '2021-01-01 00:00:00' WHERE id = ?", group)
+	db.Exec("UPDATE users SET is_online = 1 WHERE id = 'bob'")
+
+	list, err := ListConversations(db, "alice", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 || list[0].ID != withBob || list[2].ID != withCarol {
+		t.Fatalf("conversations = %+v; want bob, the group, then carol", list)
+	}
+
+	bob := list[0]
+	if bob.UnreadCount != 2 || bob.Peer == nil || bob.Peer.ID != "bob" || !bob.Peer.IsOnline {
+		t.Errorf("bob conversation = %+v, peer %+v", bob, bob.Peer)
+	}
+	if bob.LastMessage == nil || bob.LastMessage.SenderNickname != "Bob" ||
+		!strings.HasPrefix(bob.LastMessage.Snippet, "are you there? xxx") || len([]rune(bob.LastMessage.Snippet)) != MaxPreviewLength {
+		t.Errorf("bob last message = %+v", bob.LastMessage)
+	}
+	if team := list[1]; team.Kind != ConversationKindGroup || team.Title != "Team" || team.LastMessage != nil || team.Peer != nil {
+		t.Errorf("group conversation = %+v", team)
+	}
+	if carol := list[2]; carol.LastMessage.Snippet != "visible" || carol.UnreadCount != 2 {
+		t.Errorf("carol conversation = %+v, last message %+v", carol, carol.LastMessage)
+	}
+
+	page, _ := ListConversations(db, "alice", group, 10)
+	if len(page) != 1 || page[0].ID != withCarol {
+		t.Errorf("page after the group = %+v; want carol", page)
+	}
+
+	MarkConversationRead(db, "alice", withBob)
+	summary, err := GetConversationSummary(db, "alice", withBob)
+	if err != nil || summary.UnreadCount != 0 {
+		t.Errorf("summary after reading = %+v, %v; want no unread messages", summary, err)
+	}
+	if _, err := GetConversationSummary(db, "dave", withBob); err != ErrNotConversationMember {
+		t.Errorf("summary for a non-member: %v; want ErrNotConversationMember", err)
+	}
+}
@@ -0,0 +1,558 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Conversation kinds
+const (
+	ConversationKindDirect = "direct"
+	ConversationKindGroup  = "group"
+)
+
+// Conversation member roles, from most to least privileged
+const (
+	ConversationRoleOwner  = "owner"
+	ConversationRoleAdmin  = "admin"
+	ConversationRoleMember = "member"
+)
+
+// Group conversation limits
+const (
+	MaxConversationMembers     = 50
+	MaxConversationTitleLength = 100
+)
+
+// Conversation errors
+var (
+	ErrConversationNotFound     = errors.New("conversation not found")
+	ErrNotConversationMember    = errors.New("not a member of this conversation")
+	ErrConversationPermission   = errors.New("your role in this conversation does not allow this")
+	ErrNotGroupConversation     = errors.New("direct conversations cannot be changed")
+	ErrConversationFull         = errors.New("conversation has too many members")
+	ErrInvalidConversationTitle = errors.New("conversation title must be 1 to 100 characters")
+	ErrInvalidConversationRole  = errors.New("role must be admin or member")
+)
+
+// conversationRoleRank orders roles; a lower rank may manage a higher one
+var conversationRoleRank = map[string]int{
+	ConversationRoleOwner:  0,
+	ConversationRoleAdmin:  1,
+	ConversationRoleMember: 2,
+}
+
+// Conversation is a direct or group chat with its members
+type Conversation struct {
+	ID        int64                `json:"id"`        // Unique identifier
+	Kind      string               `json:"kind"`      // ConversationKindDirect or ConversationKindGroup
+	Title     string               `json:"title"`     // Group title, empty for direct conversations
+	CreatedBy string               `json:"createdBy"` // The user who created it, empty for migrated conversations
+	CreatedAt time.Time            `json:"createdAt"` // When it was created
+	Members   []ConversationMember `json:"members"`   // Current members, owner first
+}
+
+// ConversationMember is a user taking part in a conversation
+type ConversationMember struct {
+	UserID            string    `json:"userId"`
+	Nickname          string    `json:"nickname"`
+	Role              string    `json:"role"`              // One of the ConversationRole constants
+	LastReadMessageID int64     `json:"lastReadMessageId"` // Every message up to this ID has been read
+	JoinedAt          time.Time `json:"joinedAt"`
+}
+
+// DirectConversationKey identifies the direct conversation between two users
+// The order of the users does not matter.
+func DirectConversationKey(userA, userB string) string {
+	if userB < userA {
+		userA, userB = userB, userA
+	}
+	return userA + ":" + userB
+}
+
+// DirectConversationID returns the direct conversation between two users
+// The conversation and its two members are created on first use.
+// @param db - Database connection
+// @param userA - One participant
+// @param userB - The other participant
+// @returns int64 - The conversation ID
+// @returns error - Any database error
+func DirectConversationID(db *sql.DB, userA, userB string) (int64, error) {
+	key := DirectConversationKey(userA, userB)
+
+	var id int64
+	err := db.QueryRow("SELECT id FROM conversations WHERE direct_key = ?", key).Scan(&id)
+	if err == nil {
+		return id, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, fmt.Errorf("error loading conversation: %v", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		INSERT OR IGNORE INTO conversations (kind, direct_key, created_by) VALUES (?, ?, ?)
+	`, ConversationKindDirect, key, userA); err != nil {
+		return 0, fmt.Errorf("error creating conversation: %v", err)
+	}
+	if err := tx.QueryRow("SELECT id FROM conversations WHERE direct_key = ?", key).Scan(&id); err != nil {
+		return 0, fmt.Errorf("error loading conversation: %v", err)
+	}
+	for _, userID := range []string{userA, userB} {
+		if _, err := tx.Exec(`
+			INSERT OR IGNORE INTO conversation_members (conversation_id, user_id, role) VALUES (?, ?, ?)
+		`, id, userID, ConversationRoleMember); err != nil {
+			return 0, fmt.Errorf("error adding conversation member: %v", err)
+		}
+	}
+	return id, tx.Commit()
+}
+
+// ValidateConversationTitle trims and checks a group title
+// @param title - The title as entered
+// @returns string - The trimmed title
+// @returns error - ErrInvalidConversationTitle if it is empty or too long
+func ValidateConversationTitle(title string) (string, error) {
+	title = strings.TrimSpace(title)
+	if title == "" || len([]rune(title)) > MaxConversationTitleLength {
+		return "", ErrInvalidConversationTitle
+	}
+	return title, nil
+}
+
+// CreateGroupConversation creates a group owned by its creator
+// Unknown users and users with a block between them and the owner are
+// left out rather than failing the whole group.
+// @param db - Database connection
+// @param ownerID - The creating user, who becomes the owner
+// @param title - The group title
+// @param memberIDs - The other users to add
+// @returns int64 - The new conversation ID
+// @returns error - ErrInvalidConversationTitle, ErrConversationFull or any database error
+func CreateGroupConversation(db *sql.DB, ownerID, title string, memberIDs []string) (int64, error) {
+	title, err := ValidateConversationTitle(title)
+	if err != nil {
+		return 0, err
+	}
+	memberIDs = uniqueUserIDs(memberIDs, ownerID)
+	if len(memberIDs)+1 > MaxConversationMembers {
+		return 0, ErrConversationFull
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO conversations (kind, title, created_by) VALUES (?, ?, ?)
+	`, ConversationKindGroup, title, ownerID)
+	if err != nil {
+		return 0, fmt.Errorf("error creating conversation: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO conversation_members (conversation_id, user_id, role) VALUES (?, ?, ?)
+	`, id, ownerID, ConversationRoleOwner); err != nil {
+		return 0, fmt.Errorf("error adding conversation owner: %v", err)
+	}
+	if _, err := insertConversationMembers(tx, id, ownerID, memberIDs); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// GetConversation loads a conversation and its members
+// @param db - Database connection
+// @param conversationID - The conversation
+// @returns *Conversation - The conversation
+// @returns error - ErrConversationNotFound or any database error
+func GetConversation(db *sql.DB, conversationID int64) (*Conversation, error) {
+	var c Conversation
+	var createdBy sql.NullString
+	err := db.QueryRow(`
+		SELECT id, kind, title, created_by, created_at FROM conversations WHERE id = ?
+	`, conversationID).Scan(&c.ID, &c.Kind, &c.Title, &createdBy, &c.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrConversationNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error loading conversation: %v", err)
+	}
+	c.CreatedBy = createdBy.String
+
+	rows, err := db.Query(`
+		SELECT cm.user_id, COALESCE(u.nickname, ''), cm.role, cm.last_read_message_id, cm.joined_at
+		FROM conversation_members cm
+		LEFT JOIN users u ON u.id = cm.user_id
+		WHERE cm.conversation_id = ?
+		ORDER BY CASE cm.role WHEN 'owner' THEN 0 WHEN 'admin' THEN 1 ELSE 2 END, cm.joined_at, cm.rowid
+	`, conversationID)
+	if err != nil {
+		return nil, fmt.Errorf("error loading conversation members: %v", err)
+	}
+	defer rows.Close()
+
+	c.Members = []ConversationMember{}
+	for rows.Next() {
+		var m ConversationMember
+		if err := rows.Scan(&m.UserID, &m.Nickname, &m.Role, &m.LastReadMessageID, &m.JoinedAt); err != nil {
+			return nil, fmt.Errorf("error scanning conversation member: %v", err)
+		}
+		c.Members = append(c.Members, m)
+	}
+	return &c, rows.Err()
+}
+
+// ConversationMemberIDs lists the users in a conversation
+// @param db - Database connection
+// @param conversationID - The conversation
+// @returns []string - The member IDs
+// @returns error - Any database error
+func ConversationMemberIDs(db *sql.DB, conversationID int64) ([]string, error) {
+	rows, err := db.Query("SELECT user_id FROM conversation_members WHERE conversation_id = ?", conversationID)
+	if err != nil {
+		return nil, fmt.Errorf("error loading conversation members: %v", err)
+	}
+	defer rows.Close()
+
+	var members []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, fmt.Errorf("error scanning conversation member: %v", err)
+		}
+		members = append(members, userID)
+	}
+	return members, rows.Err()
+}
+
+// ConversationMemberRole returns a user's role in a conversation
+// @param db - Database connection
+// @param conversationID - The conversation
+// @param userID - The user
+// @returns string - One of the ConversationRole constants
+// @returns error - ErrNotConversationMember or any database error
+func ConversationMemberRole(db *sql.DB, conversationID int64, userID string) (string, error) {
+	return memberRole(db, conversationID, userID)
+}
+
+// IsConversationMember reports whether a user belongs to a conversation
+// Database errors count as not a member.
+func IsConversationMember(db *sql.DB, conversationID int64, userID string) bool {
+	_, err := memberRole(db, conversationID, userID)
+	return err == nil
+}
+
+// IsGroupMember reports whether a user belongs to a group conversation
+// Database errors count as not a member.
+func IsGroupMember(db *sql.DB, conversationID int64, userID string) bool {
+	_, err := groupMemberRole(db, conversationID, userID)
+	return err == nil
+}
+
+// AddConversationMembers invites users to a group
+// Only owners and admins may invite. Users who are already members, do not
+// exist or have a block with the inviter are skipped. New members start
+// with everything sent before they joined marked read.
+// @param db - Database connection
+// @param conversationID - The group
+// @param actorID - The inviting user
+// @param userIDs - The users to add
+// @returns []string - The users who were added
+// @returns error - ErrNotConversationMember, ErrNotGroupConversation,
+// ErrConversationPermission, ErrConversationFull or any database error
+func AddConversationMembers(db *sql.DB, conversationID int64, actorID string, userIDs []string) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	role, err := groupMemberRole(tx, conversationID, actorID)
+	if err != nil {
+		return nil, err
+	}
+	if role == ConversationRoleMember {
+		return nil, ErrConversationPermission
+	}
+
+	userIDs = uniqueUserIDs(userIDs, actorID)
+	var count int
+	if err := tx.QueryRow(
+		"SELECT COUNT(*) FROM conversation_members WHERE conversation_id = ?", conversationID,
+	).Scan(&count); err != nil {
+		return nil, err
+	}
+	if count+len(userIDs) > MaxConversationMembers {
+		return nil, ErrConversationFull
+	}
+
+	added, err := insertConversationMembers(tx, conversationID, actorID, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	return added, tx.Commit()
+}
+
+// RemoveConversationMember removes a user from a group
+// A user may always leave. Removing someone else requires outranking them:
+// owners may remove admins and members, admins only members. When the owner
+// leaves, ownership passes to the longest-standing admin, or failing that
+// member.
+// @param db - Database connection
+// @param conversationID - The group
+// @param actorID - The user doing the removing
+// @param userID - The user to remove; actorID to leave
+// @returns error - ErrNotConversationMember, ErrNotGroupConversation,
+// ErrConversationPermission or any database error
+func RemoveConversationMember(db *sql.DB, conversationID int64, actorID, userID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	actorRole, err := groupMemberRole(tx, conversationID, actorID)
+	if err != nil {
+		return err
+	}
+	targetRole := actorRole
+	if userID != actorID {
+		if targetRole, err = memberRole(tx, conversationID, userID); err != nil {
+			return err
+		}
+		if actorRole == ConversationRoleMember || conversationRoleRank[actorRole] >= conversationRoleRank[targetRole] {
+			return ErrConversationPermission
+		}
+	}
+
+	if _, err := tx.Exec(
+		"DELETE FROM conversation_members WHERE conversation_id = ? AND user_id = ?", conversationID, userID,
+	); err != nil {
+		return fmt.Errorf("error removing conversation member: %v", err)
+	}
+	if targetRole == ConversationRoleOwner {
+		if _, err := tx.Exec(`
+			UPDATE conversation_members SET role = ?1
+			WHERE conversation_id = ?2 AND user_id = (
+				SELECT user_id FROM conversation_members WHERE conversation_id = ?2
+				ORDER BY CASE role WHEN 'admin' THEN 0 ELSE 1 END, joined_at, rowid
+				LIMIT 1
+			)
+		`, ConversationRoleOwner, conversationID); err != nil {
+			return fmt.Errorf("error transferring conversation ownership: %v", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// SetConversationMemberRole makes a group member an admin or a plain member
+// Only the owner may change roles.
+// @param db - Database connection
+// @param conversationID - The group
+// @param actorID - The user changing the role
+// @param userID - The member whose role changes
+// @param role - ConversationRoleAdmin or ConversationRoleMember
+// @returns error - ErrInvalidConversationRole, ErrNotConversationMember,
+// ErrNotGroupConversation, ErrConversationPermission or any database error
+func SetConversationMemberRole(db *sql.DB, conversationID int64, actorID, userID, role string) error {
+	if role != ConversationRoleAdmin && role != ConversationRoleMember {
+		return ErrInvalidConversationRole
+	}
+	actorRole, err := groupMemberRole(db, conversationID, actorID)
+	if err != nil {
+		return err
+	}
+	if actorRole != ConversationRoleOwner || userID == actorID {
+		return ErrConversationPermission
+	}
+	result, err := db.Exec(`
+		UPDATE conversation_members SET role = ? WHERE conversation_id = ? AND user_id = ?
+	`, role, conversationID, userID)
+	if err != nil {
+		return fmt.Errorf("error changing conversation role: %v", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrNotConversationMember
+	}
+	return nil
+}
+
+// RenameConversation changes a group's title
+// Only owners and admins may rename.
+// @param db - Database connection
+// @param conversationID - The group
+// @param actorID - The user renaming it
+// @param title - The new title
+// @returns string - The trimmed title that was saved
+// @returns error - ErrInvalidConversationTitle, ErrNotConversationMember,
+// ErrNotGroupConversation, ErrConversationPermission or any database error
+func RenameConversation(db *sql.DB, conversationID int64, actorID, title string) (string, error) {
+	title, err := ValidateConversationTitle(title)
+	if err != nil {
+		return "", err
+	}
+	role, err := groupMemberRole(db, conversationID, actorID)
+	if err != nil {
+		return "", err
+	}
+	if role == ConversationRoleMember {
+		return "", ErrConversationPermission
+	}
+	if _, err := db.Exec("UPDATE conversations SET title = ? WHERE id = ?", title, conversationID); err != nil {
+		return "", fmt.Errorf("error renaming conversation: %v", err)
+	}
+	return title, nil
+}
+
+// MigrateDirectConversations moves messages saved before conversations
+// existed into two-member direct conversations
+// Each sender/receiver pair becomes a conversation, and the read and
+// delivered flags of its messages become the members' read pointers. It only
+// does work while some messages have no conversation.
+// @param db - Database connection
+// @returns error - Any database error
+func MigrateDirectConversations(db *sql.DB) error {
+	var pending bool
+	if err := db.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM messages WHERE conversation_id IS NULL)",
+	).Scan(&pending); err != nil || !pending {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	pairKey := "CASE WHEN sender_id < receiver_id THEN sender_id || ':' || receiver_id ELSE receiver_id || ':' || sender_id END"
+	steps := []struct{ name, query string }{
+		{"create conversations", `
+			INSERT OR IGNORE INTO conversations (kind, direct_key, created_at)
+			SELECT 'direct', ` + pairKey + `, MIN(sent_at)
+			FROM messages WHERE conversation_id IS NULL
+			GROUP BY ` + pairKey},
+		{"add members", `
+			INSERT OR IGNORE INTO conversation_members (conversation_id, user_id, role, joined_at)
+			SELECT id, substr(direct_key, 1, instr(direct_key, ':') - 1), 'member', created_at
+			FROM conversations WHERE kind = 'direct'
+			UNION ALL
+			SELECT id, substr(direct_key, instr(direct_key, ':') + 1), 'member', created_at
+			FROM conversations WHERE kind = 'direct'`},
+		{"link messages", `
+			UPDATE messages SET conversation_id = (
+				SELECT id FROM conversations WHERE direct_key = ` + pairKey + `
+			) WHERE conversation_id IS NULL`},
+		{"set read pointers", `
+			UPDATE conversation_members SET
+			last_read_message_id = MAX(last_read_message_id, COALESCE((
+				SELECT MAX(m.id) FROM messages m
+				WHERE m.conversation_id = conversation_members.conversation_id
+				AND m.sender_id != conversation_members.user_id
+				AND (m.read OR m.read_at IS NOT NULL)
+			), 0)),
+			last_delivered_message_id = MAX(last_delivered_message_id, COALESCE((
+				SELECT MAX(m.id) FROM messages m
+				WHERE m.conversation_id = conversation_members.conversation_id
+				AND m.sender_id != conversation_members.user_id
+				AND (m.read OR m.read_at IS NOT NULL OR m.delivered_at IS NOT NULL)
+			), 0))
+			WHERE conversation_id IN (SELECT id FROM conversations WHERE kind = 'direct')`},
+	}
+	for _, step := range steps {
+		if _, err := tx.Exec(step.query); err != nil {
+			return fmt.Errorf("failed to %s: %v", step.name, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// rowQuerier is satisfied by both *sql.DB and *sql.Tx
+type rowQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// memberRole looks up a user's role in a conversation
+func memberRole(db rowQuerier, conversationID int64, userID string) (string, error) {
+	var role string
+	err := db.QueryRow(
+		"SELECT role FROM conversation_members WHERE conversation_id = ? AND user_id = ?", conversationID, userID,
+	).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", ErrNotConversationMember
+	}
+	return role, err
+}
+
+// groupMemberRole looks up a user's role in a conversation that must be a group
+func groupMemberRole(db rowQuerier, conversationID int64, userID string) (string, error) {
+	var kind string
+	err := db.QueryRow("SELECT kind FROM conversations WHERE id = ?", conversationID).Scan(&kind)
+	if err == sql.ErrNoRows {
+		return "", ErrConversationNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	role, err := memberRole(db, conversationID, userID)
+	if err != nil {
+		return "", err
+	}
+	if kind != ConversationKindGroup {
+		return "", ErrNotGroupConversation
+	}
+	return role, nil
+}
+
+// insertConversationMembers adds existing, unblocked users to a conversation
+// Their read pointers start at the conversation's latest message.
+func insertConversationMembers(tx *sql.Tx, conversationID int64, inviterID string, userIDs []string) ([]string, error) {
+	var added []string
+	for _, userID := range userIDs {
+		result, err := tx.Exec(`
+			INSERT OR IGNORE INTO conversation_members
+				(conversation_id, user_id, role, last_read_message_id, last_delivered_message_id)
+			SELECT ?1, u.id, ?2, latest.id, latest.id
+			FROM users u, (SELECT COALESCE(MAX(id), 0) AS id FROM messages WHERE conversation_id = ?1) latest
+			WHERE u.id = ?3 AND NOT EXISTS (
+				SELECT 1 FROM user_blocks
+				WHERE kind = ?4
+				AND ((blocker_id = ?5 AND blocked_id = u.id) OR (blocker_id = u.id AND blocked_id = ?5))
+			)
+		`, conversationID, ConversationRoleMember, userID, BlockKindBlock, inviterID)
+		if err != nil {
+			return nil, fmt.Errorf("error adding conversation member: %v", err)
+		}
+		if affected, _ := result.RowsAffected(); affected > 0 {
+			added = append(added, userID)
+		}
+	}
+	return added, nil
+}
+
+// uniqueUserIDs drops empty and repeated IDs, and the given user
+func uniqueUserIDs(userIDs []string, exclude string) []string {
+	seen := map[string]bool{exclude: true, "": true}
+	var unique []string
+	for _, userID := range userIDs {
+		if !seen[userID] {
+			seen[userID] = true
+			unique = append(unique, userID)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGroupMembership(t *testing.T) {
+	db := setupMessagesDB(t)
+	db.Exec("INSERT INTO user_blocks VALUES ('dave', 'alice', 'block')")
+
+	group, err := CreateGroupConversation(db, "alice", "  Team  ", []string{"bob", "bob", "dave", "nobody"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conversation, err := GetConversation(db, group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var members []string
+	for _, m := range conversation.Members {
+		members = append(members, m.UserID+":"+m.Role)
+	}
+	if conversation.Title != "Team" || !reflect.DeepEqual(members, []string{"alice:owner", "bob:member"}) {
+		t.Errorf("GetConversation() = %q with %v", conversation.Title, members)
+	}
+
+	if _, err := AddConversationMembers(db, group, "bob", []string{"carol"}); err != ErrConversationPermission {
+		t.Errorf("member inviting: err = %v, want ErrConversationPermission", err)
+	}
+	if err := SetConversationMemberRole(db, group, "alice", "bob", ConversationRoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if added, err := AddConversationMembers(db, group, "bob", []string{"carol"}); err != nil || !reflect.DeepEqual(added, []string{"carol"}) {
+		t.Errorf("admin inviting = %v, %v", added, err)
+	}
+
+	// Admins may only kick members, and only the owner may kick admins
+	if err := RemoveConversationMember(db, group, "carol", "bob"); err != ErrConversationPermission {
+		t.Errorf("member kicking admin: err = %v", err)
+	}
+	if err := RemoveConversationMember(db, group, "bob", "alice"); err != ErrConversationPermission {
+		t.Errorf("admin kicking owner: err = %v", err)
+	}
+	if err := RemoveConversationMember(db, group, "bob", "carol"); err != nil {
+		t.Errorf("admin kicking member: err = %v", err)
+	}
+	if IsConversationMember(db, group, "carol") {
+		t.Error("kicked member is still a member")
+	}
+
+	// The owner leaving hands the group to the admin
+	if err := RemoveConversationMember(db, group, "alice", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if role, _ := ConversationMemberRole(db, group, "bob"); role != ConversationRoleOwner {
+		t.Errorf("bob's role after the owner left = %q, want owner", role)
+	}
+
+	direct := directConversation(t, db, "alice", "bob")
+	if _, err := AddConversationMembers(db, direct, "alice", []string{"carol"}); err != ErrNotGroupConversation {
+		t.Errorf("inviting to a direct conversation: err = %v", err)
+	}
+}
+
+func TestMigrateDirectConversations(t *testing.T) {
+	db := setupMessagesDB(t)
+	_, err := db.Exec(`
+		INSERT INTO messages (sender_id, receiver_id, content, sent_at, read, delivered_at) VALUES
+			('alice', 'bob', 'one', '2024-01-01 10:00:00', 1, NULL),
+			('bob', 'alice', 'two', '2024-01-01 10:01:00', 0, '2024-01-01 10:02:00'),
+			('alice', 'bob', 'three', '2024-01-01 10:03:00', 0, NULL),
+			('carol', 'alice', 'four', '2024-01-01 10:04:00', 0, NULL)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := MigrateDirectConversations(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conversation := directConversation(t, db, "bob", "alice")
+	messages, err := MessagesSince(db, conversation, "alice", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range messages {
+		got = append(got, m.Content+":"+m.Status)
+	}
+	if want := []string{"one:read", "two:delivered", "three:sent"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("migrated statuses = %v, want %v", got, want)
+	}
+
+	var conversations int
+	db.QueryRow("SELECT COUNT(*) FROM conversations").Scan(&conversations)
+	if conversations != 2 {
+		t.Errorf("migration created %d conversations, want 2", conversations)
+	}
+	if count, _ := UnreadCount(db, "alice", directConversation(t, db, "alice", "carol")); count != 1 {
+		t.Errorf("UnreadCount() after migration = %d, want 1", count)
+	}
+}
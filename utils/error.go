@@ -22,7 +22,8 @@ const (
 	ErrPageNotFound     = "Page not found"
 	ErrTemplateExec     = "We're experiencing technical difficulties. Please try again later."
 	ErrFileTooLarge     = "File size exceeds the 20MB limit. Please upload a smaller image."
-	ErrInvalidFileType  = "Invalid file type. Only JPEG, PNG, and GIF images are allowed."
+	ErrInvalidFileType  = "Invalid file type. Only JPEG, PNG, GIF, and WebP images are allowed."
+	ErrImageDimensions  = "Image dimensions are too large. Please upload a smaller image."
 	ErrNotFound         = "Not Found."
 )
 
@@ -0,0 +1,337 @@
+package utils
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"path"
+	"strings"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// RenditionSize is one size an uploaded image is stored in
+type RenditionSize struct {
+	Name     string // "thumb", "feed" or "full"
+	MaxWidth int    // Images wider than this are scaled down
+}
+
+// Rendition sizes for post images and for avatars, smallest first
+// Avatars are cropped to squares before they are resized.
+var (
+	PostImageSizes = []RenditionSize{{"thumb", 320}, {"feed", 960}, {"full", 2048}}
+	AvatarSizes    = []RenditionSize{{"thumb", 64}, {"feed", 160}, {"full", 512}}
+)
+
+// jpegQuality is used for every JPEG rendition
+const jpegQuality = 85
+
+// RenderedImage is one encoded rendition of an uploaded image
+type RenderedImage struct {
+	Name   string // The rendition size name
+	Ext    string // ".jpg" or ".png"
+	Data   []byte // The encoded image, without any metadata
+	Width  int
+	Height int
+}
+
+// ImageRendition describes a stored rendition in API responses
+type ImageRendition struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// ImageInfo describes a processed image and its renditions
+type ImageInfo struct {
+	Width      int              `json:"width"`      // Width of the full rendition
+	Height     int              `json:"height"`     // Height of the full rendition
+	Renditions []ImageRendition `json:"renditions"` // Renditions, smallest first
+	Srcset     string           `json:"srcset"`     // The renditions as an HTML srcset value
+}
+
+// RenderImage validates and decodes an uploaded image with DecodeImage and
+// re-encodes it in every size
+// Decoding and re-encoding drops EXIF and other metadata; the EXIF orientation
+// of JPEG photos is applied first so they keep the right way up. Animated GIFs
+// keep their first frame. Opaque images are stored as JPEG, others as PNG.
+// @param data - The uploaded file content
+// @param sizes - The renditions to produce
+// @param square - Whether to crop the image to a centred square first
+// @returns []RenderedImage - One rendition per size, in the order of sizes
+// @returns error - An *UploadError if the content is rejected, or an encoding error
+func RenderImage(data []byte, sizes []RenditionSize, square bool) ([]RenderedImage, error) {
+	img, format, err := DecodeImage(data)
+	if err != nil {
+		return nil, err
+	}
+	if format == "jpeg" {
+		img = applyOrientation(img, jpegOrientation(data))
+	}
+	if square {
+		img = cropSquare(img)
+	}
+
+	ext := ".png"
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		ext = ".jpg"
+	}
+
+	renditions := make([]RenderedImage, 0, len(sizes))
+	for _, size := range sizes {
+		resized := resizeToWidth(img, size.MaxWidth)
+
+		var buf bytes.Buffer
+		if ext == ".jpg" {
+			err = jpeg.Encode(&buf, resized, &jpeg.Options{Quality: jpegQuality})
+		} else {
+			err = png.Encode(&buf, resized)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error encoding %s rendition: %v", size.Name, err)
+		}
+
+		bounds := resized.Bounds()
+		renditions = append(renditions, RenderedImage{
+			Name:   size.Name,
+			Ext:    ext,
+			Data:   buf.Bytes(),
+			Width:  bounds.Dx(),
+			Height: bounds.Dy(),
+		})
+	}
+
+	return renditions, nil
+}
+
+// RenditionPath returns where a rendition of an image is stored
+// The full rendition uses the image's own path; smaller ones add a suffix,
+// e.g. /static/uploads/abc_thumb.jpg.
+// @param imagePath - The path of the full image
+// @param name - The rendition size name
+// @returns string - The rendition's path
+func RenditionPath(imagePath, name string) string {
+	if name == "full" || imagePath == "" {
+		return imagePath
+	}
+	ext := path.Ext(imagePath)
+	return strings.TrimSuffix(imagePath, ext) + "_" + name + ext
+}
+
+// NewImageInfo builds the API description of an image from its renditions
+// @param renditions - The renditions, smallest first; the last is the full image
+// @returns *ImageInfo - The image description with its srcset
+func NewImageInfo(renditions []ImageRendition) *ImageInfo {
+	info := &ImageInfo{Renditions: renditions}
+	var srcset []string
+	for _, rendition := range renditions {
+		// Small images have renditions of equal width; srcset lists each width once
+		if rendition.Width != info.Width {
+			srcset = append(srcset, fmt.Sprintf("%s %dw", rendition.URL, rendition.Width))
+		}
+		info.Width, info.Height = rendition.Width, rendition.Height
+	}
+	info.Srcset = strings.Join(srcset, ", ")
+	return info
+}
+
+// SaveImageRenditions records the renditions stored for an uploaded image
+// @param db - Database connection or transaction
+// @param imagePath - The path of the full image, as stored on posts and users
+// @param renditions - The stored renditions
+// @returns error - Any database error
+func SaveImageRenditions(db DBExecutor, imagePath string, renditions []RenderedImage) error {
+	for _, rendition := range renditions {
+		_, err := db.Exec(`
+			INSERT INTO image_renditions (image_path, name, path, width, height)
+			VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (image_path, name) DO UPDATE SET
+				path = excluded.path, width = excluded.width, height = excluded.height
+		`, imagePath, rendition.Name, RenditionPath(imagePath, rendition.Name), rendition.Width, rendition.Height)
+		if err != nil {
+			return fmt.Errorf("error saving image rendition: %v", err)
+		}
+	}
+	return nil
+}
+
+// GetImageInfo loads the renditions of several images
+// Images uploaded before processing existed have no renditions and are left out.
+// @param db - Database connection
+// @param imagePaths - The paths of the full images
+// @returns map[string]*ImageInfo - Image descriptions keyed by path
+// @returns error - Any database error
+func GetImageInfo(db *sql.DB, imagePaths []string) (map[string]*ImageInfo, error) {
+	infos := make(map[string]*ImageInfo)
+	if len(imagePaths) == 0 {
+		return infos, nil
+	}
+
+	placeholders := make([]string, len(imagePaths))
+	args := make([]interface{}, len(imagePaths))
+	for i, imagePath := range imagePaths {
+		placeholders[i] = "?"
+		args[i] = imagePath
+	}
+
+	rows, err := db.Query(`
+		SELECT image_path, name, path, width, height
+		FROM image_renditions
+		WHERE image_path IN (`+strings.Join(placeholders, ",")+`)
+		ORDER BY image_path, width, name = 'full'
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error loading image renditions: %v", err)
+	}
+	defer rows.Close()
+
+	byPath := make(map[string][]ImageRendition)
+	for rows.Next() {
+		var imagePath string
+		var rendition ImageRendition
+		if err := rows.Scan(&imagePath, &rendition.Name, &rendition.URL, &rendition.Width, &rendition.Height); err != nil {
+			return nil, fmt.Errorf("error scanning image rendition: %v", err)
+		}
+		byPath[imagePath] = append(byPath[imagePath], rendition)
+	}
+	for imagePath, renditions := range byPath {
+		infos[imagePath] = NewImageInfo(renditions)
+	}
+	return infos, rows.Err()
+}
+
+// resizeToWidth scales an image down to a maximum width, keeping its aspect ratio
+// Images that are already narrow enough are returned unchanged.
+func resizeToWidth(img image.Image, maxWidth int) image.Image {
+	bounds := img.Bounds()
+	if bounds.Dx() <= maxWidth {
+		return img
+	}
+	height := bounds.Dy() * maxWidth / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, maxWidth, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
+
+// cropSquare cuts the largest centred square out of an image
+func cropSquare(img image.Image) image.Image {
+	bounds := img.Bounds()
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+	x := bounds.Min.X + (bounds.Dx()-side)/2
+	y := bounds.Min.Y + (bounds.Dy()-side)/2
+
+	dst := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Copy(dst, image.Point{}, img, image.Rect(x, y, x+side, y+side), draw.Src, nil)
+	return dst
+}
+
+// jpegOrientation reads the EXIF orientation (1-8) of a JPEG file
+// Returns 1, meaning no change, when the file has no readable orientation.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		length := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+		if marker == 0xDA || length < 2 || i+2+length > len(data) {
+			return 1 // Start of scan: the metadata segments are over
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && len(segment) > 14 && string(segment[:6]) == "Exif\x00\x00" {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation finds the orientation tag in the first IFD of a TIFF header
+func exifOrientation(tiff []byte) int {
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[offset : offset+2]))
+	for n := 0; n < entries; n++ {
+		entry := offset + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:entry+2]) == 0x0112 {
+			value := int(order.Uint16(tiff[entry+8 : entry+10]))
+			if value >= 1 && value <= 8 {
+				return value
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// applyOrientation rotates and flips an image so EXIF orientation 1 applies
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	// Orientations 5-8 swap width and height
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // Mirrored horizontally
+				dx, dy = w-1-x, y
+			case 3: // Rotated 180°
+				dx, dy = w-1-x, h-1-y
+			case 4: // Mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // Mirrored along the top-left diagonal
+				dx, dy = y, x
+			case 6: // Rotated 90° clockwise to display
+				dx, dy = h-1-y, x
+			case 7: // Mirrored along the top-right diagonal
+				dx, dy = h-1-y, w-1-x
+			case 8: // Rotated 90° counter-clockwise to display
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// exifJPEG encodes a JPEG of the given size carrying an EXIF orientation tag
+func exifJPEG(t *testing.T, width, height, orientation int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// TIFF header, one IFD entry (orientation, SHORT) and no next IFD
+	tiff := []byte("II*\x00\x08\x00\x00\x00\x01\x00")
+	entry := make([]byte, 12)
+	binary.LittleEndian.PutUint16(entry[0:], 0x0112)
+	binary.LittleEndian.PutUint16(entry[2:], 3)
+	binary.LittleEndian.PutUint32(entry[4:], 1)
+	binary.LittleEndian.PutUint16(entry[8:], uint16(orientation))
+	tiff = append(append(tiff, entry...), 0, 0, 0, 0)
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(segment)+2))
+
+	data := buf.Bytes()
+	out := append([]byte{}, data[:2]...)
+	out = append(append(out, app1...), segment...)
+	return append(out, data[2:]...)
+}
+
+func TestRenderImageAppliesOrientationAndStripsMetadata(t *testing.T) {
+	data := exifJPEG(t, 40, 20, 6)
+	if got := jpegOrientation(data); got != 6 {
+		t.Fatalf("jpegOrientation() = %d, want 6", got)
+	}
+
+	renditions, err := RenderImage(data, []RenditionSize{{"full", 100}}, false)
+	if err != nil {
+		t.Fatalf("RenderImage() error = %v", err)
+	}
+	full := renditions[0]
+	if full.Width != 20 || full.Height != 40 || full.Ext != ".jpg" {
+		t.Errorf("RenderImage() = %dx%d %s, want 20x40 .jpg", full.Width, full.Height, full.Ext)
+	}
+	if bytes.Contains(full.Data, []byte("Exif")) {
+		t.Error("RenderImage() kept the EXIF segment")
+	}
+}
+
+func TestRenderImageSizes(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 1000, 500))
+	img.Set(0, 0, color.NRGBA{A: 0})
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+
+	renditions, err := RenderImage(buf.Bytes(), PostImageSizes, false)
+	if err != nil {
+		t.Fatalf("RenderImage() error = %v", err)
+	}
+	want := [][2]int{{320, 160}, {960, 480}, {1000, 500}}
+	for i, rendition := range renditions {
+		if rendition.Width != want[i][0] || rendition.Height != want[i][1] || rendition.Ext != ".png" {
+			t.Errorf("%s rendition = %dx%d %s, want %dx%d .png",
+				rendition.Name, rendition.Width, rendition.Height, rendition.Ext, want[i][0], want[i][1])
+		}
+	}
+
+	avatars, err := RenderImage(buf.Bytes(), AvatarSizes, true)
+	if err != nil {
+		t.Fatalf("RenderImage() error = %v", err)
+	}
+	if full := avatars[len(avatars)-1]; full.Width != 500 || full.Height != 500 {
+		t.Errorf("square avatar = %dx%d, want 500x500", full.Width, full.Height)
+	}
+
+	if _, err := RenderImage([]byte("not an image"), PostImageSizes, false); err == nil {
+		t.Error("RenderImage() accepted invalid content")
+	}
+}
+
+func TestNewImageInfo(t *testing.T) {
+	if got := RenditionPath("/static/uploads/abc.jpg", "thumb"); got != "/static/uploads/abc_thumb.jpg" {
+		t.Errorf("RenditionPath() = %s", got)
+	}
+
+	info := NewImageInfo([]ImageRendition{
+		{Name: "thumb", URL: "/a_thumb.jpg", Width: 320, Height: 160},
+		{Name: "feed", URL: "/a_feed.jpg", Width: 500, Height: 250},
+		{Name: "full", URL: "/a.jpg", Width: 500, Height: 250},
+	})
+	if info.Width != 500 || info.Srcset != "/a_thumb.jpg 320w, /a_feed.jpg 500w" {
+		t.Errorf("NewImageInfo() = %d, %q", info.Width, info.Srcset)
+	}
+}
@@ -47,6 +47,23 @@ func InitialiseDB() (*sql.DB, error) {
 		return nil, fmt.Errorf("failed to create users table: %v", err)
 	}
 
+	// role is either 'user' or 'admin'; see PromoteAdmins
+	if err := addColumnIfMissing(db, "users", "role", "TEXT NOT NULL DEFAULT 'user'"); err != nil {
+		return nil, err
+	}
+
+	// The status a user chose; see GetUserStatus
+	for _, column := range []struct{ name, definition string }{
+		{"presence_status", "TEXT NOT NULL DEFAULT 'online'"},
+		{"status_text", "TEXT NOT NULL DEFAULT ''"},
+		{"status_emoji", "TEXT NOT NULL DEFAULT ''"},
+		{"status_expires_at", "DATETIME"},
+	} {
+		if err := addColumnIfMissing(db, "users", column.name, column.definition); err != nil {
+			return nil, err
+		}
+	}
+
 	// Create Messages table
 	_, err = db.Exec(`
         CREATE TABLE IF NOT EXISTS messages (
@@ -66,6 +83,110 @@ func InitialiseDB() (*sql.DB, error) {
 		return nil, fmt.Errorf("failed to create messages table: %v", err)
 	}
 
+	// client_msg_id is the sender's idempotency key. read, delivered_at and
+	// read_at are only kept for MigrateDirectConversations; receipts are now
+	// the members' read pointers. receiver_id is empty for group messages.
+	// edited_at is set on edits; deleted_at marks a message deleted for
+	// everyone, whose content is cleared and shown as a tombstone.
+	for _, column := range []struct{ name, definition string }{
+		{"client_msg_id", "TEXT"},
+		{"delivered_at", "TIMESTAMP"},
+		{"read_at", "TIMESTAMP"},
+		{"conversation_id", "INTEGER REFERENCES conversations(id)"},
+		{"edited_at", "TIMESTAMP"},
+		{"deleted_at", "TIMESTAMP"},
+	} {
+		if err := addColumnIfMissing(db, "messages", column.name, column.definition); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := db.Exec(`
+        CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_client_msg_id
+        ON messages(sender_id, client_msg_id) WHERE client_msg_id IS NOT NULL
+    `); err != nil {
+		return nil, fmt.Errorf("failed to create messages client_msg_id index: %v", err)
+	}
+
+	// Create Conversations tables
+	// Direct conversations have exactly two members and a direct_key naming
+	// them; groups have a title and members with roles. Each member's
+	// last_read_message_id and last_delivered_message_id cover every message
+	// in the conversation up to that ID.
+	_, err = db.Exec(`
+    CREATE TABLE IF NOT EXISTS conversations (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        kind TEXT NOT NULL DEFAULT 'group',
+        title TEXT NOT NULL DEFAULT '',
+        direct_key TEXT UNIQUE,
+        created_by TEXT,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        FOREIGN KEY (created_by) REFERENCES users(id)
+    );
+
+    CREATE TABLE IF NOT EXISTS conversation_members (
+        conversation_id INTEGER NOT NULL,
+        user_id TEXT NOT NULL,
+        role TEXT NOT NULL DEFAULT 'member',
+        last_read_message_id INTEGER NOT NULL DEFAULT 0,
+        last_delivered_message_id INTEGER NOT NULL DEFAULT 0,
+        joined_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (conversation_id, user_id),
+        FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE,
+        FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+    );
+    CREATE INDEX IF NOT EXISTS idx_conversation_members_user_id ON conversation_members(user_id);
+    CREATE INDEX IF NOT EXISTS idx_messages_conversation_id ON messages(conversation_id, id);
+    CREATE INDEX IF NOT EXISTS idx_messages_conversation_sent_at ON messages(conversation_id, sent_at, id);
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create conversations tables: %v", err)
+	}
+
+	// Create Message Reactions and Hidden Messages tables
+	// A member reacts with each emoji at most once per message. Messages a
+	// member deleted only for themselves are listed in message_hidden.
+	_, err = db.Exec(`
+    CREATE TABLE IF NOT EXISTS message_reactions (
+        message_id INTEGER NOT NULL,
+        user_id TEXT NOT NULL,
+        emoji TEXT NOT NULL,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (message_id, user_id, emoji),
+        FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
+        FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+    );
+
+    CREATE TABLE IF NOT EXISTS message_hidden (
+        message_id INTEGER NOT NULL,
+        user_id TEXT NOT NULL,
+        hidden_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (message_id, user_id),
+        FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
+        FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+    );
+    CREATE INDEX IF NOT EXISTS idx_message_hidden_user_id ON message_hidden(user_id);
+
+    CREATE TRIGGER IF NOT EXISTS AfterMessageDeleteReactions
+    AFTER DELETE ON messages
+    BEGIN
+        DELETE FROM message_reactions WHERE message_id = OLD.id;
+        DELETE FROM message_hidden WHERE message_id = OLD.id;
+    END;
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create message reactions tables: %v", err)
+	}
+
+	// Index message content for conversation search
+	if err := CreateMessageSearchIndex(db); err != nil {
+		return nil, err
+	}
+
+	// Move one-to-one messages saved before conversations existed into them
+	if err := MigrateDirectConversations(db); err != nil {
+		return nil, fmt.Errorf("failed to migrate direct conversations: %v", err)
+	}
+
 	// Create Posts table
 	_, err = db.Exec(`
         CREATE TABLE IF NOT EXISTS posts (
@@ -88,6 +209,17 @@ func InitialiseDB() (*sql.DB, error) {
 		return nil, fmt.Errorf("failed to create posts table: %v", err)
 	}
 
+	// status is 'draft', 'scheduled' or 'published'; publish_at is set while scheduled
+	if err := addColumnIfMissing(db, "posts", "status", "TEXT NOT NULL DEFAULT 'published'"); err != nil {
+		return nil, err
+	}
+	if err := addColumnIfMissing(db, "posts", "publish_at", "DATETIME"); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_posts_status_publish_at ON posts(status, publish_at)"); err != nil {
+		return nil, fmt.Errorf("failed to create posts status index: %v", err)
+	}
+
 	_, err = db.Exec(`
     CREATE TABLE IF NOT EXISTS comments (
         id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -208,8 +340,31 @@ END;
 		return nil, fmt.Errorf("failed to create notifications table: %v", err)
 	}
 
+	// Create User Blocks table
+	// kind is 'block' or 'mute'; see BlockKindBlock and BlockKindMute
+	_, err = db.Exec(`
+    CREATE TABLE IF NOT EXISTS user_blocks (
+        blocker_id TEXT NOT NULL,
+        blocked_id TEXT NOT NULL,
+        kind TEXT NOT NULL CHECK (kind IN ('block', 'mute')),
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (blocker_id, blocked_id),
+        FOREIGN KEY (blocker_id) REFERENCES users(id),
+        FOREIGN KEY (blocked_id) REFERENCES users(id)
+    );
+    CREATE INDEX IF NOT EXISTS idx_user_blocks_blocked_id ON user_blocks(blocked_id);
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create user_blocks table: %v", err)
+	}
+
 	// Add these triggers after notifications table creation
+	// They are dropped first so databases created before blocking existed
+	// pick up the block checks
 	_, err = db.Exec(`
+DROP TRIGGER IF EXISTS AfterPostReaction;
+DROP TRIGGER IF EXISTS AfterPostComment;
+
 CREATE TRIGGER IF NOT EXISTS AfterPostReaction
 AFTER INSERT ON reaction
 BEGIN
@@ -224,7 +379,11 @@ BEGIN
         END
     FROM posts p
     WHERE p.id = NEW.post_id
-    AND p.user_id != NEW.user_id; -- Don't notify if user reacts to their own post
+    AND p.user_id != NEW.user_id -- Don't notify if user reacts to their own post
+    AND NOT EXISTS ( -- or if the post owner has blocked them
+        SELECT 1 FROM user_blocks b
+        WHERE b.blocker_id = p.user_id AND b.blocked_id = NEW.user_id AND b.kind = 'block'
+    );
 END;
 
 CREATE TRIGGER IF NOT EXISTS AfterPostComment
@@ -238,7 +397,11 @@ BEGIN
         'comment'
     FROM posts p
     WHERE p.id = NEW.post_id
-    AND p.user_id != NEW.user_id; -- Don't notify if user comments on their own post
+    AND p.user_id != NEW.user_id -- Don't notify if user comments on their own post
+    AND NOT EXISTS ( -- or if the post owner has blocked them
+        SELECT 1 FROM user_blocks b
+        WHERE b.blocker_id = p.user_id AND b.blocked_id = NEW.user_id AND b.kind = 'block'
+    );
 END;
 `)
 	if err != nil {
@@ -327,6 +490,19 @@ END;
 	if err != nil {
 		return nil, fmt.Errorf("failed to create categories table: %v", err)
 	}
+
+	// Category details managed through the admin API. Archived categories
+	// stay browsable but no longer accept new posts.
+	categoryColumns := []struct{ name, definition string }{
+		{"description", "TEXT NOT NULL DEFAULT ''"},
+		{"position", "INTEGER NOT NULL DEFAULT 0"},
+		{"archived", "BOOLEAN NOT NULL DEFAULT 0"},
+	}
+	for _, column := range categoryColumns {
+		if err := addColumnIfMissing(db, "categories", column.name, column.definition); err != nil {
+			return nil, err
+		}
+	}
 	err = InsertDefaultCategories()
 	if err != nil {
 		return nil, fmt.Errorf("failed to insert default categories: %v", err)
@@ -346,6 +522,435 @@ END;
 		return nil, fmt.Errorf("failed to create post_categories table: %v", err)
 	}
 
+	// Create Tags tables
+	// Tags are free-form labels alongside the curated categories; usage_count
+	// counts the published posts carrying a tag and is kept in sync with
+	// post_tags and post status changes by triggers, so drafts never surface
+	// in autocomplete
+	_, err = db.Exec(`
+    CREATE TABLE IF NOT EXISTS tags (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        name TEXT UNIQUE NOT NULL,
+        usage_count INTEGER DEFAULT 0,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    );
+    CREATE TABLE IF NOT EXISTS post_tags (
+        post_id INTEGER NOT NULL,
+        tag_id INTEGER NOT NULL,
+        explicit BOOLEAN DEFAULT 0,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (post_id, tag_id),
+        FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE CASCADE,
+        FOREIGN KEY (tag_id) REFERENCES tags(id)
+    );
+    CREATE INDEX IF NOT EXISTS idx_post_tags_tag_id ON post_tags(tag_id);
+    CREATE INDEX IF NOT EXISTS idx_post_tags_created_at ON post_tags(created_at);
+
+    DROP TRIGGER IF EXISTS AfterPostTagInsert;
+    CREATE TRIGGER AfterPostTagInsert
+    AFTER INSERT ON post_tags
+    WHEN (SELECT status FROM posts WHERE id = NEW.post_id) = 'published'
+    BEGIN
+        UPDATE tags SET usage_count = usage_count + 1 WHERE id = NEW.tag_id;
+    END;
+
+    DROP TRIGGER IF EXISTS AfterPostTagDelete;
+    CREATE TRIGGER AfterPostTagDelete
+    AFTER DELETE ON post_tags
+    WHEN (SELECT status FROM posts WHERE id = OLD.post_id) = 'published'
+    BEGIN
+        UPDATE tags SET usage_count = usage_count - 1 WHERE id = OLD.tag_id;
+    END;
+
+    -- Remove the tags while the post still exists so its status is known
+    DROP TRIGGER IF EXISTS AfterPostDeleteTags;
+    CREATE TRIGGER IF NOT EXISTS BeforePostDeleteTags
+    BEFORE DELETE ON posts
+    BEGIN
+        DELETE FROM post_tags WHERE post_id = OLD.id;
+    END;
+
+    CREATE TRIGGER IF NOT EXISTS AfterPostStatusTags
+    AFTER UPDATE OF status ON posts
+    WHEN (OLD.status = 'published') <> (NEW.status = 'published')
+    BEGIN
+        UPDATE tags
+        SET usage_count = usage_count + CASE WHEN NEW.status = 'published' THEN 1 ELSE -1 END
+        WHERE id IN (SELECT tag_id FROM post_tags WHERE post_id = NEW.id);
+    END;
+
+    -- Recount so databases created before drafts were excluded are corrected
+    UPDATE tags SET usage_count = (
+        SELECT COUNT(*) FROM post_tags pt
+        JOIN posts p ON p.id = pt.post_id
+        WHERE pt.tag_id = tags.id AND p.status = 'published'
+    );
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tags tables: %v", err)
+	}
+
+	// Create Subscriptions and Follows tables
+	// Subscriptions cover categories and tags (target_id is the category or tag
+	// ID); follows link a user to another user. Both drive the personalized feed.
+	_, err = db.Exec(`
+    CREATE TABLE IF NOT EXISTS subscriptions (
+        user_id TEXT NOT NULL,
+        target_type TEXT NOT NULL CHECK (target_type IN ('category', 'tag')),
+        target_id INTEGER NOT NULL,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (user_id, target_type, target_id),
+        FOREIGN KEY (user_id) REFERENCES users(id)
+    );
+    CREATE INDEX IF NOT EXISTS idx_subscriptions_target ON subscriptions(target_type, target_id);
+
+    CREATE TABLE IF NOT EXISTS follows (
+        follower_id TEXT NOT NULL,
+        followed_id TEXT NOT NULL,
+        muted BOOLEAN NOT NULL DEFAULT FALSE, -- Silences new_post notifications without unfollowing
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (follower_id, followed_id),
+        FOREIGN KEY (follower_id) REFERENCES users(id),
+        FOREIGN KEY (followed_id) REFERENCES users(id)
+    );
+    CREATE INDEX IF NOT EXISTS idx_follows_followed_id ON follows(followed_id);
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create subscriptions tables: %v", err)
+	}
+
+	// Create Mentions table
+	// source_type is 'post', 'comment' or 'message'; rows are removed with their source
+	_, err = db.Exec(`
+    CREATE TABLE IF NOT EXISTS mentions (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        source_type TEXT NOT NULL,
+        source_id INTEGER NOT NULL,
+        mentioned_user_id TEXT NOT NULL,
+        actor_id TEXT NOT NULL,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        UNIQUE (source_type, source_id, mentioned_user_id),
+        FOREIGN KEY (mentioned_user_id) REFERENCES users(id),
+        FOREIGN KEY (actor_id) REFERENCES users(id)
+    );
+    CREATE INDEX IF NOT EXISTS idx_mentions_mentioned_user_id ON mentions(mentioned_user_id);
+
+    CREATE TRIGGER IF NOT EXISTS AfterPostDeleteMentions
+    AFTER DELETE ON posts
+    BEGIN
+        DELETE FROM mentions WHERE source_type = 'post' AND source_id = OLD.id;
+    END;
+
+    CREATE TRIGGER IF NOT EXISTS AfterCommentDeleteMentions
+    AFTER DELETE ON comments
+    BEGIN
+        DELETE FROM mentions WHERE source_type = 'comment' AND source_id = OLD.id;
+    END;
+
+    CREATE TRIGGER IF NOT EXISTS AfterMessageDeleteMentions
+    AFTER DELETE ON messages
+    BEGIN
+        DELETE FROM mentions WHERE source_type = 'message' AND source_id = OLD.id;
+    END;
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create mentions table: %v", err)
+	}
+
+	// Create Collections and Bookmarks tables
+	// A post is bookmarked at most once per user; collection_id is NULL for
+	// bookmarks that are not filed in a collection. share_token is set while
+	// a collection is shared by link.
+	_, err = db.Exec(`
+    CREATE TABLE IF NOT EXISTS collections (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        user_id TEXT NOT NULL,
+        name TEXT NOT NULL,
+        share_token TEXT UNIQUE,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        UNIQUE (user_id, name),
+        FOREIGN KEY (user_id) REFERENCES users(id)
+    );
+
+    CREATE TABLE IF NOT EXISTS bookmarks (
+        user_id TEXT NOT NULL,
+        post_id INTEGER NOT NULL,
+        collection_id INTEGER,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (user_id, post_id),
+        FOREIGN KEY (user_id) REFERENCES users(id),
+        FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE CASCADE,
+        FOREIGN KEY (collection_id) REFERENCES collections(id)
+    );
+    CREATE INDEX IF NOT EXISTS idx_bookmarks_collection_id ON bookmarks(collection_id);
+
+    CREATE TRIGGER IF NOT EXISTS AfterPostDeleteBookmarks
+    AFTER DELETE ON posts
+    BEGIN
+        DELETE FROM bookmarks WHERE post_id = OLD.id;
+    END;
+
+    CREATE TRIGGER IF NOT EXISTS AfterCollectionDelete
+    AFTER DELETE ON collections
+    BEGIN
+        UPDATE bookmarks SET collection_id = NULL WHERE collection_id = OLD.id;
+    END;
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bookmarks tables: %v", err)
+	}
+
+	// Create Polls tables
+	// A post carries at most one poll. closes_at is NULL for polls without an
+	// end; close_notified records that the creator was told the poll closed.
+	// A user votes for an option at most once.
+	_, err = db.Exec(`
+    CREATE TABLE IF NOT EXISTS polls (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        post_id INTEGER NOT NULL UNIQUE,
+        question TEXT NOT NULL,
+        multiple BOOLEAN NOT NULL DEFAULT FALSE,
+        anonymous BOOLEAN NOT NULL DEFAULT FALSE,
+        closes_at DATETIME,
+        close_notified BOOLEAN NOT NULL DEFAULT FALSE,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE CASCADE
+    );
+
+    CREATE TABLE IF NOT EXISTS poll_options (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        poll_id INTEGER NOT NULL,
+        position INTEGER NOT NULL,
+        text TEXT NOT NULL,
+        FOREIGN KEY (poll_id) REFERENCES polls(id) ON DELETE CASCADE
+    );
+    CREATE INDEX IF NOT EXISTS idx_poll_options_poll_id ON poll_options(poll_id);
+
+    CREATE TABLE IF NOT EXISTS poll_votes (
+        poll_id INTEGER NOT NULL,
+        option_id INTEGER NOT NULL,
+        user_id TEXT NOT NULL,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (option_id, user_id),
+        FOREIGN KEY (poll_id) REFERENCES polls(id) ON DELETE CASCADE,
+        FOREIGN KEY (option_id) REFERENCES poll_options(id) ON DELETE CASCADE,
+        FOREIGN KEY (user_id) REFERENCES users(id)
+    );
+    CREATE INDEX IF NOT EXISTS idx_poll_votes_poll_user ON poll_votes(poll_id, user_id);
+    CREATE INDEX IF NOT EXISTS idx_polls_closes_at ON polls(close_notified, closes_at);
+
+    CREATE TRIGGER IF NOT EXISTS AfterPostDeletePoll
+    AFTER DELETE ON posts
+    BEGIN
+        DELETE FROM poll_votes WHERE poll_id IN (SELECT id FROM polls WHERE post_id = OLD.id);
+        DELETE FROM poll_options WHERE poll_id IN (SELECT id FROM polls WHERE post_id = OLD.id);
+        DELETE FROM polls WHERE post_id = OLD.id;
+    END;
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create polls tables: %v", err)
+	}
+
+	// Create Attachments table
+	// Images and files uploaded with a post, in gallery order. width and
+	// height are 0 for non-image files; checksum is the SHA-256 of the content.
+	_, err = db.Exec(`
+    CREATE TABLE IF NOT EXISTS attachments (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        post_id INTEGER NOT NULL,
+        kind TEXT NOT NULL CHECK (kind IN ('image', 'file')),
+        file_name TEXT NOT NULL,
+        content_type TEXT NOT NULL,
+        size INTEGER NOT NULL,
+        width INTEGER NOT NULL DEFAULT 0,
+        height INTEGER NOT NULL DEFAULT 0,
+        checksum TEXT NOT NULL,
+        storage_path TEXT NOT NULL,
+        position INTEGER NOT NULL DEFAULT 0,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE CASCADE
+    );
+    CREATE INDEX IF NOT EXISTS idx_attachments_post_id ON attachments(post_id, position);
+
+    CREATE TRIGGER IF NOT EXISTS AfterPostDeleteAttachments
+    AFTER DELETE ON posts
+    BEGIN
+        DELETE FROM attachments WHERE post_id = OLD.id;
+    END;
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create attachments table: %v", err)
+	}
+
+	// Create Message Attachments table
+	// Images and files sent in chat. They are uploaded before the message is
+	// sent, so message_id stays NULL until the uploader sends a message with
+	// them; unsent ones are removed by CollectUploads after the grace period.
+	_, err = db.Exec(`
+    CREATE TABLE IF NOT EXISTS message_attachments (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        message_id INTEGER,
+        uploader_id TEXT NOT NULL,
+        kind TEXT NOT NULL CHECK (kind IN ('image', 'file')),
+        file_name TEXT NOT NULL,
+        content_type TEXT NOT NULL,
+        size INTEGER NOT NULL,
+        width INTEGER NOT NULL DEFAULT 0,
+        height INTEGER NOT NULL DEFAULT 0,
+        checksum TEXT NOT NULL,
+        storage_path TEXT NOT NULL,
+        position INTEGER NOT NULL DEFAULT 0,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
+        FOREIGN KEY (uploader_id) REFERENCES users(id) ON DELETE CASCADE
+    );
+    CREATE INDEX IF NOT EXISTS idx_message_attachments_message_id ON message_attachments(message_id, position);
+    CREATE INDEX IF NOT EXISTS idx_message_attachments_storage_path ON message_attachments(storage_path);
+
+    CREATE TRIGGER IF NOT EXISTS AfterMessageDeleteAttachments
+    AFTER DELETE ON messages
+    BEGIN
+        DELETE FROM message_attachments WHERE message_id = OLD.id;
+    END;
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create message attachments table: %v", err)
+	}
+
+	// Create Image Renditions table
+	// The resized copies stored for each processed post image and avatar,
+	// keyed by the path of the full image as stored on posts and users.
+	_, err = db.Exec(`
+    CREATE TABLE IF NOT EXISTS image_renditions (
+        image_path TEXT NOT NULL,
+        name TEXT NOT NULL,
+        path TEXT NOT NULL,
+        width INTEGER NOT NULL,
+        height INTEGER NOT NULL,
+        PRIMARY KEY (image_path, name)
+    );
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create image renditions table: %v", err)
+	}
+
+	// Create Uploads table
+	// The registry of blobs in the blob store, keyed by content hash. Triggers
+	// count the posts, profiles and attachments using each upload; uploads
+	// whose count has been zero for a grace period are removed by
+	// CollectUploads.
+	_, err = db.Exec(`
+    CREATE TABLE IF NOT EXISTS uploads (
+        key TEXT PRIMARY KEY,
+        size INTEGER NOT NULL,
+        content_type TEXT NOT NULL,
+        ref_count INTEGER NOT NULL DEFAULT 0,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        unreferenced_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    );
+    CREATE INDEX IF NOT EXISTS idx_uploads_unreferenced ON uploads(ref_count, unreferenced_at);
+    CREATE INDEX IF NOT EXISTS idx_posts_imagepath ON posts(imagepath);
+    CREATE INDEX IF NOT EXISTS idx_attachments_storage_path ON attachments(storage_path);
+
+    CREATE TRIGGER IF NOT EXISTS UploadRefPostImageInsert
+    AFTER INSERT ON posts WHEN NEW.imagepath LIKE '/media/%'
+    BEGIN
+        UPDATE uploads SET ref_count = ref_count + 1, unreferenced_at = NULL
+        WHERE key = substr(NEW.imagepath, 8);
+    END;
+
+    CREATE TRIGGER IF NOT EXISTS UploadRefPostImageUpdate
+    AFTER UPDATE OF imagepath ON posts WHEN OLD.imagepath IS NOT NEW.imagepath
+    BEGIN
+        UPDATE uploads SET ref_count = MAX(ref_count - 1, 0),
+            unreferenced_at = CASE WHEN ref_count <= 1 THEN CURRENT_TIMESTAMP ELSE unreferenced_at END
+        WHERE key = substr(OLD.imagepath, 8) AND OLD.imagepath LIKE '/media/%';
+        UPDATE uploads SET ref_count = ref_count + 1, unreferenced_at = NULL
+        WHERE key = substr(NEW.imagepath, 8) AND NEW.imagepath LIKE '/media/%';
+    END;
+
+    CREATE TRIGGER IF NOT EXISTS UploadRefPostImageDelete
+    AFTER DELETE ON posts WHEN OLD.imagepath LIKE '/media/%'
+    BEGIN
+        UPDATE uploads SET ref_count = MAX(ref_count - 1, 0),
+            unreferenced_at = CASE WHEN ref_count <= 1 THEN CURRENT_TIMESTAMP ELSE unreferenced_at END
+        WHERE key = substr(OLD.imagepath, 8);
+    END;
+
+    CREATE TRIGGER IF NOT EXISTS UploadRefProfilePicInsert
+    AFTER INSERT ON users WHEN NEW.profile_pic LIKE '/media/%'
+    BEGIN
+        UPDATE uploads SET ref_count = ref_count + 1, unreferenced_at = NULL
+        WHERE key = substr(NEW.profile_pic, 8);
+    END;
+
+    CREATE TRIGGER IF NOT EXISTS UploadRefProfilePicUpdate
+    AFTER UPDATE OF profile_pic ON users WHEN OLD.profile_pic IS NOT NEW.profile_pic
+    BEGIN
+        UPDATE uploads SET ref_count = MAX(ref_count - 1, 0),
+            unreferenced_at = CASE WHEN ref_count <= 1 THEN CURRENT_TIMESTAMP ELSE unreferenced_at END
+        WHERE key = substr(OLD.profile_pic, 8) AND OLD.profile_pic LIKE '/media/%';
+        UPDATE uploads SET ref_count = ref_count + 1, unreferenced_at = NULL
+        WHERE key = substr(NEW.profile_pic, 8) AND NEW.profile_pic LIKE '/media/%';
+    END;
+
+    CREATE TRIGGER IF NOT EXISTS UploadRefProfilePicDelete
+    AFTER DELETE ON users WHEN OLD.profile_pic LIKE '/media/%'
+    BEGIN
+        UPDATE uploads SET ref_count = MAX(ref_count - 1, 0),
+            unreferenced_at = CASE WHEN ref_count <= 1 THEN CURRENT_TIMESTAMP ELSE unreferenced_at END
+        WHERE key = substr(OLD.profile_pic, 8);
+    END;
+
+    CREATE TRIGGER IF NOT EXISTS UploadRefAttachmentInsert
+    AFTER INSERT ON attachments WHEN NEW.storage_path LIKE '%/%'
+    BEGIN
+        UPDATE uploads SET ref_count = ref_count + 1, unreferenced_at = NULL
+        WHERE key = NEW.storage_path;
+    END;
+
+    CREATE TRIGGER IF NOT EXISTS UploadRefAttachmentUpdate
+    AFTER UPDATE OF storage_path ON attachments WHEN OLD.storage_path IS NOT NEW.storage_path
+    BEGIN
+        UPDATE uploads SET ref_count = MAX(ref_count - 1, 0),
+            unreferenced_at = CASE WHEN ref_count <= 1 THEN CURRENT_TIMESTAMP ELSE unreferenced_at END
+        WHERE key = OLD.storage_path AND OLD.storage_path LIKE '%/%';
+        UPDATE uploads SET ref_count = ref_count + 1, unreferenced_at = NULL
+        WHERE key = NEW.storage_path AND NEW.storage_path LIKE '%/%';
+    END;
+
+    CREATE TRIGGER IF NOT EXISTS UploadRefAttachmentDelete
+    AFTER DELETE ON attachments WHEN OLD.storage_path LIKE '%/%'
+    BEGIN
+        UPDATE uploads SET ref_count = MAX(ref_count - 1, 0),
+            unreferenced_at = CASE WHEN ref_count <= 1 THEN CURRENT_TIMESTAMP ELSE unreferenced_at END
+        WHERE key = OLD.storage_path;
+    END;
+
+    CREATE TRIGGER IF NOT EXISTS UploadRefMessageAttachmentInsert
+    AFTER INSERT ON message_attachments
+    BEGIN
+        UPDATE uploads SET ref_count = ref_count + 1, unreferenced_at = NULL
+        WHERE key = NEW.storage_path;
+    END;
+
+    CREATE TRIGGER IF NOT EXISTS UploadRefMessageAttachmentDelete
+    AFTER DELETE ON message_attachments
+    BEGIN
+        UPDATE uploads SET ref_count = MAX(ref_count - 1, 0),
+            unreferenced_at = CASE WHEN ref_count <= 1 THEN CURRENT_TIMESTAMP ELSE unreferenced_at END
+        WHERE key = OLD.storage_path;
+    END;
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create uploads table: %v", err)
+	}
+
+	// Count references made before the registry existed, or missed by it
+	if err := RecountUploads(db); err != nil {
+		return nil, fmt.Errorf("failed to count upload references: %v", err)
+	}
+
 	_, err = db.Exec(`
     CREATE TABLE IF NOT EXISTS sessions (
         id TEXT PRIMARY KEY,
@@ -360,34 +965,56 @@ END;
 		return nil, fmt.Errorf("failed to create sessions table: %v", err)
 	}
 
+	// is_online and last_seen are written by the presence tracker alone, which
+	// knows about connections and invisible users; sessions no longer set them
 	_, err = db.Exec(`
-    -- Update user online status when session is created
-    CREATE TRIGGER IF NOT EXISTS update_user_online_on_session_create
-    AFTER INSERT ON sessions
-    BEGIN
-        UPDATE users
-        SET is_online = 1,
-            last_seen = CURRENT_TIMESTAMP
-        WHERE id = NEW.user_id;
-    END;
-
-    -- Update user offline status when session is deleted
-    CREATE TRIGGER IF NOT EXISTS update_user_offline_on_session_delete
-    AFTER DELETE ON sessions
-    BEGIN
-        UPDATE users
-        SET is_online = 0,
-            last_seen = CURRENT_TIMESTAMP
-        WHERE id = OLD.user_id;
-    END;
+    DROP TRIGGER IF EXISTS update_user_online_on_session_create;
+    DROP TRIGGER IF EXISTS update_user_offline_on_session_delete;
 `)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create user status triggers: %v", err)
+		return nil, fmt.Errorf("failed to drop user status triggers: %v", err)
 	}
 
 	return db, nil
 }
 
+// addColumnIfMissing adds a column to an existing table
+// CREATE TABLE IF NOT EXISTS leaves older databases untouched, so columns added
+// after a table was first created are migrated in with this helper.
+// @param db - Database connection
+// @param table - The table to alter
+// @param column - The column name
+// @param definition - The column type and constraints
+// @returns error - Any error that occurred
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return fmt.Errorf("failed to inspect table %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			return fmt.Errorf("failed to inspect table %s: %v", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to inspect table %s: %v", table, err)
+	}
+	rows.Close()
+
+	if _, err := db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition); err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %v", table, column, err)
+	}
+	return nil
+}
+
 // InsertDefaultCategories adds default post categories to the database
 // Uses INSERT OR IGNORE to avoid duplicates if categories already exist
 // @returns error - Any error that occurred during insertion
@@ -402,8 +1029,8 @@ func InsertDefaultCategories() error {
 		"General News",
 	}
 
-	for _, category := range categories {
-		_, err := GlobalDB.Exec("INSERT OR IGNORE INTO categories (name) VALUES (?)", category)
+	for i, category := range categories {
+		_, err := GlobalDB.Exec("INSERT OR IGNORE INTO categories (name, position) VALUES (?, ?)", category, i)
 		if err != nil {
 			return fmt.Errorf("failed to insert category %s: %v", category, err)
 		}
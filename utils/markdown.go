@@ -0,0 +1,279 @@
+package utils
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	// orderedListPattern matches list items such as "1. item" or "2) item"
+	orderedListPattern = regexp.MustCompile(`^\d{1,9}[.)]\s+`)
+	// headingPattern matches ATX headings; the space keeps "#tag" from being a heading
+	headingPattern = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	// codeLanguagePattern restricts fenced code language hints to safe class names
+	codeLanguagePattern = regexp.MustCompile(`^[A-Za-z0-9_+#.-]{1,32}$`)
+)
+
+// RenderContent converts user-written Markdown into HTML that is safe to embed
+// It is used for posts, comments and chat messages so every client gets the same output
+// @param raw - The Markdown source as stored in the database
+// @returns string - Sanitized HTML
+func RenderContent(raw string) string {
+	return SanitizeHTML(RenderMarkdown(raw))
+}
+
+// RenderMarkdown converts a small Markdown subset into HTML
+// Supports paragraphs, headings, fenced code blocks with language hints,
+// block quotes, ordered and unordered lists, links, autolinks, emphasis,
+// strikethrough and inline code. All text is HTML-escaped.
+// @param src - The Markdown source
+// @returns string - The rendered HTML (should still be passed through SanitizeHTML)
+func RenderMarkdown(src string) string {
+	src = strings.ReplaceAll(src, "\r\n", "\n")
+	src = strings.ReplaceAll(src, "\r", "\n")
+	return renderBlocks(strings.Split(src, "\n"))
+}
+
+// renderBlocks renders a sequence of lines as block-level elements
+func renderBlocks(lines []string) string {
+	var out strings.Builder
+	var paragraph []string
+
+	flushParagraph := func() {
+		if len(paragraph) == 0 {
+			return
+		}
+		rendered := make([]string, len(paragraph))
+		for i, line := range paragraph {
+			rendered[i] = renderInline(strings.TrimSpace(line))
+		}
+		out.WriteString("<p>" + strings.Join(rendered, "<br>") + "</p>")
+		paragraph = nil
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case trimmed == "":
+			flushParagraph()
+
+		case strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~"):
+			flushParagraph()
+			fence := trimmed[:3]
+			language := strings.TrimSpace(strings.TrimLeft(trimmed, fence[:1]))
+			var code []string
+			i++
+			for ; i < len(lines); i++ {
+				if strings.HasPrefix(strings.TrimSpace(lines[i]), fence) {
+					break
+				}
+				code = append(code, lines[i])
+			}
+			out.WriteString("<pre><code")
+			if codeLanguagePattern.MatchString(language) {
+				out.WriteString(` class="language-` + html.EscapeString(language) + `"`)
+			}
+			out.WriteString(">" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>")
+
+		case headingPattern.MatchString(trimmed):
+			flushParagraph()
+			match := headingPattern.FindStringSubmatch(trimmed)
+			level := string(rune('0' + len(match[1])))
+			out.WriteString("<h" + level + ">" + renderInline(match[2]) + "</h" + level + ">")
+
+		case strings.HasPrefix(trimmed, ">"):
+			flushParagraph()
+			var quoted []string
+			for ; i < len(lines); i++ {
+				t := strings.TrimSpace(lines[i])
+				if !strings.HasPrefix(t, ">") {
+					i--
+					break
+				}
+				t = strings.TrimPrefix(t, ">")
+				quoted = append(quoted, strings.TrimPrefix(t, " "))
+			}
+			out.WriteString("<blockquote>" + renderBlocks(quoted) + "</blockquote>")
+
+		case isUnorderedItem(trimmed):
+			flushParagraph()
+			out.WriteString("<ul>")
+			for ; i < len(lines); i++ {
+				t := strings.TrimSpace(lines[i])
+				if !isUnorderedItem(t) {
+					i--
+					break
+				}
+				out.WriteString("<li>" + renderInline(strings.TrimSpace(t[2:])) + "</li>")
+			}
+			out.WriteString("</ul>")
+
+		case orderedListPattern.MatchString(trimmed):
+			flushParagraph()
+			out.WriteString("<ol>")
+			for ; i < len(lines); i++ {
+				t := strings.TrimSpace(lines[i])
+				loc := orderedListPattern.FindStringIndex(t)
+				if loc == nil {
+					i--
+					break
+				}
+				out.WriteString("<li>" + renderInline(t[loc[1]:]) + "</li>")
+			}
+			out.WriteString("</ol>")
+
+		default:
+			paragraph = append(paragraph, line)
+		}
+	}
+	flushParagraph()
+
+	return out.String()
+}
+
+// isUnorderedItem reports whether a trimmed line starts a bullet list item
+func isUnorderedItem(line string) bool {
+	return len(line) >= 2 && (line[0] == '-' || line[0] == '*' || line[0] == '+') && line[1] == ' '
+}
+
+// renderInline renders inline Markdown within a single block
+func renderInline(s string) string {
+	var out strings.Builder
+
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte("\\`*_[]()#~>!-+.@", s[i+1]) >= 0:
+			out.WriteString(html.EscapeString(s[i+1 : i+2]))
+			i += 2
+			continue
+
+		case c == '`':
+			if end := strings.IndexByte(s[i+1:], '`'); end >= 0 {
+				out.WriteString("<code>" + html.EscapeString(s[i+1:i+1+end]) + "</code>")
+				i += end + 2
+				continue
+			}
+
+		case c == '[':
+			if text, href, n, ok := parseLink(s[i:]); ok {
+				out.WriteString(`<a href="` + html.EscapeString(href) + `">` + renderInline(text) + "</a>")
+				i += n
+				continue
+			}
+
+		case strings.HasPrefix(s[i:], "**") || strings.HasPrefix(s[i:], "__"):
+			if inner, n, ok := delimited(s[i:], s[i:i+2]); ok {
+				out.WriteString("<strong>" + renderInline(inner) + "</strong>")
+				i += n
+				continue
+			}
+
+		case strings.HasPrefix(s[i:], "~~"):
+			if inner, n, ok := delimited(s[i:], "~~"); ok {
+				out.WriteString("<del>" + renderInline(inner) + "</del>")
+				i += n
+				continue
+			}
+
+		case c == '*' || (c == '_' && (i == 0 || !isWordByte(s[i-1]))):
+			if inner, n, ok := delimited(s[i:], s[i:i+1]); ok {
+				if c == '*' || i+n >= len(s) || !isWordByte(s[i+n]) {
+					out.WriteString("<em>" + renderInline(inner) + "</em>")
+					i += n
+					continue
+				}
+			}
+
+		case (c == 'h' || c == 'H') && (i == 0 || !isWordByte(s[i-1])):
+			if url := autolink(s[i:]); url != "" {
+				out.WriteString(`<a href="` + html.EscapeString(url) + `">` + html.EscapeString(url) + "</a>")
+				i += len(url)
+				continue
+			}
+		}
+
+		out.WriteString(html.EscapeString(s[i : i+1]))
+		i++
+	}
+
+	return out.String()
+}
+
+// delimited finds inline content wrapped in the given delimiter at the start of s
+// @returns string - The wrapped content
+// @returns int - Number of bytes consumed including both delimiters
+// @returns bool - Whether a valid span was found
+func delimited(s, delim string) (string, int, bool) {
+	rest := s[len(delim):]
+	if rest == "" || rest[0] == ' ' {
+		return "", 0, false
+	}
+	end := strings.Index(rest, delim)
+	if end <= 0 || rest[end-1] == ' ' {
+		return "", 0, false
+	}
+	return rest[:end], len(delim)*2 + end, true
+}
+
+// parseLink parses a "[text](url)" link at the start of s
+// Links with unsupported URL schemes are not treated as links
+func parseLink(s string) (string, string, int, bool) {
+	closeText := strings.Index(s, "](")
+	if closeText <= 1 || strings.ContainsRune(s[1:closeText], '\n') {
+		return "", "", 0, false
+	}
+	closeURL := strings.IndexByte(s[closeText+2:], ')')
+	if closeURL < 0 {
+		return "", "", 0, false
+	}
+	href := strings.TrimSpace(s[closeText+2 : closeText+2+closeURL])
+	if !IsSafeURL(href) {
+		return "", "", 0, false
+	}
+	return s[1:closeText], href, closeText + 3 + closeURL, true
+}
+
+// autolink returns the bare http(s) URL at the start of s, if any
+// Trailing punctuation is not considered part of the URL
+func autolink(s string) string {
+	lower := strings.ToLower(s)
+	if !strings.HasPrefix(lower, "http://") && !strings.HasPrefix(lower, "https://") {
+		return ""
+	}
+	end := strings.IndexAny(s, " \t\n<>\"'`")
+	if end < 0 {
+		end = len(s)
+	}
+	url := strings.TrimRight(s[:end], ".,;:!?)*_~")
+	if !strings.Contains(url[strings.Index(url, "//")+2:], ".") {
+		return ""
+	}
+	return url
+}
+
+// isWordByte reports whether b is an ASCII letter, digit or underscore
+func isWordByte(b byte) bool {
+	return b == '_' || (b >= '0' && b <= '9') || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
+
+// IsSafeURL reports whether a link target uses an allowed scheme
+// Only http, https, mailto and site-relative URLs are allowed
+func IsSafeURL(href string) bool {
+	if href == "" || strings.ContainsAny(href, " \t\n\r\x00\\") {
+		return false
+	}
+	lower := strings.ToLower(href)
+	switch {
+	case strings.HasPrefix(lower, "http://"), strings.HasPrefix(lower, "https://"), strings.HasPrefix(lower, "mailto:"):
+		return true
+	case strings.HasPrefix(href, "/") && !strings.HasPrefix(href, "//"):
+		return true
+	case strings.HasPrefix(href, "#"):
+		return true
+	}
+	return false
+}
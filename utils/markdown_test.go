@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderContent(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"Paragraph", "hello world", "<p>hello world</p>"},
+		{"Line breaks", "one\ntwo", "<p>one<br>two</p>"},
+		{"Inline code", "use `fmt.Println`", "<p>use <code>fmt.Println</code></p>"},
+		{"Emphasis", "**bold** and *em* and ~~gone~~", "<p><strong>bold</strong> and <em>em</em> and <del>gone</del></p>"},
+		{"Snake case is not emphasis", "call my_var_name", "<p>call my_var_name</p>"},
+		{"Link", "[docs](https://go.dev)", `<p><a href="https://go.dev" rel="nofollow noopener noreferrer">docs</a></p>`},
+		{"Autolink", "see https://go.dev.", `<p>see <a href="https://go.dev" rel="nofollow noopener noreferrer">https://go.dev</a>.</p>`},
+		{"List", "- a\n- b", "<ul><li>a</li><li>b</li></ul>"},
+		{"Ordered list", "1. a\n2. b", "<ol><li>a</li><li>b</li></ol>"},
+		{"Quote", "> quoted\n> text", "<blockquote><p>quoted<br>text</p></blockquote>"},
+		{"Heading", "## Title", "<h2>Title</h2>"},
+		{"Hashtag is not a heading", "#golang", "<p>#golang</p>"},
+		{"Code block with language", "```go\nfmt.Println(\"<hi>\")\n```", `<pre><code class="language-go">fmt.Println(&#34;&lt;hi&gt;&#34;)</code></pre>`},
+		{"Code block with bad language", "```\"><script>\nx\n```", "<pre><code>x</code></pre>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RenderContent(tt.input); got != tt.want {
+				t.Errorf("RenderContent(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderContentXSS(t *testing.T) {
+	inputs := []string{
+		"<script>alert(1)</script>",
+		"<img src=x onerror=alert(1)>",
+		"[click](javascript:alert(1))",
+		"[click](JaVaScRiPt:alert(1))",
+		"[click](data:text/html;base64,PHNjcmlwdD4=)",
+		"[click](//evil.example)",
+		"[click](/\\evil.example)",
+		"<a href=\"javascript:alert(1)\">x</a>",
+		"`<script>`",
+		"<svg onload=alert(1)>",
+	}
+
+	for _, input := range inputs {
+		got := RenderContent(input)
+		lower := strings.ToLower(got)
+		for _, bad := range []string{"<script", "<img", "<svg", "href=\"javascript", "href=\"data:", "href=\"//", "href=\"/\\"} {
+			if strings.Contains(lower, bad) {
+				t.Errorf("RenderContent(%q) = %q, contains %q", input, got, bad)
+			}
+		}
+	}
+}
+
+func TestSanitizeHTML(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"Allowed markup", "<p><strong>hi</strong></p>", "<p><strong>hi</strong></p>"},
+		{"Unknown tag keeps text", "<span>hi</span>", "hi"},
+		{"Script content removed", "a<script>alert(1)</script>b", "ab"},
+		{"Event handlers removed", `<p onclick="x()">hi</p>`, "<p>hi</p>"},
+		{"Unsafe href removed", `<a href="javascript:x()">hi</a>`, `<a rel="nofollow noopener noreferrer">hi</a>`},
+		{"Entity obfuscated scheme removed", `<a href="java&#x09;script:x()">hi</a>`, `<a rel="nofollow noopener noreferrer">hi</a>`},
+		{"Unclosed tags closed", "<p><em>hi", "<p><em>hi</em></p>"},
+		{"Stray closing tag dropped", "hi</p>", "hi"},
+		{"Comment removed", "a<!-- <script> -->b", "ab"},
+		{"Bare bracket escaped", "a < b", "a &lt; b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SanitizeHTML(tt.input); got != tt.want {
+				t.Errorf("SanitizeHTML(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package utils
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Source types recorded in the mentions table
+const (
+	MentionSourcePost    = "post"
+	MentionSourceComment = "comment"
+	MentionSourceMessage = "message"
+)
+
+// mentionPattern matches an @nickname token using the characters allowed by ValidateNickname
+var mentionPattern = regexp.MustCompile(`@([A-Za-z0-9_.-]+)`)
+
+// MentionSpan marks a resolved @mention inside a piece of content
+// Start and End are UTF-16 offsets into the raw content so browser clients
+// can slice the string directly; the span covers the leading "@".
+type MentionSpan struct {
+	UserID   string `json:"userID"`   // ID of the mentioned user
+	Nickname string `json:"nickname"` // Nickname as stored on the user
+	Start    int    `json:"start"`    // Offset of the "@"
+	End      int    `json:"end"`      // Offset just past the nickname
+}
+
+// DBExecutor is the subset of *sql.DB and *sql.Tx used by helpers that may
+// run inside or outside a transaction
+type DBExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// ParseMentions finds @nickname tokens in content
+// Tokens directly preceded by a word character (such as an email address) are
+// ignored, and trailing dots or hyphens are treated as punctuation.
+// The returned spans are not resolved, so UserID is always empty.
+// @param content - The raw content to scan
+// @returns []MentionSpan - The candidate mentions in order of appearance
+func ParseMentions(content string) []MentionSpan {
+	var spans []MentionSpan
+
+	for _, loc := range mentionPattern.FindAllStringSubmatchIndex(content, -1) {
+		if loc[0] > 0 {
+			prev, _ := utf8.DecodeLastRuneInString(content[:loc[0]])
+			if prev == '@' || isWordRune(prev) {
+				continue
+			}
+		}
+
+		nickname := strings.TrimRight(content[loc[2]:loc[3]], ".-")
+		if ValidateNickname(nickname) != nil {
+			continue
+		}
+
+		start := utf16Len(content[:loc[0]])
+		spans = append(spans, MentionSpan{
+			Nickname: nickname,
+			Start:    start,
+			End:      start + 1 + utf16Len(nickname),
+		})
+	}
+
+	return spans
+}
+
+// ResolveMentions parses content and keeps only mentions of existing users
+// Nicknames are matched case-insensitively and replaced with the stored spelling.
+// @param db - Database used to look up nicknames
+// @param content - The raw content to scan
+// @returns []MentionSpan - The resolved mentions, never nil
+// @returns error - Any error from the user lookup
+func ResolveMentions(db DBExecutor, content string) ([]MentionSpan, error) {
+	resolved, err := ResolveMentionsBatch(db, []string{content})
+	if err != nil {
+		return nil, err
+	}
+	return resolved[0], nil
+}
+
+// ResolveMentionsBatch resolves the mentions of several pieces of content,
+// such as a page of posts, with a single user lookup
+// @param db - Database used to look up nicknames
+// @param contents - The raw contents to scan
+// @returns [][]MentionSpan - The resolved mentions of each content in order, never nil
+// @returns error - Any error from the user lookup
+func ResolveMentionsBatch(db DBExecutor, contents []string) ([][]MentionSpan, error) {
+	parsed := make([][]MentionSpan, len(contents))
+	placeholders := []string{}
+	args := []interface{}{}
+	seen := make(map[string]bool)
+	for i, content := range contents {
+		parsed[i] = ParseMentions(content)
+		for _, span := range parsed[i] {
+			key := strings.ToLower(span.Nickname)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			placeholders = append(placeholders, "?")
+			args = append(args, key)
+		}
+	}
+
+	users := make(map[string][2]string)
+	if len(args) > 0 {
+		rows, err := db.Query(`
+			SELECT id, nickname FROM users
+			WHERE LOWER(nickname) IN (`+strings.Join(placeholders, ", ")+`)
+		`, args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve mentions: %v", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var id, nickname string
+			if err := rows.Scan(&id, &nickname); err != nil {
+				return nil, fmt.Errorf("failed to scan mentioned user: %v", err)
+			}
+			users[strings.ToLower(nickname)] = [2]string{id, nickname}
+		}
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to resolve mentions: %v", err)
+		}
+	}
+
+	resolved := make([][]MentionSpan, len(contents))
+	for i, spans := range parsed {
+		resolved[i] = []MentionSpan{}
+		for _, span := range spans {
+			user, ok := users[strings.ToLower(span.Nickname)]
+			if !ok {
+				continue
+			}
+			span.UserID = user[0]
+			span.Nickname = user[1]
+			resolved[i] = append(resolved[i], span)
+		}
+	}
+
+	return resolved, nil
+}
+
+// SaveMentions records the users mentioned by a post, comment or message
+// Mentions that are no longer present (after an edit) are removed and the
+// author is never recorded as mentioning themselves.
+// @param db - Database or transaction to write to
+// @param sourceType - One of the MentionSource constants
+// @param sourceID - ID of the post, comment or message
+// @param actorID - ID of the author
+// @param spans - Resolved mentions from ResolveMentions
+// @returns []string - IDs of users that were newly mentioned and should be notified
+// @returns error - Any database error
+func SaveMentions(db DBExecutor, sourceType string, sourceID int64, actorID string, spans []MentionSpan) ([]string, error) {
+	existing := make(map[string]bool)
+	rows, err := db.Query(`
+		SELECT mentioned_user_id FROM mentions
+		WHERE source_type = ? AND source_id = ?
+	`, sourceType, sourceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load existing mentions: %v", err)
+	}
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan mention: %v", err)
+		}
+		existing[userID] = true
+	}
+	rows.Close()
+
+	current := make(map[string]bool)
+	var added []string
+	for _, span := range spans {
+		if span.UserID == "" || span.UserID == actorID || current[span.UserID] {
+			continue
+		}
+		current[span.UserID] = true
+		if existing[span.UserID] {
+			continue
+		}
+
+		_, err := db.Exec(`
+			INSERT OR IGNORE INTO mentions (source_type, source_id, mentioned_user_id, actor_id)
+			VALUES (?, ?, ?, ?)
+		`, sourceType, sourceID, span.UserID, actorID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to save mention: %v", err)
+		}
+		added = append(added, span.UserID)
+	}
+
+	for userID := range existing {
+		if current[userID] {
+			continue
+		}
+		_, err := db.Exec(`
+			DELETE FROM mentions
+			WHERE source_type = ? AND source_id = ? AND mentioned_user_id = ?
+		`, sourceType, sourceID, userID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to remove mention: %v", err)
+		}
+	}
+
+	return added, nil
+}
+
+// isWordRune reports whether r is a letter, digit or underscore
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// utf16Len returns the length of s in UTF-16 code units
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		n += utf16.RuneLen(r)
+	}
+	return n
+}
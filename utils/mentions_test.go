@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMentions(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []MentionSpan
+	}{
+		{"Single mention", "hi @alice", []MentionSpan{{Nickname: "alice", Start: 3, End: 9}}},
+		{"Trailing punctuation", "thanks @bob.", []MentionSpan{{Nickname: "bob", Start: 7, End: 11}}},
+		{"Email is not a mention", "mail me at me@example.com", nil},
+		{"Too short", "@ab", nil},
+		{"Multiple", "@carol and @dave_99", []MentionSpan{{Nickname: "carol", Start: 0, End: 6}, {Nickname: "dave_99", Start: 11, End: 19}}},
+		{"UTF-16 offsets", "😀 @erin", []MentionSpan{{Nickname: "erin", Start: 3, End: 8}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseMentions(tt.content); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseMentions(%q) = %+v, want %+v", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveMentionsBatch(t *testing.T) {
+	db := setupMessagesDB(t)
+
+	got, err := ResolveMentionsBatch(db, []string{"hi @ALICE", "no mentions", "@bob and @nobody"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]MentionSpan{
+		{{UserID: "alice", Nickname: "Alice", Start: 3, End: 9}},
+		{},
+		{{UserID: "bob", Nickname: "Bob", Start: 0, End: 4}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ResolveMentionsBatch() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,250 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ChatAttachmentKeyPrefix starts the blob keys of chat attachments
+// The media handler refuses keys with it, so chat files are only served to
+// conversation members.
+const ChatAttachmentKeyPrefix = "chat/"
+
+// MaxAttachmentsPerMessage is the most attachments one chat message can carry
+const MaxAttachmentsPerMessage = 10
+
+// Message attachment errors
+var (
+	ErrAttachmentNotFound = errors.New("attachment not found")
+	ErrTooManyAttachments = fmt.Errorf("a message can have at most %d attachments", MaxAttachmentsPerMessage)
+)
+
+// MessageAttachment is an image or file sent in a chat message
+// Attachments are uploaded first and belong to their uploader alone until
+// they are sent with a message.
+type MessageAttachment struct {
+	ID          int64      `json:"id"`                  // Unique identifier
+	MessageID   int64      `json:"messageId,omitempty"` // The message it was sent with, 0 until sent
+	UploaderID  string     `json:"uploaderId"`          // The user who uploaded it
+	Kind        string     `json:"kind"`                // "image" or "file"
+	FileName    string     `json:"fileName"`            // Original file name, used for downloads
+	ContentType string     `json:"contentType"`         // MIME type the file is served with
+	Size        int64      `json:"size"`                // Size in bytes
+	Width       int        `json:"width,omitempty"`     // Image width in pixels
+	Height      int        `json:"height,omitempty"`    // Image height in pixels
+	Checksum    string     `json:"checksum"`            // SHA-256 of the content, hex encoded
+	Position    int        `json:"position"`            // Order in the message
+	URL         string     `json:"url"`                 // Inline URL, for showing images
+	DownloadURL string     `json:"downloadUrl"`         // URL that downloads the file under its original name
+	StoragePath string     `json:"-"`                   // Blob key of the content
+	Image       *ImageInfo `json:"image,omitempty"`     // Renditions of an image attachment
+}
+
+// CreateMessageAttachment records an uploaded attachment that is not sent yet
+// @param db - Database connection or transaction
+// @param attachment - The attachment; UploaderID, Kind, FileName, ContentType,
+// Size, Checksum and StoragePath must be set
+// @returns int64 - The new attachment ID
+// @returns error - Any database error
+func CreateMessageAttachment(db DBExecutor, attachment *MessageAttachment) (int64, error) {
+	result, err := db.Exec(`
+		INSERT INTO message_attachments (uploader_id, kind, file_name, content_type, size, width, height,
+		                                 checksum, storage_path)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, attachment.UploaderID, attachment.Kind, attachment.FileName, attachment.ContentType, attachment.Size,
+		attachment.Width, attachment.Height, attachment.Checksum, attachment.StoragePath)
+	if err != nil {
+		return 0, fmt.Errorf("error creating message attachment: %v", err)
+	}
+	return result.LastInsertId()
+}
+
+// GetMessageAttachment loads one chat attachment
+// @param db - Database connection
+// @param id - The attachment ID
+// @returns *MessageAttachment - The attachment with its URLs
+// @returns error - ErrAttachmentNotFound or any database error
+func GetMessageAttachment(db *sql.DB, id int64) (*MessageAttachment, error) {
+	rows, err := db.Query(messageAttachmentSelect+" WHERE id = ?", id)
+	if err != nil {
+		return nil, fmt.Errorf("error loading message attachment: %v", err)
+	}
+	attachments, err := scanMessageAttachments(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(attachments) == 0 {
+		return nil, ErrAttachmentNotFound
+	}
+	return &attachments[0], nil
+}
+
+// CanViewMessageAttachment reports whether a user may load a chat attachment
+// Unsent attachments are only visible to their uploader. Sent ones are
+// visible to the members of the message's conversation, unless the message
+// was deleted for everyone or the member deleted it for themselves.
+// Database errors count as not allowed.
+// @param db - Database connection
+// @param attachment - The attachment
+// @param userID - The user asking
+// @returns bool - True if the user may load it
+func CanViewMessageAttachment(db *sql.DB, attachment *MessageAttachment, userID string) bool {
+	if attachment.MessageID == 0 {
+		return attachment.UploaderID == userID
+	}
+	var visible bool
+	err := db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM messages m
+			JOIN conversation_members cm ON cm.conversation_id = m.conversation_id AND cm.user_id = ?2
+			WHERE m.id = ?1 AND m.deleted_at IS NULL
+			AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = ?2))
+	`, attachment.MessageID, userID).Scan(&visible)
+	return err == nil && visible
+}
+
+// ValidatePendingAttachments checks that a sender may send some attachments
+// Each attachment must have been uploaded by the sender and not sent yet.
+// Attachments already sent with the sender's message of the same client
+// message ID are accepted too, so a retried send is not refused.
+// @param db - Database connection
+// @param uploaderID - The sender
+// @param clientMsgID - The sender's idempotency key, may be empty
+// @param ids - The attachments to send
+// @returns error - ErrTooManyAttachments, ErrAttachmentNotFound or any database error
+func ValidatePendingAttachments(db *sql.DB, uploaderID, clientMsgID string, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if len(ids) > MaxAttachmentsPerMessage {
+		return ErrTooManyAttachments
+	}
+	seen := make(map[int64]bool)
+	args := []interface{}{uploaderID, clientMsgID}
+	placeholders := make([]string, len(ids))
+	for i, id := range ids {
+		if seen[id] {
+			return ErrAttachmentNotFound
+		}
+		seen[id] = true
+		args = append(args, id)
+		placeholders[i] = fmt.Sprintf("?%d", i+3)
+	}
+
+	var count int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM message_attachments
+		WHERE uploader_id = ?1 AND id IN (`+strings.Join(placeholders, ", ")+`)
+		AND (message_id IS NULL OR (?2 != '' AND message_id IN
+			(SELECT id FROM messages WHERE sender_id = ?1 AND client_msg_id = ?2)))
+	`, args...).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("error checking message attachments: %v", err)
+	}
+	if count != len(ids) {
+		return ErrAttachmentNotFound
+	}
+	return nil
+}
+
+// ClaimMessageAttachments attaches pending attachments to a sent message
+// Attachments are ordered as listed. Ones that were sent in the meantime
+// are skipped.
+// @param db - Database connection
+// @param messageID - The message
+// @param uploaderID - The sender, who must have uploaded the attachments
+// @param ids - The attachments, checked with ValidatePendingAttachments
+// @returns error - Any database error
+func ClaimMessageAttachments(db *sql.DB, messageID int64, uploaderID string, ids []int64) error {
+	for position, id := range ids {
+		if _, err := db.Exec(`
+			UPDATE message_attachments SET message_id = ?, position = ?
+			WHERE id = ? AND uploader_id = ? AND message_id IS NULL
+		`, messageID, position, id, uploaderID); err != nil {
+			return fmt.Errorf("error attaching attachment %d: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// AttachMessageAttachments fills in the attachments of a page of messages
+// @param db - Database connection
+// @param messages - The messages, whose Attachments are replaced
+// @returns error - Any database error
+func AttachMessageAttachments(db *sql.DB, messages []StoredMessage) error {
+	ids := make([]int64, len(messages))
+	for i, m := range messages {
+		ids[i] = m.ID
+	}
+	attachments, err := MessageAttachmentsFor(db, ids)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		messages[i].Attachments = attachments[messages[i].ID]
+	}
+	return nil
+}
+
+// MessageAttachmentsFor loads the attachments of some messages in order
+// @param db - Database connection
+// @param messageIDs - The messages
+// @returns map[int64][]MessageAttachment - Attachments by message ID; messages without any are absent
+// @returns error - Any database error
+func MessageAttachmentsFor(db *sql.DB, messageIDs []int64) (map[int64][]MessageAttachment, error) {
+	byMessage := make(map[int64][]MessageAttachment)
+	if len(messageIDs) == 0 {
+		return byMessage, nil
+	}
+	args := make([]interface{}, len(messageIDs))
+	for i, id := range messageIDs {
+		args[i] = id
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", ")
+
+	rows, err := db.Query(
+		messageAttachmentSelect+" WHERE message_id IN ("+placeholders+") ORDER BY message_id, position, id",
+		args...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error loading message attachments: %v", err)
+	}
+	attachments, err := scanMessageAttachments(rows)
+	if err != nil {
+		return nil, err
+	}
+	for _, attachment := range attachments {
+		byMessage[attachment.MessageID] = append(byMessage[attachment.MessageID], attachment)
+	}
+	return byMessage, nil
+}
+
+// messageAttachmentSelect selects the columns read by scanMessageAttachments
+const messageAttachmentSelect = `
+	SELECT id, COALESCE(message_id, 0), uploader_id, kind, file_name, content_type, size, width, height,
+	       checksum, storage_path, position
+	FROM message_attachments`
+
+// scanMessageAttachments reads message attachment rows and fills in their URLs
+// Images get thumb and feed renditions, as post image attachments do.
+func scanMessageAttachments(rows *sql.Rows) ([]MessageAttachment, error) {
+	defer rows.Close()
+
+	var attachments []MessageAttachment
+	for rows.Next() {
+		var a MessageAttachment
+		err := rows.Scan(&a.ID, &a.MessageID, &a.UploaderID, &a.Kind, &a.FileName, &a.ContentType, &a.Size,
+			&a.Width, &a.Height, &a.Checksum, &a.StoragePath, &a.Position)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning message attachment: %v", err)
+		}
+		a.URL = fmt.Sprintf("/api/chat/attachments/view?id=%d", a.ID)
+		a.DownloadURL = fmt.Sprintf("/api/chat/attachments/download?id=%d", a.ID)
+		if a.Kind == AttachmentKindImage && a.Width > 0 {
+			a.Image = attachmentImageInfo(Attachment{URL: a.URL, Width: a.Width, Height: a.Height})
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+)
+
+// pendingAttachment records an unsent chat attachment or fails the test
+func pendingAttachment(t *testing.T, db DBExecutor, uploaderID, kind string) int64 {
+	id, err := CreateMessageAttachment(db, &MessageAttachment{
+		UploaderID:  uploaderID,
+		Kind:        kind,
+		FileName:    "photo.jpg",
+		ContentType: "image/jpeg",
+		Size:        100,
+		Width:       1600,
+		Height:      900,
+		Checksum:    "abc",
+		StoragePath: ChatAttachmentKeyPrefix + "ab/abc.jpg",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestSendMessageAttachments(t *testing.T) {
+	db := setupMessagesDB(t)
+	conversation := directConversation(t, db, "alice", "bob")
+	first := pendingAttachment(t, db, "alice", AttachmentKindImage)
+	second := pendingAttachment(t, db, "alice", AttachmentKindFile)
+	bobs := pendingAttachment(t, db, "bob", AttachmentKindFile)
+
+	pending, err := GetMessageAttachment(db, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !CanViewMessageAttachment(db, pending, "alice") || CanViewMessageAttachment(db, pending, "bob") {
+		t.Error("unsent attachments should only be visible to their uploader")
+	}
+
+	if err := ValidatePendingAttachments(db, "alice", "", []int64{first, bobs}); !errors.Is(err, ErrAttachmentNotFound) {
+		t.Errorf("ValidatePendingAttachments() with another user's upload = %v, want ErrAttachmentNotFound", err)
+	}
+	if err := ValidatePendingAttachments(db, "alice", "", []int64{first, first}); !errors.Is(err, ErrAttachmentNotFound) {
+		t.Errorf("ValidatePendingAttachments() with a repeated ID = %v, want ErrAttachmentNotFound", err)
+	}
+	ids := []int64{second, first}
+	if err := ValidatePendingAttachments(db, "alice", "c1", ids); err != nil {
+		t.Fatalf("ValidatePendingAttachments() = %v", err)
+	}
+
+	m, _, _ := SaveMessage(db, conversation, "alice", "bob", "", "c1")
+	if err := ClaimMessageAttachments(db, m.ID, "alice", ids); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidatePendingAttachments(db, "alice", "c1", ids); err != nil {
+		t.Errorf("ValidatePendingAttachments() on a retry = %v, want nil", err)
+	}
+	if err := ValidatePendingAttachments(db, "alice", "c2", ids); !errors.Is(err, ErrAttachmentNotFound) {
+		t.Errorf("ValidatePendingAttachments() of sent attachments = %v, want ErrAttachmentNotFound", err)
+	}
+
+	stored, err := GetMessage(db, m.ID, "bob")
+	if err != nil || len(stored.Attachments) != 2 || stored.Attachments[0].ID != second {
+		t.Fatalf("GetMessage() attachments = %+v, %v; want [%d %d]", stored.Attachments, err, second, first)
+	}
+	image := stored.Attachments[1]
+	if image.Image == nil || image.Image.Renditions[0].URL != image.URL+"&size=thumb" {
+		t.Errorf("image attachment renditions = %+v", image.Image)
+	}
+
+	sent, _ := GetMessageAttachment(db, first)
+	if !CanViewMessageAttachment(db, sent, "bob") || CanViewMessageAttachment(db, sent, "carol") {
+		t.Error("sent attachments should be visible to members only")
+	}
+	HideMessage(db, m.ID, "bob")
+	if CanViewMessageAttachment(db, sent, "bob") {
+		t.Error("attachments of a message deleted for me should not be visible")
+	}
+
+	if _, err := DeleteMessageForEveryone(db, m.ID, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetMessageAttachment(db, first); !errors.Is(err, ErrAttachmentNotFound) {
+		t.Errorf("GetMessageAttachment() after deleting for everyone = %v, want ErrAttachmentNotFound", err)
+	}
+}
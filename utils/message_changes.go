@@ -0,0 +1,333 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MessageEditWindow is how long after sending a message its sender may edit it
+const MessageEditWindow = 15 * time.Minute
+
+// Reaction limits
+const (
+	MaxReactionLength      = 32 // Bytes; enough for multi-codepoint emoji sequences
+	MaxReactionsPerMessage = 10 // Distinct emoji one member may put on one message
+)
+
+// Message change errors
+var (
+	ErrMessageNotFound  = errors.New("message not found")
+	ErrNotMessageSender = errors.New("only the sender can change this message")
+	ErrEditWindowClosed = errors.New("messages can only be edited for 15 minutes after sending")
+	ErrMessageDeleted   = errors.New("message has been deleted")
+	ErrInvalidReaction  = errors.New("reaction must be a single emoji")
+	ErrTooManyReactions = errors.New("too many reactions on this message")
+)
+
+// MessageReaction summarises the members who reacted to a message with one emoji
+type MessageReaction struct {
+	Emoji   string   `json:"emoji"`
+	Count   int      `json:"count"`
+	UserIDs []string `json:"user_ids"` // In the order they reacted
+}
+
+// GetMessage loads a chat message with its reactions and attachments for one of its members
+// Users outside the conversation get ErrMessageNotFound, as do messages the
+// member deleted for themselves.
+// @param db - Database connection
+// @param messageID - The message
+// @param userID - The member asking
+// @returns StoredMessage - The message
+// @returns error - ErrMessageNotFound or any database error
+func GetMessage(db *sql.DB, messageID int64, userID string) (StoredMessage, error) {
+	m, err := scanMessage(db.QueryRow(`
+		SELECT `+messageColumns+` FROM messages
+		WHERE id = ?1
+		AND EXISTS (SELECT 1 FROM conversation_members cm
+			WHERE cm.conversation_id = messages.conversation_id AND cm.user_id = ?2)
+		AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = messages.id AND h.user_id = ?2)
+	`, messageID, userID))
+	if err == sql.ErrNoRows {
+		return StoredMessage{}, ErrMessageNotFound
+	}
+	if err != nil {
+		return StoredMessage{}, fmt.Errorf("error loading message: %v", err)
+	}
+	messages := []StoredMessage{m}
+	if err := AttachReactions(db, messages); err != nil {
+		return StoredMessage{}, err
+	}
+	if err := AttachMessageAttachments(db, messages); err != nil {
+		return StoredMessage{}, err
+	}
+	return messages[0], nil
+}
+
+// EditMessage replaces the content of a message
+// Only the sender may edit, and only within MessageEditWindow of sending.
+// @param db - Database connection
+// @param messageID - The message
+// @param userID - The user editing it
+// @param content - The new content, already validated
+// @returns StoredMessage - The edited message
+// @returns error - ErrMessageNotFound, ErrNotMessageSender, ErrMessageDeleted,
+// ErrEditWindowClosed or any database error
+func EditMessage(db *sql.DB, messageID int64, userID, content string) (StoredMessage, error) {
+	m, err := GetMessage(db, messageID, userID)
+	if err != nil {
+		return StoredMessage{}, err
+	}
+	if m.SenderID != userID {
+		return StoredMessage{}, ErrNotMessageSender
+	}
+	if m.Deleted {
+		return StoredMessage{}, ErrMessageDeleted
+	}
+	if time.Since(m.SentAt) > MessageEditWindow {
+		return StoredMessage{}, ErrEditWindowClosed
+	}
+
+	editedAt := time.Now().UTC().Truncate(time.Second)
+	result, err := db.Exec(
+		"UPDATE messages SET content = ?, edited_at = ? WHERE id = ? AND deleted_at IS NULL",
+		content, editedAt.Format(messageTimeFormat), messageID,
+	)
+	if err != nil {
+		return StoredMessage{}, fmt.Errorf("error editing message: %v", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return StoredMessage{}, ErrMessageDeleted
+	}
+	m.Content = content
+	m.EditedAt = editedAt
+	return m, nil
+}
+
+// DeleteMessageForEveryone replaces a message with a tombstone
+// Only the sender may delete for everyone. The content, reactions and
+// attachments are removed but the row stays, so the conversation keeps its order and read
+// pointers. Deleting an already deleted message changes nothing.
+// @param db - Database connection
+// @param messageID - The message
+// @param userID - The user deleting it
+// @returns StoredMessage - The deleted message
+// @returns error - ErrMessageNotFound, ErrNotMessageSender or any database error
+func DeleteMessageForEveryone(db *sql.DB, messageID int64, userID string) (StoredMessage, error) {
+	m, err := GetMessage(db, messageID, userID)
+	if err != nil {
+		return StoredMessage{}, err
+	}
+	if m.SenderID != userID {
+		return StoredMessage{}, ErrNotMessageSender
+	}
+	if m.Deleted {
+		return m, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return StoredMessage{}, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		"UPDATE messages SET content = '', deleted_at = ? WHERE id = ?",
+		time.Now().UTC().Format(messageTimeFormat), messageID,
+	); err != nil {
+		return StoredMessage{}, fmt.Errorf("error deleting message: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM message_reactions WHERE message_id = ?", messageID); err != nil {
+		return StoredMessage{}, fmt.Errorf("error deleting message reactions: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM message_attachments WHERE message_id = ?", messageID); err != nil {
+		return StoredMessage{}, fmt.Errorf("error deleting message attachments: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return StoredMessage{}, err
+	}
+
+	m.Content = ""
+	m.Deleted = true
+	m.Reactions = nil
+	m.Attachments = nil
+	return m, nil
+}
+
+// HideMessage deletes a message for one member only
+// The other members still see it.
+// @param db - Database connection
+// @param messageID - The message
+// @param userID - The member hiding it
+// @returns StoredMessage - The hidden message
+// @returns error - ErrMessageNotFound or any database error
+func HideMessage(db *sql.DB, messageID int64, userID string) (StoredMessage, error) {
+	m, err := GetMessage(db, messageID, userID)
+	if err != nil {
+		return StoredMessage{}, err
+	}
+	if _, err := db.Exec(
+		"INSERT OR IGNORE INTO message_hidden (message_id, user_id) VALUES (?, ?)", messageID, userID,
+	); err != nil {
+		return StoredMessage{}, fmt.Errorf("error hiding message: %v", err)
+	}
+	return m, nil
+}
+
+// ValidateReaction checks that a reaction looks like a single emoji
+// Emoji are not enumerated; anything short without letters, digits or
+// spaces is accepted, which covers skin tones and joined sequences.
+// @param emoji - The reaction
+// @returns error - ErrInvalidReaction
+func ValidateReaction(emoji string) error {
+	if emoji == "" || len(emoji) > MaxReactionLength || !utf8.ValidString(emoji) {
+		return ErrInvalidReaction
+	}
+	for _, r := range emoji {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsSpace(r) || unicode.IsControl(r) {
+			return ErrInvalidReaction
+		}
+	}
+	return nil
+}
+
+// SetReaction adds or removes a member's emoji reaction on a message
+// Adding a reaction the member already made, or removing one they did not,
+// changes nothing.
+// @param db - Database connection
+// @param messageID - The message
+// @param userID - The reacting member
+// @param emoji - The reaction
+// @param add - True to add the reaction, false to remove it
+// @returns StoredMessage - The message, with its reactions afterwards
+// @returns error - ErrInvalidReaction, ErrMessageNotFound, ErrMessageDeleted,
+// ErrTooManyReactions or any database error
+func SetReaction(db *sql.DB, messageID int64, userID, emoji string, add bool) (StoredMessage, error) {
+	emoji = strings.TrimSpace(emoji)
+	if err := ValidateReaction(emoji); err != nil {
+		return StoredMessage{}, err
+	}
+	m, err := GetMessage(db, messageID, userID)
+	if err != nil {
+		return StoredMessage{}, err
+	}
+	if m.Deleted {
+		return StoredMessage{}, ErrMessageDeleted
+	}
+
+	if add {
+		// The limit is checked in the insert itself so concurrent reactions
+		// cannot go past it
+		result, err := db.Exec(`
+			INSERT OR IGNORE INTO message_reactions (message_id, user_id, emoji)
+			SELECT ?1, ?2, ?3
+			WHERE (SELECT COUNT(*) FROM message_reactions WHERE message_id = ?1 AND user_id = ?2) < ?4
+			OR EXISTS (SELECT 1 FROM message_reactions WHERE message_id = ?1 AND user_id = ?2 AND emoji = ?3)
+		`, messageID, userID, emoji, MaxReactionsPerMessage)
+		if err != nil {
+			return StoredMessage{}, fmt.Errorf("error adding reaction: %v", err)
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 && !hasReaction(m.Reactions, userID, emoji) {
+			return StoredMessage{}, ErrTooManyReactions
+		}
+	} else if _, err := db.Exec(
+		"DELETE FROM message_reactions WHERE message_id = ? AND user_id = ? AND emoji = ?", messageID, userID, emoji,
+	); err != nil {
+		return StoredMessage{}, fmt.Errorf("error removing reaction: %v", err)
+	}
+
+	messages := []StoredMessage{m}
+	if err := AttachReactions(db, messages); err != nil {
+		return StoredMessage{}, err
+	}
+	return messages[0], nil
+}
+
+// AttachReactions fills in the reactions of a page of messages
+// @param db - Database connection
+// @param messages - The messages, whose Reactions are replaced
+// @returns error - Any database error
+func AttachReactions(db *sql.DB, messages []StoredMessage) error {
+	ids := make([]int64, len(messages))
+	for i, m := range messages {
+		ids[i] = m.ID
+	}
+	reactions, err := MessageReactions(db, ids)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		messages[i].Reactions = reactions[messages[i].ID]
+	}
+	return nil
+}
+
+// MessageReactions loads the reactions of some messages
+// Reactions are grouped by emoji, in the order each emoji was first used.
+// @param db - Database connection
+// @param messageIDs - The messages
+// @returns map[int64][]MessageReaction - Reactions by message ID; messages without any are absent
+// @returns error - Any database error
+func MessageReactions(db *sql.DB, messageIDs []int64) (map[int64][]MessageReaction, error) {
+	reactions := make(map[int64][]MessageReaction)
+	if len(messageIDs) == 0 {
+		return reactions, nil
+	}
+	args := make([]interface{}, len(messageIDs))
+	for i, id := range messageIDs {
+		args[i] = id
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", ")
+
+	rows, err := db.Query(`
+		SELECT message_id, emoji, user_id FROM message_reactions
+		WHERE message_id IN (`+placeholders+`)
+		ORDER BY message_id, created_at, rowid
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error loading reactions: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID int64
+		var emoji, userID string
+		if err := rows.Scan(&messageID, &emoji, &userID); err != nil {
+			return nil, fmt.Errorf("error scanning reaction: %v", err)
+		}
+		summary := reactions[messageID]
+		found := false
+		for i := range summary {
+			if summary[i].Emoji == emoji {
+				summary[i].Count++
+				summary[i].UserIDs = append(summary[i].UserIDs, userID)
+				found = true
+				break
+			}
+		}
+		if !found {
+			summary = append(summary, MessageReaction{Emoji: emoji, Count: 1, UserIDs: []string{userID}})
+		}
+		reactions[messageID] = summary
+	}
+	return reactions, rows.Err()
+}
+
+// hasReaction reports whether a user already reacted with an emoji
+func hasReaction(reactions []MessageReaction, userID, emoji string) bool {
+	for _, reaction := range reactions {
+		if reaction.Emoji != emoji {
+			continue
+		}
+		for _, id := range reaction.UserIDs {
+			if id == userID {
+				return true
+			}
+		}
+	}
+	return false
+}
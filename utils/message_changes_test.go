@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEditAndDeleteMessage(t *testing.T) {
+	db := setupMessagesDB(t)
+	conversation := directConversation(t, db, "alice", "bob")
+	m, _, err := SaveMessage(db, conversation, "alice", "bob", "helo", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := EditMessage(db, m.ID, "bob", "hacked"); !errors.Is(err, ErrNotMessageSender) {
+		t.Errorf("EditMessage() by the receiver = %v, want ErrNotMessageSender", err)
+	}
+	if _, err := EditMessage(db, m.ID, "carol", "hacked"); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("EditMessage() by an outsider = %v, want ErrMessageNotFound", err)
+	}
+	edited, err := EditMessage(db, m.ID, "alice", "hello")
+	if err != nil || edited.Content != "hello" || edited.EditedAt.IsZero() {
+		t.Fatalf("EditMessage() = %+v, %v", edited, err)
+	}
+	if stored, _ := GetMessage(db, m.ID, "bob"); stored.Content != "hello" || stored.EditedAt.IsZero() {
+		t.Errorf("stored message after edit = %+v", stored)
+	}
+
+	old := time.Now().UTC().Add(-MessageEditWindow - time.Minute).Format(messageTimeFormat)
+	db.Exec("UPDATE messages SET sent_at = ? WHERE id = ?", old, m.ID)
+	if _, err := EditMessage(db, m.ID, "alice", "too late"); !errors.Is(err, ErrEditWindowClosed) {
+		t.Errorf("EditMessage() after the window = %v, want ErrEditWindowClosed", err)
+	}
+
+	SetReaction(db, m.ID, "bob", "👍", true)
+	if _, err := DeleteMessageForEveryone(db, m.ID, "bob"); !errors.Is(err, ErrNotMessageSender) {
+		t.Errorf("DeleteMessageForEveryone() by the receiver = %v, want ErrNotMessageSender", err)
+	}
+	deleted, err := DeleteMessageForEveryone(db, m.ID, "alice")
+	if err != nil || !deleted.Deleted || deleted.Content != "" {
+		t.Fatalf("DeleteMessageForEveryone() = %+v, %v", deleted, err)
+	}
+	stored, _ := GetMessage(db, m.ID, "bob")
+	if !stored.Deleted || stored.Content != "" || len(stored.Reactions) != 0 {
+		t.Errorf("tombstone = %+v; want deleted with no content or reactions", stored)
+	}
+	if _, err := SetReaction(db, m.ID, "bob", "👍", true); !errors.Is(err, ErrMessageDeleted) {
+		t.Errorf("SetReaction() on a tombstone = %v, want ErrMessageDeleted", err)
+	}
+}
+
+func TestHideMessage(t *testing.T) {
+	db := setupMessagesDB(t)
+	conversation := directConversation(t, db, "alice", "bob")
+	m, _, _ := SaveMessage(db, conversation, "alice", "bob", "hello", "")
+
+	if _, err := HideMessage(db, m.ID, "carol"); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("HideMessage() by an outsider = %v, want ErrMessageNotFound", err)
+	}
+	if _, err := HideMessage(db, m.ID, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if messages, _ := MessagesSince(db, conversation, "bob", 0, 0); len(messages) != 0 {
+		t.Errorf("MessagesSince(bob) after hiding = %+v, want none", messages)
+	}
+	if messages, _ := MessagesSince(db, conversation, "alice", 0, 0); len(messages) != 1 {
+		t.Errorf("MessagesSince(alice) after bob hid = %d messages, want 1", len(messages))
+	}
+}
+
+func TestSetReaction(t *testing.T) {
+	db := setupMessagesDB(t)
+	group, _ := CreateGroupConversation(db, "alice", "Team", []string{"bob", "carol"})
+	m, _, _ := SaveMessage(db, group, "alice", "", "lunch?", "")
+
+	for _, r := range []struct{ user, emoji string }{{"bob", "👍"}, {"carol", "🎉"}, {"carol", "👍"}, {"bob", "👍"}} {
+		if _, err := SetReaction(db, m.ID, r.user, r.emoji, true); err != nil {
+			t.Fatalf("SetReaction(%s, %s) = %v", r.user, r.emoji, err)
+		}
+	}
+	stored, err := SetReaction(db, m.ID, "carol", "🎉", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []MessageReaction{{Emoji: "👍", Count: 2, UserIDs: []string{"bob", "carol"}}}
+	if !reflect.DeepEqual(stored.Reactions, want) {
+		t.Errorf("reactions = %+v, want %+v", stored.Reactions, want)
+	}
+
+	if _, err := SetReaction(db, m.ID, "dave", "👍", true); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("SetReaction() by an outsider = %v, want ErrMessageNotFound", err)
+	}
+	emoji := []string{"😀", "😁", "😂", "🤣", "😃", "😄", "😅", "😆", "😉"}
+	for _, e := range emoji {
+		SetReaction(db, m.ID, "bob", e, true)
+	}
+	if _, err := SetReaction(db, m.ID, "bob", "😊", true); !errors.Is(err, ErrTooManyReactions) {
+		t.Errorf("reaction past the limit = %v, want ErrTooManyReactions", err)
+	}
+	if _, err := SetReaction(db, m.ID, "bob", "👍", true); err != nil {
+		t.Errorf("repeating a reaction at the limit = %v, want nil", err)
+	}
+}
+
+func TestValidateReaction(t *testing.T) {
+	for _, emoji := range []string{"👍", "❤️", "👍🏽", "👨‍👩‍👧"} {
+		if err := ValidateReaction(emoji); err != nil {
+			t.Errorf("ValidateReaction(%q) = %v, want nil", emoji, err)
+		}
+	}
+	for _, emoji := range []string{"", "ok", "👍 👍", "1", "<b>"} {
+		if err := ValidateReaction(emoji); err == nil {
+			t.Errorf("ValidateReaction(%q) = nil, want an error", emoji)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+	"unicode"
+)
+
+// MaxSearchTerms bounds how many words one message search may contain
+const MaxSearchTerms = 10
+
+// ErrEmptySearch is returned for searches without any word to look for
+var ErrEmptySearch = errors.New("search must contain at least one word")
+
+// MessageSearchResult is a chat message matching a search
+type MessageSearchResult struct {
+	StoredMessage
+	Snippet string // Escaped HTML of the matching text, with matches in <mark>
+}
+
+// CreateMessageSearchIndex creates the full-text index of chat messages
+// The index is an FTS4 table keyed by message ID and kept up to date by
+// triggers. Messages saved before the index existed are added to it, so it
+// is safe to call on every start.
+// @param db - Database connection
+// @returns error - Any database error
+func CreateMessageSearchIndex(db DBExecutor) error {
+	_, err := db.Exec(`
+    CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts4(body, tokenize=unicode61);
+
+    CREATE TRIGGER IF NOT EXISTS MessagesFTSInsert
+    AFTER INSERT ON messages
+    BEGIN
+        INSERT INTO messages_fts (docid, body) VALUES (NEW.id, NEW.content);
+    END;
+
+    CREATE TRIGGER IF NOT EXISTS MessagesFTSUpdate
+    AFTER UPDATE OF content ON messages
+    BEGIN
+        DELETE FROM messages_fts WHERE docid = OLD.id;
+        INSERT INTO messages_fts (docid, body) VALUES (NEW.id, NEW.content);
+    END;
+
+    CREATE TRIGGER IF NOT EXISTS MessagesFTSDelete
+    AFTER DELETE ON messages
+    BEGIN
+        DELETE FROM messages_fts WHERE docid = OLD.id;
+    END;
+
+    INSERT INTO messages_fts (docid, body)
+    SELECT id, content FROM messages
+    WHERE id > (SELECT COALESCE(MAX(docid), 0) FROM messages_fts);
+    `)
+	if err != nil {
+		return fmt.Errorf("error creating message search index: %v", err)
+	}
+	return nil
+}
+
+// MessageSearchQuery turns what a user typed into an FTS4 match expression
+// Only letters and digits are kept, so FTS operators and quotes typed by the
+// user are never interpreted. Every word must match; the last one also
+// matches as a prefix, so results appear while the user is still typing.
+// @param query - The search as typed
+// @returns string - The match expression
+// @returns error - ErrEmptySearch if no word is left
+func MessageSearchQuery(query string) (string, error) {
+	words := strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) == 0 {
+		return "", ErrEmptySearch
+	}
+	if len(words) > MaxSearchTerms {
+		words = words[:MaxSearchTerms]
+	}
+	words[len(words)-1] += "*"
+	return strings.Join(words, " "), nil
+}
+
+// SearchMessages finds messages containing words in a user's conversations
+// Results are newest first. Messages deleted for everyone, and messages the
+// user deleted for themselves, are never found.
+// @param db - Database connection
+// @param userID - The member searching
+// @param query - The search as typed by the user
+// @param conversationID - The conversation to search; 0 for all of the user's conversations
+// @param beforeID - Only find messages older than this one, for the next page; 0 for the newest
+// @param limit - The most results to return, capped at MaxMessageReplay
+// @returns []MessageSearchResult - The matching messages
+// @returns error - ErrEmptySearch or any database error
+func SearchMessages(db *sql.DB, userID, query string, conversationID, beforeID int64, limit int) ([]MessageSearchResult, error) {
+	match, err := MessageSearchQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 || limit > MaxMessageReplay {
+		limit = MaxMessageReplay
+	}
+
+	rows, err := db.Query(`
+		SELECT `+messageColumns+`, snippet(messages_fts, char(2), char(3), '…', -1, 12)
+		FROM messages_fts
+		JOIN messages ON messages.id = messages_fts.docid
+		WHERE messages_fts MATCH ?1
+		AND messages.deleted_at IS NULL
+		AND EXISTS (SELECT 1 FROM conversation_members cm
+			WHERE cm.conversation_id = messages.conversation_id AND cm.user_id = ?2)
+		AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = messages.id AND h.user_id = ?2)
+		AND (?3 = 0 OR messages.conversation_id = ?3)
+		AND (?4 = 0 OR (messages.sent_at, messages.id) < (SELECT sent_at, id FROM messages WHERE id = ?4))
+		ORDER BY messages.sent_at DESC, messages.id DESC
+		LIMIT ?5
+	`, match, userID, conversationID, beforeID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error searching messages: %v", err)
+	}
+	defer rows.Close()
+
+	var results []MessageSearchResult
+	for rows.Next() {
+		var result MessageSearchResult
+		var editedAt sql.NullTime
+		var snippet string
+		m := &result.StoredMessage
+		err := rows.Scan(&m.ID, &m.ConversationID, &m.SenderID, &m.ReceiverID, &m.Content, &m.ClientMsgID, &m.SentAt,
+			&m.Status, &editedAt, &m.Deleted, &snippet)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning search result: %v", err)
+		}
+		m.EditedAt = editedAt.Time
+		result.Snippet = highlightSnippet(snippet)
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// highlightSnippet escapes a snippet marked with \x02 and \x03 and turns the marks into <mark> tags
+func highlightSnippet(snippet string) string {
+	escaped := html.EscapeString(snippet)
+	return strings.NewReplacer("\x02", "<mark>", "\x03", "</mark>").Replace(escaped)
+}
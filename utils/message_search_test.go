@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMessageSearchQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+		err   error
+	}{
+		{"hello", "hello*", nil},
+		{"  Lunch  PLANS ", "lunch plans*", nil},
+		{`"quoted" OR -not NEAR/3`, "quoted or not near 3*", nil},
+		{"café", "café*", nil},
+		{"*** ''", "", ErrEmptySearch},
+	}
+	for _, tt := range tests {
+		got, err := MessageSearchQuery(tt.query)
+		if got != tt.want || !errors.Is(err, tt.err) {
+			t.Errorf("MessageSearchQuery(%q) = %q, %v; want %q, %v", tt.query, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestSearchMessages(t *testing.T) {
+	db := setupMessagesDB(t)
+	withBob := directConversation(t, db, "alice", "bob")
+	withCarol := directConversation(t, db, "alice", "carol")
+
+	first, _, _ := SaveMessage(db, withBob, "alice", "bob", "Lunch at noon?", "")
+	second, _, _ := SaveMessage(db, withBob, "bob", "alice", "lunchtime works <b>great</b>", "")
+	other, _, _ := SaveMessage(db, withCarol, "carol", "alice", "no lunch today", "")
+	deleted, _, _ := SaveMessage(db, withBob, "alice", "bob", "secret lunch", "")
+	DeleteMessageForEveryone(db, deleted.ID, "alice")
+
+	ids := func(results []MessageSearchResult) []int64 {
+		var found []int64
+		for _, result := range results {
+			found = append(found, result.ID)
+		}
+		return found
+	}
+
+	results, err := SearchMessages(db, "alice", "lunch", 0, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(results); len(got) != 3 || got[0] != other.ID || got[2] != first.ID {
+		t.Errorf("search across conversations = %v; want [%d %d %d]", got, other.ID, second.ID, first.ID)
+	}
+	if results[1].Snippet != "<mark>lunchtime</mark> works &lt;b&gt;great&lt;/b&gt;" {
+		t.Errorf("snippet = %q", results[1].Snippet)
+	}
+
+	results, _ = SearchMessages(db, "alice", "lunch", withBob, 0, 1)
+	if got := ids(results); len(got) != 1 || got[0] != second.ID {
+		t.Fatalf("first page in one conversation = %v; want [%d]", got, second.ID)
+	}
+	results, _ = SearchMessages(db, "alice", "lunch", withBob, second.ID, 10)
+	if got := ids(results); len(got) != 1 || got[0] != first.ID {
+		t.Errorf("next page = %v; want [%d]", got, first.ID)
+	}
+
+	if results, _ := SearchMessages(db, "bob", "lunch", withCarol, 0, 10); len(results) != 0 {
+		t.Errorf("non-member found %v", ids(results))
+	}
+
+	HideMessage(db, first.ID, "alice")
+	EditMessage(db, second.ID, "bob", "dinner instead")
+	if results, _ := SearchMessages(db, "alice", "lunch", withBob, 0, 10); len(results) != 0 {
+		t.Errorf("hidden or edited messages found: %v", ids(results))
+	}
+	if results, _ := SearchMessages(db, "alice", "dinner", withBob, 0, 10); len(results) != 1 {
+		t.Errorf("edited content not found: %v", ids(results))
+	}
+}
@@ -0,0 +1,361 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Chat message delivery statuses, in order
+const (
+	MessageStatusSent      = "sent"
+	MessageStatusDelivered = "delivered"
+	MessageStatusRead      = "read"
+)
+
+// MaxMessageReplay is the most messages MessagesSince returns at once
+const MaxMessageReplay = 100
+
+// MaxClientMsgIDLength bounds the idempotency keys clients may send
+const MaxClientMsgIDLength = 64
+
+// ErrInvalidClientMsgID is returned for client message IDs longer than MaxClientMsgIDLength
+var ErrInvalidClientMsgID = errors.New("client message ID is too long")
+
+// messageTimeFormat is how sent_at and receipt times are stored
+const messageTimeFormat = "2006-01-02 15:04:05"
+
+// MessageStatusColumn computes a message's status in queries on messages
+// Members' read and delivered pointers cover every message up to them, so a
+// message is read once every other member's read pointer has reached it.
+const MessageStatusColumn = `CASE
+	WHEN NOT EXISTS (SELECT 1 FROM conversation_members cm
+		WHERE cm.conversation_id = messages.conversation_id AND cm.user_id != messages.sender_id
+		AND cm.last_read_message_id < messages.id) THEN 'read'
+	WHEN NOT EXISTS (SELECT 1 FROM conversation_members cm
+		WHERE cm.conversation_id = messages.conversation_id AND cm.user_id != messages.sender_id
+		AND cm.last_delivered_message_id < messages.id) THEN 'delivered'
+	ELSE 'sent' END`
+
+// messageColumns selects a StoredMessage
+const messageColumns = "id, conversation_id, sender_id, receiver_id, content, COALESCE(client_msg_id, ''), sent_at, " +
+	MessageStatusColumn + ", edited_at, deleted_at IS NOT NULL"
+
+// StoredMessage is a chat message as saved in the database
+type StoredMessage struct {
+	ID             int64
+	ConversationID int64
+	SenderID       string
+	ReceiverID     string // The other participant of a direct conversation, empty in groups
+	Content        string
+	ClientMsgID    string    // The sender's idempotency key, empty for messages sent without one
+	SentAt         time.Time // Server time the message was first saved
+	Status         string    // One of the MessageStatus constants
+	EditedAt       time.Time // When the content was last edited, zero if never
+	Deleted        bool      // Deleted for everyone; the content is empty
+	Reactions      []MessageReaction
+	Attachments    []MessageAttachment
+}
+
+// MessageReceipt records that messages reached or were read by one member
+type MessageReceipt struct {
+	Status         string    // MessageStatusDelivered or MessageStatusRead
+	ConversationID int64     // The conversation the messages belong to
+	Kind           string    // The conversation's kind
+	SenderID       string    // The user who sent the messages
+	ReceiverID     string    // The member who received them
+	MessageIDs     []int64   // Messages whose status changed
+	At             time.Time // When the status changed
+}
+
+// scanMessage scans a row selected with messageColumns
+func scanMessage(row interface{ Scan(...interface{}) error }) (StoredMessage, error) {
+	var m StoredMessage
+	var editedAt sql.NullTime
+	err := row.Scan(&m.ID, &m.ConversationID, &m.SenderID, &m.ReceiverID, &m.Content, &m.ClientMsgID, &m.SentAt, &m.Status,
+		&editedAt, &m.Deleted)
+	m.EditedAt = editedAt.Time
+	return m, err
+}
+
+// SaveMessage stores a chat message, once per client message ID
+// A retry carrying a client message ID the sender already used returns the
+// stored message instead of saving a duplicate.
+// @param db - Database connection
+// @param conversationID - The conversation the message is sent in
+// @param senderID - The sending user
+// @param receiverID - The receiving user of a direct conversation, empty in groups
+// @param content - The message text
+// @param clientMsgID - The sender's idempotency key; empty to always save
+// @returns StoredMessage - The saved message, with its server timestamp
+// @returns bool - True if the message had already been saved
+// @returns error - ErrInvalidClientMsgID or any database error
+func SaveMessage(db *sql.DB, conversationID int64, senderID, receiverID, content, clientMsgID string) (StoredMessage, bool, error) {
+	if len(clientMsgID) > MaxClientMsgIDLength {
+		return StoredMessage{}, false, ErrInvalidClientMsgID
+	}
+	var key interface{}
+	if clientMsgID != "" {
+		key = clientMsgID
+	}
+
+	sentAt := time.Now().UTC().Truncate(time.Second)
+	result, err := db.Exec(`
+		INSERT INTO messages (conversation_id, sender_id, receiver_id, content, sent_at, client_msg_id)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT DO NOTHING
+	`, conversationID, senderID, receiverID, content, sentAt.Format(messageTimeFormat), key)
+	if err != nil {
+		return StoredMessage{}, false, fmt.Errorf("error saving message: %v", err)
+	}
+
+	if inserted, _ := result.RowsAffected(); inserted == 0 {
+		m, err := scanMessage(db.QueryRow(
+			"SELECT "+messageColumns+" FROM messages WHERE sender_id = ? AND client_msg_id = ?",
+			senderID, clientMsgID,
+		))
+		if err != nil {
+			return StoredMessage{}, false, fmt.Errorf("error loading saved message: %v", err)
+		}
+		return m, true, nil
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return StoredMessage{}, false, err
+	}
+	return StoredMessage{
+		ID:             id,
+		ConversationID: conversationID,
+		SenderID:       senderID,
+		ReceiverID:     receiverID,
+		Content:        content,
+		ClientMsgID:    clientMsgID,
+		SentAt:         sentAt,
+		Status:         MessageStatusSent,
+	}, false, nil
+}
+
+// MessagesSince lists the messages in a conversation after a message ID
+// Used by clients resuming after a disconnect. At most limit messages are
+// returned, oldest first, with their reactions and attachments; a client asks again from the
+// last ID for more. Messages the viewer deleted for themselves are left out.
+// @param db - Database connection
+// @param conversationID - The conversation
+// @param viewerID - The member the messages are listed for
+// @param sinceID - The last message ID the client has seen
+// @param limit - The most messages to return, capped at MaxMessageReplay
+// @returns []StoredMessage - The messages, oldest first
+// @returns error - Any database error
+func MessagesSince(db *sql.DB, conversationID int64, viewerID string, sinceID int64, limit int) ([]StoredMessage, error) {
+	if limit <= 0 || limit > MaxMessageReplay {
+		limit = MaxMessageReplay
+	}
+	rows, err := db.Query(`
+		SELECT `+messageColumns+`
+		FROM messages
+		WHERE conversation_id = ? AND id > ?
+		AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = messages.id AND h.user_id = ?)
+		ORDER BY id ASC
+		LIMIT ?
+	`, conversationID, sinceID, viewerID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error loading messages: %v", err)
+	}
+	defer rows.Close()
+
+	var messages []StoredMessage
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning message: %v", err)
+		}
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	if err := AttachReactions(db, messages); err != nil {
+		return nil, err
+	}
+	return messages, AttachMessageAttachments(db, messages)
+}
+
+// MarkMessages records that a member got or read messages up to some of theirs
+// Each member keeps a read and a delivered pointer per conversation, so
+// marking a message also marks every earlier one. Only conversations the
+// user belongs to are changed, and pointers only move forward; reading also
+// advances the delivered pointer. The messages that changed status are
+// grouped into one receipt per sender.
+// @param db - Database connection
+// @param userID - The member who got the messages
+// @param status - MessageStatusDelivered or MessageStatusRead
+// @param messageIDs - The messages to mark
+// @returns []MessageReceipt - One receipt per conversation and sender whose messages changed
+// @returns error - Any database error
+func MarkMessages(db *sql.DB, userID, status string, messageIDs []int64) ([]MessageReceipt, error) {
+	if len(messageIDs) == 0 {
+		return nil, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(messageIDs)), ", ")
+	args := []interface{}{userID, userID}
+	for _, id := range messageIDs {
+		args = append(args, id)
+	}
+	rows, err := db.Query(`
+		SELECT m.conversation_id, MAX(m.id)
+		FROM messages m
+		JOIN conversation_members cm ON cm.conversation_id = m.conversation_id AND cm.user_id = ?
+		WHERE m.sender_id != ? AND m.id IN (`+placeholders+`)
+		GROUP BY m.conversation_id
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error finding messages to mark %s: %v", status, err)
+	}
+	upTo := make(map[int64]int64)
+	for rows.Next() {
+		var conversationID, id int64
+		if err := rows.Scan(&conversationID, &id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error scanning message to mark: %v", err)
+		}
+		upTo[conversationID] = id
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var receipts []MessageReceipt
+	for conversationID, id := range upTo {
+		marked, err := advancePointer(db, conversationID, userID, status, id)
+		if err != nil {
+			return nil, err
+		}
+		receipts = append(receipts, marked...)
+	}
+	sort.Slice(receipts, func(i, j int) bool { return receipts[i].MessageIDs[0] < receipts[j].MessageIDs[0] })
+	return receipts, nil
+}
+
+// MarkConversationRead marks every message in a conversation as read by a member
+// @param db - Database connection
+// @param userID - The member reading the messages
+// @param conversationID - The conversation
+// @returns []MessageReceipt - One receipt per sender whose messages changed
+// @returns error - ErrNotConversationMember or any database error
+func MarkConversationRead(db *sql.DB, userID string, conversationID int64) ([]MessageReceipt, error) {
+	if !IsConversationMember(db, conversationID, userID) {
+		return nil, ErrNotConversationMember
+	}
+	var latest sql.NullInt64
+	err := db.QueryRow(
+		"SELECT MAX(id) FROM messages WHERE conversation_id = ? AND sender_id != ?", conversationID, userID,
+	).Scan(&latest)
+	if err != nil || !latest.Valid {
+		return nil, err
+	}
+	return advancePointer(db, conversationID, userID, MessageStatusRead, latest.Int64)
+}
+
+// UnreadCount counts the messages in a conversation a member has not read
+// @param db - Database connection
+// @param userID - The member
+// @param conversationID - The conversation
+// @returns int - The number of unread messages from other members
+// @returns error - Any database error
+func UnreadCount(db *sql.DB, userID string, conversationID int64) (int, error) {
+	var count int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM messages m
+		JOIN conversation_members cm ON cm.conversation_id = m.conversation_id AND cm.user_id = ?1
+		WHERE m.conversation_id = ?2 AND m.sender_id != ?1 AND m.id > cm.last_read_message_id
+	`, userID, conversationID).Scan(&count)
+	return count, err
+}
+
+// advancePointer moves a member's read or delivered pointer forward
+// The receipts list the other members' messages the pointer passed over.
+func advancePointer(db *sql.DB, conversationID int64, userID, status string, upTo int64) ([]MessageReceipt, error) {
+	var set, pointer string
+	switch status {
+	case MessageStatusDelivered:
+		pointer = "last_delivered_message_id"
+		set = "last_delivered_message_id = MAX(last_delivered_message_id, ?1)"
+	case MessageStatusRead:
+		pointer = "last_read_message_id"
+		set = "last_read_message_id = MAX(last_read_message_id, ?1), last_delivered_message_id = MAX(last_delivered_message_id, ?1)"
+	default:
+		return nil, fmt.Errorf("unknown message status %q", status)
+	}
+
+	// Compare-and-set instead of a transaction, so a concurrent writer never
+	// deadlocks a read lock waiting to become a write lock
+	var from int64
+	var kind string
+	for moved := false; !moved; {
+		err := db.QueryRow(`
+			SELECT cm.`+pointer+`, c.kind
+			FROM conversation_members cm JOIN conversations c ON c.id = cm.conversation_id
+			WHERE cm.conversation_id = ? AND cm.user_id = ?
+		`, conversationID, userID).Scan(&from, &kind)
+		if err == sql.ErrNoRows {
+			return nil, ErrNotConversationMember
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error loading %s pointer: %v", status, err)
+		}
+		if upTo <= from {
+			return nil, nil
+		}
+		result, err := db.Exec(
+			"UPDATE conversation_members SET "+set+" WHERE conversation_id = ?2 AND user_id = ?3 AND "+pointer+" = ?4",
+			upTo, conversationID, userID, from,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("error marking messages %s: %v", status, err)
+		}
+		affected, _ := result.RowsAffected()
+		moved = affected > 0
+	}
+
+	rows, err := db.Query(`
+		SELECT id, sender_id FROM messages
+		WHERE conversation_id = ? AND sender_id != ? AND id > ? AND id <= ?
+		ORDER BY id
+	`, conversationID, userID, from, upTo)
+	if err != nil {
+		return nil, fmt.Errorf("error loading marked messages: %v", err)
+	}
+	defer rows.Close()
+
+	at := time.Now().UTC().Truncate(time.Second)
+	var receipts []MessageReceipt
+	bySender := make(map[string]int)
+	for rows.Next() {
+		var id int64
+		var senderID string
+		if err := rows.Scan(&id, &senderID); err != nil {
+			return nil, fmt.Errorf("error scanning marked message: %v", err)
+		}
+		i, ok := bySender[senderID]
+		if !ok {
+			i = len(receipts)
+			bySender[senderID] = i
+			receipts = append(receipts, MessageReceipt{
+				Status:         status,
+				ConversationID: conversationID,
+				Kind:           kind,
+				SenderID:       senderID,
+				ReceiverID:     userID,
+				At:             at,
+			})
+		}
+		receipts[i].MessageIDs = append(receipts[i].MessageIDs, id)
+	}
+	return receipts, rows.Err()
+}
@@ -0,0 +1,225 @@
+package utils
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// setupMessagesDB creates an in-memory database with the chat tables
+// Users alice, bob, carol and dave exist.
+func setupMessagesDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open test db: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec(`
+		CREATE TABLE users (
+			id TEXT PRIMARY KEY,
+			nickname TEXT,
+			profile_pic TEXT,
+			is_online BOOLEAN DEFAULT 0,
+			last_seen DATETIME DEFAULT CURRENT_TIMESTAMP,
+			presence_status TEXT NOT NULL DEFAULT 'online',
+			status_text TEXT NOT NULL DEFAULT '',
+			status_emoji TEXT NOT NULL DEFAULT '',
+			status_expires_at DATETIME
+		);
+		INSERT INTO users (id, nickname) VALUES ('alice', 'Alice'), ('bob', 'Bob'), ('carol', 'Carol'), ('dave', 'Dave');
+		CREATE TABLE user_blocks (blocker_id TEXT, blocked_id TEXT, kind TEXT);
+		CREATE TABLE messages (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			sender_id TEXT NOT NULL,
+			receiver_id TEXT NOT NULL,
+			content TEXT NOT NULL,
+			sent_at TIMESTAMP NOT NULL,
+			read BOOLEAN DEFAULT 0,
+			client_msg_id TEXT,
+			delivered_at TIMESTAMP,
+			read_at TIMESTAMP,
+			conversation_id INTEGER,
+			edited_at TIMESTAMP,
+			deleted_at TIMESTAMP
+		);
+		CREATE UNIQUE INDEX idx_messages_client_msg_id
+		ON messages(sender_id, client_msg_id) WHERE client_msg_id IS NOT NULL;
+		CREATE TABLE conversations (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			kind TEXT NOT NULL DEFAULT 'group',
+			title TEXT NOT NULL DEFAULT '',
+			direct_key TEXT UNIQUE,
+			created_by TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE conversation_members (
+			conversation_id INTEGER NOT NULL,
+			user_id TEXT NOT NULL,
+			role TEXT NOT NULL DEFAULT 'member',
+			last_read_message_id INTEGER NOT NULL DEFAULT 0,
+			last_delivered_message_id INTEGER NOT NULL DEFAULT 0,
+			joined_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (conversation_id, user_id)
+		);
+		CREATE TABLE message_reactions (
+			message_id INTEGER NOT NULL,
+			user_id TEXT NOT NULL,
+			emoji TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (message_id, user_id, emoji)
+		);
+		CREATE TABLE message_hidden (
+			message_id INTEGER NOT NULL,
+			user_id TEXT NOT NULL,
+			hidden_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (message_id, user_id)
+		);
+		CREATE TABLE message_attachments (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			message_id INTEGER,
+			uploader_id TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			file_name TEXT NOT NULL,
+			content_type TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			width INTEGER NOT NULL DEFAULT 0,
+			height INTEGER NOT NULL DEFAULT 0,
+			checksum TEXT NOT NULL,
+			storage_path TEXT NOT NULL,
+			position INTEGER NOT NULL DEFAULT 0,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create chat tables: %v", err)
+	}
+	if err := CreateMessageSearchIndex(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// directConversation returns the direct conversation between two users or fails the test
+func directConversation(t *testing.T, db *sql.DB, userA, userB string) int64 {
+	id, err := DirectConversationID(db, userA, userB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestSaveMessageIsIdempotent(t *testing.T) {
+	db := setupMessagesDB(t)
+	conversation := directConversation(t, db, "alice", "bob")
+
+	first, duplicate, err := SaveMessage(db, conversation, "alice", "bob", "hello", "c1")
+	if err != nil || duplicate {
+		t.Fatalf("SaveMessage() = %+v, %v, %v", first, duplicate, err)
+	}
+	retry, duplicate, err := SaveMessage(db, conversation, "alice", "bob", "hello", "c1")
+	if err != nil || !duplicate || retry.ID != first.ID || !retry.SentAt.Equal(first.SentAt) {
+		t.Errorf("retried SaveMessage() = %+v, %v, %v; want message %d again", retry, duplicate, err, first.ID)
+	}
+
+	// Keys are per sender, and messages without a key are always saved
+	if other, duplicate, _ := SaveMessage(db, conversation, "bob", "alice", "hi", "c1"); duplicate || other.ID == first.ID {
+		t.Errorf("another sender's c1 was treated as a duplicate")
+	}
+	for i := 0; i < 2; i++ {
+		if _, duplicate, err := SaveMessage(db, conversation, "alice", "bob", "again", ""); err != nil || duplicate {
+			t.Errorf("SaveMessage() without a key = %v, %v", duplicate, err)
+		}
+	}
+
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM messages").Scan(&count)
+	if count != 4 {
+		t.Errorf("saved %d messages, want 4", count)
+	}
+}
+
+func TestMessageReceiptsAndResume(t *testing.T) {
+	db := setupMessagesDB(t)
+	conversation := directConversation(t, db, "alice", "bob")
+
+	var ids []int64
+	for _, sender := range []string{"alice", "alice", "bob", "alice"} {
+		receiver := map[string]string{"alice": "bob", "bob": "alice"}[sender]
+		m, _, err := SaveMessage(db, conversation, sender, receiver, "text", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, m.ID)
+	}
+	elsewhere, _, _ := SaveMessage(db, directConversation(t, db, "alice", "carol"), "alice", "carol", "elsewhere", "")
+
+	// Bob can only mark messages sent to him, and marking one covers those before it
+	receipts, err := MarkMessages(db, "bob", MessageStatusDelivered, []int64{ids[1], elsewhere.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(receipts) != 1 || receipts[0].SenderID != "alice" || !reflect.DeepEqual(receipts[0].MessageIDs, []int64{ids[0], ids[1]}) {
+		t.Errorf("MarkMessages(delivered) = %+v", receipts)
+	}
+	if receipts, _ := MarkMessages(db, "bob", MessageStatusDelivered, ids[:2]); len(receipts) != 0 {
+		t.Errorf("marking delivered twice produced receipts %+v", receipts)
+	}
+
+	receipts, err = MarkConversationRead(db, "bob", conversation)
+	if err != nil || len(receipts) != 1 || len(receipts[0].MessageIDs) != 3 {
+		t.Errorf("MarkConversationRead() = %+v, %v", receipts, err)
+	}
+	if count, _ := UnreadCount(db, "alice", conversation); count != 1 {
+		t.Errorf("UnreadCount(alice) = %d, want 1", count)
+	}
+
+	messages, err := MessagesSince(db, conversation, "bob", ids[0], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range messages {
+		got = append(got, m.SenderID+":"+m.Status)
+	}
+	if want := []string{"alice:read", "bob:sent", "alice:read"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("MessagesSince() statuses = %v, want %v", got, want)
+	}
+	if messages, _ := MessagesSince(db, conversation, "bob", 0, 2); len(messages) != 2 || messages[0].ID != ids[0] {
+		t.Errorf("MessagesSince() with a limit = %+v", messages)
+	}
+}
+
+func TestGroupMessageStatus(t *testing.T) {
+	db := setupMessagesDB(t)
+	group, err := CreateGroupConversation(db, "alice", "Team", []string{"bob", "carol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _, err := SaveMessage(db, group, "alice", "", "hello all", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := func() string {
+		messages, _ := MessagesSince(db, group, "alice", 0, 0)
+		return messages[0].Status
+	}
+	MarkConversationRead(db, "bob", group)
+	if got := status(); got != MessageStatusSent {
+		t.Errorf("status after one of two members read = %q, want sent", got)
+	}
+	receipts, _ := MarkMessages(db, "carol", MessageStatusRead, []int64{m.ID})
+	if got := status(); got != MessageStatusRead || len(receipts) != 1 || receipts[0].Kind != ConversationKindGroup {
+		t.Errorf("status after everyone read = %q, receipts %+v", got, receipts)
+	}
+
+	// Members who join later start with earlier messages read
+	AddConversationMembers(db, group, "alice", []string{"dave"})
+	if got := status(); got != MessageStatusRead {
+		t.Errorf("status after a member joined = %q, want read", got)
+	}
+}
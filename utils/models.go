@@ -18,36 +18,50 @@ type User struct {
 	UpdatedAt  time.Time `json:"updatedAt"`  // Last update timestamp
 	ProfilePic string    `json:"profilePic"` // Profile picture path
 	IsOnline   bool      `json:"isOnline"`   // Online status
+	Status     string    `json:"status"`     // Status shown to others: online, away, dnd or offline
 	LastSeen   time.Time `json:"lastSeen"`   // Last activity timestamp
 }
 
 // Post represents a post in the forum
 type Post struct {
-	ID         int64      `json:"id"`         // Unique identifier
-	Title      string     `json:"title"`      // Post title
-	Content    string     `json:"content"`    // Post content
-	ImagePath  string     `json:"imagePath"`  // Path to attached image
-	PostTime   string     `json:"postTime"`   // Formatted timestamp
-	UserID     string     `json:"userID"`     // ID of post author
-	Username   string     `json:"username"`   // Username of post author
-	ProfilePic string     `json:"profilePic"` // Author's profile picture
-	Likes      int        `json:"likes"`      // Number of likes
-	Dislikes   int        `json:"dislikes"`   // Number of dislikes
-	Comments   int        `json:"comments"`   // Number of comments
-	Categories []Category `json:"categories"` // Post categories
+	ID           int64         `json:"id"`                  // Unique identifier
+	Title        string        `json:"title"`               // Post title
+	Content      string        `json:"content"`             // Post content
+	ContentRaw   string        `json:"content_raw"`         // Post content as written (Markdown)
+	ContentHTML  string        `json:"content_html"`        // Post content rendered to sanitized HTML
+	Mentions     []MentionSpan `json:"mentions"`            // Resolved @mentions in the raw content
+	ImagePath    string        `json:"imagePath"`           // Path to attached image
+	PostTime     string        `json:"postTime"`            // Formatted timestamp
+	UserID       string        `json:"userID"`              // ID of post author
+	Username     string        `json:"username"`            // Username of post author
+	ProfilePic   string        `json:"profilePic"`          // Author's profile picture
+	Likes        int           `json:"likes"`               // Number of likes
+	Dislikes     int           `json:"dislikes"`            // Number of dislikes
+	Comments     int           `json:"comments"`            // Number of comments
+	Categories   []Category    `json:"categories"`          // Post categories
+	Tags         []string      `json:"tags"`                // Free-form tags, without the "#"
+	IsBookmarked bool          `json:"isBookmarked"`        // Whether the current user bookmarked the post
+	Status       string        `json:"status,omitempty"`    // draft, scheduled or published; only set for the author's drafts
+	PublishAt    string        `json:"publishAt,omitempty"` // Scheduled publication time (RFC3339)
+	Poll         *Poll         `json:"poll,omitempty"`      // Attached poll with its results, if any
+	Attachments  []Attachment  `json:"attachments"`         // Gallery images and downloadable files, in order
+	Image        *ImageInfo    `json:"image,omitempty"`     // Renditions of the post image, if it was processed
 }
 
 // Comment represents a comment on a post
 type Comment struct {
-	ID          int       `json:"id"`          // Unique identifier
-	PostID      int       `json:"postID"`      // ID of the parent post
-	UserID      string    `json:"userID"`      // ID of comment author
-	Username    string    `json:"username"`    // Username of comment author
-	Content     string    `json:"content"`     // Comment content
-	CommentTime time.Time `json:"commentTime"` // Timestamp
-	Likes       int       `json:"likes"`       // Number of likes
-	Dislikes    int       `json:"dislikes"`    // Number of dislikes
-	ProfilePic  string    `json:"profilePic"`  // Author's profile picture
+	ID          int           `json:"id"`           // Unique identifier
+	PostID      int           `json:"postID"`       // ID of the parent post
+	UserID      string        `json:"userID"`       // ID of comment author
+	Username    string        `json:"username"`     // Username of comment author
+	Content     string        `json:"content"`      // Comment content
+	ContentRaw  string        `json:"content_raw"`  // Comment content as written (Markdown)
+	ContentHTML string        `json:"content_html"` // Comment content rendered to sanitized HTML
+	Mentions    []MentionSpan `json:"mentions"`     // Resolved @mentions in the raw content
+	CommentTime time.Time     `json:"commentTime"`  // Timestamp
+	Likes       int           `json:"likes"`        // Number of likes
+	Dislikes    int           `json:"dislikes"`     // Number of dislikes
+	ProfilePic  string        `json:"profilePic"`   // Author's profile picture
 }
 
 // Category represents a post category
@@ -56,6 +70,28 @@ type Category struct {
 	Name string `json:"name"` // Category name
 }
 
+// CategoryListing is a category with its details and activity, as shown in
+// the category listing and the admin API
+type CategoryListing struct {
+	ID             int    `json:"id"`                       // Unique identifier
+	Name           string `json:"name"`                     // Category name
+	Description    string `json:"description"`              // Short description shown with the category
+	Position       int    `json:"position"`                 // Display order, lowest first
+	Archived       bool   `json:"archived"`                 // Archived categories accept no new posts
+	PostCount      int    `json:"postCount"`                // Number of posts in the category
+	LatestActivity string `json:"latestActivity,omitempty"` // Time of the latest post or comment (RFC3339)
+}
+
+// Collection is a named group of a user's bookmarks
+type Collection struct {
+	ID            int64  `json:"id"`                   // Unique identifier
+	Name          string `json:"name"`                 // Collection name, unique per user
+	Shared        bool   `json:"shared"`               // Whether the collection can be opened by link
+	ShareToken    string `json:"shareToken,omitempty"` // Token for the share link, only shown to the owner
+	BookmarkCount int    `json:"bookmarkCount"`        // Number of bookmarks in the collection
+	OwnerName     string `json:"ownerName,omitempty"`  // Owner's nickname, shown on shared collections
+}
+
 // Session represents a user session
 type Session struct {
 	ID        string    `json:"id"`        // Session token
@@ -0,0 +1,382 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Poll size limits
+const (
+	MinPollOptions        = 2
+	MaxPollOptions        = 10
+	MaxPollQuestionLength = 200
+	MaxPollOptionLength   = 100
+)
+
+// Poll voting errors
+var (
+	ErrPollClosed        = errors.New("poll is closed")
+	ErrInvalidPollOption = errors.New("invalid poll option")
+)
+
+// Poll is a question attached to a post, with aggregated results
+type Poll struct {
+	ID         int64        `json:"id"`                 // Unique identifier
+	PostID     int64        `json:"postId"`             // The post carrying the poll
+	Question   string       `json:"question"`           // The question asked
+	Multiple   bool         `json:"multiple"`           // Whether voters may choose several options
+	Anonymous  bool         `json:"anonymous"`          // Whether voter names are hidden
+	ClosesAt   string       `json:"closesAt,omitempty"` // Close time (RFC3339), empty if open-ended
+	Closed     bool         `json:"closed"`             // Whether voting has ended
+	Options    []PollOption `json:"options"`            // Options in display order
+	TotalVotes int          `json:"totalVotes"`         // Number of votes across all options
+	Voters     int          `json:"voters"`             // Number of distinct voters
+	MyVotes    []int64      `json:"myVotes"`            // Options chosen by the current user
+}
+
+// PollOption is one answer of a poll with its vote count
+type PollOption struct {
+	ID     int64       `json:"id"`               // Unique identifier
+	Text   string      `json:"text"`             // Option text
+	Votes  int         `json:"votes"`            // Number of votes
+	Voters []PollVoter `json:"voters,omitempty"` // Who voted, only for public polls
+}
+
+// PollVoter is a user who voted for an option of a public poll
+type PollVoter struct {
+	ID       string `json:"id"`
+	Nickname string `json:"nickname"`
+}
+
+// ClosedPoll identifies a poll whose close time has passed
+type ClosedPoll struct {
+	PollID int64
+	PostID int64
+	UserID string // The post author, who created the poll
+}
+
+// ValidatePoll trims and checks a poll before it is created
+// @param question - The poll question
+// @param options - The option texts
+// @returns string - The trimmed question
+// @returns []string - The trimmed options
+// @returns error - A client-facing error if the poll is invalid
+func ValidatePoll(question string, options []string) (string, []string, error) {
+	question = strings.TrimSpace(question)
+	if question == "" {
+		return "", nil, fmt.Errorf("Poll question is required")
+	}
+	if len([]rune(question)) > MaxPollQuestionLength {
+		return "", nil, fmt.Errorf("Poll question must be at most %d characters", MaxPollQuestionLength)
+	}
+
+	var trimmed []string
+	seen := make(map[string]bool)
+	for _, option := range options {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+		if len([]rune(option)) > MaxPollOptionLength {
+			return "", nil, fmt.Errorf("Poll options must be at most %d characters", MaxPollOptionLength)
+		}
+		if seen[strings.ToLower(option)] {
+			return "", nil, fmt.Errorf("Poll options must be different")
+		}
+		seen[strings.ToLower(option)] = true
+		trimmed = append(trimmed, option)
+	}
+	if len(trimmed) < MinPollOptions || len(trimmed) > MaxPollOptions {
+		return "", nil, fmt.Errorf("A poll needs between %d and %d options", MinPollOptions, MaxPollOptions)
+	}
+
+	return question, trimmed, nil
+}
+
+// CreatePoll attaches a validated poll to a post
+// @param db - Database connection or transaction
+// @param postID - The post carrying the poll
+// @param question - The poll question
+// @param options - The option texts in display order
+// @param multiple - Whether voters may choose several options
+// @param anonymous - Whether voter names are hidden
+// @param closesAt - When voting ends, or an invalid NullTime for no end
+// @returns int64 - The new poll ID
+// @returns error - Any database error
+func CreatePoll(db DBExecutor, postID int64, question string, options []string, multiple, anonymous bool, closesAt sql.NullTime) (int64, error) {
+	result, err := db.Exec(`
+		INSERT INTO polls (post_id, question, multiple, anonymous, closes_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, postID, question, multiple, anonymous, closesAt)
+	if err != nil {
+		return 0, fmt.Errorf("error creating poll: %v", err)
+	}
+	pollID, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("error creating poll: %v", err)
+	}
+
+	for i, option := range options {
+		_, err := db.Exec(
+			"INSERT INTO poll_options (poll_id, position, text) VALUES (?, ?, ?)",
+			pollID, i, option,
+		)
+		if err != nil {
+			return 0, fmt.Errorf("error creating poll option: %v", err)
+		}
+	}
+
+	return pollID, nil
+}
+
+// GetPostPoll loads the poll of a post with its results
+// @param db - Database connection
+// @param postID - The post to load the poll for
+// @param viewerID - The user whose votes fill MyVotes, or "" for guests
+// @returns *Poll - The poll, or nil if the post has none
+// @returns error - Any database error
+func GetPostPoll(db *sql.DB, postID int64, viewerID string) (*Poll, error) {
+	var pollID int64
+	err := db.QueryRow("SELECT id FROM polls WHERE post_id = ?", postID).Scan(&pollID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error loading poll: %v", err)
+	}
+	return GetPoll(db, pollID, viewerID)
+}
+
+// GetPoll loads a poll with its results
+// @param db - Database connection
+// @param pollID - The poll to load
+// @param viewerID - The user whose votes fill MyVotes, or "" for guests
+// @returns *Poll - The poll
+// @returns error - sql.ErrNoRows if the poll does not exist, or any database error
+func GetPoll(db *sql.DB, pollID int64, viewerID string) (*Poll, error) {
+	poll := &Poll{Options: []PollOption{}, MyVotes: []int64{}}
+	var closesAt sql.NullTime
+	err := db.QueryRow(`
+		SELECT id, post_id, question, multiple, anonymous, closes_at,
+		       closes_at IS NOT NULL AND julianday(closes_at) <= julianday('now'),
+		       (SELECT COUNT(DISTINCT user_id) FROM poll_votes WHERE poll_id = polls.id)
+		FROM polls WHERE id = ?
+	`, pollID).Scan(
+		&poll.ID, &poll.PostID, &poll.Question, &poll.Multiple, &poll.Anonymous, &closesAt,
+		&poll.Closed, &poll.Voters,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if closesAt.Valid {
+		poll.ClosesAt = closesAt.Time.UTC().Format(time.RFC3339)
+	}
+
+	rows, err := db.Query(`
+		SELECT o.id, o.text, (SELECT COUNT(*) FROM poll_votes v WHERE v.option_id = o.id)
+		FROM poll_options o
+		WHERE o.poll_id = ?
+		ORDER BY o.position
+	`, pollID)
+	if err != nil {
+		return nil, fmt.Errorf("error loading poll options: %v", err)
+	}
+	index := make(map[int64]int)
+	for rows.Next() {
+		var option PollOption
+		if err := rows.Scan(&option.ID, &option.Text, &option.Votes); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error scanning poll option: %v", err)
+		}
+		index[option.ID] = len(poll.Options)
+		poll.TotalVotes += option.Votes
+		poll.Options = append(poll.Options, option)
+	}
+	rows.Close()
+
+	rows, err = db.Query(`
+		SELECT v.option_id, v.user_id, COALESCE(u.nickname, '')
+		FROM poll_votes v
+		LEFT JOIN users u ON u.id = v.user_id
+		WHERE v.poll_id = ?
+		ORDER BY v.created_at
+	`, pollID)
+	if err != nil {
+		return nil, fmt.Errorf("error loading poll votes: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var optionID int64
+		var voter PollVoter
+		if err := rows.Scan(&optionID, &voter.ID, &voter.Nickname); err != nil {
+			return nil, fmt.Errorf("error scanning poll vote: %v", err)
+		}
+		if viewerID != "" && voter.ID == viewerID {
+			poll.MyVotes = append(poll.MyVotes, optionID)
+		}
+		if i, ok := index[optionID]; ok && !poll.Anonymous {
+			poll.Options[i].Voters = append(poll.Options[i].Voters, voter)
+		}
+	}
+
+	return poll, rows.Err()
+}
+
+// CastVote records a user's choice in a poll, replacing any earlier vote
+// @param db - Database connection
+// @param pollID - The poll being voted in
+// @param userID - The voter
+// @param optionIDs - The chosen options; exactly one unless the poll allows several
+// @returns error - ErrPollClosed, ErrInvalidPollOption, sql.ErrNoRows for an unknown poll, or any database error
+func CastVote(db *sql.DB, pollID int64, userID string, optionIDs []int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var multiple, closed bool
+	err = tx.QueryRow(`
+		SELECT multiple, closes_at IS NOT NULL AND julianday(closes_at) <= julianday('now')
+		FROM polls WHERE id = ?
+	`, pollID).Scan(&multiple, &closed)
+	if err != nil {
+		return err
+	}
+	if closed {
+		return ErrPollClosed
+	}
+
+	unique := make(map[int64]bool)
+	for _, optionID := range optionIDs {
+		unique[optionID] = true
+	}
+	if len(unique) == 0 || (!multiple && len(unique) > 1) {
+		return ErrInvalidPollOption
+	}
+
+	if _, err := tx.Exec("DELETE FROM poll_votes WHERE poll_id = ? AND user_id = ?", pollID, userID); err != nil {
+		return err
+	}
+	for optionID := range unique {
+		result, err := tx.Exec(`
+			INSERT INTO poll_votes (poll_id, option_id, user_id)
+			SELECT poll_id, id, ? FROM poll_options WHERE id = ? AND poll_id = ?
+		`, userID, optionID, pollID)
+		if err != nil {
+			return err
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			return ErrInvalidPollOption
+		}
+	}
+
+	return tx.Commit()
+}
+
+// RetractVote removes a user's vote from a poll
+// @param db - Database connection
+// @param pollID - The poll
+// @param userID - The voter
+// @param optionID - The option to withdraw from, or 0 for all of the user's votes
+// @returns error - ErrPollClosed, sql.ErrNoRows for an unknown poll, or any database error
+func RetractVote(db *sql.DB, pollID int64, userID string, optionID int64) error {
+	var closed bool
+	err := db.QueryRow(`
+		SELECT closes_at IS NOT NULL AND julianday(closes_at) <= julianday('now')
+		FROM polls WHERE id = ?
+	`, pollID).Scan(&closed)
+	if err != nil {
+		return err
+	}
+	if closed {
+		return ErrPollClosed
+	}
+
+	if optionID == 0 {
+		_, err = db.Exec("DELETE FROM poll_votes WHERE poll_id = ? AND user_id = ?", pollID, userID)
+	} else {
+		_, err = db.Exec(
+			"DELETE FROM poll_votes WHERE poll_id = ? AND user_id = ? AND option_id = ?",
+			pollID, userID, optionID,
+		)
+	}
+	return err
+}
+
+// CloseDuePolls marks polls whose close time has passed as handled
+// Each poll is returned once so its creator is notified a single time.
+// @param db - Database connection
+// @param now - The current time
+// @returns []ClosedPoll - The polls that have just closed
+// @returns error - Any error that occurred
+func CloseDuePolls(db *sql.DB, now time.Time) ([]ClosedPoll, error) {
+	rows, err := db.Query(`
+		SELECT pl.id, pl.post_id, p.user_id
+		FROM polls pl
+		JOIN posts p ON p.id = pl.post_id
+		WHERE pl.close_notified = FALSE AND pl.closes_at IS NOT NULL
+		AND julianday(pl.closes_at) <= julianday(?)
+	`, now.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("error finding closed polls: %v", err)
+	}
+
+	var due []ClosedPoll
+	for rows.Next() {
+		var poll ClosedPoll
+		if err := rows.Scan(&poll.PollID, &poll.PostID, &poll.UserID); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error scanning closed poll: %v", err)
+		}
+		due = append(due, poll)
+	}
+	rows.Close()
+
+	var closed []ClosedPoll
+	for _, poll := range due {
+		result, err := db.Exec(
+			"UPDATE polls SET close_notified = TRUE WHERE id = ? AND close_notified = FALSE", poll.PollID,
+		)
+		if err != nil {
+			return closed, fmt.Errorf("error closing poll %d: %v", poll.PollID, err)
+		}
+		if affected, _ := result.RowsAffected(); affected > 0 {
+			closed = append(closed, poll)
+		}
+	}
+
+	return closed, nil
+}
+
+// StartPollCloser starts a background goroutine that periodically reports polls that have closed
+// @param ctx - Context for cancellation
+// @param db - Database connection
+// @param interval - Time interval between runs
+// @param onClose - Called once for each poll after its close time, e.g. to notify its creator
+func StartPollCloser(ctx context.Context, db *sql.DB, interval time.Duration, onClose func(ClosedPoll)) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				closed, err := CloseDuePolls(db, time.Now())
+				if err != nil {
+					log.Printf("Failed to close polls: %v", err)
+				}
+				for _, poll := range closed {
+					onClose(poll)
+				}
+			case <-ctx.Done():
+				log.Println("Stopping poll closer goroutine")
+				return
+			}
+		}
+	}()
+}
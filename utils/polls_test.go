@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidatePoll(t *testing.T) {
+	tests := []struct {
+		name     string
+		question string
+		options  []string
+		want     []string
+		wantErr  bool
+	}{
+		{"Trimmed, blank options dropped", " Lunch? ", []string{" Pizza ", "", "Sushi"}, []string{"Pizza", "Sushi"}, false},
+		{"Missing question", "  ", []string{"Yes", "No"}, nil, true},
+		{"Too few options", "Lunch?", []string{"Pizza", " "}, nil, true},
+		{"Duplicate options", "Lunch?", []string{"Pizza", "pizza"}, nil, true},
+		{"Option too long", "Lunch?", []string{"Pizza", strings.Repeat("a", MaxPollOptionLength+1)}, nil, true},
+		{"Too many options", "Pick", []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, got, err := ValidatePoll(tt.question, tt.options)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ValidatePoll() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ValidatePoll() options = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// User roles stored in users.role
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// IsAdmin reports whether a user has the admin role
+// @param db - Database connection
+// @param userID - The user to check
+// @returns bool - True if the user is an admin
+// @returns error - Any error other than the user not existing
+func IsAdmin(db *sql.DB, userID string) (bool, error) {
+	var role string
+	err := db.QueryRow("SELECT role FROM users WHERE id = ?", userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error checking user role: %v", err)
+	}
+	return role == RoleAdmin, nil
+}
+
+// PromoteAdmins gives the admin role to the users with the given emails
+// Called at startup with the comma-separated ADMIN_EMAILS setting; accounts
+// registered later are promoted on the next start.
+// @param db - Database connection
+// @param emails - Comma-separated list of admin email addresses
+// @returns int64 - Number of users promoted
+// @returns error - Any error that occurred
+func PromoteAdmins(db *sql.DB, emails string) (int64, error) {
+	var promoted int64
+	for _, email := range strings.Split(emails, ",") {
+		email = strings.TrimSpace(email)
+		if email == "" {
+			continue
+		}
+		result, err := db.Exec(
+			"UPDATE users SET role = ? WHERE LOWER(email) = LOWER(?) AND role != ?",
+			RoleAdmin, email, RoleAdmin,
+		)
+		if err != nil {
+			return promoted, fmt.Errorf("failed to promote %s: %v", email, err)
+		}
+		if n, err := result.RowsAffected(); err == nil {
+			promoted += n
+		}
+	}
+	return promoted, nil
+}
@@ -0,0 +1,255 @@
+package utils
+
+import (
+	"html"
+	"strings"
+)
+
+// allowedTags lists the HTML elements kept by SanitizeHTML and the attributes
+// each one may carry. Everything else is dropped.
+var allowedTags = map[string][]string{
+	"p":          nil,
+	"br":         nil,
+	"hr":         nil,
+	"strong":     nil,
+	"em":         nil,
+	"del":        nil,
+	"code":       {"class"},
+	"pre":        nil,
+	"blockquote": nil,
+	"ul":         nil,
+	"ol":         nil,
+	"li":         nil,
+	"a":          {"href"},
+	"h1":         nil,
+	"h2":         nil,
+	"h3":         nil,
+	"h4":         nil,
+	"h5":         nil,
+	"h6":         nil,
+}
+
+// voidTags are allowed elements that never have a closing tag
+var voidTags = map[string]bool{"br": true, "hr": true}
+
+// droppedContentTags are elements whose content is removed along with the tag
+var droppedContentTags = map[string]bool{
+	"script": true, "style": true, "iframe": true, "object": true,
+	"embed": true, "noscript": true, "template": true, "textarea": true,
+	"title": true, "svg": true, "math": true,
+}
+
+// SanitizeHTML filters HTML through a strict allow-list
+// Unknown tags are removed (keeping their text), dangerous containers such as
+// <script> are removed with their content, attributes are limited per tag,
+// link targets must use a safe scheme and unclosed tags are closed.
+// @param input - The HTML to sanitize
+// @returns string - HTML containing only allowed markup
+func SanitizeHTML(input string) string {
+	var out strings.Builder
+	var open []string
+	skipUntil := ""
+
+	for len(input) > 0 {
+		lt := strings.IndexByte(input, '<')
+		if lt < 0 {
+			if skipUntil == "" {
+				out.WriteString(escapeText(input))
+			}
+			break
+		}
+		if lt > 0 {
+			if skipUntil == "" {
+				out.WriteString(escapeText(input[:lt]))
+			}
+			input = input[lt:]
+			continue
+		}
+
+		// Comments, doctypes and processing instructions are dropped entirely
+		if strings.HasPrefix(input, "<!--") {
+			end := strings.Index(input, "-->")
+			if end < 0 {
+				break
+			}
+			input = input[end+3:]
+			continue
+		}
+		if strings.HasPrefix(input, "<!") || strings.HasPrefix(input, "<?") {
+			end := strings.IndexByte(input, '>')
+			if end < 0 {
+				break
+			}
+			input = input[end+1:]
+			continue
+		}
+
+		name, attrs, closing, n := parseTag(input)
+		if n == 0 {
+			// Not a tag: escape the bracket and carry on
+			if skipUntil == "" {
+				out.WriteString("&lt;")
+			}
+			input = input[1:]
+			continue
+		}
+		input = input[n:]
+
+		if skipUntil != "" {
+			if closing && name == skipUntil {
+				skipUntil = ""
+			}
+			continue
+		}
+		if droppedContentTags[name] {
+			if !closing {
+				skipUntil = name
+			}
+			continue
+		}
+
+		allowedAttrs, ok := allowedTags[name]
+		if !ok {
+			continue
+		}
+
+		if closing {
+			// Close the matching open element along with anything left open inside it
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] == name {
+					for j := len(open) - 1; j >= i; j-- {
+						out.WriteString("</" + open[j] + ">")
+					}
+					open = open[:i]
+					break
+				}
+			}
+			continue
+		}
+
+		out.WriteString("<" + name)
+		for _, attr := range allowedAttrs {
+			value, present := attrs[attr]
+			if !present || !isAllowedAttribute(name, attr, value) {
+				continue
+			}
+			out.WriteString(" " + attr + `="` + html.EscapeString(value) + `"`)
+		}
+		if name == "a" {
+			out.WriteString(` rel="nofollow noopener noreferrer"`)
+		}
+		out.WriteString(">")
+
+		if !voidTags[name] {
+			open = append(open, name)
+		}
+	}
+
+	for i := len(open) - 1; i >= 0; i-- {
+		out.WriteString("</" + open[i] + ">")
+	}
+
+	return out.String()
+}
+
+// isAllowedAttribute validates the value of an allow-listed attribute
+func isAllowedAttribute(tag, attr, value string) bool {
+	switch {
+	case tag == "a" && attr == "href":
+		return IsSafeURL(value)
+	case tag == "code" && attr == "class":
+		return strings.HasPrefix(value, "language-") && codeLanguagePattern.MatchString(strings.TrimPrefix(value, "language-"))
+	}
+	return false
+}
+
+// escapeText normalizes a run of text so it contains no raw markup characters
+// Existing entities are decoded first so they are not double-escaped
+func escapeText(s string) string {
+	return html.EscapeString(html.UnescapeString(s))
+}
+
+// parseTag parses the tag at the start of s
+// @returns string - The lower-cased tag name
+// @returns map[string]string - The tag's attributes with decoded values
+// @returns bool - Whether this is a closing tag
+// @returns int - Number of bytes consumed, or 0 if s does not start with a tag
+func parseTag(s string) (string, map[string]string, bool, int) {
+	i := 1
+	closing := false
+	if i < len(s) && s[i] == '/' {
+		closing = true
+		i++
+	}
+
+	start := i
+	for i < len(s) && isTagNameByte(s[i]) {
+		i++
+	}
+	if i == start || (start < len(s) && !isLetter(s[start])) {
+		return "", nil, false, 0
+	}
+	name := strings.ToLower(s[start:i])
+
+	attrs := make(map[string]string)
+	for i < len(s) {
+		// Skip whitespace and stray slashes
+		for i < len(s) && (s[i] == ' ' || s[i] == '\t' || s[i] == '\n' || s[i] == '\r' || s[i] == '\f' || s[i] == '/') {
+			i++
+		}
+		if i >= len(s) {
+			return "", nil, false, 0
+		}
+		if s[i] == '>' {
+			return name, attrs, closing, i + 1
+		}
+
+		attrStart := i
+		for i < len(s) && !strings.ContainsRune(" \t\n\r\f/>=", rune(s[i])) {
+			i++
+		}
+		attrName := strings.ToLower(s[attrStart:i])
+
+		for i < len(s) && (s[i] == ' ' || s[i] == '\t' || s[i] == '\n' || s[i] == '\r' || s[i] == '\f') {
+			i++
+		}
+		value := ""
+		if i < len(s) && s[i] == '=' {
+			i++
+			for i < len(s) && (s[i] == ' ' || s[i] == '\t' || s[i] == '\n' || s[i] == '\r' || s[i] == '\f') {
+				i++
+			}
+			if i < len(s) && (s[i] == '"' || s[i] == '\'') {
+				quote := s[i]
+				end := strings.IndexByte(s[i+1:], quote)
+				if end < 0 {
+					return "", nil, false, 0
+				}
+				value = s[i+1 : i+1+end]
+				i += end + 2
+			} else {
+				valueStart := i
+				for i < len(s) && !strings.ContainsRune(" \t\n\r\f>", rune(s[i])) {
+					i++
+				}
+				value = s[valueStart:i]
+			}
+		}
+
+		if _, seen := attrs[attrName]; !seen && attrName != "" {
+			attrs[attrName] = html.UnescapeString(value)
+		}
+	}
+
+	return "", nil, false, 0
+}
+
+// isTagNameByte reports whether b may appear in an HTML tag name
+func isTagNameByte(b byte) bool {
+	return isLetter(b) || (b >= '0' && b <= '9') || b == '-'
+}
+
+// isLetter reports whether b is an ASCII letter
+func isLetter(b byte) bool {
+	return (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
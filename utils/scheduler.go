@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Post statuses stored in posts.status
+// Only published posts appear in listings; drafts and scheduled posts are
+// visible to their author alone.
+const (
+	PostStatusDraft     = "draft"
+	PostStatusScheduled = "scheduled"
+	PostStatusPublished = "published"
+)
+
+// PublishedPost identifies a post the scheduler has just published
+type PublishedPost struct {
+	ID     int64
+	UserID string
+}
+
+// PublishDuePosts publishes every scheduled post whose publish_at has passed
+// The post's post_at is set to its publish_at so it sorts as newly posted.
+// @param db - Database connection
+// @param now - The current time
+// @returns []PublishedPost - The posts that were published
+// @returns error - Any error that occurred
+func PublishDuePosts(db *sql.DB, now time.Time) ([]PublishedPost, error) {
+	rows, err := db.Query(`
+		SELECT id, user_id FROM posts
+		WHERE status = ? AND julianday(publish_at) <= julianday(?)
+	`, PostStatusScheduled, now.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("error finding scheduled posts: %v", err)
+	}
+
+	var due []PublishedPost
+	for rows.Next() {
+		var post PublishedPost
+		if err := rows.Scan(&post.ID, &post.UserID); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error scanning scheduled post: %v", err)
+		}
+		due = append(due, post)
+	}
+	rows.Close()
+
+	var published []PublishedPost
+	for _, post := range due {
+		// The status check keeps a post from being published twice if its
+		// author unscheduled or published it in the meantime
+		result, err := db.Exec(`
+			UPDATE posts SET status = ?, post_at = publish_at, publish_at = NULL
+			WHERE id = ? AND status = ?
+		`, PostStatusPublished, post.ID, PostStatusScheduled)
+		if err != nil {
+			return published, fmt.Errorf("error publishing post %d: %v", post.ID, err)
+		}
+		if affected, _ := result.RowsAffected(); affected > 0 {
+			published = append(published, post)
+		}
+	}
+
+	return published, nil
+}
+
+// StartPostScheduler starts a background goroutine that periodically publishes scheduled posts
+// @param ctx - Context for cancellation
+// @param db - Database connection
+// @param interval - Time interval between runs
+// @param onPublish - Called for each post once it is published, e.g. to notify followers
+func StartPostScheduler(ctx context.Context, db *sql.DB, interval time.Duration, onPublish func(PublishedPost)) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				published, err := PublishDuePosts(db, time.Now())
+				if err != nil {
+					log.Printf("Failed to publish scheduled posts: %v", err)
+				}
+				if len(published) > 0 {
+					log.Printf("Published %d scheduled posts", len(published))
+				}
+				for _, post := range published {
+					onPublish(post)
+				}
+			case <-ctx.Done():
+				log.Println("Stopping post scheduler goroutine")
+				return
+			}
+		}
+	}()
+}
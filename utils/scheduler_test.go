@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPublishDuePosts(t *testing.T) {
+	db := setupForumDB(t)
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	// Post 1 is already published and keeps a stale publish_at; post 2 is a draft
+	_, err := db.Exec(`
+		UPDATE posts SET post_at = '2024-01-01 00:00:00', publish_at = ? WHERE id = 1;
+		INSERT INTO posts (id, user_id, title, content, status, publish_at) VALUES
+			(3, 'alice', 'Due', 'content', 'scheduled', ?),
+			(4, 'alice', 'Not yet due', 'content', 'scheduled', ?);
+	`, now.Add(-time.Hour), now.Add(-time.Minute), now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Failed to insert posts: %v", err)
+	}
+
+	published, err := PublishDuePosts(db, now)
+	if err != nil {
+		t.Fatalf("PublishDuePosts() error = %v", err)
+	}
+	if len(published) != 1 || published[0].ID != 3 || published[0].UserID != "alice" {
+		t.Errorf("PublishDuePosts() = %+v, want post 3", published)
+	}
+
+	want := map[int64]string{
+		1: PostStatusPublished,
+		2: PostStatusDraft,
+		3: PostStatusPublished,
+		4: PostStatusScheduled,
+	}
+	for id, status := range want {
+		var got string
+		if err := db.QueryRow("SELECT status FROM posts WHERE id = ?", id).Scan(&got); err != nil {
+			t.Fatalf("Failed to read post %d: %v", id, err)
+		}
+		if got != status {
+			t.Errorf("post %d status = %s, want %s", id, got, status)
+		}
+	}
+
+	// The published post takes its scheduled time; the other published post is untouched
+	var postAt time.Time
+	db.QueryRow("SELECT post_at FROM posts WHERE id = 3").Scan(&postAt)
+	if !postAt.Equal(now.Add(-time.Minute)) {
+		t.Errorf("post 3 post_at = %v, want %v", postAt, now.Add(-time.Minute))
+	}
+	db.QueryRow("SELECT post_at FROM posts WHERE id = 1").Scan(&postAt)
+	if !postAt.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("post 1 post_at changed to %v", postAt)
+	}
+
+	// Running again publishes nothing
+	if published, err := PublishDuePosts(db, now); err != nil || len(published) != 0 {
+		t.Errorf("second PublishDuePosts() = %+v, %v, want nothing", published, err)
+	}
+}
@@ -55,16 +55,6 @@ func CreateSession(db *sql.DB, userID string) (string, error) {
         return "", fmt.Errorf("failed to create session: %v", err)
     }
 
-    // Set user as online
-    _, err = db.Exec(`
-        UPDATE users
-        SET is_online = 1
-        WHERE id = ?
-    `, userID)
-    if err != nil {
-        return "", fmt.Errorf("failed to update user online status: %v", err)
-    }
-
     return sessionToken, nil
 }
 
@@ -0,0 +1,300 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxTagsPerPost limits how many tags a single post can carry
+const MaxTagsPerPost = 10
+
+// ErrInvalidTag is returned when an explicitly supplied tag is not valid
+var ErrInvalidTag = errors.New("tags must be 2-30 letters, digits, underscores or hyphens and contain a letter")
+
+var (
+	// hashtagPattern matches #tag tokens in post content
+	hashtagPattern = regexp.MustCompile(`#([\p{L}\p{N}_-]+)`)
+	// tagPattern is the format every stored tag must follow
+	tagPattern = regexp.MustCompile(`^[\p{L}\p{N}_-]{2,30}$`)
+	// tagLetterPattern requires at least one letter so "#1" is not a tag
+	tagLetterPattern = regexp.MustCompile(`\p{L}`)
+)
+
+// Tag represents a free-form tag and how many posts use it
+type Tag struct {
+	ID         int64  `json:"id"`         // Unique identifier
+	Name       string `json:"name"`       // Normalized tag name, without the "#"
+	UsageCount int    `json:"usageCount"` // Number of posts carrying the tag
+}
+
+// NormalizeTag lower-cases a tag and strips a leading "#"
+// @param name - The tag as typed by the user
+// @returns string - The normalized tag
+// @returns error - ErrInvalidTag if the tag does not follow the tag format
+func NormalizeTag(name string) (string, error) {
+	tag := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(name), "#"))
+	if !tagPattern.MatchString(tag) || !tagLetterPattern.MatchString(tag) {
+		return "", ErrInvalidTag
+	}
+	return tag, nil
+}
+
+// ExtractTags finds #tags in post content
+// Tokens inside words, HTML entities (such as "a#b" or "&#39;") and code are
+// ignored, invalid tokens are skipped and duplicates are removed.
+// @param content - The raw post content
+// @returns []string - Normalized tags in order of first appearance
+func ExtractTags(content string) []string {
+	content = stripCode(content)
+	var tags []string
+	seen := make(map[string]bool)
+
+	for _, loc := range hashtagPattern.FindAllStringSubmatchIndex(content, -1) {
+		if loc[0] > 0 {
+			prev, _ := utf8.DecodeLastRuneInString(content[:loc[0]])
+			if prev == '&' || prev == '#' || isWordRune(prev) {
+				continue
+			}
+		}
+
+		tag, err := NormalizeTag(strings.TrimRight(content[loc[2]:loc[3]], "-"))
+		if err != nil || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+
+	return tags
+}
+
+// stripCode removes fenced code blocks and inline code spans from Markdown
+// so that things like "#include" in a snippet are not read as tags
+func stripCode(content string) string {
+	var out strings.Builder
+	fence := ""
+
+	for _, line := range strings.Split(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if fence != "" {
+			if strings.HasPrefix(trimmed, fence) {
+				fence = ""
+			}
+			out.WriteString("\n")
+			continue
+		}
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			fence = trimmed[:3]
+			out.WriteString("\n")
+			continue
+		}
+
+		parts := strings.Split(line, "`")
+		for i, part := range parts {
+			// Odd segments sit between backticks; an unmatched final backtick is literal
+			if i%2 == 1 && i < len(parts)-1 {
+				out.WriteString(" ")
+				continue
+			}
+			out.WriteString(part)
+		}
+		out.WriteString("\n")
+	}
+
+	return out.String()
+}
+
+// NormalizeTags validates explicitly supplied tags
+// Empty entries are ignored and duplicates are removed.
+// @param names - The tags supplied with the request
+// @returns []string - Normalized tags in order of first appearance
+// @returns error - ErrInvalidTag naming the first invalid tag
+func NormalizeTags(names []string) ([]string, error) {
+	var tags []string
+	seen := make(map[string]bool)
+
+	for _, name := range names {
+		if strings.TrimSpace(name) == "" {
+			continue
+		}
+		tag, err := NormalizeTag(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag %q: %w", name, err)
+		}
+		if seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+
+	if len(tags) > MaxTagsPerPost {
+		return nil, fmt.Errorf("a post can have at most %d tags", MaxTagsPerPost)
+	}
+
+	return tags, nil
+}
+
+// SetPostTags replaces the tags of a post
+// Explicit tags are kept as supplied; content tags are those extracted from the
+// post body. Only the tags that changed are inserted or removed, so tags the
+// post already had keep their original created_at. Usage counts on the tags
+// table are maintained by triggers.
+// @param db - Database or transaction to write to
+// @param postID - The post to tag
+// @param explicit - Normalized tags supplied with the request
+// @param fromContent - Normalized tags extracted from the content
+// @returns error - Any database error
+func SetPostTags(db DBExecutor, postID int64, explicit, fromContent []string) error {
+	rows, err := db.Query(`
+		SELECT t.name, pt.explicit FROM post_tags pt
+		JOIN tags t ON t.id = pt.tag_id
+		WHERE pt.post_id = ?
+	`, postID)
+	if err != nil {
+		return fmt.Errorf("failed to load post tags: %v", err)
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		var isExplicit bool
+		if err := rows.Scan(&name, &isExplicit); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan post tag: %v", err)
+		}
+		existing[name] = isExplicit
+	}
+	rows.Close()
+
+	// wanted maps each tag the post should carry to whether it is explicit
+	wanted := make(map[string]bool)
+	var order []string
+	add := func(tag string, isExplicit bool) {
+		if _, ok := wanted[tag]; ok || len(order) >= MaxTagsPerPost {
+			return
+		}
+		wanted[tag] = isExplicit
+		order = append(order, tag)
+	}
+	for _, tag := range explicit {
+		add(tag, true)
+	}
+	for _, tag := range fromContent {
+		add(tag, false)
+	}
+
+	for name := range existing {
+		if _, ok := wanted[name]; ok {
+			continue
+		}
+		_, err := db.Exec(`
+			DELETE FROM post_tags
+			WHERE post_id = ? AND tag_id = (SELECT id FROM tags WHERE name = ?)
+		`, postID, name)
+		if err != nil {
+			return fmt.Errorf("failed to remove tag %s: %v", name, err)
+		}
+	}
+
+	for _, tag := range order {
+		isExplicit := wanted[tag]
+		if wasExplicit, ok := existing[tag]; ok {
+			if wasExplicit == isExplicit {
+				continue
+			}
+			_, err := db.Exec(`
+				UPDATE post_tags SET explicit = ?
+				WHERE post_id = ? AND tag_id = (SELECT id FROM tags WHERE name = ?)
+			`, isExplicit, postID, tag)
+			if err != nil {
+				return fmt.Errorf("failed to update tag %s: %v", tag, err)
+			}
+			continue
+		}
+
+		if _, err := db.Exec("INSERT OR IGNORE INTO tags (name) VALUES (?)", tag); err != nil {
+			return fmt.Errorf("failed to create tag %s: %v", tag, err)
+		}
+		_, err := db.Exec(`
+			INSERT INTO post_tags (post_id, tag_id, explicit)
+			SELECT ?, id, ? FROM tags WHERE name = ?
+		`, postID, isExplicit, tag)
+		if err != nil {
+			return fmt.Errorf("failed to tag post with %s: %v", tag, err)
+		}
+	}
+
+	return nil
+}
+
+// GetExplicitPostTags returns the tags that were supplied with a post rather
+// than extracted from its content
+// @param db - Database or transaction to read from
+// @param postID - The post to look up
+// @returns []string - The explicit tag names
+// @returns error - Any database error
+func GetExplicitPostTags(db DBExecutor, postID int64) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT t.name FROM post_tags pt
+		JOIN tags t ON t.id = pt.tag_id
+		WHERE pt.post_id = ? AND pt.explicit = 1
+		ORDER BY pt.rowid
+	`, postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tags = append(tags, name)
+	}
+	return tags, rows.Err()
+}
+
+// GetPostsTags returns the tag names of several posts, such as a page of a listing
+// @param db - Database to read from
+// @param postIDs - The posts to look up
+// @returns map[int64][]string - The tag names by post ID; posts without tags are absent
+// @returns error - Any database error
+func GetPostsTags(db DBExecutor, postIDs []int64) (map[int64][]string, error) {
+	tags := make(map[int64][]string)
+	if len(postIDs) == 0 {
+		return tags, nil
+	}
+
+	placeholders := make([]string, len(postIDs))
+	args := make([]interface{}, len(postIDs))
+	for i, id := range postIDs {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+
+	rows, err := db.Query(`
+		SELECT pt.post_id, t.name FROM post_tags pt
+		JOIN tags t ON t.id = pt.tag_id
+		WHERE pt.post_id IN (`+strings.Join(placeholders, ", ")+`)
+		ORDER BY t.name
+	`, args...)
+	if err != nil {
+		return tags, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var postID int64
+		var name string
+		if err := rows.Scan(&postID, &name); err != nil {
+			return tags, err
+		}
+		tags[postID] = append(tags[postID], name)
+	}
+	return tags, rows.Err()
+}
@@ -0,0 +1,142 @@
+package utils
+
+import (
+	"database/sql"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// setupForumDB creates the full forum schema in a temporary directory
+func setupForumDB(t *testing.T) *sql.DB {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	db, err := InitialiseDB()
+	if err != nil {
+		t.Fatalf("Failed to initialise database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec(`
+		INSERT INTO users (id, nickname, email) VALUES ('alice', 'alice', 'alice@example.com');
+		INSERT INTO posts (id, user_id, title, content, status) VALUES
+			(1, 'alice', 'Published', 'content', 'published'),
+			(2, 'alice', 'Draft', 'content', 'draft');
+	`)
+	if err != nil {
+		t.Fatalf("Failed to insert test data: %v", err)
+	}
+	return db
+}
+
+func TestExtractTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"Single tag", "learning #golang today", []string{"golang"}},
+		{"Normalized and deduplicated", "#Go-Lang and #go-lang", []string{"go-lang"}},
+		{"Numbers only are not tags", "issue #42", nil},
+		{"Inside a word", "C#sharp", nil},
+		{"HTML entity", "it&#39;s", nil},
+		{"Inline code", "use `#include` here #cpp", []string{"cpp"}},
+		{"Fenced code", "```\n#define X\n```\n#macros", []string{"macros"}},
+		{"Heading is not a tag", "# Title", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ExtractTags(tt.content); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ExtractTags(%q) = %v, want %v", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeTags(t *testing.T) {
+	got, err := NormalizeTags([]string{"#Web", "web", "", "api_design"})
+	if err != nil {
+		t.Fatalf("NormalizeTags() error = %v", err)
+	}
+	if want := []string{"web", "api_design"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("NormalizeTags() = %v, want %v", got, want)
+	}
+
+	for _, invalid := range []string{"a", "has space", "<script>", "123"} {
+		if _, err := NormalizeTags([]string{invalid}); err == nil {
+			t.Errorf("NormalizeTags(%q) expected an error", invalid)
+		}
+	}
+}
+
+func TestSetPostTags(t *testing.T) {
+	db := setupForumDB(t)
+
+	usage := func(tag string) int {
+		t.Helper()
+		var count int
+		if err := db.QueryRow("SELECT usage_count FROM tags WHERE name = ?", tag).Scan(&count); err != nil {
+			t.Fatalf("Failed to read usage of %s: %v", tag, err)
+		}
+		return count
+	}
+
+	if err := SetPostTags(db, 1, []string{"golang"}, []string{"web", "sqlite"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE post_tags SET created_at = '2020-01-01 00:00:00' WHERE post_id = 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Editing keeps unchanged tags, removes dropped ones and updates the explicit flag
+	if err := SetPostTags(db, 1, []string{"web"}, []string{"golang"}); err != nil {
+		t.Fatal(err)
+	}
+	var kept int
+	db.QueryRow("SELECT COUNT(*) FROM post_tags WHERE post_id = 1 AND created_at = '2020-01-01 00:00:00'").Scan(&kept)
+	if kept != 2 {
+		t.Errorf("%d tags kept their created_at, want 2", kept)
+	}
+	explicit, err := GetExplicitPostTags(db, 1)
+	if err != nil || !reflect.DeepEqual(explicit, []string{"web"}) {
+		t.Errorf("GetExplicitPostTags() = %v, %v, want [web]", explicit, err)
+	}
+	if got := usage("sqlite"); got != 0 {
+		t.Errorf("usage of removed tag = %d, want 0", got)
+	}
+	if got := usage("golang"); got != 1 {
+		t.Errorf("usage of kept tag = %d, want 1", got)
+	}
+
+	// Drafts are not counted until they are published
+	if err := SetPostTags(db, 2, nil, []string{"golang", "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := usage("secret"); got != 0 {
+		t.Errorf("usage of draft tag = %d, want 0", got)
+	}
+	db.Exec("UPDATE posts SET status = 'published' WHERE id = 2")
+	if got := usage("golang"); got != 2 {
+		t.Errorf("usage after publishing = %d, want 2", got)
+	}
+	db.Exec("UPDATE posts SET status = 'draft' WHERE id = 2")
+	if got := usage("golang"); got != 1 {
+		t.Errorf("usage after unpublishing = %d, want 1", got)
+	}
+
+	// Deleting posts releases their tags
+	db.Exec("DELETE FROM posts WHERE id = 2")
+	db.Exec("DELETE FROM posts WHERE id = 1")
+	if got := usage("golang"); got != 0 {
+		t.Errorf("usage after deleting = %d, want 0", got)
+	}
+}
@@ -0,0 +1,346 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// UploadGCGrace is how long an upload stays unreferenced before it is collected
+// New uploads start unreferenced until the post or profile using them is
+// saved, so the grace period must outlast any form submission.
+const UploadGCGrace = 24 * time.Hour
+
+// Blob is one blob of an upload, such as an image rendition
+type Blob struct {
+	Key         string
+	Data        []byte
+	ContentType string
+}
+
+// UploadGCOptions configures CollectUploads
+type UploadGCOptions struct {
+	Grace         time.Duration // How long uploads stay unreferenced before they are removed
+	DryRun        bool          // Report orphans without removing them
+	ImageDir      string        // Directory of images stored before the blob store, swept if set
+	AttachmentDir string        // Directory of attachments stored before the blob store, swept if set
+}
+
+// OrphanedUpload is an upload nothing uses any more
+type OrphanedUpload struct {
+	Key            string    // The upload's key, or the path of a file stored before the blob store
+	Size           int64     // Size in bytes, including renditions
+	UnreferencedAt time.Time // When the last reference went away, or the file's modification time
+}
+
+// UploadGCReport describes the uploads CollectUploads looked at
+type UploadGCReport struct {
+	Uploads       int              // Uploads in the registry, before collection
+	Bytes         int64            // Their total size
+	Pending       int              // Unreferenced uploads still within the grace period
+	Orphaned      []OrphanedUpload // Uploads past the grace period, removed unless this is a dry run
+	OrphanedBytes int64            // Total size of the orphaned uploads
+	LegacyFiles   int              // Files in the directories used before the blob store
+	LegacyBytes   int64            // Their total size
+	Unsent        int              // Chat attachments uploaded but never sent within the grace period
+}
+
+// StoreUpload registers an upload and writes its blobs to the store
+// Uploads are keyed by content hash, so when an identical upload is already
+// stored its blobs are not written again. The upload starts unreferenced and
+// is collected after the grace period unless a post, profile or attachment
+// starts using it.
+// @param ctx - Context for the blob store requests
+// @param db - Database connection or transaction
+// @param store - The blob store
+// @param key - The upload's content-addressed key; blobs[0] should be stored under it
+// @param blobs - The blobs making up the upload, e.g. an image and its renditions
+// @returns bool - True if an identical upload was already stored
+// @returns error - Any storage or database error
+func StoreUpload(ctx context.Context, db DBExecutor, store BlobStore, key string, blobs []Blob) (bool, error) {
+	var size int64
+	for _, blob := range blobs {
+		size += int64(len(blob.Data))
+	}
+
+	rows, err := db.Query("SELECT 1 FROM uploads WHERE key = ?", key)
+	if err != nil {
+		return false, fmt.Errorf("error looking up upload: %v", err)
+	}
+	existed := rows.Next()
+	rows.Close()
+
+	// Registering first restarts the grace period, so the collector cannot
+	// remove an identical unreferenced upload while this one is being saved
+	_, err = db.Exec(`
+		INSERT INTO uploads (key, size, content_type) VALUES (?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET
+			size = MAX(size, excluded.size),
+			unreferenced_at = CASE WHEN ref_count = 0 THEN CURRENT_TIMESTAMP ELSE unreferenced_at END
+	`, key, size, blobs[0].ContentType)
+	if err != nil {
+		return false, fmt.Errorf("error registering upload: %v", err)
+	}
+
+	if existed {
+		if _, err := store.Stat(ctx, key); err == nil {
+			return true, nil
+		}
+	}
+	for _, blob := range blobs {
+		if err := store.Put(ctx, blob.Key, blob.Data, blob.ContentType); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// RecountUploads recomputes the reference count of every upload
+// Uploads referenced but missing from the registry, such as ones stored
+// before it existed, are added to it.
+// @param db - Database connection
+// @returns error - Any database error
+func RecountUploads(db *sql.DB) error {
+	_, err := db.Exec(`
+		INSERT OR IGNORE INTO uploads (key, size, content_type)
+		SELECT substr(imagepath, 8), 0, '' FROM posts WHERE imagepath LIKE '/media/%'
+		UNION
+		SELECT substr(profile_pic, 8), 0, '' FROM users WHERE profile_pic LIKE '/media/%'
+		UNION
+		SELECT storage_path, size, content_type FROM attachments WHERE storage_path LIKE '%/%'
+		UNION
+		SELECT storage_path, size, content_type FROM message_attachments;
+
+		UPDATE uploads SET ref_count =
+			(SELECT COUNT(*) FROM posts WHERE imagepath = '/media/' || uploads.key) +
+			(SELECT COUNT(*) FROM users WHERE profile_pic = '/media/' || uploads.key) +
+			(SELECT COUNT(*) FROM attachments WHERE storage_path = uploads.key) +
+			(SELECT COUNT(*) FROM message_attachments WHERE storage_path = uploads.key);
+
+		UPDATE uploads SET unreferenced_at =
+			CASE WHEN ref_count = 0 THEN COALESCE(unreferenced_at, CURRENT_TIMESTAMP) ELSE NULL END;
+	`)
+	return err
+}
+
+// CollectUploads removes uploads that have been unreferenced for the grace period
+// Each removed upload takes its renditions with it. Chat attachments that
+// were never sent within the grace period are dropped first, which leaves
+// their uploads unreferenced for a later run. If legacy directories are set,
+// files in them that nothing references are removed too once they are
+// older than the grace period.
+// @param ctx - Context for the blob store requests
+// @param db - Database connection
+// @param store - The blob store
+// @param options - The grace period, dry run flag and legacy directories
+// @returns UploadGCReport - Disk usage and the orphans found
+// @returns error - Any storage or database error
+func CollectUploads(ctx context.Context, db *sql.DB, store BlobStore, options UploadGCOptions) (UploadGCReport, error) {
+	var report UploadGCReport
+	cutoff := time.Now().Add(-options.Grace).UTC()
+
+	if options.DryRun {
+		err := db.QueryRow(
+			"SELECT COUNT(*) FROM message_attachments WHERE message_id IS NULL AND julianday(created_at) <= julianday(?)",
+			cutoff,
+		).Scan(&report.Unsent)
+		if err != nil {
+			return report, fmt.Errorf("error counting unsent chat attachments: %v", err)
+		}
+	} else {
+		result, err := db.Exec(
+			"DELETE FROM message_attachments WHERE message_id IS NULL AND julianday(created_at) <= julianday(?)",
+			cutoff,
+		)
+		if err != nil {
+			return report, fmt.Errorf("error removing unsent chat attachments: %v", err)
+		}
+		unsent, _ := result.RowsAffected()
+		report.Unsent = int(unsent)
+	}
+
+	err := db.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(size), 0),
+		       COALESCE(SUM(ref_count = 0 AND julianday(unreferenced_at) > julianday(?)), 0)
+		FROM uploads
+	`, cutoff).Scan(&report.Uploads, &report.Bytes, &report.Pending)
+	if err != nil {
+		return report, fmt.Errorf("error measuring uploads: %v", err)
+	}
+
+	rows, err := db.Query(`
+		SELECT key, size, unreferenced_at FROM uploads
+		WHERE ref_count = 0 AND julianday(unreferenced_at) <= julianday(?)
+		ORDER BY unreferenced_at
+	`, cutoff)
+	if err != nil {
+		return report, fmt.Errorf("error finding orphaned uploads: %v", err)
+	}
+	for rows.Next() {
+		var orphan OrphanedUpload
+		if err := rows.Scan(&orphan.Key, &orphan.Size, &orphan.UnreferencedAt); err != nil {
+			rows.Close()
+			return report, fmt.Errorf("error scanning upload: %v", err)
+		}
+		report.Orphaned = append(report.Orphaned, orphan)
+		report.OrphanedBytes += orphan.Size
+	}
+	rows.Close()
+
+	if !options.DryRun {
+		for _, orphan := range report.Orphaned {
+			if err := removeUpload(ctx, db, store, orphan.Key, cutoff); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	if options.ImageDir != "" || options.AttachmentDir != "" {
+		if err := collectLegacyUploads(db, options, cutoff, &report); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// removeUpload deletes an orphaned upload, its renditions and its registry entry
+// The registry entry is deleted first, and only if the upload is still
+// unreferenced, so an upload that was reused since it was listed is kept.
+func removeUpload(ctx context.Context, db *sql.DB, store BlobStore, key string, cutoff time.Time) error {
+	result, err := db.Exec(`
+		DELETE FROM uploads
+		WHERE key = ? AND ref_count = 0 AND julianday(unreferenced_at) <= julianday(?)
+	`, key, cutoff)
+	if err != nil {
+		return fmt.Errorf("error removing upload %s: %v", key, err)
+	}
+	if removed, _ := result.RowsAffected(); removed == 0 {
+		return nil
+	}
+
+	if _, err := db.Exec("DELETE FROM image_renditions WHERE image_path = ?", MediaURL(key)); err != nil {
+		return fmt.Errorf("error removing renditions of %s: %v", key, err)
+	}
+	for _, name := range renditionNames() {
+		if err := store.Delete(ctx, RenditionPath(key, name)); err != nil {
+			return fmt.Errorf("error deleting blob %s: %v", RenditionPath(key, name), err)
+		}
+	}
+	return nil
+}
+
+// renditionNames lists every rendition size name, "full" included
+func renditionNames() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, sizes := range [][]RenditionSize{PostImageSizes, AvatarSizes} {
+		for _, size := range sizes {
+			if !seen[size.Name] {
+				seen[size.Name] = true
+				names = append(names, size.Name)
+			}
+		}
+	}
+	return names
+}
+
+// collectLegacyUploads sweeps the directories uploads were stored in before the blob store
+func collectLegacyUploads(db *sql.DB, options UploadGCOptions, cutoff time.Time, report *UploadGCReport) error {
+	// Every file name a stored path refers to, renditions included
+	referenced := make(map[string]bool)
+	imagePaths, err := queryStrings(db, `
+		SELECT imagepath FROM posts WHERE imagepath LIKE '/static/uploads/%'
+		UNION
+		SELECT profile_pic FROM users WHERE profile_pic LIKE '/static/uploads/%'
+		UNION
+		SELECT path FROM image_renditions WHERE image_path LIKE '/static/uploads/%'
+	`)
+	if err != nil {
+		return fmt.Errorf("error listing images: %v", err)
+	}
+	for _, imagePath := range imagePaths {
+		referenced[filepath.Join(options.ImageDir, path.Base(imagePath))] = true
+	}
+	storagePaths, err := queryStrings(db, "SELECT storage_path FROM attachments WHERE storage_path NOT LIKE '%/%'")
+	if err != nil {
+		return fmt.Errorf("error listing attachments: %v", err)
+	}
+	for _, storagePath := range storagePaths {
+		for _, name := range renditionNames() {
+			referenced[filepath.Join(options.AttachmentDir, RenditionPath(storagePath, name))] = true
+		}
+	}
+
+	for _, dir := range []string{options.ImageDir, options.AttachmentDir} {
+		if dir == "" {
+			continue
+		}
+		entries, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("error reading %s: %v", dir, err)
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			file := filepath.Join(dir, entry.Name())
+			report.LegacyFiles++
+			report.LegacyBytes += info.Size()
+			if referenced[file] || info.ModTime().After(cutoff) {
+				continue
+			}
+
+			report.Orphaned = append(report.Orphaned, OrphanedUpload{Key: file, Size: info.Size(), UnreferencedAt: info.ModTime()})
+			report.OrphanedBytes += info.Size()
+			if !options.DryRun {
+				if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+					return fmt.Errorf("error removing %s: %v", file, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// StartUploadCollector starts a background goroutine that periodically removes orphaned uploads
+// @param ctx - Context for cancellation
+// @param db - Database connection
+// @param store - The blob store
+// @param interval - Time interval between runs
+// @param options - The grace period and legacy directories; DryRun is ignored
+func StartUploadCollector(ctx context.Context, db *sql.DB, store BlobStore, interval time.Duration, options UploadGCOptions) {
+	options.DryRun = false
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				report, err := CollectUploads(ctx, db, store, options)
+				if err != nil {
+					log.Printf("Failed to collect uploads: %v", err)
+				}
+				if len(report.Orphaned) > 0 {
+					log.Printf("Removed %d orphaned upload(s), %d bytes", len(report.Orphaned), report.OrphanedBytes)
+				}
+			case <-ctx.Done():
+				log.Println("Stopping upload collector goroutine")
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,169 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Statuses a user can choose
+// Away and online are also set automatically: connected users who stop
+// sending activity heartbeats are shown away until they come back.
+const (
+	UserStatusOnline    = "online"
+	UserStatusAway      = "away"
+	UserStatusDND       = "dnd"       // Do not disturb: notifications are stored but not pushed
+	UserStatusInvisible = "invisible" // Shown offline to everyone else
+)
+
+// UserStatusOffline is the status shown for users who are not connected and
+// for invisible users; it cannot be chosen
+const UserStatusOffline = "offline"
+
+// Custom status limits
+const (
+	MaxStatusTextLength  = 100
+	MaxStatusEmojiLength = 8
+)
+
+// User status errors
+var (
+	ErrInvalidUserStatus   = errors.New("status must be online, away, dnd or invisible")
+	ErrInvalidStatusText   = errors.New("status text must be at most 100 characters")
+	ErrInvalidStatusEmoji  = errors.New("status emoji must be at most 8 characters without spaces")
+	ErrInvalidStatusExpiry = errors.New("status expiry must be in the future")
+)
+
+// UserStatus is the status a user chose, with an optional custom text and emoji
+type UserStatus struct {
+	Status    string     `json:"status"`               // One of the UserStatus constants
+	Text      string     `json:"text,omitempty"`       // Custom status text
+	Emoji     string     `json:"emoji,omitempty"`      // Custom status emoji
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // When the status resets to online, nil to keep it
+}
+
+// Expired reports whether a status has reached its expiry
+// @param now - The current time
+// @returns bool - True once the status should reset to online
+func (s *UserStatus) Expired(now time.Time) bool {
+	return s.ExpiresAt != nil && !now.Before(*s.ExpiresAt)
+}
+
+// validateUserStatus checks and normalises a status before it is stored
+func validateUserStatus(status *UserStatus, now time.Time) error {
+	switch status.Status {
+	case UserStatusOnline, UserStatusAway, UserStatusDND, UserStatusInvisible:
+	default:
+		return ErrInvalidUserStatus
+	}
+	status.Text = strings.Join(strings.Fields(status.Text), " ")
+	if len([]rune(status.Text)) > MaxStatusTextLength {
+		return ErrInvalidStatusText
+	}
+	if len([]rune(status.Emoji)) > MaxStatusEmojiLength || strings.ContainsAny(status.Emoji, " \t\r\n") {
+		return ErrInvalidStatusEmoji
+	}
+	if status.Expired(now) {
+		return ErrInvalidStatusExpiry
+	}
+	return nil
+}
+
+// GetUserStatus loads the status a user chose
+// Expired statuses are returned as plain online; ClearUserStatus removes them.
+// @param db - Database connection
+// @param userID - The user
+// @returns *UserStatus - The status, online without text if none was chosen
+// @returns error - sql.ErrNoRows for unknown users, or any database error
+func GetUserStatus(db *sql.DB, userID string) (*UserStatus, error) {
+	status := &UserStatus{}
+	var expiresAt sql.NullTime
+	err := db.QueryRow(`
+		SELECT presence_status, status_text, status_emoji, status_expires_at
+		FROM users WHERE id = ?`, userID).Scan(&status.Status, &status.Text, &status.Emoji, &expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, err
+		}
+		return nil, fmt.Errorf("error loading user status: %v", err)
+	}
+	if expiresAt.Valid {
+		status.ExpiresAt = &expiresAt.Time
+	}
+	if status.Expired(time.Now()) {
+		return &UserStatus{Status: UserStatusOnline}, nil
+	}
+	return status, nil
+}
+
+// SetUserStatus stores the status a user chose
+// The text is trimmed and its whitespace collapsed.
+// @param db - Database connection
+// @param userID - The user
+// @param status - The new status; normalised in place
+// @returns error - One of the user status errors or any database error
+func SetUserStatus(db *sql.DB, userID string, status *UserStatus) error {
+	if err := validateUserStatus(status, time.Now()); err != nil {
+		return err
+	}
+	var expiresAt interface{}
+	if status.ExpiresAt != nil {
+		utc := status.ExpiresAt.UTC()
+		status.ExpiresAt = &utc
+		expiresAt = utc
+	}
+	_, err := db.Exec(`
+		UPDATE users SET presence_status = ?, status_text = ?, status_emoji = ?, status_expires_at = ?
+		WHERE id = ?`, status.Status, status.Text, status.Emoji, expiresAt, userID)
+	if err != nil {
+		return fmt.Errorf("error storing user status: %v", err)
+	}
+	return nil
+}
+
+// ClearUserStatus resets a user to online without a custom status, e.g. when it expired
+// @param db - Database connection
+// @param userID - The user
+// @returns error - Any database error
+func ClearUserStatus(db *sql.DB, userID string) error {
+	_, err := db.Exec(`
+		UPDATE users SET presence_status = 'online', status_text = '', status_emoji = '', status_expires_at = NULL
+		WHERE id = ?`, userID)
+	if err != nil {
+		return fmt.Errorf("error clearing user status: %v", err)
+	}
+	return nil
+}
+
+// VisibleStatusSQL selects the status other users see for a user
+// is_online is only written by the presence tracker, which stores invisible
+// users as offline; away and do not disturb are shown as chosen. Users the
+// tracker shows away for being idle are listed online.
+// @param users - The users table or its alias in the query
+// @returns string - An SQL expression for a UserStatus constant or UserStatusOffline
+func VisibleStatusSQL(users string) string {
+	return fmt.Sprintf(`(CASE WHEN COALESCE(%[1]s.is_online, 0) = 0 OR %[1]s.presence_status = 'invisible' THEN 'offline'
+		WHEN %[1]s.presence_status IN ('away', 'dnd') THEN %[1]s.presence_status ELSE 'online' END)`, users)
+}
+
+// ResetOnlineUsers marks every user offline
+// Run when the server starts, before the presence tracker sees any connection.
+// @param db - Database connection
+// @returns error - Any database error
+func ResetOnlineUsers(db *sql.DB) error {
+	if _, err := db.Exec("UPDATE users SET is_online = 0 WHERE is_online != 0"); err != nil {
+		return fmt.Errorf("error resetting online users: %v", err)
+	}
+	return nil
+}
+
+// IsDoNotDisturb reports whether a user chose do not disturb and it has not expired
+// @param db - Database connection
+// @param userID - The user
+// @returns bool - True if notifications should not be pushed to the user
+func IsDoNotDisturb(db *sql.DB, userID string) bool {
+	status, err := GetUserStatus(db, userID)
+	return err == nil && status.Status == UserStatusDND
+}
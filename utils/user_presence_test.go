@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserStatus(t *testing.T) {
+	db := setupMessagesDB(t)
+
+	if status, err := GetUserStatus(db, "alice"); err != nil || status.Status != UserStatusOnline {
+		t.Fatalf("default status = %+v, %v; want online", status, err)
+	}
+
+	past := time.Now().Add(-time.Minute)
+	invalid := []struct {
+		status UserStatus
+		want   error
+	}{
+		{UserStatus{Status: "busy"}, ErrInvalidUserStatus},
+		{UserStatus{Status: UserStatusAway, Text: strings.Repeat("x", MaxStatusTextLength+1)}, ErrInvalidStatusText},
+		{UserStatus{Status: UserStatusAway, Emoji: "a b"}, ErrInvalidStatusEmoji},
+		{UserStatus{Status: UserStatusAway, ExpiresAt: &past}, ErrInvalidStatusExpiry},
+	}
+	for _, tt := range invalid {
+		if err := SetUserStatus(db, "alice", &tt.status); err != tt.want {
+			t.Errorf("SetUserStatus(%+v) = %v, want %v", tt.status, err, tt.want)
+		}
+	}
+
+	expiry := time.Now().Add(time.Hour)
+	dnd := UserStatus{Status: UserStatusDND, Text: "  in a\nmeeting ", Emoji: "📅", ExpiresAt: &expiry}
+	if err := SetUserStatus(db, "alice", &dnd); err != nil {
+		t.Fatal(err)
+	}
+	status, err := GetUserStatus(db, "alice")
+	if err != nil || status.Status != UserStatusDND || status.Text != "in a meeting" || status.Emoji != "📅" || status.ExpiresAt == nil {
+		t.Errorf("status = %+v, %v", status, err)
+	}
+	if !IsDoNotDisturb(db, "alice") || IsDoNotDisturb(db, "bob") {
+		t.Error("only alice should be in do not disturb")
+	}
+
+	// Expired statuses read as online until they are cleared
+	db.Exec("UPDATE users SET status_expires_at = ? WHERE id = 'alice'", past.UTC())
+	if status, _ := GetUserStatus(db, "alice"); status.Status != UserStatusOnline || status.Text != "" || IsDoNotDisturb(db, "alice") {
+		t.Errorf("expired status = %+v; want online", status)
+	}
+	if err := ClearUserStatus(db, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	var expiresAt *time.Time
+	db.QueryRow("SELECT status_expires_at FROM users WHERE id = 'alice'").Scan(&expiresAt)
+	if expiresAt != nil {
+		t.Errorf("expiry kept after clearing: %v", expiresAt)
+	}
+}
@@ -1,43 +1,199 @@
 package utils
 
 import (
-	"errors"
+	"bytes"
+	"fmt"
+	"image"
+	"io"
 	"mime/multipart"
-	"path/filepath"
+	"net/http"
 )
 
 // MaxFileSize defines the maximum allowed file size for uploaded images (20MB)
 const MaxFileSize = 20 << 20 // 20MB
 
-// ValidImageTypes defines the allowed MIME types for uploaded images
-var ValidImageTypes = map[string]bool{
-	"image/jpeg": true,
-	"image/png":  true,
-	"image/gif":  true,
+// Pixel limits for uploaded images
+// Decoding allocates memory for every pixel, so a small file declaring huge
+// dimensions (a decompression bomb) is rejected before it is decoded.
+const (
+	MaxImageSide   = 10000      // Maximum width or height in pixels
+	MaxImagePixels = 40_000_000 // Maximum width × height
+)
+
+// ValidImageTypes maps the image formats accepted for upload to their MIME types
+// The keys are the format names reported by the image package.
+var ValidImageTypes = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+	"webp": "image/webp",
+}
+
+// UploadErrorKind classifies why an upload was rejected
+type UploadErrorKind int
+
+const (
+	UploadTooLarge      UploadErrorKind = iota + 1 // The file is over the size limit
+	UploadInvalidType                              // The content is not an accepted, readable image
+	UploadTooManyPixels                            // The image dimensions are over the pixel limits
+)
+
+// UploadError is returned when an uploaded image is rejected
+// Error gives the detailed reason for logs; Message gives the text shown to
+// users. Use errors.Is with ErrUploadTooLarge, ErrUploadInvalidType or
+// ErrUploadTooManyPixels to check the kind.
+type UploadError struct {
+	Kind   UploadErrorKind
+	Reason string
+}
+
+// Upload error kinds for use with errors.Is
+var (
+	ErrUploadTooLarge      = &UploadError{Kind: UploadTooLarge, Reason: "file too large"}
+	ErrUploadInvalidType   = &UploadError{Kind: UploadInvalidType, Reason: "invalid file type"}
+	ErrUploadTooManyPixels = &UploadError{Kind: UploadTooManyPixels, Reason: "image dimensions too large"}
+)
+
+func (e *UploadError) Error() string {
+	return e.Reason
+}
+
+// Is reports whether target is an UploadError of the same kind
+func (e *UploadError) Is(target error) bool {
+	t, ok := target.(*UploadError)
+	return ok && t.Kind == e.Kind
+}
+
+// Message returns the user-facing error message for the kind of rejection
+func (e *UploadError) Message() string {
+	switch e.Kind {
+	case UploadTooLarge:
+		return ErrFileTooLarge
+	case UploadTooManyPixels:
+		return ErrImageDimensions
+	default:
+		return ErrInvalidFileType
+	}
+}
+
+// Status returns the HTTP status to respond with for the kind of rejection
+func (e *UploadError) Status() int {
+	switch e.Kind {
+	case UploadTooLarge, UploadTooManyPixels:
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusUnsupportedMediaType
+	}
+}
+
+// uploadError creates an UploadError with a detailed reason
+func uploadError(kind UploadErrorKind, format string, args ...interface{}) *UploadError {
+	return &UploadError{Kind: kind, Reason: fmt.Sprintf(format, args...)}
+}
+
+// SniffImageType identifies an image format from the magic bytes at the start of a file
+// The client's file name and Content-Type are never consulted.
+// @param head - The first bytes of the file; 12 bytes are enough
+// @returns string - "jpeg", "png", "gif" or "webp", or "" if the format is not accepted
+func SniffImageType(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8, 0xFF}):
+		return "jpeg"
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		return "png"
+	case bytes.HasPrefix(head, []byte("GIF87a")), bytes.HasPrefix(head, []byte("GIF89a")):
+		return "gif"
+	case len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "WEBP":
+		return "webp"
+	}
+	return ""
+}
+
+// checkImageHeader sniffs an image and checks its declared dimensions
+// @param r - The image content, read from the start
+// @param head - The first bytes of the content, for sniffing
+// @returns string - The image format
+// @returns error - An *UploadError if the image is rejected
+func checkImageHeader(r io.Reader, head []byte) (string, error) {
+	format := SniffImageType(head)
+	if format == "" {
+		return "", uploadError(UploadInvalidType, "unrecognised image signature")
+	}
+
+	config, decoded, err := image.DecodeConfig(r)
+	if err != nil {
+		return "", uploadError(UploadInvalidType, "unreadable %s header: %v", format, err)
+	}
+	if decoded != format {
+		return "", uploadError(UploadInvalidType, "%s signature but %s content", format, decoded)
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return "", uploadError(UploadInvalidType, "image has no pixels")
+	}
+	if config.Width > MaxImageSide || config.Height > MaxImageSide ||
+		int64(config.Width)*int64(config.Height) > MaxImagePixels {
+		return "", uploadError(UploadTooManyPixels, "image is %dx%d pixels", config.Width, config.Height)
+	}
+	return format, nil
+}
+
+// CheckUploadSize rejects content over a size limit
+// @param data - The uploaded file content, read with a limit one byte over maxSize
+// @param maxSize - The size limit in bytes
+// @returns error - An *UploadError of kind UploadTooLarge, or nil
+func CheckUploadSize(data []byte, maxSize int64) error {
+	if int64(len(data)) > maxSize {
+		return uploadError(UploadTooLarge, "file is over %d bytes", maxSize)
+	}
+	return nil
+}
+
+// DecodeImage validates uploaded image content and decodes it
+// The content must start with the magic bytes of an accepted format, declare
+// dimensions within MaxImageSide and MaxImagePixels, and decode completely.
+// Shared by post images, image attachments and avatars through RenderImage.
+// @param data - The uploaded file content
+// @returns image.Image - The decoded image
+// @returns string - The image format
+// @returns error - An *UploadError if the content is rejected
+func DecodeImage(data []byte) (image.Image, string, error) {
+	format, err := checkImageHeader(bytes.NewReader(data), data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", uploadError(UploadInvalidType, "corrupt %s image: %v", format, err)
+	}
+	return img, format, nil
 }
 
 // ValidateImage checks if an uploaded file is a valid image
-// Validates both file size and file type
+// Validates the file size, the magic bytes and the declared dimensions; the
+// file name and Content-Type sent by the client are ignored. The file is
+// rewound afterwards. Full decoding is left to DecodeImage.
 // @param file - The uploaded file
 // @param header - The file header containing metadata
-// @returns error - An error if validation fails, nil otherwise
+// @returns error - An *UploadError if validation fails, nil otherwise
 func ValidateImage(file multipart.File, header *multipart.FileHeader) error {
 	// Check file size
 	if header.Size > MaxFileSize {
-		return errors.New("file too large")
+		return uploadError(UploadTooLarge, "file is %d bytes", header.Size)
 	}
 
-	// Check file type
-	ext := filepath.Ext(header.Filename)
-	switch ext {
-	case ".jpg", ".jpeg", ".png", ".gif":
-		contentType := header.Header.Get("Content-Type")
-		if !ValidImageTypes[contentType] {
-			return errors.New("invalid file type")
-		}
-	default:
-		return errors.New("invalid file type")
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return uploadError(UploadInvalidType, "unreadable file: %v", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
 	}
 
-	return nil
+	_, err = checkImageHeader(file, head[:n])
+	if _, seekErr := file.Seek(0, io.SeekStart); seekErr != nil && err == nil {
+		err = seekErr
+	}
+	return err
 }
@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"errors"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The corpus in testdata/uploads holds valid images and malicious samples.
+// Each sample's extension is what a client would claim it is.
+func TestValidateUploadCorpus(t *testing.T) {
+	tests := []struct {
+		file         string
+		wantValidate error // Error kind from ValidateImage, which reads only the header
+		wantDecode   error // Error kind from DecodeImage, which decodes the whole image
+	}{
+		{"valid.png", nil, nil},
+		{"valid.jpg", nil, nil},
+		{"valid.gif", nil, nil},
+		{"valid.webp", nil, nil},
+		{"script.png", ErrUploadInvalidType, ErrUploadInvalidType},
+		{"page.jpg", ErrUploadInvalidType, ErrUploadInvalidType},
+		{"polyglot.gif", nil, ErrUploadInvalidType},
+		{"garbage.webp", ErrUploadInvalidType, ErrUploadInvalidType},
+		{"empty.png", ErrUploadInvalidType, ErrUploadInvalidType},
+		{"truncated.jpg", nil, ErrUploadInvalidType},
+		{"bomb.png", ErrUploadTooManyPixels, ErrUploadTooManyPixels},
+		{"bomb.gif", ErrUploadTooManyPixels, ErrUploadTooManyPixels},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			path := filepath.Join("testdata", "uploads", tt.file)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			file, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			header := &multipart.FileHeader{Filename: tt.file, Size: int64(len(data))}
+
+			err = ValidateImage(file, header)
+			if !errorIs(err, tt.wantValidate) {
+				t.Errorf("ValidateImage() error = %v, want %v", err, tt.wantValidate)
+			}
+
+			_, _, err = DecodeImage(data)
+			if !errorIs(err, tt.wantDecode) {
+				t.Errorf("DecodeImage() error = %v, want %v", err, tt.wantDecode)
+			}
+			var uploadErr *UploadError
+			if err != nil && !errors.As(err, &uploadErr) {
+				t.Errorf("DecodeImage() error %T is not an *UploadError", err)
+			}
+		})
+	}
+}
+
+func TestUploadErrorMessages(t *testing.T) {
+	tests := []struct {
+		err         *UploadError
+		wantMessage string
+		wantStatus  int
+	}{
+		{ErrUploadTooLarge, ErrFileTooLarge, 413},
+		{ErrUploadInvalidType, ErrInvalidFileType, 415},
+		{ErrUploadTooManyPixels, ErrImageDimensions, 413},
+	}
+
+	for _, tt := range tests {
+		if tt.err.Message() != tt.wantMessage || tt.err.Status() != tt.wantStatus {
+			t.Errorf("%v: Message() = %q, Status() = %d", tt.err, tt.err.Message(), tt.err.Status())
+		}
+	}
+
+	if err := CheckUploadSize(make([]byte, 11), 10); !errors.Is(err, ErrUploadTooLarge) {
+		t.Errorf("CheckUploadSize() error = %v, want %v", err, ErrUploadTooLarge)
+	}
+}
+
+func TestCheckFileContent(t *testing.T) {
+	tests := []struct {
+		name        string
+		head        string
+		contentType string
+		wantErr     bool
+	}{
+		{"PDF", "%PDF-1.7\n", "application/pdf", false},
+		{"Renamed PDF", "MZ\x90\x00", "application/pdf", true},
+		{"Text", "hello, world\n", "text/plain; charset=utf-8", false},
+		{"Binary as text", "\x7fELF\x02\x01\x01\x00", "text/plain; charset=utf-8", true},
+		{"Binary as JSON", "{\x00}", "application/json", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckFileContent([]byte(tt.head), tt.contentType)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CheckFileContent() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// errorIs is errors.Is that also matches a nil error against a nil target
+func errorIs(err, target error) bool {
+	if target == nil {
+		return err == nil
+	}
+	return errors.Is(err, target)
+}